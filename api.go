@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NewSensorRouter serves the sensor API under /api/
+func NewSensorRouter(sm *SensorManagement) (httpRouter *gin.Engine) {
+	httpRouter = gin.New()
+	httpRouter.Use(gin.Recovery())
+
+	httpRouter.GET("/api/sensors", func(c *gin.Context) {
+		c.JSON(http.StatusOK, sm.Snapshots())
+	})
+
+	httpRouter.GET("/api/sensors/:name", func(c *gin.Context) {
+		if ss, ok := sm.Snapshot(c.Param("name")); ok {
+			c.JSON(http.StatusOK, ss)
+		} else {
+			c.JSON(http.StatusNotFound, gin.H{"status": "failed", "message": "unknown sensor " + c.Param("name")})
+		}
+	})
+
+	httpRouter.GET("/api/rooms", func(c *gin.Context) {
+		c.JSON(http.StatusOK, sm.RoomSnapshots())
+	})
+
+	httpRouter.GET("/api/rooms/:name", func(c *gin.Context) {
+		if rs, ok := sm.RoomSnapshot(c.Param("name")); ok {
+			c.JSON(http.StatusOK, rs)
+		} else {
+			c.JSON(http.StatusNotFound, gin.H{"status": "failed", "message": "unknown room " + c.Param("name")})
+		}
+	})
+
+	httpRouter.GET("/api/health", func(c *gin.Context) {
+		report := sm.HealthReport()
+		if report.Status == HealthFailed {
+			c.JSON(http.StatusServiceUnavailable, report)
+		} else {
+			c.JSON(http.StatusOK, report)
+		}
+	})
+
+	httpRouter.GET("/api/stats", func(c *gin.Context) {
+		c.JSON(http.StatusOK, sm.Statistics().All())
+	})
+
+	httpRouter.GET("/api/history", func(c *gin.Context) {
+		history := sm.History()
+		if history == nil {
+			c.JSON(http.StatusNotFound, gin.H{"status": "failed", "message": "history is not enabled"})
+			return
+		}
+
+		q, err := parseHistoryQuery(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "message": err.Error()})
+			return
+		}
+
+		if q.Points, err = history.Query(q.Sensor, q.Metric, q.From, q.To, q.Step); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+			return
+		}
+
+		if ss, ok := sm.Snapshot(q.Sensor); ok {
+			if r, ok := ss.Reading(q.Metric); ok {
+				q.Unit = r.Unit
+			}
+		}
+
+		c.JSON(http.StatusOK, q)
+	})
+
+	httpRouter.GET("/api/export", func(c *gin.Context) {
+		recording := sm.Recording()
+		if recording == nil {
+			c.JSON(http.StatusNotFound, gin.H{"status": "failed", "message": "recording is not enabled"})
+			return
+		}
+
+		o, err := ParseExportOptions(strings.Join(c.QueryArray("sensor"), ","), strings.Join(c.QueryArray("metric"), ","),
+			c.Query("from"), c.Query("to"), c.Query("tz"), c.Query("format"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"status": "failed", "message": err.Error()})
+			return
+		}
+
+		c.Header("Content-Type", o.ContentType())
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"readings.%s\"", o.Format))
+		c.Status(http.StatusOK)
+
+		// The status has been sent, so a failure part way through can only end the stream
+		if err = Export(c.Writer, recording.Dir(), o); err != nil {
+			logHTTP.Error("Export failed", "error", err)
+		}
+	})
+
+	http.Handle("/api/", httpRouter.Handler())
+	return
+}
+
+// NewConfigRouter serves the running configuration, with its secrets redacted, at /api/config
+func NewConfigRouter(config func() *I2cConfiguration) {
+	httpRouter := gin.New()
+	httpRouter.Use(gin.Recovery())
+
+	httpRouter.GET("/api/config", func(c *gin.Context) {
+		node, err := RedactedConfiguration(config())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+			return
+		}
+
+		var dump map[string]interface{}
+		if err = node.Decode(&dump); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"status": "failed", "message": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, dump)
+	})
+
+	http.Handle("/api/config", httpRouter.Handler())
+}
+
+// The time range of a history query without from
+const DefaultHistoryRange = 24 * time.Hour
+
+// HistoryQuery is the query and the result served by the history endpoint
+type HistoryQuery struct {
+	Sensor string
+	Metric string
+	Unit   string
+	From   time.Time
+	To     time.Time
+	Step   time.Duration
+	Points []HistoryPoint
+}
+
+// parseHistoryQuery reads the sensor, metric, from, to and step parameters. Times are RFC 3339, a
+// local date and time, or Unix seconds and the step is a duration such as 5m. The range defaults to the last day.
+func parseHistoryQuery(c *gin.Context) (q HistoryQuery, err error) {
+	if q.Sensor, q.Metric = c.Query("sensor"), c.Query("metric"); q.Sensor == "" || q.Metric == "" {
+		err = fmt.Errorf("sensor and metric are required")
+		return
+	}
+
+	q.To = time.Now()
+	if v := c.Query("to"); v != "" {
+		if q.To, err = parseQueryTime(v, time.Local); err != nil {
+			return
+		}
+	}
+
+	q.From = q.To.Add(-DefaultHistoryRange)
+	if v := c.Query("from"); v != "" {
+		if q.From, err = parseQueryTime(v, time.Local); err != nil {
+			return
+		}
+	}
+
+	if v := c.Query("step"); v != "" {
+		if q.Step, err = time.ParseDuration(v); err != nil || q.Step < 0 {
+			err = fmt.Errorf("invalid step \"%s\"", v)
+			return
+		}
+	}
+
+	if q.From.After(q.To) {
+		err = fmt.Errorf("from is after to")
+	}
+
+	return
+}
@@ -2,35 +2,61 @@ package main
 
 import (
 	"periph.io/x/conn/v3/i2c"
-	"periph.io/x/conn/v3/i2c/i2creg"
 	"periph.io/x/conn/v3/physic"
 	"periph.io/x/devices/v3/bmxx80"
-	"periph.io/x/host/v3"
 )
 
+const BME280Address = 0x77
+
 type BME280 struct {
-	bus i2c.BusCloser
 	dev *bmxx80.Dev
 }
 
-func NewBME280(address uint8) (d *BME280, err error) {
-	d = &BME280{}
+// BME280Options are how many times each of the measurements is sampled and averaged, which is
+// 1, 2, 4, 8 or 16, or 0 to not measure pressure or humidity at all
+type BME280Options struct {
+	Temperature, Pressure, Humidity int
+}
 
-	if _, err = host.Init(); err != nil {
-		return
+// The oversampling of bmxx80.DefaultOpts
+var DefaultBME280Options = BME280Options{Temperature: 4, Pressure: 4, Humidity: 4}
+
+func bme280Oversampling(times int) bmxx80.Oversampling {
+	switch times {
+	case 0:
+		return bmxx80.Off
+	case 1:
+		return bmxx80.O1x
+	case 2:
+		return bmxx80.O2x
+	case 8:
+		return bmxx80.O8x
+	case 16:
+		return bmxx80.O16x
 	}
+	return bmxx80.O4x
+}
 
-	if d.bus, err = i2creg.Open(""); err != nil {
-		return
+func NewBME280(bus i2c.Bus, address uint8, options BME280Options) (d *BME280, err error) {
+	d = &BME280{}
+
+	opts := bmxx80.Opts{
+		Temperature: bme280Oversampling(options.Temperature),
+		Pressure:    bme280Oversampling(options.Pressure),
+		Humidity:    bme280Oversampling(options.Humidity),
 	}
 
-	if d.dev, err = bmxx80.NewI2C(d.bus, uint16(address), &bmxx80.DefaultOpts); err != nil {
+	if d.dev, err = bmxx80.NewI2C(bus, uint16(address), &opts); err != nil {
 		return
 	}
 
 	return
 }
 
+func (d *BME280) Close() {
+	d.dev.Halt()
+}
+
 func (d *BME280) Read() (temperature float64, pressure float64, humidity float64, err error) {
 	e := physic.Env{}
 	if err = d.dev.Sense(&e); err != nil {
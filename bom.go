@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -14,16 +13,22 @@ import (
 
 const BOMURL = "http://www.bom.gov.au/fwo/IDV60901/IDV60901.95867.json"
 
-type BOMScanner struct {
-	scheduler    *gocron.Scheduler
-	bomUpdateJob *gocron.Job
-
+// BOMObservation is the latest weather observation read from the BOM
+type BOMObservation struct {
 	AirTemp   float64
 	WindSpeed float64
 	WindGust  float64
 	WindDir   float64
+	Updated   time.Time
+}
+
+type BOMScanner struct {
+	scheduler    *gocron.Scheduler
+	bomUpdateJob *gocron.Job
 
-	debugOutput bool
+	// Written by the scheduler on each BOM update
+	mu          sync.RWMutex
+	observation BOMObservation
 }
 
 var bomScannerOnce sync.Once
@@ -87,11 +92,10 @@ type BOMQueryResult struct {
 	} `json:"observations"`
 }
 
-func NewBOMScanner(debug bool) (bs *BOMScanner, err error) {
+func NewBOMScanner() (bs *BOMScanner, err error) {
 	bomScannerOnce.Do(func() {
 		bomScanner = &BOMScanner{
-			scheduler:   gocron.NewScheduler(time.Local),
-			debugOutput: debug,
+			scheduler: gocron.NewScheduler(time.Local),
 		}
 
 		if bomScanner.bomUpdateJob, err = bomScanner.scheduler.Every("5m").SingletonMode().Tag("BOMUpdate").Do(bomUpdate); err != nil {
@@ -106,6 +110,13 @@ func NewBOMScanner(debug bool) (bs *BOMScanner, err error) {
 	return
 }
 
+// StopBOMScanner stops the scheduled updates of the BOM observations, if they were started
+func StopBOMScanner() {
+	if bomScanner != nil {
+		bomScanner.scheduler.Stop()
+	}
+}
+
 func convertDir(dir string) float64 {
 	switch strings.ToUpper(dir) {
 	case "CALM":
@@ -143,20 +154,19 @@ func convertDir(dir string) float64 {
 	case "NNW":
 		return 337.5
 	default:
-		fmt.Println("Unknown direction:", dir)
+		logBOM.Warn("Unknown wind direction", "direction", dir)
 		return 0.0
 	}
 }
 
-func bomUpdate() {
-	var err error
+// queryBOM reads the observations of a weather station from the BOM JSON feed at the URL
+func queryBOM(url string) (qr *BOMQueryResult, err error) {
 	httpClient := http.Client{
 		Timeout: time.Second * 30,
 	}
 
 	var req *http.Request
-	if req, err = http.NewRequest("GET", BOMURL, nil); err != nil {
-		fmt.Println(err)
+	if req, err = http.NewRequest("GET", url, nil); err != nil {
 		return
 	}
 
@@ -164,7 +174,6 @@ func bomUpdate() {
 
 	var resp *http.Response
 	if resp, err = httpClient.Do(req); err != nil {
-		fmt.Println(err)
 		return
 	}
 
@@ -172,24 +181,52 @@ func bomUpdate() {
 
 	var body []byte
 	if body, err = ioutil.ReadAll(resp.Body); err != nil {
-		fmt.Println(err)
 		return
 	}
 
-	qr := new(BOMQueryResult)
-	if err = json.Unmarshal(body, qr); err != nil {
-		fmt.Println(err)
+	qr = new(BOMQueryResult)
+	err = json.Unmarshal(body, qr)
+	return
+}
+
+func bomUpdate() {
+	qr, err := queryBOM(BOMURL)
+	if err != nil {
+		logBOM.Error("Failed to query observations", "error", err)
 		return
 	}
 
-	if qr.Observations.Data != nil && len(qr.Observations.Data) > 0 {
-		bomScanner.AirTemp = qr.Observations.Data[0].AirTemp
-		bomScanner.WindSpeed = float64(qr.Observations.Data[0].WindSpdKmh)
-		bomScanner.WindGust = float64(qr.Observations.Data[0].GustKmh)
-		bomScanner.WindDir = convertDir(qr.Observations.Data[0].WindDir)
+	if bomScanner.setObservation(qr) {
+		o := bomScanner.Observation()
 		_, t := bomScanner.scheduler.NextRun()
-		if bomScanner.debugOutput {
-			fmt.Printf("BOM: air temp = %f, wind = %f,%f, next: %v\n", bomScanner.AirTemp, bomScanner.WindSpeed, bomScanner.WindDir, t)
-		}
+		logBOM.Debug("Observation", "airtemp", o.AirTemp, "windspeed", o.WindSpeed, "winddir", o.WindDir, "next", t)
+	}
+}
+
+// setObservation records the most recent observation in a query result, returning false if there is none
+func (bs *BOMScanner) setObservation(qr *BOMQueryResult) bool {
+	if len(qr.Observations.Data) == 0 {
+		return false
 	}
+
+	d := qr.Observations.Data[0]
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	bs.observation = BOMObservation{
+		AirTemp:   d.AirTemp,
+		WindSpeed: float64(d.WindSpdKmh),
+		WindGust:  float64(d.GustKmh),
+		WindDir:   convertDir(d.WindDir),
+		Updated:   time.Now(),
+	}
+
+	return true
+}
+
+func (bs *BOMScanner) Observation() BOMObservation {
+	bs.mu.RLock()
+	defer bs.mu.RUnlock()
+	return bs.observation
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConvertDir(t *testing.T) {
+	tests := []struct {
+		dir      string
+		expected float64
+	}{
+		{"CALM", 0},
+		{"N", 0},
+		{"NNE", 22.5},
+		{"NE", 45},
+		{"ENE", 67.5},
+		{"E", 90},
+		{"ESE", 112.5},
+		{"SE", 135},
+		{"SSE", 157.5},
+		{"S", 180},
+		{"SSW", 202.5},
+		{"SW", 225},
+		{"WSW", 247.5},
+		{"W", 270},
+		{"WNW", 292.5},
+		{"NW", 315},
+		{"NNW", 337.5},
+		{"nnw", 337.5},
+		{"-", 0},
+		{"", 0},
+	}
+
+	for _, test := range tests {
+		if dir := convertDir(test.dir); dir != test.expected {
+			t.Errorf("convertDir(%q) = %f, expected %f", test.dir, dir, test.expected)
+		}
+	}
+}
+
+// newFixtureServer serves the files in testdata named by the query parameter
+func newFixtureServer(t *testing.T, param string, files map[string]string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, ok := files[r.URL.Query().Get(param)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.ServeFile(w, r, "testdata/"+file)
+	}))
+
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestQueryBOM(t *testing.T) {
+	srv := newFixtureServer(t, "station", map[string]string{
+		"95867": "bom_IDV60901.95867.json",
+		"calm":  "bom_calm.json",
+		"empty": "bom_empty.json",
+	})
+
+	tests := []struct {
+		station     string
+		found       bool
+		observation BOMObservation
+	}{
+		{"95867", true, BOMObservation{AirTemp: 14.6, WindSpeed: 17, WindGust: 28, WindDir: 337.5}},
+		{"calm", true, BOMObservation{AirTemp: -1.5, WindSpeed: 0, WindGust: 0, WindDir: 0}},
+		{"empty", false, BOMObservation{}},
+	}
+
+	for _, test := range tests {
+		qr, err := queryBOM(srv.URL + "/?station=" + test.station)
+		if err != nil {
+			t.Fatalf("failed to query station %s: %v", test.station, err)
+		}
+
+		bs := &BOMScanner{}
+		if found := bs.setObservation(qr); found != test.found {
+			t.Errorf("station %s: expected an observation to be found = %t", test.station, test.found)
+		}
+
+		o := bs.Observation()
+		if test.found == o.Updated.IsZero() {
+			t.Errorf("station %s: unexpected update time %v", test.station, o.Updated)
+		}
+
+		o.Updated = test.observation.Updated
+		if o != test.observation {
+			t.Errorf("station %s: expected %+v, got %+v", test.station, test.observation, o)
+		}
+	}
+
+	if _, err := queryBOM(srv.URL + "/?station=missing"); err == nil {
+		t.Errorf("expected an error when the station is not found")
+	}
+}
+
+func TestQueryBOMHeader(t *testing.T) {
+	srv := newFixtureServer(t, "station", map[string]string{"95867": "bom_IDV60901.95867.json"})
+
+	qr, err := queryBOM(srv.URL + "/?station=95867")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(qr.Observations.Header) != 1 || qr.Observations.Header[0].Name != "Scoresby" || qr.Observations.Header[0].ID != "IDV60901" {
+		t.Errorf("unexpected header: %+v", qr.Observations.Header)
+	}
+
+	if len(qr.Observations.Data) != 2 || qr.Observations.Data[1].LocalDateTimeFull != "20240513150000" || qr.Observations.Data[1].RelHum != 64 {
+		t.Errorf("unexpected data: %+v", qr.Observations.Data)
+	}
+}
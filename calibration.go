@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The suffix of the metric of the readings of a sensor before they are calibrated
+const RawMetricSuffix = "_raw"
+
+// CalibrationConfiguration corrects one metric of a sensor, either by scale and offset or by two
+// points each giving the raw reading of the sensor and the true value at the same time
+type CalibrationConfiguration struct {
+	Offset float64
+	Scale  *float64
+	Points []CalibrationPoint
+}
+
+type CalibrationPoint struct {
+	Raw    float64
+	Actual float64
+}
+
+// Calibration is the linear correction of a raw reading, raw * Scale + Offset
+type Calibration struct {
+	Scale  float64
+	Offset float64
+}
+
+// Calibration returns the correction of the configuration, where the scale is 1 when not set
+func (cc *CalibrationConfiguration) Calibration() (c Calibration, err error) {
+	if len(cc.Points) == 0 {
+		c = Calibration{Scale: 1, Offset: cc.Offset}
+		if cc.Scale != nil {
+			c.Scale = *cc.Scale
+		}
+
+		if c.Scale == 0 {
+			err = errors.New("scale 0 would make every reading the offset")
+		}
+		return
+	}
+
+	if cc.Scale != nil || cc.Offset != 0 {
+		err = errors.New("points cannot be combined with scale or offset")
+		return
+	}
+
+	if len(cc.Points) != 2 {
+		err = fmt.Errorf("expected two points, got %d", len(cc.Points))
+		return
+	}
+
+	p, q := cc.Points[0], cc.Points[1]
+	if p.Raw == q.Raw {
+		err = fmt.Errorf("the points have the same raw reading %v", p.Raw)
+		return
+	}
+
+	c.Scale = (q.Actual - p.Actual) / (q.Raw - p.Raw)
+	c.Offset = p.Actual - c.Scale*p.Raw
+	if c.Scale == 0 {
+		err = errors.New("the points have the same actual value, which would make every reading the same")
+	}
+	return
+}
+
+func (c Calibration) Apply(raw float64) float64 {
+	return raw*c.Scale + c.Offset
+}
+
+// sensorCalibrations returns the correction of each metric of the sensor by metric name
+func sensorCalibrations(sc *SensorConfiguration) (calibrations map[string]Calibration, err error) {
+	metrics := make([]string, 0, len(sc.Calibration))
+	for metric := range sc.Calibration {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	for _, metric := range metrics {
+		cc := sc.Calibration[metric]
+
+		var c Calibration
+		if c, err = cc.Calibration(); err != nil {
+			return nil, fmt.Errorf("calibration of %s: %v", metric, err)
+		}
+
+		if calibrations == nil {
+			calibrations = make(map[string]Calibration)
+		}
+		calibrations[metric] = c
+	}
+
+	return
+}
+
+// calibrate corrects the readings of each metric with a calibration, adding the raw reading as
+// the metric with RawMetricSuffix after it
+func calibrate(readings []Reading, calibrations map[string]Calibration) []Reading {
+	if len(calibrations) == 0 {
+		return readings
+	}
+
+	calibrated := make([]Reading, 0, len(readings)+len(calibrations))
+	var raw []Reading
+	for _, r := range readings {
+		if c, ok := calibrations[r.Metric]; ok {
+			rr := r
+			rr.Metric += RawMetricSuffix
+			raw = append(raw, rr)
+			r.Value = c.Apply(r.Value)
+		}
+		calibrated = append(calibrated, r)
+	}
+
+	return append(calibrated, raw...)
+}
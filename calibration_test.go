@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func gaugeValue(t *testing.T, name string) (value float64, ok bool) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range families {
+		if mf.GetName() == name && len(mf.GetMetric()) > 0 {
+			return mf.GetMetric()[0].GetGauge().GetValue(), true
+		}
+	}
+	return
+}
+
+func TestCalibration(t *testing.T) {
+	scale := 1.25
+	zero := 0.0
+
+	tests := []struct {
+		cc      CalibrationConfiguration
+		raw     float64
+		value   float64
+		problem string
+	}{
+		{CalibrationConfiguration{}, 20, 20, ""},
+		{CalibrationConfiguration{Offset: -1.3}, 22.5, 21.2, ""},
+		{CalibrationConfiguration{Scale: &scale, Offset: 10}, 100, 135, ""},
+		{CalibrationConfiguration{Points: []CalibrationPoint{{Raw: 100, Actual: 150}, {Raw: 500, Actual: 650}}}, 300, 400, ""},
+		{CalibrationConfiguration{Scale: &zero}, 0, 0, "scale 0"},
+		{CalibrationConfiguration{Points: []CalibrationPoint{{Raw: 100, Actual: 150}}}, 0, 0, "expected two points, got 1"},
+		{CalibrationConfiguration{Points: []CalibrationPoint{{Raw: 100, Actual: 150}, {Raw: 100, Actual: 160}}}, 0, 0, "the same raw reading 100"},
+		{CalibrationConfiguration{Offset: 1, Points: []CalibrationPoint{{Raw: 1, Actual: 2}, {Raw: 3, Actual: 4}}}, 0, 0, "cannot be combined"},
+	}
+
+	for i, test := range tests {
+		c, err := test.cc.Calibration()
+		if test.problem != "" {
+			if err == nil || !strings.Contains(err.Error(), test.problem) {
+				t.Errorf("%d: expected the problem \"%s\", got %v", i, test.problem, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+		} else if value := c.Apply(test.raw); math.Abs(value-test.value) > 1e-9 {
+			t.Errorf("%d: expected %v to be calibrated to %v, got %v", i, test.raw, test.value, value)
+		}
+	}
+}
+
+func TestSensorManagementCalibratesReadings(t *testing.T) {
+	sm := NewSensorManagement(time.Second, time.Minute)
+	sm.AddSensor(&testReadingsSensor{readings: []Reading{
+		NewReading(MetricTemperature, 22.5, UnitCelsius, time.Now()),
+		NewReading(MetricHumidity, 50, UnitRelativeHumidity, time.Now()),
+	}}, SensorConfiguration{SensorType: "test", Name: "calibrated", Calibration: map[string]CalibrationConfiguration{
+		MetricTemperature: {Offset: -1.5},
+	}})
+	sm.UpdateSensors()
+
+	if temperature, _ := sm.GetTemperature(); temperature != 21 {
+		t.Errorf("expected the calibrated temperature 21, got %v", temperature)
+	}
+
+	if humidity, _ := sm.GetHumidity(); humidity != 50 {
+		t.Errorf("expected the humidity which is not calibrated to be unchanged, got %v", humidity)
+	}
+
+	ss, _ := sm.Snapshot("calibrated")
+	if r, ok := ss.Reading(MetricTemperature + RawMetricSuffix); !ok || r.Value != 22.5 || r.Unit != UnitCelsius {
+		t.Errorf("expected the raw temperature 22.5, got %t %+v", ok, r)
+	}
+
+	if _, ok := ss.Reading(MetricHumidity + RawMetricSuffix); ok {
+		t.Error("expected no raw humidity as it is not calibrated")
+	}
+
+	if ss.Summary != "calibrated: 21.00 C, 50.00 rH" || ss.Details != "calibrated - test: 21.00 C, 50.00 rH" {
+		t.Errorf("expected the summary and details to show the calibrated temperature, got %s and %s", ss.Summary, ss.Details)
+	}
+}
+
+func TestCalibratedGauges(t *testing.T) {
+	UseSimulatedDevices()
+	defer func() { devices = HardwareDevices{} }()
+
+	scale := 2.0
+	sc := SensorConfiguration{SensorType: "tmp117", Name: "calibrated_study", Calibration: map[string]CalibrationConfiguration{
+		MetricTemperature: {Scale: &scale, Offset: 1},
+	}}
+
+	sm := NewSensorManagement(time.Second, time.Minute)
+	if err := sm.OpenSensor(sc, func() (Sensor, error) { return NewSensor(&sc, &I2cConfiguration{}) }); err != nil {
+		t.Fatal(err)
+	}
+	sm.UpdateSensors()
+
+	raw, rok := gaugeValue(t, "calibrated_study_temperature_raw")
+	value, ok := gaugeValue(t, "calibrated_study_temperature")
+	if !rok || !ok || value != raw*2+1 {
+		t.Errorf("expected the gauge to be the calibrated raw gauge, got %v and raw %v", value, raw)
+	}
+
+	if temperature, _ := sm.GetTemperature(); temperature != value {
+		t.Errorf("expected the reading %v to match the gauge %v", temperature, value)
+	}
+
+	if err := sm.RemoveSensor(sc.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	if registeredMetric(t, "calibrated_study_temperature_raw") {
+		t.Error("the raw gauge of the removed sensor is still registered")
+	}
+}
+
+func TestParseConfigurationCalibration(t *testing.T) {
+	config, err := parseConfiguration([]byte(testConfigHeader+`sensors:
+  - sensortype: veml6030
+    name: hall
+    calibration:
+      light_level:
+        points:
+          - raw: 120
+            actual: 150
+          - raw: 800
+            actual: 1000
+`), []string{"I2C_SENSORS_HALL_CALIBRATION_TEMPERATURE_OFFSET=-1.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if calibration := config.Sensors[0].Calibration; len(calibration[MetricLightLevel].Points) != 2 || calibration[MetricTemperature].Offset != -1.3 {
+		t.Errorf("expected the calibration of the light level and temperature, got %+v", calibration)
+	}
+}
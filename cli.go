@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The configuration loaded when --config is not given
+const DefaultConfigPath = "config/config.yaml"
+
+// Version is the version of the build, set with -ldflags "-X main.Version=..."
+var Version = "dev"
+
+// usageError is a command line which cannot be run, as opposed to a command which failed
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usagef(format string, a ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, a...)}
+}
+
+// cliCommand is a subcommand of i2c, which is run with the arguments after its name
+type cliCommand struct {
+	name        string
+	args        string
+	description string
+	run         func(ctx context.Context, w io.Writer, args []string) error
+}
+
+var cliCommands []cliCommand
+
+func init() {
+	cliCommands = []cliCommand{
+		{"serve", "[--config PATH] [--simulate]", "run the service (the default)", runServe},
+		{"read", "SENSOR [--config PATH] [--simulate]", "read a sensor once and print its readings", runRead},
+		{"config", "validate | show [--config PATH]", "check the configuration, or show it with the environment applied and secrets redacted", runConfig},
+		{"homekit", "qr [--config PATH]", "print the HomeKit pairing QR code and setup code", runHomeKit},
+		{"lifx", "list | on [BULB] | off [BULB] [--config PATH]", "list the Lifx bulbs or switch one, the configured bulb by default", runLifx},
+		{"scan", "[--bus N] [--simulate]", "scan an I2C bus and print a configuration for the devices found", runScan},
+		{"export", "[--config PATH] [flags]", "export the recorded readings as CSV or NDJSON", runExport},
+		{"sensor-types", "", "list the supported sensor types", runSensorTypes},
+		{"version", "", "print the version", runVersion},
+	}
+}
+
+// RunCLI runs the command line. With no command, or only flags, the service is run as before
+// there were commands.
+func RunCLI(ctx context.Context, w io.Writer, args []string) (err error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		switch {
+		case len(args) > 0 && (args[0] == "-h" || args[0] == "--help" || args[0] == "-help"):
+			writeUsage(w)
+			return
+		case len(args) > 0 && (args[0] == "--list-sensor-types" || args[0] == "-list-sensor-types"):
+			return runSensorTypes(ctx, w, args[1:])
+		}
+		return runServe(ctx, w, args)
+	}
+
+	if args[0] == "help" {
+		writeUsage(w)
+		return
+	}
+
+	for _, c := range cliCommands {
+		if c.name == args[0] {
+			return c.run(ctx, w, args[1:])
+		}
+	}
+
+	writeUsage(os.Stderr)
+	return usagef("unknown command \"%s\"", args[0])
+}
+
+func writeUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: i2c COMMAND [ARGS]")
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, c := range cliCommands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", c.name, c.args, c.description)
+	}
+	tw.Flush()
+}
+
+// commandFlags are the flags of a command, with --config and --simulate where it uses them
+type commandFlags struct {
+	*flag.FlagSet
+	configPath *string
+	simulate   *bool
+}
+
+func newCommandFlags(name string, simulate bool) (cf *commandFlags) {
+	cf = &commandFlags{FlagSet: flag.NewFlagSet(name, flag.ContinueOnError)}
+	cf.configPath = cf.String("config", DefaultConfigPath, "the configuration file")
+	if simulate {
+		cf.simulate = cf.Bool("simulate", false, "use simulated I2C devices instead of the hardware")
+	}
+	return
+}
+
+// parse parses the flags, which may come before or after the positional arguments, and
+// returns the positional arguments
+func (cf *commandFlags) parse(args []string) (positional []string, err error) {
+	for {
+		if err = cf.Parse(args); err != nil {
+			if err != flag.ErrHelp {
+				err = &usageError{msg: err.Error()}
+			}
+			return
+		}
+
+		if cf.NArg() == 0 {
+			return
+		}
+
+		positional = append(positional, cf.Arg(0))
+		args = cf.Args()[1:]
+	}
+}
+
+// load loads the configuration and switches to the simulated devices when asked to
+func (cf *commandFlags) load() (config *I2cConfiguration, err error) {
+	if config, err = LoadConfiguration(*cf.configPath); err != nil {
+		return
+	}
+
+	if (cf.simulate != nil && *cf.simulate) || config.Simulate {
+		UseSimulatedDevices()
+	}
+	return
+}
+
+func runServe(ctx context.Context, w io.Writer, args []string) (err error) {
+	cf := newCommandFlags("serve", true)
+	var positional []string
+	if positional, err = cf.parse(args); err != nil {
+		return
+	} else if len(positional) > 0 {
+		return usagef("serve takes no arguments")
+	}
+
+	var config *I2cConfiguration
+	if config, err = cf.load(); err != nil {
+		return
+	}
+
+	if err = ConfigureLogging(config.Logging, config.DebugOutput); err != nil {
+		return
+	}
+	defer CloseLogging()
+
+	if config.Simulate || *cf.simulate {
+		logMain.Info("Using simulated I2C devices")
+	}
+
+	return serve(ctx, config)
+}
+
+// runRead opens a sensor with the same constructor as the service, updates it once and prints
+// its readings
+func runRead(ctx context.Context, w io.Writer, args []string) (err error) {
+	cf := newCommandFlags("read", true)
+	var positional []string
+	if positional, err = cf.parse(args); err != nil {
+		return
+	} else if len(positional) != 1 {
+		return usagef("read takes the name of a sensor")
+	}
+
+	var config *I2cConfiguration
+	if config, err = cf.load(); err != nil {
+		return
+	}
+
+	var sc *SensorConfiguration
+	for i := range config.Sensors {
+		if config.Sensors[i].Name == positional[0] {
+			sc = &config.Sensors[i]
+		}
+	}
+
+	if sc == nil {
+		return fmt.Errorf("there is no sensor named \"%s\" in %s", positional[0], *cf.configPath)
+	}
+
+	if _, err = config.SensorBus(sc); err != nil {
+		return
+	}
+
+	var s Sensor
+	if s, err = NewSensor(sc, config); err != nil {
+		return
+	}
+
+	sm := NewSensorManagement(config.SamplePeriod(), config.StaleAfter)
+	sm.AddSensor(s, *sc)
+	defer sm.Close()
+
+	sm.UpdateSensors()
+	ss, _ := sm.Snapshot(sc.Name)
+	if ss.Error != "" {
+		return errors.New(ss.Error)
+	}
+
+	fmt.Fprintln(w, ss.Details)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, r := range ss.Readings {
+		fmt.Fprintf(tw, "%s\t%g\t%s\n", r.Metric, r.Value, r.Unit)
+	}
+	return tw.Flush()
+}
+
+func runConfig(ctx context.Context, w io.Writer, args []string) (err error) {
+	cf := newCommandFlags("config", false)
+	var positional []string
+	if positional, err = cf.parse(args); err != nil {
+		return
+	} else if len(positional) != 1 || (positional[0] != "validate" && positional[0] != "show") {
+		return usagef("config takes the subcommand validate or show")
+	}
+
+	var config *I2cConfiguration
+	if config, err = cf.load(); err != nil {
+		return
+	}
+
+	if err = config.Validate(); err != nil {
+		return fmt.Errorf("%s: %v", *cf.configPath, err)
+	}
+
+	if positional[0] == "show" {
+		var node *yaml.Node
+		if node, err = RedactedConfiguration(config); err != nil {
+			return
+		}
+
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err = enc.Encode(node); err != nil {
+			return
+		}
+		return enc.Close()
+	}
+
+	fmt.Fprintf(w, "%s is valid: %d sensors\n", *cf.configPath, len(config.Sensors))
+	return
+}
+
+func runHomeKit(ctx context.Context, w io.Writer, args []string) (err error) {
+	cf := newCommandFlags("homekit", false)
+	var positional []string
+	if positional, err = cf.parse(args); err != nil {
+		return
+	} else if len(positional) != 1 || positional[0] != "qr" {
+		return usagef("homekit takes the subcommand qr")
+	}
+
+	var config *I2cConfiguration
+	if config, err = cf.load(); err != nil {
+		return
+	}
+
+	return WriteHomeKitPairing(w, config.HomeKitDeviceID, config.HomeKitDevicePin)
+}
+
+func runLifx(ctx context.Context, w io.Writer, args []string) (err error) {
+	cf := newCommandFlags("lifx", false)
+	var positional []string
+	if positional, err = cf.parse(args); err != nil {
+		return
+	} else if len(positional) == 0 || len(positional) > 2 {
+		return usagef("lifx takes the subcommand list, on or off")
+	}
+
+	var config *I2cConfiguration
+	if config, err = cf.load(); err != nil {
+		return
+	}
+
+	lbs := NewLifxBulbState()
+
+	switch positional[0] {
+	case "list":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tMAC\tPOWER\tLABEL")
+		for _, b := range lbs.bulbs {
+			fmt.Fprintf(tw, "%s\t%s\t%t\t%s\n", b.Name, b.MACAddress, b.Power, b.Label)
+		}
+		return tw.Flush()
+
+	case "on", "off":
+		mac := config.LifxMAC
+		if len(positional) == 2 {
+			mac = positional[1]
+			for _, b := range lbs.bulbs {
+				if strings.EqualFold(b.Name, positional[1]) {
+					mac = b.MACAddress
+				}
+			}
+		}
+
+		if mac == "" {
+			return usagef("lifx %s takes a bulb when lifxmac is not configured", positional[0])
+		}
+
+		return lbs.SetBulbPower(mac, positional[0])
+	}
+
+	return usagef("unknown lifx subcommand \"%s\"", positional[0])
+}
+
+func runScan(ctx context.Context, w io.Writer, args []string) error {
+	return RunScan(w, args)
+}
+
+func runExport(ctx context.Context, w io.Writer, args []string) error {
+	return RunExport(w, args)
+}
+
+func runSensorTypes(ctx context.Context, w io.Writer, args []string) error {
+	PrintSensorTypes(w)
+	return nil
+}
+
+func runVersion(ctx context.Context, w io.Writer, args []string) (err error) {
+	_, err = fmt.Fprintf(w, "i2c %s (%s %s/%s)\n", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return
+}
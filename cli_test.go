@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTestConfig writes a configuration file for a command to load
+func writeTestConfig(t *testing.T, yaml string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func runTestCLI(t *testing.T, args ...string) (string, error) {
+	defer func() { devices = HardwareDevices{} }()
+
+	var out bytes.Buffer
+	err := RunCLI(context.Background(), &out, args)
+	return out.String(), err
+}
+
+const cliTestConfig = `
+homekitdeviceid: TF0X
+homekitdevicepin: 12344321
+sensors:
+  - sensortype: tmp117
+    name: study
+`
+
+func TestCLIRead(t *testing.T) {
+	config := writeTestConfig(t, cliTestConfig)
+
+	out, err := runTestCLI(t, "read", "study", "--config", config, "--simulate")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(out, "study") || !strings.Contains(out, "temperature") || !strings.Contains(out, UnitCelsius) {
+		t.Errorf("expected the temperature of the sensor:\n%s", out)
+	}
+
+	if _, err = runTestCLI(t, "read", "--config", config, "--simulate", "kitchen"); err == nil {
+		t.Error("no error reading a sensor which is not configured")
+	}
+}
+
+func TestCLIConfigValidate(t *testing.T) {
+	out, err := runTestCLI(t, "config", "validate", "--config", writeTestConfig(t, cliTestConfig))
+	if err != nil || !strings.Contains(out, "is valid: 1 sensors") {
+		t.Errorf("expected the configuration to be valid, got %v:\n%s", err, out)
+	}
+
+	_, err = runTestCLI(t, "config", "validate", "--config", writeTestConfig(t, cliTestConfig+`  - sensortype: toaster
+    name: kitchen
+`))
+	if err == nil || !strings.Contains(err.Error(), "toaster") {
+		t.Errorf("expected an unknown sensor type to be invalid, got %v", err)
+	}
+}
+
+func TestCLIConfigShow(t *testing.T) {
+	out, err := runTestCLI(t, "config", "show", "--config", writeTestConfig(t, cliTestConfig))
+	if err != nil || !strings.Contains(out, "homekitdevicepin: "+Redacted) || !strings.Contains(out, "name: study") {
+		t.Errorf("expected the configuration with the setup code redacted, got %v:\n%s", err, out)
+	}
+}
+
+func TestCLIHomeKitQR(t *testing.T) {
+	out, err := runTestCLI(t, "homekit", "qr", "--config", writeTestConfig(t, cliTestConfig))
+	if err != nil || !strings.Contains(out, "Setup code: 123-44-321") {
+		t.Errorf("expected the setup code, got %v:\n%s", err, out)
+	}
+}
+
+func TestCLIVersion(t *testing.T) {
+	if out, err := runTestCLI(t, "version"); err != nil || !strings.HasPrefix(out, "i2c "+Version+" ") {
+		t.Errorf("unexpected version %v: %s", err, out)
+	}
+}
+
+func TestCLIUsageErrors(t *testing.T) {
+	for _, args := range [][]string{{"frobnicate"}, {"config", "check"}, {"read"}, {"serve", "--colour"}} {
+		var usage *usageError
+		if _, err := runTestCLI(t, args...); !errors.As(err, &usage) {
+			t.Errorf("expected a usage error for %v, got %v", args, err)
+		}
+	}
+}
@@ -1,44 +1,246 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
-
-	"gopkg.in/yaml.v2"
+	"time"
 )
 
 type SensorConfiguration struct {
-	SensorType string
+	SensorType  string
+	Name        string
+	I2CAddress  uint8
+	I2CBus      *int
+	Multiplexer string
+	MuxChannel  int
+	Server      string
+	DeviceType  string
+	Serial      string
+	Password    string
+	Interval    time.Duration
+	StaleAfter  time.Duration
+	Options     SensorOptions
+	Calibration map[string]CalibrationConfiguration
+	Filters     map[string]FilterConfiguration
+}
+
+// MultiplexerConfiguration is a TCA9548A, whose channels are referenced by name from the sensors
+type MultiplexerConfiguration struct {
 	Name       string
 	I2CAddress uint8
-	Server     string
-	DeviceType string
-	Serial     string
-	Password   string
+	I2CBus     *int
+}
+
+// The default address of a TCA9548A
+const TCA9548AAddress = 0x70
+
+func (mc *MultiplexerConfiguration) Address() uint8 {
+	if mc.I2CAddress != 0 {
+		return mc.I2CAddress
+	}
+
+	return TCA9548AAddress
+}
+
+// HistoryConfiguration sets where the history of the readings is kept and for how long at each resolution
+type HistoryConfiguration struct {
+	Dir             string
+	RawRetention    time.Duration
+	MinuteRetention time.Duration
+	HourRetention   time.Duration
+}
+
+// The directory of the history when it is not configured
+const DefaultHistoryDir = "history"
+
+func (hc *HistoryConfiguration) Directory() string {
+	if hc.Dir != "" {
+		return hc.Dir
+	}
+
+	return DefaultHistoryDir
+}
+
+// LoggingConfiguration sets the level and format of the log, and the file it is written to
+// instead of standard output. Subsystems sets the level of individual subsystems, such as dyson.
+type LoggingConfiguration struct {
+	Level      string
+	Format     string
+	File       string
+	MaxSizeMB  int
+	MaxBackups int
+	Subsystems map[string]string
+}
+
+func (lc *LoggingConfiguration) MaxSize() int {
+	if lc.MaxSizeMB > 0 {
+		return lc.MaxSizeMB
+	}
+
+	return DefaultLogMaxSizeMB
+}
+
+func (lc *LoggingConfiguration) Backups() int {
+	if lc.MaxBackups > 0 {
+		return lc.MaxBackups
+	}
+
+	return DefaultLogMaxBackups
 }
 
 type I2cConfiguration struct {
 	HomeKitDeviceID   string
 	HomeKitDevicePin  uint32
 	HomeKitBridgeName string
+	HomeKitDerived    []string // The derived metrics of the home room shown by HomeKit, such as dew_point
 	SampleTime        uint32
+	StaleAfter        time.Duration
 	EnableLifx        bool
 	LifxMAC           string
 	EnableOLED        bool
+	OLEDBus           *int
 	EnableLED         bool
+	LEDBus            *int
 	EnableHDPrice     bool
+	EnableHistory     bool
+	History           HistoryConfiguration
+	EnableRecording   bool
+	RecordingDir      string
+	StatsFile         string
 	DebugOutput       bool
+	Logging           LoggingConfiguration
+	Simulate          bool
+	ListenAddress     string
+	WatchConfig       bool
+
+	Multiplexers []MultiplexerConfiguration
+	Sensors      []SensorConfiguration
+
+	// The rooms of the sensors, and the room used by HomeKit, the OLED and the automations, which
+	// is the first room when not set
+	Rooms    []RoomConfiguration
+	HomeRoom string
+
+	// The line of each key in the file, such as sensors[2].name
+	lines map[string]int
+
+	// The file the configuration was loaded from, which is loaded again when it is reloaded
+	path string
+
+	// The paths of the values which were read from files, which are secret
+	secrets map[string]bool
+}
+
+// busNumber returns the configured bus, or the default bus when it is not set
+func busNumber(bus *int) int {
+	if bus != nil {
+		return *bus
+	}
+
+	return DefaultI2CBus
+}
+
+// I2CBusNumber is the bus of the sensor's device, set by i2cbus
+func (sc *SensorConfiguration) I2CBusNumber() int {
+	return busNumber(sc.I2CBus)
+}
+
+func (c *I2cConfiguration) LookupMultiplexer(name string) (mc *MultiplexerConfiguration, err error) {
+	for i := range c.Multiplexers {
+		if c.Multiplexers[i].Name == name {
+			return &c.Multiplexers[i], nil
+		}
+	}
 
-	Sensors []SensorConfiguration
+	return nil, fmt.Errorf("unknown multiplexer \"%s\"", name)
 }
 
+// SensorBus is the bus of the sensor's device, which is a channel of its multiplexer when it has one
+func (c *I2cConfiguration) SensorBus(sc *SensorConfiguration) (bus BusRef, err error) {
+	if sc.Multiplexer == "" {
+		return OnBus(sc.I2CBusNumber()), nil
+	}
+
+	var mc *MultiplexerConfiguration
+	if mc, err = c.LookupMultiplexer(sc.Multiplexer); err != nil {
+		return
+	}
+
+	if sc.MuxChannel < 0 || sc.MuxChannel >= MultiplexerChannels {
+		err = fmt.Errorf("sensor \"%s\" is on channel %d of multiplexer \"%s\", which has channels 0 to %d",
+			sc.Name, sc.MuxChannel, mc.Name, MultiplexerChannels-1)
+		return
+	}
+
+	if sc.I2CBus != nil && *sc.I2CBus != busNumber(mc.I2CBus) {
+		err = fmt.Errorf("sensor \"%s\" is on bus %d, but its multiplexer \"%s\" is on bus %d",
+			sc.Name, *sc.I2CBus, mc.Name, busNumber(mc.I2CBus))
+		return
+	}
+
+	return BusRef{Number: busNumber(mc.I2CBus), Mux: mc.Address(), Channel: sc.MuxChannel}, nil
+}
+
+func (c *I2cConfiguration) RecordingDirectory() string {
+	if c.RecordingDir != "" {
+		return c.RecordingDir
+	}
+
+	return DefaultRecordingDir
+}
+
+func (c *I2cConfiguration) StatsPath() string {
+	if c.StatsFile != "" {
+		return c.StatsFile
+	}
+
+	return DefaultStatsFile
+}
+
+func (c *I2cConfiguration) OLEDBusNumber() int {
+	return busNumber(c.OLEDBus)
+}
+
+func (c *I2cConfiguration) LEDBusNumber() int {
+	return busNumber(c.LEDBus)
+}
+
+// The time between sensor updates when sampletime is not configured
+const DefaultSamplePeriod = 5 * time.Second
+
+// SamplePeriod is the time between updates of sensors without their own interval and of the
+// HomeKit, OLED and Lifx outputs
+func (c *I2cConfiguration) SamplePeriod() time.Duration {
+	if c.SampleTime > 0 {
+		return time.Duration(c.SampleTime) * time.Second
+	}
+
+	return DefaultSamplePeriod
+}
+
+// The address of the web UI, API and Prometheus metrics when listenaddress is not configured
+const DefaultListenAddress = ":2112"
+
+func (c *I2cConfiguration) HTTPAddress() string {
+	if c.ListenAddress != "" {
+		return c.ListenAddress
+	}
+
+	return DefaultListenAddress
+}
+
+// LoadConfiguration reads the configuration file, returning ConfigErrors with every problem in it
 func LoadConfiguration(fileName string) (cfg *I2cConfiguration, err error) {
-	var f *os.File
-	if f, err = os.Open(fileName); err != nil {
+	var data []byte
+	if data, err = ioutil.ReadFile(fileName); err != nil {
+		return
+	}
+
+	if cfg, err = parseConfiguration(data, os.Environ()); err != nil {
 		return
 	}
-	defer f.Close()
 
-	cfg = &I2cConfiguration{}
-	err = yaml.NewDecoder(f).Decode(&cfg)
+	cfg.path = fileName
 	return
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// DerivedMetrics are calculated from the temperature and relative humidity of a sensor or room,
+// rather than measured
+var DerivedMetrics = []string{
+	MetricDewPoint, MetricAbsoluteHumidity, MetricHumidex, MetricHeatIndex, MetricApparentTemperature, MetricVPD,
+}
+
+// The derived metrics which HomeKit can show, as temperature sensors, with the names of the sensors
+var HomeKitDerivedMetrics = []string{MetricDewPoint, MetricHumidex, MetricHeatIndex, MetricApparentTemperature}
+
+var derivedMetricNames = map[string]string{
+	MetricDewPoint:            "Dew Point",
+	MetricHumidex:             "Humidex",
+	MetricHeatIndex:           "Heat Index",
+	MetricApparentTemperature: "Feels Like",
+}
+
+// The accessory IDs of the derived metrics, which are fixed so that HomeKit keeps each sensor
+// however many of them are shown
+var derivedAccessoryIDs = map[string]uint64{
+	MetricDewPoint:            6,
+	MetricHumidex:             7,
+	MetricHeatIndex:           8,
+	MetricApparentTemperature: 9,
+}
+
+// saturationVapourPressure returns the pressure of water vapour in hPa in saturated air at the
+// temperature in °C, by the Magnus formula
+func saturationVapourPressure(temperature float64) float64 {
+	return 6.112 * math.Exp(17.62*temperature/(243.12+temperature))
+}
+
+// dewPoint returns the temperature in °C to which the air must be cooled to become saturated
+func dewPoint(temperature, humidity float64) float64 {
+	gamma := math.Log(math.Max(humidity, 0.1)/100) + 17.62*temperature/(243.12+temperature)
+	return 243.12 * gamma / (17.62 - gamma)
+}
+
+// absoluteHumidity returns the mass of water vapour in the air in g/m³
+func absoluteHumidity(temperature, humidity float64) float64 {
+	return 216.7 * humidity / 100 * saturationVapourPressure(temperature) / (273.15 + temperature)
+}
+
+// humidex returns the Canadian humidex, which is how hot humid air feels
+func humidex(temperature, humidity float64) float64 {
+	e := 6.11 * math.Exp(5417.7530*(1/273.16-1/(273.15+dewPoint(temperature, humidity))))
+	return temperature + 0.5555*(e-10)
+}
+
+// heatIndex returns the heat index in °C of the US National Weather Service, by the Rothfusz
+// regression when the air is warm and the simpler formula of Steadman when it is not
+func heatIndex(temperature, humidity float64) float64 {
+	t := temperature*9/5 + 32
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + humidity*0.094)
+
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*humidity - 0.22475541*t*humidity - 0.00683783*t*t -
+			0.05481717*humidity*humidity + 0.00122874*t*t*humidity + 0.00085282*t*humidity*humidity -
+			0.00000199*t*t*humidity*humidity
+
+		if humidity < 13 && t >= 80 && t <= 112 {
+			hi -= (13 - humidity) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		} else if humidity > 85 && t >= 80 && t <= 87 {
+			hi += (humidity - 85) / 10 * (87 - t) / 5
+		}
+	}
+
+	return (hi - 32) * 5 / 9
+}
+
+// apparentTemperature returns the apparent temperature in °C used by the Bureau of Meteorology,
+// in still air
+func apparentTemperature(temperature, humidity float64) float64 {
+	e := humidity / 100 * 6.105 * math.Exp(17.27*temperature/(237.7+temperature))
+	return temperature + 0.33*e - 4
+}
+
+// vapourPressureDeficit returns how far the water vapour in the air is below saturation in kPa
+func vapourPressureDeficit(temperature, humidity float64) float64 {
+	return saturationVapourPressure(temperature) * (1 - humidity/100) / 10
+}
+
+// deriveReadings returns the readings with the derived metrics appended when there is a
+// temperature and a humidity. Each derived reading has the time of the older of the two, and is
+// stale when either is. Until both have been read the derived readings are zero, to show which
+// metrics the sensor will have.
+func deriveReadings(readings []Reading) []Reading {
+	var temperature, humidity *Reading
+	for i := range readings {
+		switch readings[i].Metric {
+		case MetricTemperature:
+			temperature = &readings[i]
+		case MetricHumidity:
+			humidity = &readings[i]
+		}
+	}
+
+	if temperature == nil || humidity == nil {
+		return readings
+	}
+
+	t, h := temperature.Value, humidity.Value
+	var when time.Time
+	if !temperature.Time.IsZero() && !humidity.Time.IsZero() {
+		if when = temperature.Time; humidity.Time.Before(when) {
+			when = humidity.Time
+		}
+	}
+	stale := temperature.Stale || humidity.Stale
+
+	derived := []Reading{
+		NewReading(MetricDewPoint, dewPoint(t, h), UnitCelsius, when),
+		NewReading(MetricAbsoluteHumidity, absoluteHumidity(t, h), UnitGramsPerCubicMetre, when),
+		NewReading(MetricHumidex, humidex(t, h), UnitIndex, when),
+		NewReading(MetricHeatIndex, heatIndex(t, h), UnitCelsius, when),
+		NewReading(MetricApparentTemperature, apparentTemperature(t, h), UnitCelsius, when),
+		NewReading(MetricVPD, vapourPressureDeficit(t, h), UnitKilopascal, when),
+	}
+
+	for _, r := range derived {
+		if r.Time.IsZero() {
+			r.Value = 0
+		}
+		r.Stale = stale
+		readings = append(readings, r)
+	}
+
+	return readings
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/accessory"
+)
+
+func TestDerivedMetrics(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    float64
+		expected float64
+	}{
+		// Published values of each, to the precision of the tables they come from
+		{"dew point at 25 °C and 60%", dewPoint(25, 60), 16.7},
+		{"absolute humidity at 25 °C and 60%", absoluteHumidity(25, 60), 13.8},
+		{"humidex at 30 °C with a dew point of 15 °C", humidex(30, 100*saturationVapourPressure(15)/saturationVapourPressure(30)), 34},
+		{"heat index at 90 °F and 70%", heatIndex((90-32)*5.0/9, 70), (106 - 32) * 5.0 / 9},
+		{"heat index at 68 °F and 50%", heatIndex(20, 50), (66.7 - 32) * 5.0 / 9},
+		{"apparent temperature at 25 °C and 60%", apparentTemperature(25, 60), 27.3},
+		{"vapour pressure deficit at 25 °C and 60%", vapourPressureDeficit(25, 60), 1.27},
+	}
+
+	for _, test := range tests {
+		if math.Abs(test.value-test.expected) > 0.5 {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, test.value)
+		}
+	}
+}
+
+func TestDeriveReadings(t *testing.T) {
+	now := time.Now()
+	readings := deriveReadings([]Reading{
+		NewReading(MetricTemperature, 25, UnitCelsius, now),
+		NewReading(MetricHumidity, 60, UnitRelativeHumidity, now.Add(-time.Second)),
+	})
+
+	if len(readings) != 2+len(DerivedMetrics) {
+		t.Fatalf("expected the derived metrics to be appended, got %+v", readings)
+	}
+
+	for i, metric := range DerivedMetrics {
+		if r := readings[2+i]; r.Metric != metric || !r.Time.Equal(now.Add(-time.Second)) {
+			t.Errorf("expected %s at the time of the older reading, got %+v", metric, r)
+		}
+	}
+
+	if readings = deriveReadings([]Reading{NewReading(MetricTemperature, 25, UnitCelsius, now)}); len(readings) != 1 {
+		t.Errorf("expected nothing to be derived without a humidity, got %+v", readings)
+	}
+
+	readings = deriveReadings([]Reading{
+		NewReading(MetricTemperature, 25, UnitCelsius, now),
+		NewReading(MetricHumidity, 0, UnitRelativeHumidity, time.Time{}),
+	})
+	if r := readings[2]; !r.Time.IsZero() || r.Value != 0 {
+		t.Errorf("expected the derived readings to be zero until the humidity is read, got %+v", r)
+	}
+}
+
+func TestSensorManagementDerivesReadings(t *testing.T) {
+	sm := NewSensorManagement(time.Second, time.Minute)
+	sm.AddSensor(&testReadingsSensor{readings: []Reading{
+		NewReading(MetricTemperature, 25, UnitCelsius, time.Now()), NewReading(MetricHumidity, 60, UnitRelativeHumidity, time.Now()),
+	}}, SensorConfiguration{SensorType: "test", Name: "derived_study"})
+	defer sm.RemoveSensor("derived_study")
+	sm.UpdateSensors()
+
+	dew, ok := sm.GetDerived(MetricDewPoint)
+	if !ok || math.Abs(dew-dewPoint(25, 60)) > 1e-9 {
+		t.Errorf("expected the dew point of the sensor, got %t %v", ok, dew)
+	}
+
+	if value, ok := gaugeValue(t, "derived_study_dew_point"); !ok || value != dew {
+		t.Errorf("expected the gauge of the dew point to be %v, got %t %v", dew, ok, value)
+	}
+
+	sm.RemoveSensor("derived_study")
+	if registeredMetric(t, "derived_study_dew_point") {
+		t.Error("expected the gauge of the dew point to be unregistered with the sensor")
+	}
+}
+
+func TestDerivedAccessoryIDs(t *testing.T) {
+	// The bridge and the other accessories use the IDs up to 5
+	seen := map[uint64]string{}
+	for _, metric := range HomeKitDerivedMetrics {
+		id := derivedAccessoryIDs[metric]
+		if id <= 5 || seen[id] != "" {
+			t.Errorf("the accessory ID %d of %s is taken", id, metric)
+		}
+		seen[id] = metric
+	}
+}
+
+func TestDerivedAccessoryBelowFreezing(t *testing.T) {
+	a := newDerivedAccessory(MetricDewPoint)
+	b := &HomeKitBridge{derived: map[string]*accessory.Thermometer{MetricDewPoint: a}}
+
+	dew := dewPoint(2, 40)
+	if b.SetDerived(MetricDewPoint, dew); a.TempSensor.CurrentTemperature.Value() != dew || dew >= 0 {
+		t.Errorf("expected HomeKit to show the dew point %v, got %v", dew, a.TempSensor.CurrentTemperature.Value())
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"image"
+)
+
+// The I2C bus used by devices when the configuration does not set one
+const DefaultI2CBus = 1
+
+// Device drivers used by the sensors, OLED and LED. The methods are those of the go-piicodev and
+// periph devices so that the hardware backend can hand them out directly.
+
+type TMP117Device interface {
+	ReadTempC() (float64, error)
+	Close()
+}
+
+type MS5637Device interface {
+	Read() (pressure float64, temperature float64, err error)
+	Close()
+}
+
+type AHT10Device interface {
+	ReadSensor() (temperature float64, humidity float64, err error)
+	Close()
+}
+
+type VEML6030Device interface {
+	Read() (light float64, err error)
+	Close()
+}
+
+type BME280Device interface {
+	Read() (temperature float64, pressure float64, humidity float64, err error)
+	Close()
+}
+
+type VL53L1XDevice interface {
+	Read() (distance uint16, err error)
+	Close()
+}
+
+type ENS160Device interface {
+	GetOperation() (operation string, err error)
+	ReadAQI() (aqi byte, rating string, err error)
+	ReadTVOC() (tvoc uint16, err error)
+	ReadECO2() (eco2 uint16, rating string, err error)
+	Close()
+}
+
+type CAP1203Device interface {
+	SetSensitivity(sensitivity int) error
+	Read() (status1, status2, status3 bool, err error)
+	Close()
+}
+
+type SwitchDevice interface {
+	SetLED(enable bool) error
+	WasPressed() (pressed bool, err error)
+	WasDoublePressed() (doublePressed bool, err error)
+	Close()
+}
+
+type PotentiometerDevice interface {
+	SetLED(enable bool) error
+	ReadRawValue() (value uint16, err error)
+	Close()
+}
+
+type PIRDevice interface {
+	GetRawReading() (detected bool, err error)
+	Close()
+}
+
+type RGBLEDDevice interface {
+	SetBrightness(brightness byte) error
+	EnablePowerLED(state bool) error
+	FillPixels(red, green, blue byte)
+	Show() error
+	Close()
+}
+
+// DisplayDevice is a monochrome display such as the SSD1306 OLED
+type DisplayDevice interface {
+	Bounds() image.Rectangle
+	Draw(r image.Rectangle, src image.Image, sp image.Point) error
+	Close()
+}
+
+// MultiplexerDevice is a TCA9548A, which connects the bus to the devices on the channels in the mask
+type MultiplexerDevice interface {
+	SelectChannels(mask byte) error
+	Close()
+}
+
+// RegisterDevice reads the registers of any device on the bus, to identify it
+type RegisterDevice interface {
+	ReadReg(reg byte, length int) ([]byte, error)
+	ReadReg16(reg uint16, length int) ([]byte, error)
+	Close()
+}
+
+// DeviceBackend opens the device drivers, either on the I2C hardware or simulated
+type DeviceBackend interface {
+	// ProbeI2C returns an error if there is no device at the address
+	ProbeI2C(address uint8, bus int) error
+	OpenRegisters(address uint8, bus int) (RegisterDevice, error)
+	OpenMultiplexer(address uint8, bus int) (MultiplexerDevice, error)
+
+	OpenTMP117(address uint8, bus BusRef) (TMP117Device, error)
+	OpenMS5637(address uint8, bus BusRef) (MS5637Device, error)
+	OpenAHT10(address uint8, bus BusRef) (AHT10Device, error)
+	OpenVEML6030(address uint8, bus BusRef) (VEML6030Device, error)
+	OpenBME280(address uint8, bus BusRef, options BME280Options) (BME280Device, error)
+	OpenVL53L1X(address uint8, bus BusRef) (VL53L1XDevice, error)
+	OpenENS160(address uint8, bus BusRef) (ENS160Device, error)
+	OpenCAP1203(address uint8, bus BusRef) (CAP1203Device, error)
+	OpenSwitch(address uint8, bus BusRef) (SwitchDevice, error)
+	OpenPotentiometer(address uint8, bus BusRef) (PotentiometerDevice, error)
+	OpenPIR(address uint8, bus BusRef) (PIRDevice, error)
+	OpenRGBLED(address uint8, bus BusRef) (RGBLEDDevice, error)
+	OpenSSD1306(bus BusRef) (DisplayDevice, error)
+}
+
+// The backend used to open devices. It is replaced with the simulated backend by --simulate.
+var devices DeviceBackend = HardwareDevices{}
+
+// UseSimulatedDevices makes every device opened from now on a simulated one
+func UseSimulatedDevices() {
+	devices = NewSimulatedDevices()
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/drtimf/go-piicodev"
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/devices/v3/ssd1306"
+)
+
+// HardwareDevices opens the go-piicodev and periph drivers for devices on the I2C buses. Every
+// device holds the lock of its shared bus for each call to its driver.
+type HardwareDevices struct{}
+
+// ErrI2CAddressBusy is returned when probing an address which is in use by a kernel driver
+var ErrI2CAddressBusy = errors.New("in use by a kernel driver")
+
+// ProbeI2C reads a byte from the address in the same way as i2cdetect -r, which fails if no
+// device acknowledges. Nothing is written so that devices are not disturbed by the probe.
+func (HardwareDevices) ProbeI2C(address uint8, bus int) (err error) {
+	var f *os.File
+	if f, err = os.OpenFile(fmt.Sprintf("/dev/i2c-%d", bus), os.O_RDWR, 0600); err != nil {
+		return
+	}
+	defer f.Close()
+
+	b := OpenBus(OnBus(bus))
+	defer b.Close()
+	if err = b.Lock(); err != nil {
+		return
+	}
+	defer b.Unlock()
+
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), piicodev.I2C_SLAVE, uintptr(address)); errno != 0 {
+		if errno == syscall.EBUSY {
+			return ErrI2CAddressBusy
+		}
+		return errno
+	}
+
+	_, err = f.Read(make([]byte, 1))
+	return
+}
+
+func (HardwareDevices) OpenRegisters(address uint8, bus int) (d RegisterDevice, err error) {
+	dev := &busRegisters{}
+	if dev.bus, err = openOnBus(OnBus(bus), func() (err error) {
+		dev.dev, err = piicodev.OpenI2C(address, bus)
+		return
+	}); err != nil {
+		return
+	}
+	return dev, nil
+}
+
+type busRegisters struct {
+	bus *I2CBus
+	dev *piicodev.I2C
+}
+
+func (d *busRegisters) ReadReg(reg byte, length int) (val []byte, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.ReadReg(reg, length)
+}
+
+func (d *busRegisters) ReadReg16(reg uint16, length int) (val []byte, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.ReadReg16(reg, length)
+}
+
+func (d *busRegisters) Close() {
+	d.dev.Close()
+	d.bus.Close()
+}
+
+func (HardwareDevices) OpenTMP117(address uint8, bus BusRef) (d TMP117Device, err error) {
+	dev := &busTMP117{}
+	if dev.bus, err = openOnBus(bus, func() (err error) {
+		dev.dev, err = piicodev.NewTMP117(address, bus.Number)
+		return
+	}); err != nil {
+		return
+	}
+	return dev, nil
+}
+
+type busTMP117 struct {
+	bus *I2CBus
+	dev *piicodev.TMP117
+}
+
+func (d *busTMP117) ReadTempC() (t float64, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.ReadTempC()
+}
+
+func (d *busTMP117) Close() {
+	d.dev.Close()
+	d.bus.Close()
+}
+
+func (HardwareDevices) OpenMS5637(address uint8, bus BusRef) (d MS5637Device, err error) {
+	dev := &busMS5637{}
+	if dev.bus, err = openOnBus(bus, func() (err error) {
+		dev.dev, err = piicodev.NewMS5637(address, bus.Number)
+		return
+	}); err != nil {
+		return
+	}
+	return dev, nil
+}
+
+type busMS5637 struct {
+	bus *I2CBus
+	dev *piicodev.MS5637
+}
+
+func (d *busMS5637) Read() (pressure float64, temperature float64, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.Read()
+}
+
+func (d *busMS5637) Close() {
+	d.dev.Close()
+	d.bus.Close()
+}
+
+func (HardwareDevices) OpenAHT10(address uint8, bus BusRef) (d AHT10Device, err error) {
+	dev := &busAHT10{}
+	if dev.bus, err = openOnBus(bus, func() (err error) {
+		dev.dev, err = piicodev.NewAHT10(address, bus.Number)
+		return
+	}); err != nil {
+		return
+	}
+	return dev, nil
+}
+
+type busAHT10 struct {
+	bus *I2CBus
+	dev *piicodev.AHT10
+}
+
+func (d *busAHT10) ReadSensor() (temperature float64, humidity float64, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.ReadSensor()
+}
+
+func (d *busAHT10) Close() {
+	d.dev.Close()
+	d.bus.Close()
+}
+
+func (HardwareDevices) OpenVEML6030(address uint8, bus BusRef) (d VEML6030Device, err error) {
+	dev := &busVEML6030{}
+	if dev.bus, err = openOnBus(bus, func() (err error) {
+		dev.dev, err = piicodev.NewVEML6030(address, bus.Number)
+		return
+	}); err != nil {
+		return
+	}
+	return dev, nil
+}
+
+type busVEML6030 struct {
+	bus *I2CBus
+	dev *piicodev.VEML6030
+}
+
+func (d *busVEML6030) Read() (light float64, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.Read()
+}
+
+func (d *busVEML6030) Close() {
+	d.dev.Close()
+	d.bus.Close()
+}
+
+func (HardwareDevices) OpenVL53L1X(address uint8, bus BusRef) (d VL53L1XDevice, err error) {
+	dev := &busVL53L1X{}
+	if dev.bus, err = openOnBus(bus, func() (err error) {
+		dev.dev, err = piicodev.NewVL53L1X(address, bus.Number)
+		return
+	}); err != nil {
+		return
+	}
+	return dev, nil
+}
+
+type busVL53L1X struct {
+	bus *I2CBus
+	dev *piicodev.VL53L1X
+}
+
+func (d *busVL53L1X) Read() (distance uint16, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.Read()
+}
+
+func (d *busVL53L1X) Close() {
+	d.dev.Close()
+	d.bus.Close()
+}
+
+func (HardwareDevices) OpenENS160(address uint8, bus BusRef) (d ENS160Device, err error) {
+	dev := &busENS160{}
+	if dev.bus, err = openOnBus(bus, func() (err error) {
+		dev.dev, err = piicodev.NewENS160(address, bus.Number)
+		return
+	}); err != nil {
+		return
+	}
+	return dev, nil
+}
+
+type busENS160 struct {
+	bus *I2CBus
+	dev *piicodev.ENS160
+}
+
+func (d *busENS160) GetOperation() (operation string, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.GetOperation()
+}
+
+func (d *busENS160) ReadAQI() (aqi byte, rating string, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.ReadAQI()
+}
+
+func (d *busENS160) ReadTVOC() (tvoc uint16, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.ReadTVOC()
+}
+
+func (d *busENS160) ReadECO2() (eco2 uint16, rating string, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.ReadECO2()
+}
+
+func (d *busENS160) Close() {
+	d.dev.Close()
+	d.bus.Close()
+}
+
+func (HardwareDevices) OpenCAP1203(address uint8, bus BusRef) (d CAP1203Device, err error) {
+	dev := &busCAP1203{}
+	if dev.bus, err = openOnBus(bus, func() (err error) {
+		dev.dev, err = piicodev.NewCAP1203(address, bus.Number)
+		return
+	}); err != nil {
+		return
+	}
+	return dev, nil
+}
+
+type busCAP1203 struct {
+	bus *I2CBus
+	dev *piicodev.CAP1203
+}
+
+func (d *busCAP1203) SetSensitivity(sensitivity int) (err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.SetSensitivity(sensitivity)
+}
+
+func (d *busCAP1203) Read() (status1, status2, status3 bool, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.Read()
+}
+
+func (d *busCAP1203) Close() {
+	d.dev.Close()
+	d.bus.Close()
+}
+
+func (HardwareDevices) OpenSwitch(address uint8, bus BusRef) (d SwitchDevice, err error) {
+	dev := &busSwitch{}
+	if dev.bus, err = openOnBus(bus, func() (err error) {
+		dev.dev, err = piicodev.NewSwitch(address, bus.Number)
+		return
+	}); err != nil {
+		return
+	}
+	return dev, nil
+}
+
+type busSwitch struct {
+	bus *I2CBus
+	dev *piicodev.Switch
+}
+
+func (d *busSwitch) SetLED(enable bool) (err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.SetLED(enable)
+}
+
+func (d *busSwitch) WasPressed() (pressed bool, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.WasPressed()
+}
+
+func (d *busSwitch) WasDoublePressed() (doublePressed bool, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.WasDoublePressed()
+}
+
+func (d *busSwitch) Close() {
+	d.dev.Close()
+	d.bus.Close()
+}
+
+func (HardwareDevices) OpenPotentiometer(address uint8, bus BusRef) (d PotentiometerDevice, err error) {
+	dev := &busPotentiometer{}
+	if dev.bus, err = openOnBus(bus, func() (err error) {
+		dev.dev, err = piicodev.NewPotentiometer(address, bus.Number)
+		return
+	}); err != nil {
+		return
+	}
+	return dev, nil
+}
+
+type busPotentiometer struct {
+	bus *I2CBus
+	dev *piicodev.Potentiometer
+}
+
+func (d *busPotentiometer) SetLED(enable bool) (err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.SetLED(enable)
+}
+
+func (d *busPotentiometer) ReadRawValue() (value uint16, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.ReadRawValue()
+}
+
+func (d *busPotentiometer) Close() {
+	d.dev.Close()
+	d.bus.Close()
+}
+
+func (HardwareDevices) OpenPIR(address uint8, bus BusRef) (d PIRDevice, err error) {
+	dev := &busPIR{}
+	if dev.bus, err = openOnBus(bus, func() (err error) {
+		dev.dev, err = piicodev.NewQwiicPIR(address, bus.Number)
+		return
+	}); err != nil {
+		return
+	}
+	return dev, nil
+}
+
+type busPIR struct {
+	bus *I2CBus
+	dev *piicodev.QwiicPIR
+}
+
+func (d *busPIR) GetRawReading() (detected bool, err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.GetRawReading()
+}
+
+func (d *busPIR) Close() {
+	d.dev.Close()
+	d.bus.Close()
+}
+
+func (HardwareDevices) OpenRGBLED(address uint8, bus BusRef) (d RGBLEDDevice, err error) {
+	dev := &busRGBLED{}
+	if dev.bus, err = openOnBus(bus, func() (err error) {
+		dev.dev, err = piicodev.NewRGBLED(address, bus.Number)
+		return
+	}); err != nil {
+		return
+	}
+	return dev, nil
+}
+
+type busRGBLED struct {
+	bus *I2CBus
+	dev *piicodev.RGBLED
+}
+
+func (d *busRGBLED) SetBrightness(brightness byte) (err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.SetBrightness(brightness)
+}
+
+func (d *busRGBLED) EnablePowerLED(state bool) (err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.EnablePowerLED(state)
+}
+
+// FillPixels only sets the colour which is written to the LEDs by Show
+func (d *busRGBLED) FillPixels(red, green, blue byte) {
+	d.dev.FillPixels(red, green, blue)
+}
+
+func (d *busRGBLED) Show() (err error) {
+	if err = d.bus.Lock(); err != nil {
+		return
+	}
+	defer d.bus.Unlock()
+	return d.dev.Show()
+}
+
+func (d *busRGBLED) Close() {
+	d.dev.Close()
+	d.bus.Close()
+}
+
+func (HardwareDevices) OpenBME280(address uint8, bus BusRef, options BME280Options) (d BME280Device, err error) {
+	b := OpenBus(bus)
+
+	var pb i2c.Bus
+	if pb, err = b.Periph(); err != nil {
+		b.Close()
+		return
+	}
+
+	dev := &busBME280{bus: b}
+	if dev.BME280, err = NewBME280(pb, address, options); err != nil {
+		b.Close()
+		return
+	}
+	return dev, nil
+}
+
+// busBME280 is a BME280 on the periph bus, which holds the bus lock for each transaction itself
+type busBME280 struct {
+	*BME280
+	bus *I2CBus
+}
+
+func (d *busBME280) Close() {
+	d.BME280.Close()
+	d.bus.Close()
+}
+
+// ssd1306Display is an SSD1306 OLED on the periph bus
+type ssd1306Display struct {
+	*ssd1306.Dev
+	bus *I2CBus
+}
+
+func (HardwareDevices) OpenSSD1306(bus BusRef) (d DisplayDevice, err error) {
+	b := OpenBus(bus)
+
+	var pb i2c.Bus
+	if pb, err = b.Periph(); err != nil {
+		b.Close()
+		return
+	}
+
+	display := &ssd1306Display{bus: b}
+	if display.Dev, err = ssd1306.NewI2C(pb, &ssd1306.DefaultOpts); err != nil {
+		b.Close()
+		return
+	}
+
+	return display, nil
+}
+
+func (d *ssd1306Display) Close() {
+	d.Halt()
+	d.bus.Close()
+}
+
+func (HardwareDevices) OpenMultiplexer(address uint8, bus int) (d MultiplexerDevice, err error) {
+	var dev *piicodev.I2C
+	if dev, err = piicodev.OpenI2C(address, bus); err != nil {
+		return
+	}
+	return tca9548a{dev}, nil
+}
+
+// tca9548a is a TCA9548A multiplexer, whose only register is the channel selection
+type tca9548a struct {
+	*piicodev.I2C
+}
+
+func (m tca9548a) SelectChannels(mask byte) error {
+	return m.Write([]byte{mask})
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"periph.io/x/devices/v3/ssd1306/image1bit"
+)
+
+// simulatedSignal is a value which rises and falls smoothly around its mean over a period,
+// with a little random noise on each reading
+type simulatedSignal struct {
+	mean      float64
+	amplitude float64
+	period    time.Duration
+	noise     float64
+}
+
+func (g simulatedSignal) at(t time.Time) float64 {
+	phase := 2 * math.Pi * float64(t.UnixNano()%int64(g.period)) / float64(g.period)
+	return g.mean + g.amplitude*math.Sin(phase) + g.noise*(2*rand.Float64()-1)
+}
+
+func (g simulatedSignal) read() float64 {
+	return g.at(time.Now())
+}
+
+// The signals of a room over a day, shared by the simulated devices which measure the same thing
+var (
+	simulatedTemperature = simulatedSignal{mean: 21, amplitude: 3, period: 24 * time.Hour, noise: 0.05}
+	simulatedHumidity    = simulatedSignal{mean: 55, amplitude: 10, period: 24 * time.Hour, noise: 0.5}
+	simulatedPressure    = simulatedSignal{mean: 1013, amplitude: 5, period: 12 * time.Hour, noise: 0.1}
+	simulatedLightLevel  = simulatedSignal{mean: 200, amplitude: 200, period: 24 * time.Hour, noise: 2}
+	simulatedDistance    = simulatedSignal{mean: 1200, amplitude: 800, period: 10 * time.Minute, noise: 10}
+	simulatedTVOC        = simulatedSignal{mean: 150, amplitude: 100, period: 2 * time.Hour, noise: 5}
+	simulatedECO2        = simulatedSignal{mean: 700, amplitude: 300, period: 2 * time.Hour, noise: 10}
+	simulatedDial        = simulatedSignal{mean: 512, amplitude: 400, period: 10 * time.Minute, noise: 1}
+	simulatedMovement    = simulatedSignal{mean: 0, amplitude: 1, period: 5 * time.Minute}
+)
+
+// The chance of each read of a simulated switch or touch pad finding it pressed
+const (
+	simulatedPressChance       = 0.02
+	simulatedDoublePressChance = 0.005
+	simulatedTouchChance       = 0.01
+)
+
+func chance(p float64) bool {
+	return rand.Float64() < p
+}
+
+func clamp(v, low, high float64) float64 {
+	return math.Max(low, math.Min(high, v))
+}
+
+// The devices found by scanning the simulated bus, with the contents of their ID registers
+var simulatedBus = map[uint8]map[uint16][]byte{
+	0x08: {0x00: {0x84}},         // RGB LED
+	0x10: {},                     // VEML6030
+	0x12: {0x00: {0x72}},         // Qwiic PIR
+	0x28: {0xFD: {0x6D}},         // CAP1203
+	0x29: {0x010F: {0xEA, 0xCC}}, // VL53L1X
+	0x35: {0x01: {0x01, 0x7B}},   // Potentiometer
+	0x38: {},                     // AHT10
+	0x3C: {},                     // SSD1306
+	0x42: {0x01: {0x01, 0x99}},   // Switch
+	0x48: {0x0F: {0x01, 0x17}},   // TMP117
+	0x53: {0x00: {0x60, 0x01}},   // ENS160
+	0x76: {},                     // MS5637
+	0x77: {0xD0: {0x60}},         // BME280
+}
+
+// SimulatedDevices opens devices which generate plausible readings without any hardware, so that
+// the service can run on any machine
+type SimulatedDevices struct{}
+
+func NewSimulatedDevices() *SimulatedDevices {
+	return &SimulatedDevices{}
+}
+
+func (*SimulatedDevices) ProbeI2C(address uint8, bus int) error {
+	if _, ok := simulatedBus[address]; !ok {
+		return fmt.Errorf("no device at address 0x%02x on simulated bus %d", address, bus)
+	}
+	return nil
+}
+
+func (*SimulatedDevices) OpenRegisters(address uint8, bus int) (RegisterDevice, error) {
+	registers, ok := simulatedBus[address]
+	if !ok {
+		return nil, fmt.Errorf("no device at address 0x%02x on simulated bus %d", address, bus)
+	}
+	return simulatedRegisters(registers), nil
+}
+
+func (*SimulatedDevices) OpenMultiplexer(address uint8, bus int) (MultiplexerDevice, error) {
+	return &SimulatedMultiplexer{}, nil
+}
+
+func (*SimulatedDevices) OpenTMP117(address uint8, bus BusRef) (TMP117Device, error) {
+	return simulatedTMP117{}, nil
+}
+
+func (*SimulatedDevices) OpenMS5637(address uint8, bus BusRef) (MS5637Device, error) {
+	return simulatedMS5637{}, nil
+}
+
+func (*SimulatedDevices) OpenAHT10(address uint8, bus BusRef) (AHT10Device, error) {
+	return simulatedAHT10{}, nil
+}
+
+func (*SimulatedDevices) OpenVEML6030(address uint8, bus BusRef) (VEML6030Device, error) {
+	return simulatedVEML6030{}, nil
+}
+
+func (*SimulatedDevices) OpenBME280(address uint8, bus BusRef, options BME280Options) (BME280Device, error) {
+	return simulatedBME280{}, nil
+}
+
+func (*SimulatedDevices) OpenVL53L1X(address uint8, bus BusRef) (VL53L1XDevice, error) {
+	return simulatedVL53L1X{}, nil
+}
+
+func (*SimulatedDevices) OpenENS160(address uint8, bus BusRef) (ENS160Device, error) {
+	return simulatedENS160{}, nil
+}
+
+func (*SimulatedDevices) OpenCAP1203(address uint8, bus BusRef) (CAP1203Device, error) {
+	return simulatedCAP1203{}, nil
+}
+
+func (*SimulatedDevices) OpenSwitch(address uint8, bus BusRef) (SwitchDevice, error) {
+	return simulatedSwitch{}, nil
+}
+
+func (*SimulatedDevices) OpenPotentiometer(address uint8, bus BusRef) (PotentiometerDevice, error) {
+	return simulatedPotentiometer{}, nil
+}
+
+func (*SimulatedDevices) OpenPIR(address uint8, bus BusRef) (PIRDevice, error) {
+	return simulatedPIR{}, nil
+}
+
+func (*SimulatedDevices) OpenRGBLED(address uint8, bus BusRef) (RGBLEDDevice, error) {
+	return &SimulatedRGBLED{}, nil
+}
+
+func (*SimulatedDevices) OpenSSD1306(bus BusRef) (DisplayDevice, error) {
+	return NewSimulatedDisplay(128, 64), nil
+}
+
+// simulatedRegisters reads zero from every register that is not set
+type simulatedRegisters map[uint16][]byte
+
+func (r simulatedRegisters) ReadReg(reg byte, length int) ([]byte, error) {
+	return r.ReadReg16(uint16(reg), length)
+}
+
+func (r simulatedRegisters) ReadReg16(reg uint16, length int) ([]byte, error) {
+	val := make([]byte, length)
+	copy(val, r[reg])
+	return val, nil
+}
+
+func (r simulatedRegisters) Close() {}
+
+type simulatedTMP117 struct{}
+
+func (simulatedTMP117) ReadTempC() (float64, error) {
+	return simulatedTemperature.read(), nil
+}
+
+func (simulatedTMP117) Close() {}
+
+type simulatedMS5637 struct{}
+
+func (simulatedMS5637) Read() (pressure float64, temperature float64, err error) {
+	return simulatedPressure.read(), simulatedTemperature.read(), nil
+}
+
+func (simulatedMS5637) Close() {}
+
+type simulatedAHT10 struct{}
+
+func (simulatedAHT10) ReadSensor() (temperature float64, humidity float64, err error) {
+	return simulatedTemperature.read(), simulatedHumidity.read(), nil
+}
+
+func (simulatedAHT10) Close() {}
+
+type simulatedVEML6030 struct{}
+
+func (simulatedVEML6030) Read() (light float64, err error) {
+	return math.Max(0, simulatedLightLevel.read()), nil
+}
+
+func (simulatedVEML6030) Close() {}
+
+type simulatedBME280 struct{}
+
+func (simulatedBME280) Read() (temperature float64, pressure float64, humidity float64, err error) {
+	return simulatedTemperature.read(), simulatedPressure.read(), simulatedHumidity.read(), nil
+}
+
+func (simulatedBME280) Close() {}
+
+type simulatedVL53L1X struct{}
+
+func (simulatedVL53L1X) Read() (distance uint16, err error) {
+	return uint16(clamp(simulatedDistance.read(), 0, 4000)), nil
+}
+
+func (simulatedVL53L1X) Close() {}
+
+type simulatedENS160 struct{}
+
+func (simulatedENS160) GetOperation() (operation string, err error) {
+	return "operating ok", nil
+}
+
+func (simulatedENS160) ReadAQI() (aqi byte, rating string, err error) {
+	aqi = byte(clamp(math.Round(simulatedTVOC.read()/100), 1, 5))
+	rating = []string{"excellent", "good", "moderate", "poor", "unhealthy"}[aqi-1]
+	return
+}
+
+func (simulatedENS160) ReadTVOC() (tvoc uint16, err error) {
+	return uint16(clamp(simulatedTVOC.read(), 0, 65000)), nil
+}
+
+func (simulatedENS160) ReadECO2() (eco2 uint16, rating string, err error) {
+	eco2 = uint16(clamp(simulatedECO2.read(), 400, 65000))
+
+	switch {
+	case eco2 > 1500:
+		rating = "unhealthy"
+	case eco2 > 1000:
+		rating = "poor"
+	case eco2 > 800:
+		rating = "fair"
+	case eco2 > 600:
+		rating = "good"
+	default:
+		rating = "excellent"
+	}
+
+	return
+}
+
+func (simulatedENS160) Close() {}
+
+type simulatedCAP1203 struct{}
+
+func (simulatedCAP1203) SetSensitivity(sensitivity int) error {
+	return nil
+}
+
+func (simulatedCAP1203) Read() (status1, status2, status3 bool, err error) {
+	return chance(simulatedTouchChance), chance(simulatedTouchChance), chance(simulatedTouchChance), nil
+}
+
+func (simulatedCAP1203) Close() {}
+
+type simulatedSwitch struct{}
+
+func (simulatedSwitch) SetLED(enable bool) error {
+	return nil
+}
+
+func (simulatedSwitch) WasPressed() (pressed bool, err error) {
+	return chance(simulatedPressChance), nil
+}
+
+func (simulatedSwitch) WasDoublePressed() (doublePressed bool, err error) {
+	return chance(simulatedDoublePressChance), nil
+}
+
+func (simulatedSwitch) Close() {}
+
+type simulatedPotentiometer struct{}
+
+func (simulatedPotentiometer) SetLED(enable bool) error {
+	return nil
+}
+
+func (simulatedPotentiometer) ReadRawValue() (value uint16, err error) {
+	return uint16(clamp(simulatedDial.read(), 0, 1023)), nil
+}
+
+func (simulatedPotentiometer) Close() {}
+
+// simulatedPIR detects movement for about a fifth of every five minutes
+type simulatedPIR struct{}
+
+func (simulatedPIR) GetRawReading() (detected bool, err error) {
+	return simulatedMovement.read() > 0.8, nil
+}
+
+func (simulatedPIR) Close() {}
+
+// SimulatedRGBLED remembers the colour last shown
+// SimulatedMultiplexer records the channels selected on a TCA9548A
+type SimulatedMultiplexer struct {
+	mu   sync.Mutex
+	mask byte
+}
+
+func (m *SimulatedMultiplexer) SelectChannels(mask byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mask = mask
+	return nil
+}
+
+// Selected returns the mask of the channels connected to the bus
+func (m *SimulatedMultiplexer) Selected() byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mask
+}
+
+func (m *SimulatedMultiplexer) Close() {}
+
+type SimulatedRGBLED struct {
+	mu               sync.Mutex
+	brightness       byte
+	powerLED         bool
+	pending          [3]byte
+	red, green, blue byte
+}
+
+func (l *SimulatedRGBLED) SetBrightness(brightness byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.brightness = brightness
+	return nil
+}
+
+func (l *SimulatedRGBLED) EnablePowerLED(state bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.powerLED = state
+	return nil
+}
+
+func (l *SimulatedRGBLED) FillPixels(red, green, blue byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pending = [3]byte{red, green, blue}
+}
+
+func (l *SimulatedRGBLED) Show() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.red, l.green, l.blue = l.pending[0], l.pending[1], l.pending[2]
+	return nil
+}
+
+// Color returns the colour last shown on the LED
+func (l *SimulatedRGBLED) Color() (red, green, blue byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.red, l.green, l.blue
+}
+
+func (l *SimulatedRGBLED) Close() {}
+
+// SimulatedDisplay keeps the image last drawn on it
+type SimulatedDisplay struct {
+	mu  sync.Mutex
+	img *image1bit.VerticalLSB
+}
+
+func NewSimulatedDisplay(width, height int) *SimulatedDisplay {
+	return &SimulatedDisplay{
+		img: image1bit.NewVerticalLSB(image.Rect(0, 0, width, height)),
+	}
+}
+
+func (d *SimulatedDisplay) Bounds() image.Rectangle {
+	return d.img.Bounds()
+}
+
+func (d *SimulatedDisplay) Draw(r image.Rectangle, src image.Image, sp image.Point) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	draw.Draw(d.img, r, src, sp, draw.Src)
+	return nil
+}
+
+// Image returns a copy of what is shown on the display
+func (d *SimulatedDisplay) Image() image.Image {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	img := image1bit.NewVerticalLSB(d.img.Bounds())
+	copy(img.Pix, d.img.Pix)
+	return img
+}
+
+func (d *SimulatedDisplay) Close() {}
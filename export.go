@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	// The time zone database, for images such as alpine which do not have one
+	_ "time/tzdata"
+)
+
+// The export formats
+const (
+	ExportCSV    = "csv"
+	ExportNDJSON = "ndjson"
+)
+
+// The columns of a CSV export, which are also the keys of an NDJSON export
+var exportColumns = []string{"time", "sensor", "type", "metric", "value", "unit"}
+
+// ExportOptions selects the readings to export. Empty sensors or metrics select all of them and a
+// zero time leaves that end of the range open. Times are written in the location.
+type ExportOptions struct {
+	Sensors  []string
+	Metrics  []string
+	From     time.Time
+	To       time.Time
+	Location *time.Location
+	Format   string
+}
+
+func (o *ExportOptions) selects(r *RecordedReading) bool {
+	return (len(o.Sensors) == 0 || containsString(o.Sensors, r.Sensor)) &&
+		(len(o.Metrics) == 0 || containsString(o.Metrics, r.Metric)) &&
+		(o.From.IsZero() || !r.Time.Before(o.From)) && (o.To.IsZero() || !r.Time.After(o.To))
+}
+
+// containsString is true when the value is in the list
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentType is the MIME type of the export format
+func (o *ExportOptions) ContentType() string {
+	if o.Format == ExportNDJSON {
+		return "application/x-ndjson"
+	}
+	return "text/csv"
+}
+
+// ParseExportOptions reads the options from the values of the query parameters or command line flags.
+// Sensors and metrics are comma separated, times are RFC 3339, a date and time in the time zone, or
+// Unix seconds, and the time zone is an IANA name such as Australia/Sydney, Local or UTC (the default).
+func ParseExportOptions(sensors, metrics, from, to, tz, format string) (o ExportOptions, err error) {
+	o.Sensors = splitList(sensors)
+	o.Metrics = splitList(metrics)
+
+	if tz == "" {
+		tz = "UTC"
+	}
+
+	if o.Location, err = time.LoadLocation(tz); err != nil {
+		err = fmt.Errorf("unknown time zone \"%s\"", tz)
+		return
+	}
+
+	if from != "" {
+		if o.From, err = parseQueryTime(from, o.Location); err != nil {
+			return
+		}
+	}
+
+	if to != "" {
+		if o.To, err = parseQueryTime(to, o.Location); err != nil {
+			return
+		}
+	}
+
+	switch o.Format = strings.ToLower(format); o.Format {
+	case "":
+		o.Format = ExportCSV
+	case ExportCSV, ExportNDJSON:
+	default:
+		err = fmt.Errorf("unknown export format \"%s\", expected %s or %s", format, ExportCSV, ExportNDJSON)
+	}
+
+	return
+}
+
+func splitList(s string) (list []string) {
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return
+}
+
+// The layouts of times without a zone, which are in the time zone of the query
+var queryTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"}
+
+// parseQueryTime reads a time which is RFC 3339, Unix seconds or one of the layouts in the location
+func parseQueryTime(v string, loc *time.Location) (t time.Time, err error) {
+	if sec, perr := strconv.ParseInt(v, 10, 64); perr == nil {
+		return time.Unix(sec, 0), nil
+	}
+
+	if t, err = time.Parse(time.RFC3339, v); err == nil {
+		return
+	}
+
+	for _, layout := range queryTimeLayouts {
+		if t, err = time.ParseInLocation(layout, v, loc); err == nil {
+			return
+		}
+	}
+
+	err = fmt.Errorf("invalid time \"%s\", expected RFC 3339, a date and time or Unix seconds", v)
+	return
+}
+
+// exportWriter writes the rows of an export in its format
+type exportWriter interface {
+	Write(r *RecordedReading) error
+	Flush() error
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (e *csvExportWriter) Write(r *RecordedReading) error {
+	return e.w.Write([]string{
+		r.Time.Format(time.RFC3339Nano),
+		r.Sensor,
+		r.Type,
+		r.Metric,
+		strconv.FormatFloat(r.Value, 'f', -1, 64),
+		r.Unit,
+	})
+}
+
+func (e *csvExportWriter) Flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+type ndjsonExportWriter struct {
+	enc *json.Encoder
+}
+
+func (e *ndjsonExportWriter) Write(r *RecordedReading) error {
+	return e.enc.Encode(r)
+}
+
+func (e *ndjsonExportWriter) Flush() error {
+	return nil
+}
+
+func newExportWriter(w io.Writer, format string) (ew exportWriter, err error) {
+	if format == ExportNDJSON {
+		return &ndjsonExportWriter{enc: json.NewEncoder(w)}, nil
+	}
+
+	cw := csv.NewWriter(w)
+	if err = cw.Write(exportColumns); err != nil {
+		return
+	}
+	return &csvExportWriter{w: cw}, nil
+}
+
+// recordingDays returns the days of the recording files which can hold readings in the range, in order
+func recordingDays(dir string, from, to time.Time) (days []string, err error) {
+	var files []os.FileInfo
+	if files, err = ioutil.ReadDir(dir); err != nil {
+		return
+	}
+
+	first, last := "", "9999-12-31"
+	if !from.IsZero() {
+		first = from.UTC().Format(recordingFileDate)
+	}
+	if !to.IsZero() {
+		last = to.UTC().Format(recordingFileDate)
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, "readings-") || !strings.HasSuffix(name, ".ndjson") {
+			continue
+		}
+
+		day := name[len("readings-") : len(name)-len(".ndjson")]
+		if day >= first && day <= last {
+			days = append(days, day)
+		}
+	}
+
+	// The file names sort by date, as returned by ReadDir
+	return
+}
+
+// Export streams the readings in the recording directory which the options select. Lines which
+// cannot be read, such as one still being written, are skipped.
+func Export(w io.Writer, dir string, o ExportOptions) (err error) {
+	var days []string
+	if days, err = recordingDays(dir, o.From, o.To); err != nil {
+		return
+	}
+
+	var ew exportWriter
+	if ew, err = newExportWriter(w, o.Format); err != nil {
+		return
+	}
+
+	for _, day := range days {
+		if err = exportFile(ew, filepath.Join(dir, recordingFileName(day)), &o); err != nil {
+			return
+		}
+	}
+
+	return ew.Flush()
+}
+
+func exportFile(ew exportWriter, path string, o *ExportOptions) (err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r RecordedReading
+		if json.Unmarshal(scanner.Bytes(), &r) != nil || !o.selects(&r) {
+			continue
+		}
+
+		r.Time = r.Time.In(o.Location)
+		if err = ew.Write(&r); err != nil {
+			return
+		}
+	}
+
+	return scanner.Err()
+}
+
+// RunExport is the export command, which writes the recorded readings to standard output or a file
+func RunExport(w io.Writer, args []string) (err error) {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	configPath := fs.String("config", DefaultConfigPath, "the configuration, which sets the recording directory")
+	dir := fs.String("dir", "", "the recording directory, instead of the configured one")
+	sensors := fs.String("sensor", "", "comma separated sensors to export, all by default")
+	metrics := fs.String("metric", "", "comma separated metrics to export, all by default")
+	from := fs.String("from", "", "the start of the range, as RFC 3339, a date and time in the time zone, or Unix seconds")
+	to := fs.String("to", "", "the end of the range")
+	tz := fs.String("tz", "UTC", "the time zone of the times, such as Australia/Sydney or Local")
+	format := fs.String("format", ExportCSV, "csv or ndjson")
+	output := fs.String("output", "", "the file to write, instead of standard output")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+
+	if *dir == "" {
+		var config *I2cConfiguration
+		if config, err = LoadConfiguration(*configPath); err != nil {
+			return
+		}
+		*dir = config.RecordingDirectory()
+	}
+
+	var o ExportOptions
+	if o, err = ParseExportOptions(*sensors, *metrics, *from, *to, *tz, *format); err != nil {
+		return
+	}
+
+	if *output != "" {
+		var f *os.File
+		if f, err = os.Create(*output); err != nil {
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+
+	bw := bufio.NewWriter(w)
+	if err = Export(bw, *dir, o); err != nil {
+		return
+	}
+	return bw.Flush()
+}
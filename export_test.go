@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordReadings records a temperature of two sensors and the humidity of one every six hours over
+// two days, starting at midnight UTC on the 1st of May 2024
+func recordReadings(t *testing.T, dir string) {
+	rec, err := OpenRecording(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Close()
+
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 8; i++ {
+		at := start.Add(time.Duration(i) * 6 * time.Hour)
+		for _, r := range []struct {
+			sensor, sensorType string
+			reading            Reading
+		}{
+			{"lounge", "tmp117", NewReading(MetricTemperature, 20+float64(i), UnitCelsius, at)},
+			{"bedroom", "bme280", NewReading(MetricTemperature, 18+float64(i), UnitCelsius, at)},
+			{"bedroom", "bme280", NewReading(MetricHumidity, 60, UnitRelativeHumidity, at)},
+		} {
+			if err = rec.Record(r.sensor, r.sensorType, r.reading); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Readings which are not new are only recorded once
+		if err = rec.Record("lounge", "tmp117", NewReading(MetricTemperature, 99, UnitCelsius, at)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecordingFiles(t *testing.T) {
+	dir := t.TempDir()
+	recordReadings(t, dir)
+
+	for _, day := range []string{"2024-05-01", "2024-05-02"} {
+		f, err := os.Open(filepath.Join(dir, recordingFileName(day)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := 0
+		for scanner := bufio.NewScanner(f); scanner.Scan(); lines++ {
+		}
+		f.Close()
+
+		if lines != 12 {
+			t.Errorf("expected 12 readings recorded on %s, got %d", day, lines)
+		}
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	dir := t.TempDir()
+	recordReadings(t, dir)
+
+	// The first day in Sydney, which is ten hours ahead of UTC in May
+	o, err := ParseExportOptions("bedroom", "temperature", "2024-05-01", "2024-05-01T23:59:59", "Australia/Sydney", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err = Export(&out, dir, o); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := [][]string{
+		exportColumns,
+		{"2024-05-01T10:00:00+10:00", "bedroom", "bme280", "temperature", "18", "C"},
+		{"2024-05-01T16:00:00+10:00", "bedroom", "bme280", "temperature", "19", "C"},
+		{"2024-05-01T22:00:00+10:00", "bedroom", "bme280", "temperature", "20", "C"},
+	}
+
+	if len(rows) != len(expected) {
+		t.Fatalf("expected %d rows, got %v", len(expected), rows)
+	}
+
+	for i := range expected {
+		for j := range expected[i] {
+			if rows[i][j] != expected[i][j] {
+				t.Errorf("row %d is %v, expected %v", i, rows[i], expected[i])
+				break
+			}
+		}
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	dir := t.TempDir()
+	recordReadings(t, dir)
+
+	var out bytes.Buffer
+	if err := RunExport(&out, []string{"--dir", dir, "--format", "ndjson", "--from", "2024-05-02T00:00:00Z"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var readings []RecordedReading
+	for scanner := bufio.NewScanner(&out); scanner.Scan(); {
+		var r RecordedReading
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid line %q: %v", scanner.Text(), err)
+		}
+		readings = append(readings, r)
+	}
+
+	if len(readings) != 12 {
+		t.Fatalf("expected 12 readings from the second day, got %d", len(readings))
+	}
+
+	if r := readings[0]; r.Sensor != "lounge" || r.Type != "tmp117" || r.Value != 24 || !r.Time.Equal(time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected first reading %+v", r)
+	}
+}
+
+func TestParseExportOptions(t *testing.T) {
+	for _, args := range [][]string{
+		{"", "", "yesterday", "", "", ""},
+		{"", "", "", "", "Mars/Olympus_Mons", ""},
+		{"", "", "", "", "", "xlsx"},
+	} {
+		if _, err := ParseExportOptions(args[0], args[1], args[2], args[3], args[4], args[5]); err == nil {
+			t.Errorf("expected an error for the options %q", args)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The reasons a reading is rejected by a filter, counted by sensor_rejected_samples_total
+const (
+	RejectedOutOfRange   = "range"
+	RejectedRateOfChange = "rate"
+)
+
+// The temperatures in degrees Celsius and the relative humidities outside which a reading is
+// rejected as a glitch of the device, unless the filter of the metric sets its own min or max
+const (
+	DefaultMinTemperature = -100.0
+	DefaultMaxTemperature = 100.0
+	DefaultMinHumidity    = 0.0
+	DefaultMaxHumidity    = 100.0
+)
+
+// The number of readings in a row rejected for their rate of change after which the new level is
+// taken to be real, so that a filter cannot reject every reading after a genuine step
+const MaxRateRejections = 3
+
+// The most readings a median filter can take the median of
+const MaxMedianReadings = 100
+
+// FilterConfiguration filters the readings of one metric of a sensor. The stages run in order: a
+// reading outside min or max is rejected, then a reading which changes by more than maxrate per
+// second from the last reading accepted, then the median of the last median readings is taken,
+// then the exponential moving average where ema is the weight of the new reading.
+type FilterConfiguration struct {
+	Min     *float64
+	Max     *float64
+	MaxRate float64
+	Median  int
+	EMA     float64
+}
+
+// Check returns the problem with the configuration, if there is one
+func (fc *FilterConfiguration) Check() error {
+	switch {
+	case fc.Min != nil && fc.Max != nil && *fc.Min >= *fc.Max:
+		return fmt.Errorf("min %v is not below max %v", *fc.Min, *fc.Max)
+	case fc.MaxRate < 0:
+		return fmt.Errorf("maxrate %v is negative", fc.MaxRate)
+	case fc.Median < 0 || fc.Median > MaxMedianReadings:
+		return fmt.Errorf("median %d is out of range, expected 0 to %d", fc.Median, MaxMedianReadings)
+	case fc.EMA < 0 || fc.EMA > 1:
+		return fmt.Errorf("ema %v is out of range, expected 0 to 1", fc.EMA)
+	}
+	return nil
+}
+
+var promSensorRejectedSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "sensor_rejected_samples_total",
+	Help: "Readings of a metric of the sensor rejected by its filter, by the reason",
+}, []string{"sensor", "metric", "reason"})
+
+func unpublishRejectedSamples(sensor string, metrics []string) {
+	for _, metric := range metrics {
+		for _, reason := range []string{RejectedOutOfRange, RejectedRateOfChange} {
+			promSensorRejectedSamples.DeleteLabelValues(sensor, metric, reason)
+		}
+	}
+}
+
+// metricFilter is the state of the filter of one metric of a sensor
+type metricFilter struct {
+	min, max *float64
+	config   FilterConfiguration
+
+	// The time of the last reading filtered, so that a reading repeated by the sensor is not
+	// filtered again
+	last time.Time
+
+	accepted       Reading
+	rateRejections int
+	window         []float64
+	average        float64
+
+	output     Reading
+	haveOutput bool
+}
+
+func newMetricFilter(metric string, fc FilterConfiguration) (f *metricFilter, err error) {
+	if err = fc.Check(); err != nil {
+		return
+	}
+
+	f = &metricFilter{min: fc.Min, max: fc.Max, config: fc}
+
+	var min, max float64
+	switch metric {
+	case MetricTemperature:
+		min, max = DefaultMinTemperature, DefaultMaxTemperature
+	case MetricHumidity:
+		min, max = DefaultMinHumidity, DefaultMaxHumidity
+	default:
+		return
+	}
+
+	if f.min == nil {
+		f.min = &min
+	}
+
+	if f.max == nil {
+		f.max = &max
+	}
+
+	if *f.min >= *f.max {
+		err = fmt.Errorf("min %v is not below max %v", *f.min, *f.max)
+	}
+
+	return
+}
+
+// filter returns the filtered reading, or the last reading the filter produced along with the
+// reason when the reading is rejected. Until a reading has been accepted the reading returned has
+// no time, as though the sensor had not produced one.
+func (f *metricFilter) filter(r Reading) (filtered Reading, rejected string) {
+	if rejected = f.check(r); rejected != "" {
+		return f.reject(r, rejected), rejected
+	}
+	return f.accept(r), ""
+}
+
+// check returns the reason the reading is rejected, without changing the filter. A reading
+// without a time, or which the filter has already seen, is not rejected.
+func (f *metricFilter) check(r Reading) string {
+	if r.Time.IsZero() || !r.Time.After(f.last) {
+		return ""
+	}
+
+	if (f.min != nil && r.Value < *f.min) || (f.max != nil && r.Value > *f.max) {
+		return RejectedOutOfRange
+	}
+
+	if f.config.MaxRate > 0 && !f.accepted.Time.IsZero() {
+		elapsed := r.Time.Sub(f.accepted.Time).Seconds()
+		if math.Abs(r.Value-f.accepted.Value) > f.config.MaxRate*elapsed && f.rateRejections+1 < MaxRateRejections {
+			return RejectedRateOfChange
+		}
+	}
+
+	return ""
+}
+
+// reject returns the last reading the filter produced in place of a reading rejected for the
+// reason, or with no reason when it is rejected along with a reading of another metric
+func (f *metricFilter) reject(r Reading, reason string) Reading {
+	if r.Time.IsZero() {
+		return r
+	}
+
+	if r.Time.After(f.last) {
+		f.last = r.Time
+		if reason == RejectedRateOfChange {
+			f.rateRejections++
+		}
+	}
+
+	return f.current(r)
+}
+
+// accept takes the reading through the median and moving average of the filter
+func (f *metricFilter) accept(r Reading) (filtered Reading) {
+	if r.Time.IsZero() {
+		return r
+	}
+
+	if !r.Time.After(f.last) {
+		return f.current(r)
+	}
+	f.last = r.Time
+
+	f.rateRejections = 0
+	f.accepted = r
+
+	value := r.Value
+	if f.config.Median > 1 {
+		if f.window = append(f.window, value); len(f.window) > f.config.Median {
+			f.window = f.window[1:]
+		}
+		value = median(f.window)
+	}
+
+	if f.config.EMA > 0 {
+		if f.haveOutput {
+			value = f.config.EMA*value + (1-f.config.EMA)*f.average
+		}
+		f.average = value
+	}
+
+	filtered = r
+	filtered.Value = value
+	f.output, f.haveOutput = filtered, true
+	return
+}
+
+func (f *metricFilter) current(r Reading) Reading {
+	if f.haveOutput {
+		return f.output
+	}
+
+	r.Value, r.Time = 0, time.Time{}
+	return r
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	if n := len(sorted); n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return sorted[len(sorted)/2]
+}
+
+// sensorFilters returns the filter of each measured metric of the sensor by metric name, which
+// only keeps the last value of a metric which is not filtered. The range of the temperature is the
+// default or the mintemperature and maxtemperature options of the sensor where its filter does not
+// set min or max.
+func sensorFilters(sc *SensorConfiguration) (filters map[string]*metricFilter, err error) {
+	configs := make(map[string]FilterConfiguration, len(sc.Filters)+1)
+	for metric, fc := range sc.Filters {
+		configs[metric] = fc
+	}
+
+	if options := resolvedOptions(sc); options["mintemperature"] != nil {
+		limits, _ := temperatureLimits(options)
+		fc := configs[MetricTemperature]
+		if fc.Min == nil {
+			fc.Min = &limits.Min
+		}
+		if fc.Max == nil {
+			fc.Max = &limits.Max
+		}
+		configs[MetricTemperature] = fc
+	}
+
+	filters = make(map[string]*metricFilter)
+	for _, metric := range MeasuredMetrics {
+		if filters[metric], err = newMetricFilter(metric, FilterConfiguration{}); err != nil {
+			return
+		}
+	}
+
+	for metric, fc := range configs {
+		var f *metricFilter
+		if f, err = newMetricFilter(metric, fc); err != nil {
+			return nil, fmt.Errorf("filter of %s: %v", metric, err)
+		}
+		filters[metric] = f
+	}
+
+	return
+}
+
+// filterReadings filters the readings of each metric, counting those rejected. When any reading
+// is rejected every reading of the update keeps its last value, as a glitch of the device spoils
+// all of the values read with it. It must be called with the sensor held, as the filters keep the
+// readings they have seen.
+func (ms *managedSensor) filterReadings(readings []Reading) []Reading {
+	reasons := make([]string, len(readings))
+	rejected := false
+	for i, r := range readings {
+		f, ok := ms.filters[r.Metric]
+		if !ok {
+			continue
+		}
+
+		if reasons[i] = f.check(r); reasons[i] != "" {
+			rejected = true
+			logSensors.Debug("Reading rejected", "sensor", ms.config.Name, "metric", r.Metric, "value", r.Value, "reason", reasons[i])
+			promSensorRejectedSamples.WithLabelValues(ms.config.Name, r.Metric, reasons[i]).Inc()
+		}
+	}
+
+	for i, r := range readings {
+		if f, ok := ms.filters[r.Metric]; ok && rejected {
+			readings[i] = f.reject(r, reasons[i])
+		} else if ok {
+			readings[i] = f.accept(r)
+		}
+	}
+
+	return readings
+}
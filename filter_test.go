@@ -0,0 +1,211 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func rejectedSamples(t *testing.T, sensor, metric, reason string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range families {
+		if mf.GetName() != "sensor_rejected_samples_total" {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+
+			if labels["sensor"] == sensor && labels["metric"] == metric && labels["reason"] == reason {
+				return m.GetCounter().GetValue()
+			}
+		}
+	}
+	return 0
+}
+
+func TestMetricFilter(t *testing.T) {
+	min, max := 0.0, 50.0
+
+	tests := []struct {
+		name     string
+		metric   string
+		config   FilterConfiguration
+		values   []float64
+		expected []float64
+		rejected []string
+	}{
+		{"default temperature range", MetricTemperature, FilterConfiguration{},
+			[]float64{20, 150, 21}, []float64{20, 20, 21}, []string{"", RejectedOutOfRange, ""}},
+		{"range", MetricHumidity, FilterConfiguration{Min: &min, Max: &max},
+			[]float64{-1, 40, 60}, []float64{0, 40, 40}, []string{RejectedOutOfRange, "", RejectedOutOfRange}},
+		{"rate of change", MetricHumidity, FilterConfiguration{MaxRate: 1},
+			[]float64{40, 40.5, 60, 40.8, 60, 60, 60}, []float64{40, 40.5, 40.5, 40.8, 40.8, 40.8, 60},
+			[]string{"", "", RejectedRateOfChange, "", RejectedRateOfChange, RejectedRateOfChange, ""}},
+		{"median", MetricHumidity, FilterConfiguration{Median: 3},
+			[]float64{40, 90, 41, 42}, []float64{40, 65, 41, 42}, []string{"", "", "", ""}},
+		{"ema", MetricHumidity, FilterConfiguration{EMA: 0.25},
+			[]float64{40, 48, 48}, []float64{40, 42, 43.5}, []string{"", "", ""}},
+	}
+
+	start := time.Now()
+	for _, test := range tests {
+		f, err := newMetricFilter(test.metric, test.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, v := range test.values {
+			r, rejected := f.filter(NewReading(test.metric, v, "", start.Add(time.Duration(i)*time.Second)))
+			if math.Abs(r.Value-test.expected[i]) > 1e-9 || rejected != test.rejected[i] {
+				t.Errorf("%s: reading %d of %v: expected %v \"%s\", got %v \"%s\"", test.name, i, v, test.expected[i], test.rejected[i], r.Value, rejected)
+			}
+		}
+	}
+
+	// A reading which the sensor repeats, such as after a failed update, is not filtered again
+	f, _ := newMetricFilter(MetricHumidity, FilterConfiguration{EMA: 0.5})
+	r := NewReading(MetricHumidity, 40, UnitRelativeHumidity, start)
+	f.filter(r)
+	if filtered, _ := f.filter(NewReading(MetricHumidity, 60, UnitRelativeHumidity, start)); filtered.Value != 40 {
+		t.Errorf("expected the repeated reading to be ignored, got %v", filtered.Value)
+	}
+}
+
+func TestSensorManagementFiltersReadings(t *testing.T) {
+	sensor := &testReadingsSensor{readings: []Reading{NewReading(MetricTemperature, 21, UnitCelsius, time.Now())}}
+
+	sm := NewSensorManagement(time.Second, time.Minute)
+	sm.AddSensor(sensor, SensorConfiguration{SensorType: "test", Name: "filtered", Filters: map[string]FilterConfiguration{
+		MetricTemperature: {MaxRate: 0.5},
+	}})
+	defer sm.RemoveSensor("filtered")
+
+	sensor.readings = []Reading{NewReading(MetricTemperature, 85, UnitCelsius, time.Now().Add(time.Second))}
+	sm.UpdateSensors()
+
+	if temperature, _ := sm.GetTemperature(); temperature != 21 {
+		t.Errorf("expected the spike to be rejected, got %v", temperature)
+	}
+
+	if ss, _ := sm.Snapshot("filtered"); ss.Details != "filtered - test: 21.00 C" {
+		t.Errorf("expected the details to show the temperature before the spike, got %s", ss.Details)
+	}
+
+	if n := rejectedSamples(t, "filtered", MetricTemperature, RejectedRateOfChange); n != 1 {
+		t.Errorf("expected one rejected sample to be counted, got %v", n)
+	}
+
+	sensor.readings = []Reading{NewReading(MetricTemperature, -120, UnitCelsius, time.Now().Add(2*time.Second))}
+	sm.UpdateSensors()
+
+	if n := rejectedSamples(t, "filtered", MetricTemperature, RejectedOutOfRange); n != 1 {
+		t.Errorf("expected the reading outside the default range to be counted, got %v", n)
+	}
+}
+
+func TestSensorManagementRejectsWholeUpdate(t *testing.T) {
+	now := time.Now()
+	sensor := &testReadingsSensor{readings: []Reading{
+		NewReading(MetricTemperature, 21, UnitCelsius, now), NewReading(MetricHumidity, 50, UnitRelativeHumidity, now),
+		NewReading(MetricPressure, 1013, UnitHectopascal, now),
+	}}
+
+	sm := NewSensorManagement(time.Second, time.Minute)
+	sm.AddSensor(sensor, SensorConfiguration{SensorType: "test", Name: "glitched"})
+	defer sm.RemoveSensor("glitched")
+
+	later := now.Add(time.Second)
+	sensor.readings = []Reading{
+		NewReading(MetricTemperature, 180, UnitCelsius, later), NewReading(MetricHumidity, 0, UnitRelativeHumidity, later),
+		NewReading(MetricPressure, 0, UnitHectopascal, later),
+	}
+	sm.UpdateSensors()
+
+	snapshot, _ := sm.Snapshot("glitched")
+	for _, r := range snapshot.Readings {
+		if expected, ok := map[string]float64{MetricTemperature: 21, MetricHumidity: 50, MetricPressure: 1013}[r.Metric]; ok && r.Value != expected {
+			t.Errorf("expected the %s read with a rejected temperature to keep %v, got %v", r.Metric, expected, r.Value)
+		}
+	}
+
+	if n := rejectedSamples(t, "glitched", MetricHumidity, RejectedOutOfRange); n != 0 {
+		t.Errorf("expected only the temperature to be counted as rejected, got %v humidities", n)
+	}
+
+	sensor.readings = []Reading{NewReading(MetricHumidity, 120, UnitRelativeHumidity, later.Add(time.Second))}
+	sm.UpdateSensors()
+
+	if n := rejectedSamples(t, "glitched", MetricHumidity, RejectedOutOfRange); n != 1 {
+		t.Errorf("expected the humidity outside the default range to be rejected, got %v", n)
+	}
+}
+
+func TestTemperatureLimitOptionsFilter(t *testing.T) {
+	filters, err := sensorFilters(&SensorConfiguration{SensorType: "tmp117", Name: "limited", Options: SensorOptions{"maxtemperature": 40}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	filters[MetricTemperature].filter(NewReading(MetricTemperature, 20, UnitCelsius, start))
+	if _, rejected := filters[MetricTemperature].filter(NewReading(MetricTemperature, 45, UnitCelsius, start.Add(time.Second))); rejected != RejectedOutOfRange {
+		t.Errorf("expected a temperature above the maxtemperature option to be rejected, got \"%s\"", rejected)
+	}
+}
+
+func TestFilteredGauges(t *testing.T) {
+	UseSimulatedDevices()
+	defer func() { devices = HardwareDevices{} }()
+
+	sc := SensorConfiguration{SensorType: "aht10", Name: "filtered_hall", Filters: map[string]FilterConfiguration{
+		MetricHumidity: {EMA: 0.5},
+	}}
+
+	sm := NewSensorManagement(time.Second, time.Minute)
+	if err := sm.OpenSensor(sc, func() (Sensor, error) { return NewSensor(&sc, &I2cConfiguration{}) }); err != nil {
+		t.Fatal(err)
+	}
+	defer sm.RemoveSensor(sc.Name)
+
+	for i := 0; i < 3; i++ {
+		sm.UpdateSensors()
+		time.Sleep(time.Millisecond)
+	}
+
+	humidity, _ := sm.GetHumidity()
+	if value, ok := gaugeValue(t, "filtered_hall_humidity"); !ok || value != humidity {
+		t.Errorf("expected the gauge to be the filtered humidity %v, got %v", humidity, value)
+	}
+}
+
+func TestParseConfigurationFilters(t *testing.T) {
+	config, err := parseConfiguration([]byte(testConfigHeader+`sensors:
+  - sensortype: aht10
+    name: hall
+    filters:
+      temperature:
+        min: -20
+        max: 60
+        maxrate: 0.1
+      humidity:
+        median: 5
+        ema: 0.3
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filters := config.Sensors[0].Filters; *filters[MetricTemperature].Max != 60 || filters[MetricHumidity].Median != 5 {
+		t.Errorf("expected the filters of the temperature and humidity, got %+v", filters)
+	}
+}
@@ -29,6 +29,9 @@ const (
 	hdTypeCapacitySize
 )
 
+// The disk price search, queried with the locale, condition and disk types
+var diskPricesURL = "https://diskprices.com/"
+
 type node html.Node
 
 func (n *node) getAttribute(key string) (string, bool) {
@@ -117,7 +120,7 @@ func queryDisks(diskTypes string) (doc *node, err error) {
 		Timeout: time.Second * 30,
 	}
 
-	query := "https://diskprices.com/?locale=au&condition=new&disk_types="+diskTypes
+	query := diskPricesURL + "?locale=au&condition=new&disk_types=" + diskTypes
 	var req *http.Request
 	if req, err = http.NewRequest("GET", query, nil); err != nil {
 		err = fmt.Errorf("failed to create new request for \"%s\": %v", query, err)
@@ -161,6 +164,7 @@ func GetDistInfo(diskTypes string) (disks []DiskInfo, err error) {
 	var tbody []*node
 	if tbody = tbl.getElementsByName("tbody"); len(tbody) < 1 {
 		err = fmt.Errorf("table with Id = diskprices does not have a tbody")
+		return
 	}
 
 	disks = make([]DiskInfo, 0)
@@ -269,7 +273,17 @@ func (wd *WesternDigitalDiskPrices) pricePerTB(capacityIndex hdTypeCapacity) flo
 type HDPriceScanner struct {
 	scheduler    *gocron.Scheduler
 	bomUpdateJob *gocron.Job
-	wd           *WesternDigitalDiskPrices
+
+	// Written by the scheduler on each price update
+	mu sync.RWMutex
+	wd *WesternDigitalDiskPrices
+}
+
+// Prices returns the most recent Western Digital prices, or nil if they have not been read yet
+func (hdp *HDPriceScanner) Prices() *WesternDigitalDiskPrices {
+	hdp.mu.RLock()
+	defer hdp.mu.RUnlock()
+	return hdp.wd
 }
 
 var hdPriceScannerOnce sync.Once
@@ -292,13 +306,20 @@ func NewHDPriceScanner() (hdp *HDPriceScanner, err error) {
 	return
 }
 
+// Stop stops the scheduled price updates
+func (hdp *HDPriceScanner) Stop() {
+	hdp.scheduler.Stop()
+}
+
 func cronHDPriceUpdate() {
 	var err error
 	var wd *WesternDigitalDiskPrices
 	if wd, err = GetWesternDigitalDiskPrices(); err != nil {
-		fmt.Printf("Failed to get hard disk price data: %v\n", err)
+		logHDPrice.Error("Failed to get hard disk prices", "error", err)
 		return
 	}
 
+	hdPriceScanner.mu.Lock()
 	hdPriceScanner.wd = wd
+	hdPriceScanner.mu.Unlock()
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+)
+
+func useDiskPricesFixtures(t *testing.T) {
+	srv := newFixtureServer(t, "disk_types", map[string]string{
+		"external_hdd": "diskprices_external_hdd.html",
+		"internal_hdd": "diskprices_internal_hdd.html",
+		"no_table":     "bom_empty.json",
+	})
+
+	url := diskPricesURL
+	diskPricesURL = srv.URL + "/"
+	t.Cleanup(func() { diskPricesURL = url })
+}
+
+func TestGetDistInfo(t *testing.T) {
+	useDiskPricesFixtures(t)
+
+	disks, err := GetDistInfo("external_hdd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []DiskInfo{
+		{0.018, 18.14, 399, "22 TB", `External 3.5"`, "WD 22TB Elements Desktop External Hard Drive"},
+		{0.019, 19.44, 349.99, "18 TB", `External 3.5"`, "Western Digital 18TB My Book Desktop External Hard Drive"},
+		{0.020, 20.28, 365, "18 TB", `External 3.5"`, "WD 18TB Elements Desktop External Hard Drive"},
+		{0.017, 17.06, 272.95, "16 TB", `External 3.5"`, "Seagate Expansion Desktop 16TB External Hard Drive"},
+		{0.021, 21.07, 1053.5, "50 TB", `External 3.5"`, "WD 50TB My Book Duo Desktop RAID External Hard Drive"},
+		{0.025, 25, 349.99, "14 TB", `Internal 3.5"`, "WD 14TB Elements Desktop Hard Drive (bare)"},
+	}
+
+	if len(disks) != len(expected) {
+		t.Fatalf("expected %d disks, got %d: %+v", len(expected), len(disks), disks)
+	}
+
+	for i := range expected {
+		if disks[i] != expected[i] {
+			t.Errorf("disk %d: expected %+v, got %+v", i, expected[i], disks[i])
+		}
+	}
+
+	if _, err = GetDistInfo("no_table"); err == nil {
+		t.Errorf("expected an error for a page without the price table")
+	}
+
+	if _, err = GetDistInfo("missing"); err == nil {
+		t.Errorf("expected an error when the page is not found")
+	}
+}
+
+func TestGetWesternDigitalDiskPrices(t *testing.T) {
+	useDiskPricesFixtures(t)
+
+	wd, err := GetWesternDigitalDiskPrices()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[hdTypeCapacity]float64{
+		external18TB: 19.44,
+		external22TB: 18.14,
+		red14TB:      29.29,
+		red18TB:      34.44,
+	}
+
+	for hdtc := hdTypeCapacity(0); hdtc < hdTypeCapacitySize; hdtc++ {
+		if price := wd.pricePerTB(hdtc); price != expected[hdtc] {
+			t.Errorf("type %d: expected %.2f per TB, got %.2f", hdtc, expected[hdtc], price)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The age after which a reading is stale when neither the sensor nor the configuration sets one
+const DefaultStaleAfter = 10 * time.Minute
+
+// The number of consecutive failed updates after which a sensor is considered failed
+const SensorFailedAfter = 5
+
+type HealthState int
+
+const (
+	HealthHealthy HealthState = iota
+	HealthDegraded
+	HealthFailed
+)
+
+func (h HealthState) String() string {
+	switch h {
+	case HealthHealthy:
+		return "healthy"
+	case HealthDegraded:
+		return "degraded"
+	case HealthFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(h))
+	}
+}
+
+func (h HealthState) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *HealthState) UnmarshalText(text []byte) error {
+	for s := HealthHealthy; s <= HealthFailed; s++ {
+		if s.String() == string(text) {
+			*h = s
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown health state \"%s\"", text)
+}
+
+// SensorHealth records how well a sensor has been opened and updated. A sensor is degraded after a
+// failed open or update or when its readings are stale, and failed after SensorFailedAfter failures
+// in a row.
+type SensorHealth struct {
+	State               HealthState
+	LastSuccess         time.Time
+	ConsecutiveFailures int
+	Stale               bool
+}
+
+func (h *SensorHealth) recordUpdate(err error, t time.Time) {
+	if err == nil {
+		h.LastSuccess = t
+		h.ConsecutiveFailures = 0
+	} else {
+		h.ConsecutiveFailures++
+	}
+}
+
+// assess works out the state of the sensor, marking readings older than staleAfter as stale
+func (h *SensorHealth) assess(readings []Reading, staleAfter time.Duration, now time.Time) {
+	h.Stale = false
+	for i := range readings {
+		readings[i].Stale = readings[i].Time.IsZero() || now.Sub(readings[i].Time) > staleAfter
+		if readings[i].Stale {
+			h.Stale = true
+		}
+	}
+
+	switch {
+	case h.ConsecutiveFailures >= SensorFailedAfter:
+		h.State = HealthFailed
+	case h.ConsecutiveFailures > 0 || h.Stale:
+		h.State = HealthDegraded
+	default:
+		h.State = HealthHealthy
+	}
+}
+
+func (h SensorHealth) String() string {
+	s := h.State.String()
+
+	if h.ConsecutiveFailures > 0 {
+		s += fmt.Sprintf(", %d failures", h.ConsecutiveFailures)
+	}
+
+	if h.Stale {
+		s += ", stale"
+	}
+
+	return s
+}
+
+var promSensorUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sensor_up",
+	Help: "Whether the last update of the sensor succeeded with readings that are not stale",
+}, []string{"sensor", "type"})
+
+var promSensorLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sensor_last_success_timestamp",
+	Help: "Unix time of the last successful update of the sensor",
+}, []string{"sensor", "type"})
+
+func publishSensorHealth(ss *SensorSnapshot) {
+	up := 0.0
+	if ss.Error == "" && !ss.Health.Stale {
+		up = 1.0
+	}
+
+	promSensorUp.WithLabelValues(ss.Name, ss.Type).Set(up)
+
+	if !ss.Health.LastSuccess.IsZero() {
+		promSensorLastSuccess.WithLabelValues(ss.Name, ss.Type).Set(float64(ss.Health.LastSuccess.UnixNano()) / 1e9)
+	}
+}
+
+// unpublishSensorHealth removes the health of a sensor which has been removed
+func unpublishSensorHealth(name, sensorType string) {
+	promSensorUp.DeleteLabelValues(name, sensorType)
+	promSensorLastSuccess.DeleteLabelValues(name, sensorType)
+}
+
+// SensorHealthReport is the JSON served by the health endpoint
+type SensorHealthReport struct {
+	Status  HealthState
+	Sensors []SensorHealthStatus
+}
+
+type SensorHealthStatus struct {
+	Name string
+	Type string
+	SensorHealth
+	Error string
+}
+
+// HealthReport returns the health of every sensor. The overall status is the worst of the sensors.
+func (sm *SensorManagement) HealthReport() (report SensorHealthReport) {
+	report.Sensors = make([]SensorHealthStatus, 0)
+
+	for _, ss := range sm.Snapshots() {
+		if ss.Health.State > report.Status {
+			report.Status = ss.Health.State
+		}
+
+		report.Sensors = append(report.Sensors, SensorHealthStatus{
+			Name:         ss.Name,
+			Type:         ss.Type,
+			SensorHealth: ss.Health,
+			Error:        ss.Error,
+		})
+	}
+
+	return
+}
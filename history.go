@@ -0,0 +1,601 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The retention of each resolution of the history when the configuration does not set one
+const (
+	DefaultHistoryRawRetention    = 48 * time.Hour
+	DefaultHistoryMinuteRetention = 30 * 24 * time.Hour
+	DefaultHistoryHourRetention   = 5 * 365 * 24 * time.Hour
+)
+
+// The length of each raw segment file
+const historySegmentLength = time.Hour
+
+// HistoryPoint is a value of a series over a step of the history. Raw points have a count of one.
+type HistoryPoint struct {
+	Time  time.Time
+	Value float64
+	Min   float64
+	Max   float64
+	Count int
+}
+
+func (p *HistoryPoint) add(q HistoryPoint) {
+	if p.Count == 0 {
+		*p = q
+		return
+	}
+
+	p.Value = (p.Value*float64(p.Count) + q.Value*float64(q.Count)) / float64(p.Count+q.Count)
+	p.Min = math.Min(p.Min, q.Min)
+	p.Max = math.Max(p.Max, q.Max)
+	p.Count += q.Count
+}
+
+// historyResolution is one of the resolutions the history is kept at, for its retention.
+// The raw resolution has a step of zero.
+type historyResolution struct {
+	name      string
+	step      time.Duration
+	retention time.Duration
+}
+
+// History is an on-disk store of the readings of every sensor. Each series, a metric of a sensor,
+// is kept raw in hourly segment files which are deleted after the raw retention, and rolled up to
+// one minute and one hour in ring files with a slot for every step of their retention.
+type History struct {
+	dir         string
+	resolutions []historyResolution
+
+	mu     sync.Mutex
+	series map[string]*historySeries
+	closed bool
+}
+
+// OpenHistory opens the history in the directory of the configuration, creating it if needed
+func OpenHistory(hc HistoryConfiguration) (h *History, err error) {
+	h = &History{
+		dir: hc.Directory(),
+		resolutions: []historyResolution{
+			{name: "raw", retention: retentionOrDefault(hc.RawRetention, DefaultHistoryRawRetention)},
+			{name: "1m", step: time.Minute, retention: retentionOrDefault(hc.MinuteRetention, DefaultHistoryMinuteRetention)},
+			{name: "1h", step: time.Hour, retention: retentionOrDefault(hc.HourRetention, DefaultHistoryHourRetention)},
+		},
+		series: make(map[string]*historySeries),
+	}
+
+	if err = os.MkdirAll(h.dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create history directory \"%s\": %v", h.dir, err)
+	}
+
+	return
+}
+
+func retentionOrDefault(retention, defaultRetention time.Duration) time.Duration {
+	if retention > 0 {
+		return retention
+	}
+	return defaultRetention
+}
+
+// Close closes the files of every series. Readings recorded after the history is closed are dropped.
+func (h *History) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for key, s := range h.series {
+		s.close()
+		delete(h.series, key)
+	}
+}
+
+// historyName makes a sensor or metric name safe to use as a directory name
+func historyName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// getSeries returns the open series, opening it when create is set or it exists on disk
+func (h *History) getSeries(sensor, metric string, create bool) (s *historySeries, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, nil
+	}
+
+	key := sensor + "/" + metric
+	if s = h.series[key]; s != nil {
+		return
+	}
+
+	dir := filepath.Join(h.dir, historyName(sensor), historyName(metric))
+	if !create {
+		if _, err = os.Stat(dir); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			return
+		}
+	}
+
+	if s, err = openHistorySeries(dir, h.resolutions); err != nil {
+		return nil, err
+	}
+
+	h.series[key] = s
+	return
+}
+
+// Record adds a reading of a sensor to the history. Readings which have not been taken yet or are
+// no newer than the last reading of the series are ignored.
+func (h *History) Record(sensor string, r Reading) (err error) {
+	if r.Time.IsZero() {
+		return
+	}
+
+	var s *historySeries
+	if s, err = h.getSeries(sensor, r.Metric, true); err != nil || s == nil {
+		return
+	}
+
+	if err = s.record(r.Time, r.Value); err != nil {
+		err = fmt.Errorf("failed to record %s of \"%s\" in the history: %v", r.Metric, sensor, err)
+	}
+	return
+}
+
+// Query returns the points of a series from the time range. A zero step returns the finest
+// resolution still kept for the start of the range, otherwise the points are combined into steps
+// from the coarsest resolution which is no coarser than the step.
+func (h *History) Query(sensor, metric string, from, to time.Time, step time.Duration) (points []HistoryPoint, err error) {
+	points = make([]HistoryPoint, 0)
+
+	var s *historySeries
+	if s, err = h.getSeries(sensor, metric, false); err != nil || s == nil {
+		return
+	}
+
+	res := h.resolutionFor(from, step, time.Now())
+
+	var source []HistoryPoint
+	if res.step == 0 {
+		source, err = s.queryRaw(from, to)
+	} else {
+		source, err = s.queryRing(res.name, from, to)
+	}
+
+	if err != nil || step <= res.step {
+		return append(points, source...), err
+	}
+
+	return downsample(source, step), nil
+}
+
+// resolutionFor picks the coarsest resolution no coarser than the step which is still kept for the
+// start of the range. When none is kept that far back the coarsest resolution is used.
+func (h *History) resolutionFor(from time.Time, step time.Duration, now time.Time) (res historyResolution) {
+	res = h.resolutions[len(h.resolutions)-1]
+
+	for i := len(h.resolutions) - 1; i >= 0; i-- {
+		r := h.resolutions[i]
+		if !from.Before(now.Add(-r.retention)) && r.step <= step {
+			return r
+		}
+	}
+
+	// Prefer a finer resolution which covers the range over a coarser one than asked for
+	for _, r := range h.resolutions {
+		if !from.Before(now.Add(-r.retention)) {
+			return r
+		}
+	}
+
+	return
+}
+
+// downsample combines points into steps aligned to the step
+func downsample(points []HistoryPoint, step time.Duration) (steps []HistoryPoint) {
+	steps = make([]HistoryPoint, 0)
+
+	for _, p := range points {
+		t := p.Time.Truncate(step)
+		if len(steps) == 0 || !steps[len(steps)-1].Time.Equal(t) {
+			steps = append(steps, HistoryPoint{Time: t})
+		}
+
+		last := &steps[len(steps)-1]
+		start := last.Time
+		last.add(p)
+		last.Time = start
+	}
+
+	return
+}
+
+// historySeries is the files of a metric of a sensor
+type historySeries struct {
+	dir          string
+	rawRetention time.Duration
+
+	mu      sync.Mutex
+	last    time.Time
+	segment *os.File
+	segTime time.Time
+	rings   map[string]*historyRing
+}
+
+// The size of a raw record: the time in Unix nanoseconds and the value
+const historyRecordSize = 16
+
+func openHistorySeries(dir string, resolutions []historyResolution) (s *historySeries, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return
+	}
+
+	s = &historySeries{dir: dir, rings: make(map[string]*historyRing)}
+
+	for _, res := range resolutions {
+		if res.step == 0 {
+			s.rawRetention = res.retention
+			continue
+		}
+
+		var ring *historyRing
+		if ring, err = openHistoryRing(filepath.Join(dir, res.name+".ring"), res.step, res.retention); err != nil {
+			s.close()
+			return nil, err
+		}
+		s.rings[res.name] = ring
+	}
+
+	// Continue from the last reading so that readings are not recorded twice after a restart
+	var segments []time.Time
+	if segments, err = s.segments(); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	if len(segments) > 0 {
+		var records []HistoryPoint
+		if records, err = s.readSegment(segments[len(segments)-1]); err != nil {
+			s.close()
+			return nil, err
+		}
+
+		if len(records) > 0 {
+			s.last = records[len(records)-1].Time
+		}
+	}
+
+	return
+}
+
+func (s *historySeries) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.segment != nil {
+		s.segment.Close()
+		s.segment = nil
+	}
+
+	for _, ring := range s.rings {
+		ring.close()
+	}
+}
+
+func (s *historySeries) segmentPath(t time.Time) string {
+	return filepath.Join(s.dir, fmt.Sprintf("raw-%d.dat", t.Unix()))
+}
+
+// segments returns the start times of the raw segment files in order
+func (s *historySeries) segments() (segments []time.Time, err error) {
+	var files []os.FileInfo
+	if files, err = ioutil.ReadDir(s.dir); err != nil {
+		return
+	}
+
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, "raw-") || !strings.HasSuffix(name, ".dat") {
+			continue
+		}
+
+		if sec, perr := strconv.ParseInt(name[len("raw-"):len(name)-len(".dat")], 10, 64); perr == nil {
+			segments = append(segments, time.Unix(sec, 0))
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Before(segments[j]) })
+	return
+}
+
+// readSegment reads the records of a raw segment, ignoring a partly written record at the end
+func (s *historySeries) readSegment(start time.Time) (points []HistoryPoint, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(s.segmentPath(start)); err != nil {
+		return
+	}
+
+	for i := 0; i+historyRecordSize <= len(data); i += historyRecordSize {
+		v := math.Float64frombits(binary.LittleEndian.Uint64(data[i+8:]))
+		points = append(points, HistoryPoint{
+			Time:  time.Unix(0, int64(binary.LittleEndian.Uint64(data[i:]))),
+			Value: v,
+			Min:   v,
+			Max:   v,
+			Count: 1,
+		})
+	}
+
+	return
+}
+
+func (s *historySeries) record(t time.Time, v float64) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !t.After(s.last) {
+		return
+	}
+
+	if err = s.appendRaw(t, v); err != nil {
+		return
+	}
+
+	for _, ring := range s.rings {
+		if err = ring.add(t, v); err != nil {
+			return
+		}
+	}
+
+	s.last = t
+	return
+}
+
+// appendRaw writes the reading to the segment of its hour, starting a new segment and deleting
+// the segments past the raw retention when the hour changes
+func (s *historySeries) appendRaw(t time.Time, v float64) (err error) {
+	segTime := t.Truncate(historySegmentLength)
+
+	if s.segment == nil || !segTime.Equal(s.segTime) {
+		if s.segment != nil {
+			s.segment.Close()
+			s.segment = nil
+		}
+
+		if s.segment, err = os.OpenFile(s.segmentPath(segTime), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return
+		}
+		s.segTime = segTime
+
+		if err = s.prune(time.Now()); err != nil {
+			return
+		}
+	}
+
+	record := make([]byte, historyRecordSize)
+	binary.LittleEndian.PutUint64(record, uint64(t.UnixNano()))
+	binary.LittleEndian.PutUint64(record[8:], math.Float64bits(v))
+	_, err = s.segment.Write(record)
+	return
+}
+
+// prune deletes the raw segments which ended before the raw retention
+func (s *historySeries) prune(now time.Time) (err error) {
+	var segments []time.Time
+	if segments, err = s.segments(); err != nil {
+		return
+	}
+
+	for _, start := range segments {
+		if start.Add(historySegmentLength).Before(now.Add(-s.rawRetention)) {
+			if err = os.Remove(s.segmentPath(start)); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+func (s *historySeries) queryRaw(from, to time.Time) (points []HistoryPoint, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var segments []time.Time
+	if segments, err = s.segments(); err != nil {
+		return
+	}
+
+	for _, start := range segments {
+		if start.After(to) || start.Add(historySegmentLength).Before(from) {
+			continue
+		}
+
+		var records []HistoryPoint
+		if records, err = s.readSegment(start); err != nil {
+			return
+		}
+
+		for _, p := range records {
+			if !p.Time.Before(from) && !p.Time.After(to) {
+				points = append(points, p)
+			}
+		}
+	}
+
+	return
+}
+
+func (s *historySeries) queryRing(name string, from, to time.Time) (points []HistoryPoint, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rings[name].query(from, to)
+}
+
+// historyRing is a rollup file with a slot for each step of its retention. The slot of a time is
+// its step number modulo the number of slots, and holds the start of the step it was last written
+// for so that slots left from an earlier pass around the ring are recognised as empty.
+type historyRing struct {
+	f     *os.File
+	step  time.Duration
+	slots int64
+}
+
+// The ring file header is the magic, step in seconds and number of slots. Each slot is the start
+// of its step in Unix seconds, the count and the minimum, maximum and sum of the values.
+const (
+	historyRingMagic      = "I2CRING1"
+	historyRingHeaderSize = 24
+	historyRingSlotSize   = 40
+)
+
+func openHistoryRing(path string, step, retention time.Duration) (ring *historyRing, err error) {
+	ring = &historyRing{step: step, slots: int64(retention / step)}
+	if ring.slots < 1 {
+		ring.slots = 1
+	}
+
+	if ring.f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, historyRingHeaderSize)
+	if _, err = ring.f.ReadAt(header, 0); err == nil &&
+		string(header[:8]) == historyRingMagic &&
+		int64(binary.LittleEndian.Uint64(header[8:])) == int64(step/time.Second) &&
+		int64(binary.LittleEndian.Uint64(header[16:])) == ring.slots {
+		return ring, nil
+	}
+
+	// A new ring, or one from a different retention which cannot be reused
+	copy(header, historyRingMagic)
+	binary.LittleEndian.PutUint64(header[8:], uint64(step/time.Second))
+	binary.LittleEndian.PutUint64(header[16:], uint64(ring.slots))
+
+	if err = ring.f.Truncate(0); err == nil {
+		if err = ring.f.Truncate(historyRingHeaderSize + ring.slots*historyRingSlotSize); err == nil {
+			_, err = ring.f.WriteAt(header, 0)
+		}
+	}
+
+	if err != nil {
+		ring.f.Close()
+		return nil, err
+	}
+
+	return ring, nil
+}
+
+func (ring *historyRing) close() {
+	ring.f.Close()
+}
+
+func (ring *historyRing) slotOffset(stepStart int64) int64 {
+	return historyRingHeaderSize + ((stepStart/int64(ring.step/time.Second))%ring.slots)*historyRingSlotSize
+}
+
+func decodeRingSlot(b []byte) (start int64, p HistoryPoint) {
+	start = int64(binary.LittleEndian.Uint64(b))
+	p.Count = int(binary.LittleEndian.Uint64(b[8:]))
+	p.Min = math.Float64frombits(binary.LittleEndian.Uint64(b[16:]))
+	p.Max = math.Float64frombits(binary.LittleEndian.Uint64(b[24:]))
+	if p.Count > 0 {
+		p.Value = math.Float64frombits(binary.LittleEndian.Uint64(b[32:])) / float64(p.Count)
+	}
+	p.Time = time.Unix(start, 0)
+	return
+}
+
+func (ring *historyRing) add(t time.Time, v float64) (err error) {
+	start := t.Truncate(ring.step).Unix()
+	offset := ring.slotOffset(start)
+
+	slot := make([]byte, historyRingSlotSize)
+	if _, err = ring.f.ReadAt(slot, offset); err != nil {
+		return
+	}
+
+	count, min, max, sum := uint64(1), v, v, v
+	if slotStart, p := decodeRingSlot(slot); slotStart == start && p.Count > 0 {
+		count = uint64(p.Count) + 1
+		min = math.Min(p.Min, v)
+		max = math.Max(p.Max, v)
+		sum = p.Value*float64(p.Count) + v
+	}
+
+	binary.LittleEndian.PutUint64(slot, uint64(start))
+	binary.LittleEndian.PutUint64(slot[8:], count)
+	binary.LittleEndian.PutUint64(slot[16:], math.Float64bits(min))
+	binary.LittleEndian.PutUint64(slot[24:], math.Float64bits(max))
+	binary.LittleEndian.PutUint64(slot[32:], math.Float64bits(sum))
+	_, err = ring.f.WriteAt(slot, offset)
+	return
+}
+
+// query reads the slots of the steps in the range, which are at most one pass around the ring
+func (ring *historyRing) query(from, to time.Time) (points []HistoryPoint, err error) {
+	stepSeconds := int64(ring.step / time.Second)
+	first := from.Truncate(ring.step).Unix()
+	last := to.Truncate(ring.step).Unix()
+
+	if n := (last-first)/stepSeconds + 1; n > ring.slots {
+		first = last - (ring.slots-1)*stepSeconds
+	}
+
+	if last < first {
+		return
+	}
+
+	// Read the slots from the first step to the end of the file, and from the start of the file if the range wraps
+	n := (last-first)/stepSeconds + 1
+	startOffset := ring.slotOffset(first)
+	startIndex := (startOffset - historyRingHeaderSize) / historyRingSlotSize
+
+	data := make([]byte, n*historyRingSlotSize)
+	head := n
+	if startIndex+n > ring.slots {
+		head = ring.slots - startIndex
+	}
+
+	if _, err = ring.f.ReadAt(data[:head*historyRingSlotSize], startOffset); err != nil && err != io.EOF {
+		return
+	}
+
+	if head < n {
+		if _, err = ring.f.ReadAt(data[head*historyRingSlotSize:], historyRingHeaderSize); err != nil && err != io.EOF {
+			return
+		}
+	}
+	err = nil
+
+	for i := int64(0); i < n; i++ {
+		start, p := decodeRingSlot(data[i*historyRingSlotSize:])
+		if start == first+i*stepSeconds && p.Count > 0 {
+			points = append(points, p)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// recordHistory records a reading every 30 seconds for three hours from the start of an hour,
+// with the value counting up from zero
+func recordHistory(t *testing.T, h *History, start time.Time) {
+	for i := 0; i < 3*60*2; i++ {
+		r := NewReading(MetricTemperature, float64(i), UnitCelsius, start.Add(time.Duration(i)*30*time.Second))
+		if err := h.Record("lounge", r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHistoryQuery(t *testing.T) {
+	h, err := OpenHistory(HistoryConfiguration{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	start := time.Now().Add(-4 * time.Hour).Truncate(time.Hour)
+	recordHistory(t, h, start)
+
+	tests := []struct {
+		from, to time.Duration
+		step     time.Duration
+		points   int
+		count    int
+		value    float64
+	}{
+		{0, 10 * time.Minute, 0, 21, 1, 0},
+		{0, time.Hour - time.Second, time.Minute, 60, 2, 0.5},
+		{0, time.Hour - time.Second, 10 * time.Minute, 6, 20, 9.5},
+		{0, 3 * time.Hour, time.Hour, 3, 120, 59.5},
+		{time.Hour, 2*time.Hour - time.Second, 90 * time.Second, 40, 4, 121.5},
+	}
+
+	for _, test := range tests {
+		points, err := h.Query("lounge", MetricTemperature, start.Add(test.from), start.Add(test.to), test.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(points) != test.points {
+			t.Errorf("query from %v to %v by %v returned %d points, expected %d", test.from, test.to, test.step, len(points), test.points)
+			continue
+		}
+
+		if points[0].Count != test.count || points[0].Value != test.value {
+			t.Errorf("query from %v to %v by %v started with %+v, expected count %d and value %f",
+				test.from, test.to, test.step, points[0], test.count, test.value)
+		}
+	}
+
+	points, err := h.Query("lounge", MetricHumidity, start, start.Add(time.Hour), 0)
+	if err != nil || len(points) != 0 {
+		t.Errorf("expected no points for a metric without history, got %d: %v", len(points), err)
+	}
+}
+
+func TestHistoryReopen(t *testing.T) {
+	hc := HistoryConfiguration{Dir: t.TempDir()}
+	h, err := OpenHistory(hc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now().Add(-4 * time.Hour).Truncate(time.Hour)
+	recordHistory(t, h, start)
+	h.Close()
+
+	if h, err = OpenHistory(hc); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	// A reading from before the last one recorded is ignored after reopening
+	if err = h.Record("lounge", NewReading(MetricTemperature, 1000, UnitCelsius, start.Add(time.Minute))); err != nil {
+		t.Fatal(err)
+	}
+
+	points, err := h.Query("lounge", MetricTemperature, start, start.Add(time.Minute), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 2 || points[0].Count != 2 || points[0].Max != 1 {
+		t.Errorf("unexpected points after reopening the history: %+v", points)
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	hc := HistoryConfiguration{Dir: t.TempDir(), RawRetention: 2 * time.Hour}
+	h, err := OpenHistory(hc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	start := time.Now().Add(-4 * time.Hour).Truncate(time.Hour)
+	recordHistory(t, h, start)
+
+	segment := filepath.Join(hc.Dir, "lounge", MetricTemperature, "raw-"+strconv.FormatInt(start.Unix(), 10)+".dat")
+	if _, err = os.Stat(segment); !os.IsNotExist(err) {
+		t.Errorf("expected the first raw segment to be deleted after the retention: %v", err)
+	}
+
+	// The raw readings are no longer kept, so the minute rollup is used
+	points, err := h.Query("lounge", MetricTemperature, start, start.Add(10*time.Minute), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 11 || points[0].Count != 2 {
+		t.Errorf("expected the minute rollup after the raw retention, got %d points: %+v", len(points), points)
+	}
+}
+
+func TestHistoryRingWraps(t *testing.T) {
+	ring, err := openHistoryRing(filepath.Join(t.TempDir(), "1m.ring"), time.Minute, 10*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ring.close()
+
+	start := time.Unix(1700000000, 0).Truncate(time.Minute)
+	for i := 0; i < 30; i++ {
+		if err = ring.add(start.Add(time.Duration(i)*time.Minute), float64(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	points, err := ring.query(start, start.Add(29*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(points) != 10 || points[0].Value != 20 || points[9].Value != 29 {
+		t.Errorf("expected the last 10 minutes from the ring, got %+v", points)
+	}
+
+	// Slots overwritten by later steps are not returned for the earlier ones
+	if points, err = ring.query(start, start.Add(9*time.Minute)); err != nil || len(points) != 0 {
+		t.Errorf("expected no points for overwritten steps, got %+v: %v", points, err)
+	}
+}
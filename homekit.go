@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"os"
 
 	"github.com/brutella/hap"
 	"github.com/brutella/hap/accessory"
@@ -49,12 +50,16 @@ type HomeKitBridge struct {
 	temperature *accessory.Thermometer
 	lightLevel  *LightSensor
 	occupancy   *OccupancySensor
+	derived     map[string]*accessory.Thermometer
 
 	setLamp func(hue, saturation float64, brightness int) (err error)
+
+	cancel  context.CancelFunc
+	stopped chan struct{}
 }
 
-func HomeKitBridgeStart(ctx context.Context, deviceID string, devicePin uint32, bridgeName string, enableTemperature bool, enableLight bool, enableOccupancy bool, enableLED bool) (b *HomeKitBridge, err error) {
-	b = &HomeKitBridge{}
+func HomeKitBridgeStart(deviceID string, devicePin uint32, bridgeName string, enableTemperature bool, enableLight bool, enableOccupancy bool, enableLED bool, derived []string) (b *HomeKitBridge, err error) {
+	b = &HomeKitBridge{derived: make(map[string]*accessory.Thermometer)}
 	accessories := make([]*accessory.A, 0)
 
 	b.bridge = accessory.NewBridge(accessory.Info{Name: bridgeName})
@@ -86,13 +91,13 @@ func HomeKitBridgeStart(ctx context.Context, deviceID string, devicePin uint32,
 
 		b.Lamp.Lightbulb.On.OnValueRemoteUpdate(func(on bool) {
 			if on {
-				fmt.Println("Lamp on")
+				logHomeKit.Info("Lamp on")
 				if err := b.updateLamp(hue, saturation, brightness); err == nil {
 					b.Lamp.Lightbulb.On.SetValue(true)
 				}
 
 			} else {
-				fmt.Println("Lamp off")
+				logHomeKit.Info("Lamp off")
 				if err := b.lampOff(); err == nil {
 					b.Lamp.Lightbulb.On.SetValue(false)
 				}
@@ -115,6 +120,13 @@ func HomeKitBridgeStart(ctx context.Context, deviceID string, devicePin uint32,
 		})
 	}
 
+	// Each derived metric is a temperature sensor, as HomeKit has nothing else to show it with
+	for _, metric := range derived {
+		t := newDerivedAccessory(metric)
+		b.derived[metric] = t
+		accessories = append(accessories, t.A)
+	}
+
 	fs := hap.NewFsStore("config/bridge")
 	server, err := hap.NewServer(fs, b.bridge.A, accessories...)
 	if err != nil {
@@ -124,46 +136,43 @@ func HomeKitBridgeStart(ctx context.Context, deviceID string, devicePin uint32,
 	server.Pin = fmt.Sprintf("%d", devicePin)
 	server.SetupId = deviceID
 
-	xhm := CreateXHMUrl(accessory.TypeBridge, HAP_TYPE_IP, devicePin, deviceID)
-	qr, _ := GenCLIQRCode(xhm)
-	fmt.Println(qr)
-	/*
-		c := make(chan os.Signal)
-		signal.Notify(c, os.Interrupt)
-		signal.Notify(c, syscall.SIGTERM)
-
-		ctx, cancel := context.WithCancel(context.Background())
-		go func() {
-			<-c
-			// Stop ivering signals.
-			signal.Stop(c)
-			// Cance the context to stop the server.
-			cancel()
-		}()
-
-		go func() {
-			server.ListenAndServe(ctx)
-		}()
-	*/
+	WriteHomeKitPairing(os.Stdout, deviceID, devicePin)
+	// The server runs until Stop, rather than until the service is cancelled, so that it is
+	// stopped in turn with everything else
+	var ctx context.Context
+	ctx, b.cancel = context.WithCancel(context.Background())
+	b.stopped = make(chan struct{})
 
 	go func() {
-		if err := server.ListenAndServe(ctx); !errors.Is(err, http.ErrServerClosed) {
-			fmt.Println("HomeKit server error: ", err)
+		defer close(b.stopped)
+		if err := server.ListenAndServe(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, context.Canceled) {
+			logHomeKit.Error("Server failed", "error", err)
 		}
-		fmt.Println("HomeKit server shutdown")
+		logHomeKit.Info("Server shutdown")
 	}()
 
-	go func() {
-		select {
-		case <-ctx.Done():
+	return
+}
 
-			//if err := server.Shutdown(ctx); err != nil {
-			//	fmt.Println("HomeKit HTTP server shutdown error: ", err)
-			//}
-			return
-		}
-	}()
+// Stop shuts down the HomeKit server and waits for it to finish
+func (b *HomeKitBridge) Stop(ctx context.Context) error {
+	b.cancel()
+
+	select {
+	case <-b.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
+// newDerivedAccessory returns the temperature sensor showing the derived metric, which unlike a
+// measured temperature in HomeKit can be below 0 °C
+func newDerivedAccessory(metric string) (t *accessory.Thermometer) {
+	t = accessory.NewTemperatureSensor(accessory.Info{Name: derivedMetricNames[metric], Manufacturer: "Tim"})
+	t.Id = derivedAccessoryIDs[metric]
+	t.TempSensor.CurrentTemperature.SetMinValue(DefaultMinTemperature)
+	t.TempSensor.CurrentTemperature.SetMaxValue(DefaultMaxTemperature)
 	return
 }
 
@@ -173,6 +182,12 @@ func (b *HomeKitBridge) SetTemperature(temp float64) {
 	}
 }
 
+func (b *HomeKitBridge) SetDerived(metric string, value float64) {
+	if t, ok := b.derived[metric]; ok {
+		t.TempSensor.CurrentTemperature.SetValue(value)
+	}
+}
+
 func (b *HomeKitBridge) SetLightLevel(lightLevel float64) {
 	if b.lightLevel != nil {
 		b.lightLevel.LightSensor.CurrentAmbientLightLevel.SetValue(lightLevel)
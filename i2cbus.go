@@ -0,0 +1,252 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"periph.io/x/conn/v3/i2c"
+	"periph.io/x/conn/v3/i2c/i2creg"
+	"periph.io/x/conn/v3/physic"
+	"periph.io/x/host/v3"
+)
+
+// BusRef identifies the bus a device is on. Devices behind a TCA9548A multiplexer are on one
+// of its channels, which is selected before each transaction with the device.
+type BusRef struct {
+	Number  int
+	Mux     uint8 // Address of the multiplexer, or zero for a device directly on the bus
+	Channel int
+}
+
+// OnBus refers to a device directly on the bus with the number
+func OnBus(number int) BusRef {
+	return BusRef{Number: number}
+}
+
+func (r BusRef) String() string {
+	if r.Mux == 0 {
+		return strconv.Itoa(r.Number)
+	}
+
+	return fmt.Sprintf("%d (multiplexer 0x%02x channel %d)", r.Number, r.Mux, r.Channel)
+}
+
+// The number of channels of a TCA9548A multiplexer
+const MultiplexerChannels = 8
+
+// An unknown channel selection, after writing to the multiplexer failed
+const muxSelectionUnknown = 0xFF
+
+// I2CBus is an I2C bus shared by every device on it. The devices hold the bus lock for each
+// transaction, so that transactions from different devices on the same bus never interleave.
+// Software I2C buses on other GPIO pins (dtoverlay=i2c-gpio) are used in the same way by number.
+//
+// The bus of a multiplexer channel shares the lock of the physical bus, and taking the lock
+// switches the multiplexers to the channel.
+type I2CBus struct {
+	BusRef
+
+	refs   int
+	parent *I2CBus // The physical bus of a multiplexer channel
+
+	// Only used on the physical bus, under mu
+	mu       sync.Mutex
+	periph   i2c.BusCloser
+	muxes    map[uint8]MultiplexerDevice
+	selected map[uint8]byte
+}
+
+var busesMu sync.Mutex
+var buses = make(map[BusRef]*I2CBus)
+
+// OpenBus returns the shared bus, creating it for the first device on the bus. Each device
+// releases the bus with Close when it is closed.
+func OpenBus(ref BusRef) *I2CBus {
+	busesMu.Lock()
+	defer busesMu.Unlock()
+	return openBus(ref)
+}
+
+func openBus(ref BusRef) *I2CBus {
+	b, ok := buses[ref]
+	if !ok {
+		b = &I2CBus{
+			BusRef:   ref,
+			muxes:    make(map[uint8]MultiplexerDevice),
+			selected: make(map[uint8]byte),
+		}
+
+		if ref.Mux != 0 {
+			b.parent = openBus(OnBus(ref.Number))
+		}
+
+		buses[ref] = b
+	}
+
+	b.refs++
+	return b
+}
+
+// Close releases the bus, closing it when the last device on it is closed
+func (b *I2CBus) Close() {
+	busesMu.Lock()
+	defer busesMu.Unlock()
+	b.release()
+}
+
+func (b *I2CBus) release() {
+	if b.refs--; b.refs > 0 {
+		return
+	}
+
+	delete(buses, b.BusRef)
+
+	if b.parent != nil {
+		b.parent.release()
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.periph != nil {
+		b.periph.Close()
+		b.periph = nil
+	}
+
+	for address, m := range b.muxes {
+		m.Close()
+		delete(b.muxes, address)
+	}
+}
+
+func (b *I2CBus) physical() *I2CBus {
+	if b.parent != nil {
+		return b.parent
+	}
+	return b
+}
+
+// Lock takes the lock of the physical bus and switches the multiplexers to the channel of the
+// bus. The lock is not held if the channel cannot be selected.
+func (b *I2CBus) Lock() (err error) {
+	p := b.physical()
+	p.mu.Lock()
+
+	if err = p.selectChannel(b.Mux, b.Channel); err != nil {
+		p.mu.Unlock()
+	}
+
+	return
+}
+
+func (b *I2CBus) Unlock() {
+	b.physical().mu.Unlock()
+}
+
+// selectChannel disconnects the channels of every other multiplexer on the bus, so that devices
+// with the same address behind them do not answer, then selects the channel of the multiplexer.
+// A device directly on the bus has every multiplexer disconnected.
+func (b *I2CBus) selectChannel(mux uint8, channel int) (err error) {
+	for address, mask := range b.selected {
+		if address == mux || mask == 0 {
+			continue
+		}
+
+		if err = b.muxes[address].SelectChannels(0); err != nil {
+			b.selected[address] = muxSelectionUnknown
+			return fmt.Errorf("failed to disconnect multiplexer 0x%02x on bus %d: %v", address, b.Number, err)
+		}
+		b.selected[address] = 0
+	}
+
+	if mux == 0 {
+		return
+	}
+
+	mask := byte(1) << uint(channel)
+	if selected, ok := b.selected[mux]; ok && selected == mask {
+		return
+	}
+
+	m, ok := b.muxes[mux]
+	if !ok {
+		if m, err = devices.OpenMultiplexer(mux, b.Number); err != nil {
+			return fmt.Errorf("failed to open multiplexer 0x%02x on bus %d: %v", mux, b.Number, err)
+		}
+		b.muxes[mux] = m
+	}
+
+	if err = m.SelectChannels(mask); err != nil {
+		b.selected[mux] = muxSelectionUnknown
+		return fmt.Errorf("failed to select channel %d of multiplexer 0x%02x on bus %d: %v", channel, mux, b.Number, err)
+	}
+
+	b.selected[mux] = mask
+	return
+}
+
+var hostInitOnce sync.Once
+var hostInitErr error
+
+// Periph returns the bus for periph device drivers. The periph bus is opened once and shared by
+// the periph devices on the physical bus, and each of its transactions holds the bus lock.
+func (b *I2CBus) Periph() (pb i2c.Bus, err error) {
+	hostInitOnce.Do(func() { _, hostInitErr = host.Init() })
+	if err = hostInitErr; err != nil {
+		return
+	}
+
+	p := b.physical()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.periph == nil {
+		if p.periph, err = i2creg.Open(strconv.Itoa(p.Number)); err != nil {
+			return
+		}
+	}
+
+	return &periphBus{bus: b, Bus: p.periph}, nil
+}
+
+// periphBus is a periph bus which holds the bus lock for each transaction
+type periphBus struct {
+	bus *I2CBus
+	i2c.Bus
+}
+
+func (p *periphBus) Tx(addr uint16, w, r []byte) (err error) {
+	if err = p.bus.Lock(); err != nil {
+		return
+	}
+	defer p.bus.Unlock()
+	return p.Bus.Tx(addr, w, r)
+}
+
+func (p *periphBus) SetSpeed(f physic.Frequency) (err error) {
+	if err = p.bus.Lock(); err != nil {
+		return
+	}
+	defer p.bus.Unlock()
+	return p.Bus.SetSpeed(f)
+}
+
+// openOnBus opens a device on the shared bus, holding the bus lock while the driver initialises
+// the device. The bus is released again if the device fails to open.
+func openOnBus(ref BusRef, open func() error) (b *I2CBus, err error) {
+	b = OpenBus(ref)
+
+	if err = b.Lock(); err == nil {
+		err = open()
+		b.Unlock()
+	}
+
+	if err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return
+}
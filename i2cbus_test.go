@@ -0,0 +1,154 @@
+package main
+
+import (
+	"testing"
+)
+
+func openBusCount() int {
+	busesMu.Lock()
+	defer busesMu.Unlock()
+	return len(buses)
+}
+
+func TestOpenBusShared(t *testing.T) {
+	a := OpenBus(OnBus(5))
+	b := OpenBus(OnBus(5))
+	other := OpenBus(OnBus(6))
+
+	if a != b {
+		t.Error("devices on the same bus number were given different buses")
+	}
+
+	if a == other {
+		t.Error("devices on different bus numbers were given the same bus")
+	}
+
+	a.Close()
+	if OpenBus(OnBus(5)) != b {
+		t.Error("bus was released while a device was still on it")
+	}
+
+	b.Close()
+	b.Close()
+	other.Close()
+
+	if n := openBusCount(); n != 0 {
+		t.Errorf("%d buses left open after every device was closed", n)
+	}
+}
+
+func TestSensorI2CBus(t *testing.T) {
+	bus := 3
+	sc := SensorConfiguration{}
+	if sc.I2CBusNumber() != DefaultI2CBus {
+		t.Errorf("sensor without i2cbus is on bus %d, expected %d", sc.I2CBusNumber(), DefaultI2CBus)
+	}
+
+	sc.I2CBus = &bus
+	if sc.I2CBusNumber() != 3 {
+		t.Errorf("sensor with i2cbus 3 is on bus %d", sc.I2CBusNumber())
+	}
+
+	if v := sensorConfigValue(&sc, "i2cbus"); v != "3" {
+		t.Errorf("i2cbus config value is \"%s\"", v)
+	}
+}
+
+// recordingMultiplexers hands out simulated multiplexers which can be inspected by address
+type recordingMultiplexers struct {
+	*SimulatedDevices
+	muxes map[uint8]*SimulatedMultiplexer
+}
+
+func (d *recordingMultiplexers) OpenMultiplexer(address uint8, bus int) (MultiplexerDevice, error) {
+	m := &SimulatedMultiplexer{}
+	d.muxes[address] = m
+	return m, nil
+}
+
+func useRecordingMultiplexers(t *testing.T) *recordingMultiplexers {
+	d := &recordingMultiplexers{SimulatedDevices: NewSimulatedDevices(), muxes: make(map[uint8]*SimulatedMultiplexer)}
+
+	saved := devices
+	devices = d
+	t.Cleanup(func() { devices = saved })
+	return d
+}
+
+func TestMultiplexerChannelSelection(t *testing.T) {
+	d := useRecordingMultiplexers(t)
+
+	left := OpenBus(BusRef{Number: 1, Mux: 0x70, Channel: 2})
+	right := OpenBus(BusRef{Number: 1, Mux: 0x70, Channel: 5})
+	other := OpenBus(BusRef{Number: 1, Mux: 0x71, Channel: 0})
+	direct := OpenBus(OnBus(1))
+
+	lock := func(b *I2CBus) {
+		if err := b.Lock(); err != nil {
+			t.Fatalf("failed to lock bus %s: %v", b.BusRef, err)
+		}
+		b.Unlock()
+	}
+
+	lock(left)
+	if got := d.muxes[0x70].Selected(); got != 0x04 {
+		t.Errorf("channel 2 selected mask 0x%02x", got)
+	}
+
+	lock(right)
+	if got := d.muxes[0x70].Selected(); got != 0x20 {
+		t.Errorf("channel 5 selected mask 0x%02x", got)
+	}
+
+	// Selecting a channel on another multiplexer disconnects the first
+	lock(other)
+	if got := d.muxes[0x70].Selected(); got != 0 {
+		t.Errorf("multiplexer 0x70 still has mask 0x%02x when 0x71 is selected", got)
+	}
+	if got := d.muxes[0x71].Selected(); got != 0x01 {
+		t.Errorf("channel 0 of multiplexer 0x71 selected mask 0x%02x", got)
+	}
+
+	// A device directly on the bus disconnects every multiplexer
+	lock(direct)
+	if got := d.muxes[0x71].Selected(); got != 0 {
+		t.Errorf("multiplexer 0x71 still has mask 0x%02x for a device directly on the bus", got)
+	}
+
+	left.Close()
+	right.Close()
+	other.Close()
+	direct.Close()
+
+	if n := openBusCount(); n != 0 {
+		t.Errorf("%d buses left open after every device was closed", n)
+	}
+}
+
+func TestSensorBusMultiplexer(t *testing.T) {
+	config := &I2cConfiguration{
+		Multiplexers: []MultiplexerConfiguration{{Name: "cabinet"}},
+	}
+
+	sc := &SensorConfiguration{Name: "shelf", Multiplexer: "cabinet", MuxChannel: 3}
+	bus, err := config.SensorBus(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := BusRef{Number: DefaultI2CBus, Mux: TCA9548AAddress, Channel: 3}
+	if bus != expected {
+		t.Errorf("sensor is on bus %s, expected %s", bus, expected)
+	}
+
+	sc.MuxChannel = MultiplexerChannels
+	if _, err = config.SensorBus(sc); err == nil {
+		t.Error("no error for a channel the multiplexer does not have")
+	}
+
+	sc.Multiplexer = "missing"
+	sc.MuxChannel = 0
+	if _, err = config.SensorBus(sc); err == nil {
+		t.Error("no error for an unknown multiplexer")
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log entry
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l LogLevel) String() string {
+	if l < LogDebug || l > LogError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel reads a level name, such as info, in any case. Warning is accepted for warn.
+func ParseLogLevel(s string) (l LogLevel, err error) {
+	name := strings.ToLower(strings.TrimSpace(s))
+	if name == "warning" {
+		name = "warn"
+	}
+
+	for i, n := range logLevelNames {
+		if n == name {
+			return LogLevel(i), nil
+		}
+	}
+
+	err = fmt.Errorf("unknown log level \"%s\", expected one of %s", s, strings.Join(logLevelNames, ", "))
+	return
+}
+
+// The log formats
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// The size a log file grows to before it is rotated, and the number of rotated files kept, when
+// they are not configured
+const (
+	DefaultLogMaxSizeMB  = 10
+	DefaultLogMaxBackups = 3
+)
+
+// Logger writes the log entries of a subsystem. Each entry is a message and pairs of keys and
+// values, such as logSensors.Error("Update failed", "sensor", name, "error", err).
+type Logger struct {
+	subsystem string
+}
+
+var logSubsystems []string
+
+// NewLogger creates the logger of a subsystem, whose level can then be set in the configuration
+func NewLogger(subsystem string) *Logger {
+	logSubsystems = append(logSubsystems, subsystem)
+	return &Logger{subsystem: subsystem}
+}
+
+// The loggers of the subsystems
+var (
+	logMain    = NewLogger("main")
+	logSensors = NewLogger("sensors")
+	logStorage = NewLogger("storage")
+	logHTTP    = NewLogger("http")
+	logHomeKit = NewLogger("homekit")
+	logLifx    = NewLogger("lifx")
+	logBOM     = NewLogger("bom")
+	logDyson   = NewLogger("dyson")
+	logHDPrice = NewLogger("hdprice")
+	logOLED    = NewLogger("oled")
+)
+
+// LogSubsystems returns the names of the subsystems which log, in order
+func LogSubsystems() []string {
+	names := append([]string(nil), logSubsystems...)
+	sort.Strings(names)
+	return names
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { logging.write(l.subsystem, LogDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { logging.write(l.subsystem, LogInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { logging.write(l.subsystem, LogWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { logging.write(l.subsystem, LogError, msg, kv) }
+
+// Enabled is true when entries of the level are written, so that expensive values need only be
+// built when they will be logged
+func (l *Logger) Enabled(level LogLevel) bool {
+	return logging.enabled(l.subsystem, level)
+}
+
+// logSink is where every logger writes, which is replaced by ConfigureLogging
+type logSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	json   bool
+	level  LogLevel
+	levels map[string]LogLevel
+	now    func() time.Time
+}
+
+var logging = &logSink{w: os.Stdout, level: LogInfo, now: time.Now}
+
+func (s *logSink) enabled(subsystem string, level LogLevel) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.enabledLocked(subsystem, level)
+}
+
+func (s *logSink) enabledLocked(subsystem string, level LogLevel) bool {
+	if l, ok := s.levels[subsystem]; ok {
+		return level >= l
+	}
+	return level >= s.level
+}
+
+func (s *logSink) write(subsystem string, level LogLevel, msg string, kv []interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.enabledLocked(subsystem, level) {
+		return
+	}
+
+	var b bytes.Buffer
+	t := s.now()
+	if s.json {
+		writeJSONEntry(&b, t, level, subsystem, msg, kv)
+	} else {
+		writeTextEntry(&b, t, level, subsystem, msg, kv)
+	}
+
+	// There is nowhere to report a failure to write the log
+	io.WriteString(s.w, RedactSecrets(b.String()))
+}
+
+// logValue is the value which is logged for a value of the entry
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+// logPairs calls the function with each key and value, with a missing value logged as such
+func logPairs(kv []interface{}, fn func(key string, value interface{})) {
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		if i+1 < len(kv) {
+			fn(key, logValue(kv[i+1]))
+		} else {
+			fn(key, "(missing)")
+		}
+	}
+}
+
+// writeTextEntry writes the entry as a line of key=value pairs (logfmt), quoting values which need it
+func writeTextEntry(b *bytes.Buffer, t time.Time, level LogLevel, subsystem, msg string, kv []interface{}) {
+	fmt.Fprintf(b, "time=%s level=%s subsystem=%s msg=%s", t.Format("2006-01-02T15:04:05.000Z07:00"), level, subsystem, logfmtValue(msg))
+	logPairs(kv, func(key string, value interface{}) {
+		fmt.Fprintf(b, " %s=%s", key, logfmtValue(fmt.Sprint(value)))
+	})
+	b.WriteByte('\n')
+}
+
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " =\"\\\t\r\n") || strconv.QuoteToASCII(s) != `"`+s+`"` {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// writeJSONEntry writes the entry as a JSON object on a line, with the time, level, subsystem and
+// message first
+func writeJSONEntry(b *bytes.Buffer, t time.Time, level LogLevel, subsystem, msg string, kv []interface{}) {
+	field := func(key string, value interface{}) {
+		data, err := json.Marshal(value)
+		if err != nil {
+			data, _ = json.Marshal(fmt.Sprint(value))
+		}
+
+		if b.Len() > 1 {
+			b.WriteByte(',')
+		}
+
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(data)
+	}
+
+	b.WriteByte('{')
+	field("time", t.Format(time.RFC3339Nano))
+	field("level", level.String())
+	field("subsystem", subsystem)
+	field("msg", msg)
+	logPairs(kv, field)
+	b.WriteString("}\n")
+}
+
+// parseLogging reads the level of each subsystem and the format from the configuration
+func parseLogging(lc LoggingConfiguration, debugOutput bool) (level LogLevel, levels map[string]LogLevel, jsonFormat bool, err error) {
+	level = LogInfo
+	if debugOutput {
+		level = LogDebug
+	}
+
+	if lc.Level != "" {
+		if level, err = ParseLogLevel(lc.Level); err != nil {
+			return
+		}
+	}
+
+	levels = make(map[string]LogLevel)
+	for subsystem, name := range lc.Subsystems {
+		if !containsString(logSubsystems, subsystem) {
+			err = fmt.Errorf("unknown log subsystem \"%s\", expected one of %s", subsystem, strings.Join(LogSubsystems(), ", "))
+			return
+		}
+
+		if levels[subsystem], err = ParseLogLevel(name); err != nil {
+			err = fmt.Errorf("log subsystem \"%s\": %v", subsystem, err)
+			return
+		}
+	}
+
+	switch strings.ToLower(lc.Format) {
+	case "", LogFormatText:
+	case LogFormatJSON:
+		jsonFormat = true
+	default:
+		err = fmt.Errorf("unknown log format \"%s\", expected %s or %s", lc.Format, LogFormatText, LogFormatJSON)
+	}
+
+	return
+}
+
+// ConfigureLogging sets the level, format and destination of the log from the configuration.
+// Debug output makes debug the default level when no level is configured.
+func ConfigureLogging(lc LoggingConfiguration, debugOutput bool) (err error) {
+	var level LogLevel
+	var levels map[string]LogLevel
+	var jsonFormat bool
+	if level, levels, jsonFormat, err = parseLogging(lc, debugOutput); err != nil {
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	var closer io.Closer
+	if lc.File != "" {
+		var rf *rotatingFile
+		if rf, err = openRotatingFile(lc.File, int64(lc.MaxSize())*1024*1024, lc.Backups()); err != nil {
+			return
+		}
+		w, closer = rf, rf
+	}
+
+	logging.mu.Lock()
+	previous := logging.closer
+	logging.w, logging.closer = w, closer
+	logging.json = jsonFormat
+	logging.level = level
+	logging.levels = levels
+	logging.mu.Unlock()
+
+	if previous != nil {
+		previous.Close()
+	}
+
+	return
+}
+
+// CloseLogging closes the log file, after which the log is written to standard output
+func CloseLogging() {
+	logging.mu.Lock()
+	closer := logging.closer
+	logging.w, logging.closer = os.Stdout, nil
+	logging.mu.Unlock()
+
+	if closer != nil {
+		closer.Close()
+	}
+}
+
+// rotatingFile is a log file which is renamed to path.1 when it reaches its maximum size, with
+// the older files renamed up to path.N and the oldest deleted
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (rf *rotatingFile, err error) {
+	rf = &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err = rf.open(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (rf *rotatingFile) open() (err error) {
+	if rf.f, err = os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return fmt.Errorf("failed to open log file \"%s\": %v", rf.path, err)
+	}
+
+	var fi os.FileInfo
+	if fi, err = rf.f.Stat(); err != nil {
+		rf.f.Close()
+		return
+	}
+
+	rf.size = fi.Size()
+	return
+}
+
+func (rf *rotatingFile) Write(p []byte) (n int, err error) {
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err = rf.rotate(); err != nil {
+			return
+		}
+	}
+
+	n, err = rf.f.Write(p)
+	rf.size += int64(n)
+	return
+}
+
+func (rf *rotatingFile) rotate() (err error) {
+	rf.f.Close()
+
+	os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+
+	if rf.maxBackups > 0 {
+		os.Rename(rf.path, rf.path+".1")
+	} else {
+		os.Remove(rf.path)
+	}
+
+	return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.f.Close()
+}
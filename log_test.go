@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureLog writes the log to a buffer at a fixed time until the test finishes
+func captureLog(t *testing.T, lc LoggingConfiguration) *bytes.Buffer {
+	if err := ConfigureLogging(lc, false); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	logging.mu.Lock()
+	logging.w = &b
+	logging.now = func() time.Time { return time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC) }
+	logging.mu.Unlock()
+
+	t.Cleanup(func() {
+		ConfigureLogging(LoggingConfiguration{}, false)
+		logging.mu.Lock()
+		logging.now = time.Now
+		logging.mu.Unlock()
+	})
+	return &b
+}
+
+func TestLogText(t *testing.T) {
+	b := captureLog(t, LoggingConfiguration{})
+
+	logSensors.Error("Update failed", "sensor", "lounge", "error", errors.New("read failed"), "attempt", 2)
+	logSensors.Debug("Summary")
+
+	expected := `time=2024-05-01T10:00:00.000Z level=error subsystem=sensors msg="Update failed" sensor=lounge error="read failed" attempt=2` + "\n"
+	if b.String() != expected {
+		t.Errorf("unexpected log:\n%s\nexpected:\n%s", b.String(), expected)
+	}
+}
+
+func TestLogJSON(t *testing.T) {
+	b := captureLog(t, LoggingConfiguration{Format: "json", Level: "debug"})
+
+	logDyson.Debug("Connected", "sensor", "fan", "interval", 5*time.Second)
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(b.Bytes(), &entry); err != nil {
+		t.Fatalf("log is not JSON: %v\n%s", err, b.String())
+	}
+
+	for key, value := range map[string]interface{}{
+		"level": "debug", "subsystem": "dyson", "msg": "Connected", "sensor": "fan", "interval": "5s",
+	} {
+		if entry[key] != value {
+			t.Errorf("expected %s to be %v in %s", key, value, b.String())
+		}
+	}
+
+	if !strings.HasPrefix(b.String(), `{"time":"2024-05-01T10:00:00Z","level":"debug"`) {
+		t.Errorf("expected the time and level first: %s", b.String())
+	}
+}
+
+func TestLogSubsystemLevels(t *testing.T) {
+	b := captureLog(t, LoggingConfiguration{Level: "warn", Subsystems: map[string]string{"bom": "debug"}})
+
+	logBOM.Debug("Observation")
+	logSensors.Info("Opened sensor")
+	logSensors.Warn("Reopening sensor")
+
+	if log := b.String(); !strings.Contains(log, "Observation") || strings.Contains(log, "Opened sensor") || !strings.Contains(log, "Reopening sensor") {
+		t.Errorf("unexpected log for the levels:\n%s", log)
+	}
+
+	if logSensors.Enabled(LogInfo) || !logBOM.Enabled(LogDebug) {
+		t.Error("unexpected enabled levels")
+	}
+}
+
+func TestConfigureLoggingErrors(t *testing.T) {
+	defer ConfigureLogging(LoggingConfiguration{}, false)
+
+	for _, lc := range []LoggingConfiguration{
+		{Level: "loud"},
+		{Format: "xml"},
+		{Subsystems: map[string]string{"toaster": "debug"}},
+		{Subsystems: map[string]string{"bom": "loud"}},
+	} {
+		if err := ConfigureLogging(lc, false); err == nil {
+			t.Errorf("no error for %+v", lc)
+		}
+	}
+}
+
+func TestLogFileRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "i2c.log")
+
+	rf, err := openRotatingFile(path, 100, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for i := 0; i < 5; i++ {
+		if _, err = rf.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil || len(data) != len(line) {
+			t.Errorf("expected %s to hold one line, got %d bytes: %v", name, len(data), err)
+		}
+	}
+
+	if _, err = os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error("more rotated files were kept than configured")
+	}
+}
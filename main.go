@@ -3,14 +3,18 @@ package main
 import (
 	"context"
 	"embed"
+	"errors"
+	"flag"
 	"fmt"
 	"math"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	// "i2c/go-piicodev.local"
 	"github.com/2tvenom/golifx"
-	"github.com/drtimf/go-piicodev"
 	"github.com/gin-gonic/gin"
 )
 
@@ -18,11 +22,7 @@ import (
 var f embed.FS
 
 func PrintState(device string, status bool) {
-	if status {
-		fmt.Printf("Enabled: %s\n", device)
-	} else {
-		fmt.Printf("Disabled: %s\n", device)
-	}
+	logMain.Info("Feature", "name", device, "enabled", status)
 }
 
 // HSV2RGB calculates the red, green and blue (RGB) values from hue, saturation and value (HSV) values.
@@ -85,6 +85,11 @@ func NewMainPageRouter() {
 		c.Data(http.StatusOK, "text/html", file)
 	})
 
+	router.GET("/stats", func(c *gin.Context) {
+		file, _ := f.ReadFile("assets/stats.html")
+		c.Data(http.StatusOK, "text/html", file)
+	})
+
 	router.StaticFS("/public", http.FS(f))
 
 	// router.StaticFile("/", "./assets/index.html")
@@ -94,131 +99,130 @@ func NewMainPageRouter() {
 
 func main() {
 	var err error
-	ctx := context.Background()
-
-	var config *I2cConfiguration
-	if config, err = LoadConfiguration("config/config.yaml"); err != nil {
-		fmt.Println(err)
-		return
-	}
 
-	prom := PrometheusStart(ctx)
+	// The first SIGINT or SIGTERM shuts the service down, and a second one exits straight away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
 
-	NewMainPageRouter()
-
-	sensorManagement := NewSensorManagement()
-
-	for _, s := range config.Sensors {
-		var err error
-		var newSensor Sensor
-
-		switch s.SensorType {
-		case "tmp117":
-			newSensor, err = NewSensorTMP117(s.Name, s.I2CAddress)
-		case "ms5637":
-			newSensor, err = NewSensorMS5637(s.Name, s.I2CAddress)
-		case "aht10":
-			newSensor, err = NewSensorAHT10(s.Name, s.I2CAddress)
-		case "veml6030":
-			newSensor, err = NewSensorVEML6030(s.Name, s.I2CAddress)
-		case "bme280":
-			newSensor, err = NewSensorBME280(s.Name, s.I2CAddress)
-		case "cap1203":
-			newSensor, err = NewSensorCAP1203(s.Name, s.I2CAddress)
-		case "vl53l1x":
-			newSensor, err = NewSensorVL53L1X(s.Name, s.I2CAddress)
-		case "ens160":
-			newSensor, err = NewSensorENS160(s.Name, s.I2CAddress)
-		case "switch":
-			newSensor, err = NewSensorSwitch(s.Name, s.I2CAddress)
-		case "potentiometer":
-			newSensor, err = NewSensorPotentiometer(s.Name, s.I2CAddress)
-		case "pir":
-			newSensor, err = NewSensorPIR(s.Name, s.I2CAddress)
-		case "bom":
-			newSensor, err = NewSensorBOM(s.Name, config.DebugOutput)
-		case "dysonhotcool":
-			newSensor, err = NewSensorDysonHotCool(s.Name, s.Server, s.DeviceType, s.Serial, s.Password, config.DebugOutput)
-		default:
-			fmt.Printf("ERROR: Unknown sensor type \"%s\"\n", s.SensorType)
+	if err = RunCLI(ctx, os.Stdout, os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
 			return
 		}
 
-		if err == nil {
-			sensorManagement.AddSensor(newSensor)
-		} else {
-			fmt.Printf("ERROR: Failed to initialize sensor of type \"%s\": %v", s.SensorType, err)
+		fmt.Fprintf(os.Stderr, "i2c: %v\n", err)
+
+		var usage *usageError
+		if errors.As(err, &usage) {
+			os.Exit(2)
 		}
+		os.Exit(1)
 	}
+}
 
-	var haveTemperature, haveLightLevel, haveOccupancy bool
-	_, haveTemperature = sensorManagement.GetTemperature()
-	_, haveLightLevel = sensorManagement.GetLightLevel()
-	_, haveOccupancy = sensorManagement.GetOccupancy()
-
-	fmt.Println("HomeKit bridge device ID:", config.HomeKitDeviceID)
-	var hkb *HomeKitBridge
-	if hkb, err = HomeKitBridgeStart(ctx, config.HomeKitDeviceID, config.HomeKitDevicePin, config.HomeKitBridgeName,
-		haveTemperature, haveLightLevel, haveOccupancy, config.EnableLED); err != nil {
-		fmt.Println(err)
+// serve runs the sensors, HomeKit bridge, outputs and HTTP server until the context is cancelled,
+// then shuts them down in turn within ShutdownTimeout
+func serve(ctx context.Context, config *I2cConfiguration) (err error) {
+	if err = config.Validate(); err != nil {
 		return
 	}
 
-	var bulb *LifxBulb
+	prom := PrometheusStart(config.HTTPAddress())
+
+	NewMainPageRouter()
+
+	sensorManagement := NewSensorManagement(config.SamplePeriod(), config.StaleAfter)
+	sensorManagement.SetRooms(config.Rooms, config.HomeRoom)
 
-	PrintState("Lifx bulb", config.EnableLifx)
-	if config.EnableLifx {
-		lbs := NewLifxBulbState()
+	var history *History
+	var recording *Recording
+	var hkb *HomeKitBridge
+	var hdPriceScanner *HDPriceScanner
+	outputs := newServeOutputs(config.EnableLED)
 
-		fmt.Println(">>> Looking for Lifx", config.LifxMAC)
-		if bulb, _ = lbs.FindBulbByMAC(config.LifxMAC); bulb != nil {
-			fmt.Println(bulb.bulb.String())
-		} else {
-			fmt.Println("Not found")
+	defer func() {
+		logMain.Info("Shutting down")
+		if serr := Shutdown(serveShutdownSteps(prom, sensorManagement, history, recording, hkb, hdPriceScanner, outputs), ShutdownTimeout); serr != nil && err == nil {
+			err = serr
 		}
+	}()
 
-		NewBulbLifxRouter(lbs)
+	if err = sensorManagement.Statistics().Load(config.StatsPath()); err != nil {
+		logStorage.Error("Failed to load statistics", "error", err)
 	}
 
-	var oled *OLEDDisplay = nil
-	PrintState("OLED display", config.EnableOLED)
-	if config.EnableOLED {
-		if oled, err = NewOLEDDisplay(); err != nil {
-			fmt.Println(err)
+	PrintState("History", config.EnableHistory)
+	if config.EnableHistory {
+		if history, err = OpenHistory(config.History); err != nil {
+			return
 		}
+
+		sensorManagement.SetHistory(history)
 	}
 
-	var led *piicodev.RGBLED = nil
-	PrintState("RGB LED", config.EnableLED)
-	if config.EnableLED {
-		if led, err = piicodev.NewRGBLED(piicodev.RGBLEDAddress, 1); err != nil {
-			fmt.Println(err)
+	PrintState("Recording", config.EnableRecording)
+	if config.EnableRecording {
+		if recording, err = OpenRecording(config.RecordingDirectory()); err != nil {
 			return
 		}
 
-		led.SetBrightness(255)
-		led.EnablePowerLED(false)
+		sensorManagement.SetRecording(recording)
+	}
 
-		hkb.OnLampChange(func(hue, saturation float64, brightness int) (err error) {
-			red, green, blue := HSV2RGB(hue, float64(saturation)/100.0, float64(brightness)/100.0)
-			fmt.Printf("Set lamp (%f,%f,%d) -> (%d,%d,%d)\n", hue, saturation, brightness, byte(red*255.0), byte(green*255.0), byte(blue*255.0))
+	for i := range config.Sensors {
+		s := &config.Sensors[i]
 
-			led.FillPixels(byte(red*255.0), byte(green*255.0), byte(blue*255.0))
-			err = led.Show()
-			return
-		})
+		if err = sensorManagement.OpenSensor(*s, func() (Sensor, error) { return NewSensor(s, config) }); err != nil {
+			logSensors.Error("Failed to open sensor, retrying in the background", "sensor", s.Name, "type", s.SensorType, "error", err)
+		}
+	}
+
+	NewSensorRouter(sensorManagement)
+
+	accessories := sensorAccessories(sensorManagement)
+	reloader := &configReloader{config: config, sm: sensorManagement, outputs: outputs, homeKit: accessories}
+	NewConfigRouter(reloader.Configuration)
+
+	logHomeKit.Info("Starting bridge", "deviceid", config.HomeKitDeviceID)
+	if hkb, err = HomeKitBridgeStart(config.HomeKitDeviceID, config.HomeKitDevicePin, config.HomeKitBridgeName,
+		accessories.temperature, accessories.lightLevel, accessories.occupancy, config.EnableLED, config.HomeKitDerived); err != nil {
+		return
+	}
+
+	if err = outputs.apply(config); err != nil {
+		return
+	}
+
+	if config.EnableLED {
+		hkb.OnLampChange(outputs.setLamp)
 	}
 
-	var hdPriceScanner *HDPriceScanner = nil
 	PrintState("HD Price", config.EnableHDPrice)
 	if config.EnableHDPrice {
 		if hdPriceScanner, err = NewHDPriceScanner(); err != nil {
-			fmt.Println(err)
+			logHDPrice.Error("Failed to start price updates", "error", err)
 		}
 	}
 
 	sensorManagement.UpdateSensors()
-	println(sensorManagement.Details())
+	for _, ss := range sensorManagement.Snapshots() {
+		logSensors.Info("Sensor", "sensor", ss.Name, "details", ss.DetailsWithHealth())
+	}
+	sensorManagement.Start(ctx)
+
+	// The configuration is reloaded on SIGHUP, and when the file changes if watchconfig is set
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	var fileChanged chan struct{}
+	if config.path != "" {
+		fileChanged = make(chan struct{}, 1)
+		go watchConfiguration(ctx, config.path, ConfigWatchInterval, fileChanged)
+	}
 
 	for {
 		/*
@@ -251,13 +255,11 @@ func main() {
 			}
 		*/
 
-		sensorManagement.UpdateSensors()
-
 		var pubTemp, pubPressure, pubHumidity, pubLightLevel float64
-		var pubOccupancy bool
+		var pubOccupancy, haveLightLevel bool
 
 		pubTemp, _ = sensorManagement.GetTemperature()
-		pubLightLevel, _ = sensorManagement.GetLightLevel()
+		pubLightLevel, haveLightLevel = sensorManagement.GetLightLevel()
 		pubPressure, _ = sensorManagement.GetPressure()
 		pubHumidity, _ = sensorManagement.GetHumidity()
 		pubOccupancy, _ = sensorManagement.GetOccupancy()
@@ -266,10 +268,18 @@ func main() {
 		hkb.SetLightLevel(pubLightLevel)
 		hkb.SetOccupancy(pubOccupancy)
 
+		for _, metric := range config.HomeKitDerived {
+			if value, ok := sensorManagement.GetDerived(metric); ok {
+				hkb.SetDerived(metric, value)
+			}
+		}
+
 		if hdPriceScanner != nil {
-			prom.SetWesternDigitalHDPrice(hdPriceScanner.wd)
+			prom.SetWesternDigitalHDPrice(hdPriceScanner.Prices())
 		}
 
+		oled, bulb := outputs.current()
+
 		if oled != nil {
 			// oled.WriteOLED(fmt.Sprintf("%.2f C\n%.2f hPa\n%.2f lux", tempC, pressure, light))
 			if haveLightLevel {
@@ -292,7 +302,7 @@ func main() {
 
 				if pressType, ok := sensorManagement.GetSwitchPress(); ok {
 					if pressType == 1 {
-						fmt.Println("Light on")
+						logLifx.Info("Light on")
 						bulb.bulb.SetColorState(&golifx.HSBK{
 							Hue:        5461,
 							Saturation: 0,
@@ -303,14 +313,14 @@ func main() {
 					}
 
 					if pressType == 2 {
-						fmt.Println("Light off")
+						logLifx.Info("Light off")
 						bulb.bulb.SetPowerState(false)
 					}
 				}
 
 				if changed, value, ok := sensorManagement.GetPotentiometer(); ok {
 					if changed {
-						fmt.Println("Light ", value)
+						logLifx.Info("Light", "value", value)
 						bulb.bulb.SetColorState(&golifx.HSBK{
 							Hue:        5461,
 							Saturation: 0,
@@ -322,12 +332,12 @@ func main() {
 
 				if status, ok := sensorManagement.GetCapSensorStatus(); ok {
 					if status[0] {
-						fmt.Println("Light off")
+						logLifx.Info("Light off")
 						bulb.bulb.SetPowerState(false)
 					}
 
 					if status[1] {
-						fmt.Println("Low light")
+						logLifx.Info("Low light")
 						bulb.bulb.SetColorState(&golifx.HSBK{
 							Hue:        5461,
 							Saturation: 0,
@@ -338,7 +348,7 @@ func main() {
 					}
 
 					if status[2] {
-						fmt.Println("Full light")
+						logLifx.Info("Full light")
 						bulb.bulb.SetColorState(&golifx.HSBK{
 							Hue:        5461,
 							Saturation: 0,
@@ -351,14 +361,72 @@ func main() {
 			}
 		}
 
-		if config.DebugOutput {
-			fmt.Println(sensorManagement.Summary() + fmt.Sprintf(" | bulb: %s", powerState))
+		if logSensors.Enabled(LogDebug) {
+			logSensors.Debug("Summary", "sensors", sensorManagement.Summary(), "bulb", powerState)
 		}
 
-		if config.SampleTime > 0 {
-			time.Sleep(time.Duration(config.SampleTime) * time.Second)
-		} else {
-			time.Sleep(5 * time.Second)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hangup:
+			reloadConfiguration(reloader, "SIGHUP")
+		case <-fileChanged:
+			if reloader.config.WatchConfig {
+				reloadConfiguration(reloader, "file changed")
+			}
+		case <-time.After(reloader.config.SamplePeriod()):
 		}
 	}
 }
+
+// reloadConfiguration reloads the configuration, keeping the running configuration when the
+// new one is rejected
+func reloadConfiguration(reloader *configReloader, reason string) {
+	logMain.Info("Reloading configuration", "reason", reason)
+	if err := reloader.Reload(); err != nil {
+		logMain.Error("Configuration reload rejected, keeping the running configuration", "error", err)
+	}
+}
+
+// serveShutdownSteps stops what serve started: the sensor polling first so that nothing else is
+// read or written, then the schedulers and sensors, the servers, and finally the outputs are
+// turned off. Parts which were not started are skipped.
+func serveShutdownSteps(prom *PrometheusSensors, sm *SensorManagement, history *History, recording *Recording,
+	hkb *HomeKitBridge, hdPriceScanner *HDPriceScanner, outputs *serveOutputs) (steps []ShutdownStep) {
+	steps = append(steps, ShutdownStep{"sensor polling", sm.Wait})
+
+	steps = append(steps, ShutdownStep{"schedulers", func(ctx context.Context) error {
+		StopBOMScanner()
+		if hdPriceScanner != nil {
+			hdPriceScanner.Stop()
+		}
+		return nil
+	}})
+
+	steps = append(steps, ShutdownStep{"sensors", func(ctx context.Context) error {
+		sm.Close()
+		return nil
+	}})
+
+	steps = append(steps, ShutdownStep{"history and recording", func(ctx context.Context) error {
+		if history != nil {
+			history.Close()
+		}
+		if recording != nil {
+			recording.Close()
+		}
+		return nil
+	}})
+
+	if hkb != nil {
+		steps = append(steps, ShutdownStep{"HomeKit server", hkb.Stop})
+	}
+
+	steps = append(steps, ShutdownStep{"HTTP server", prom.Shutdown})
+
+	steps = append(steps, ShutdownStep{"RGB LED and OLED display", func(ctx context.Context) error {
+		return outputs.close()
+	}})
+
+	return
+}
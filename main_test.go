@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHSV2RGB(t *testing.T) {
+	tests := []struct {
+		hue, saturation, value float64
+		red, green, blue       float64
+	}{
+		{0, 1, 1, 1, 0, 0},
+		{60, 1, 1, 1, 1, 0},
+		{120, 1, 1, 0, 1, 0},
+		{180, 1, 1, 0, 1, 1},
+		{240, 1, 1, 0, 0, 1},
+		{300, 1, 1, 1, 0, 1},
+		{360, 1, 1, 1, 0, 0},
+		{30, 0.5, 0.8, 0.8, 0.6, 0.4},
+		{0, 0, 0.5, 0.5, 0.5, 0.5},
+		{200, 0.25, 0, 0, 0, 0},
+		{-10, 1, 1, 0, 0, 0},
+	}
+
+	for _, test := range tests {
+		red, green, blue := HSV2RGB(test.hue, test.saturation, test.value)
+		if math.Abs(red-test.red) > 1e-9 || math.Abs(green-test.green) > 1e-9 || math.Abs(blue-test.blue) > 1e-9 {
+			t.Errorf("HSV2RGB(%f, %f, %f) = (%f, %f, %f), expected (%f, %f, %f)",
+				test.hue, test.saturation, test.value, red, green, blue, test.red, test.green, test.blue)
+		}
+	}
+}
+
+func httpGet(t *testing.T, url string) (status int, body string) {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(b)
+}
+
+// TestServeWithSimulatedSensors runs the whole service against simulated devices and checks what
+// it serves over HTTP. It can only run once per process as the handlers are registered globally.
+func TestServeWithSimulatedSensors(t *testing.T) {
+	// The HomeKit bridge keeps its pairing in the working directory
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	UseSimulatedDevices()
+	defer func() { devices = HardwareDevices{} }()
+
+	config := &I2cConfiguration{
+		HomeKitDeviceID:   "TE57",
+		HomeKitDevicePin:  12344321,
+		HomeKitBridgeName: "Test Bridge",
+		SampleTime:        1,
+		EnableLED:         true,
+		EnableHistory:     true,
+		EnableRecording:   true,
+		ListenAddress:     "127.0.0.1:0",
+		Sensors: []SensorConfiguration{
+			{SensorType: "tmp117", Name: "e2e_tmp117"},
+			{SensorType: "bme280", Name: "e2e_bme280"},
+			{SensorType: "vl53l1x", Name: "e2e_vl53l1x"},
+			{SensorType: "ens160", Name: "e2e_ens160"},
+			{SensorType: "switch", Name: "e2e_switch"},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, config) }()
+
+	srv := httptest.NewServer(http.DefaultServeMux)
+	defer srv.Close()
+
+	var metrics string
+	for deadline := time.Now().Add(10 * time.Second); ; {
+		var status int
+		if status, metrics = httpGet(t, srv.URL+"/metrics"); status == http.StatusOK && strings.Contains(metrics, `sensor_up{sensor="e2e_switch",type="switch"}`) {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("the service did not publish the sensor metrics:\n%s", metrics)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	for _, expected := range []string{
+		"e2e_tmp117_temperature ",
+		"e2e_bme280_pressure ",
+		"e2e_bme280_humidity ",
+		"e2e_vl53l1x_distance ",
+		"e2e_ens160_eco2 ",
+		`sensor_up{sensor="e2e_tmp117",type="tmp117"} 1`,
+		`sensor_last_success_timestamp{sensor="e2e_bme280",type="bme280"} `,
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Errorf("expected the metrics to contain %q", expected)
+		}
+	}
+
+	status, body := httpGet(t, srv.URL+"/api/sensors")
+	var snapshots []SensorSnapshot
+	if err = json.Unmarshal([]byte(body), &snapshots); err != nil || status != http.StatusOK {
+		t.Fatalf("unexpected sensors response %d: %s", status, body)
+	}
+
+	if len(snapshots) != len(config.Sensors) {
+		t.Errorf("expected %d sensors, got %d", len(config.Sensors), len(snapshots))
+	}
+
+	status, body = httpGet(t, srv.URL+"/api/sensors/e2e_bme280")
+	var ss SensorSnapshot
+	if err = json.Unmarshal([]byte(body), &ss); err != nil || status != http.StatusOK {
+		t.Fatalf("unexpected sensor response %d: %s", status, body)
+	}
+
+	if r, ok := ss.Reading(MetricPressure); !ok || r.Unit != UnitHectopascal || r.Value < 990 || r.Value > 1030 || r.Stale {
+		t.Errorf("unexpected pressure from the simulated BME280: %+v", r)
+	}
+
+	if status, _ = httpGet(t, srv.URL+"/api/sensors/missing"); status != http.StatusNotFound {
+		t.Errorf("expected an unknown sensor to be not found, got %d", status)
+	}
+
+	status, body = httpGet(t, srv.URL+"/api/health")
+	var report SensorHealthReport
+	if err = json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatalf("unexpected health response %d: %s", status, body)
+	}
+
+	if status != http.StatusOK || report.Status != HealthHealthy {
+		t.Errorf("expected the simulated sensors to be healthy, got %d: %s", status, body)
+	}
+
+	status, body = httpGet(t, srv.URL+"/api/history?sensor=e2e_bme280&metric=pressure")
+	var history HistoryQuery
+	if err = json.Unmarshal([]byte(body), &history); err != nil || status != http.StatusOK {
+		t.Fatalf("unexpected history response %d: %s", status, body)
+	}
+
+	if len(history.Points) == 0 || history.Unit != UnitHectopascal {
+		t.Errorf("expected the history of the pressure, got %s", body)
+	}
+
+	if status, _ = httpGet(t, srv.URL+"/api/history?sensor=e2e_bme280"); status != http.StatusBadRequest {
+		t.Errorf("expected a history query without a metric to fail, got %d", status)
+	}
+
+	status, body = httpGet(t, srv.URL+"/api/export?sensor=e2e_tmp117&format=ndjson")
+	var recorded RecordedReading
+	if err = json.Unmarshal([]byte(strings.SplitN(body, "\n", 2)[0]), &recorded); err != nil || status != http.StatusOK {
+		t.Fatalf("unexpected export response %d: %s", status, body)
+	}
+
+	if recorded.Sensor != "e2e_tmp117" || recorded.Type != "tmp117" || recorded.Metric != MetricTemperature {
+		t.Errorf("unexpected exported reading %+v", recorded)
+	}
+
+	status, body = httpGet(t, srv.URL+"/api/stats")
+	var stats []SensorStats
+	if err = json.Unmarshal([]byte(body), &stats); err != nil || status != http.StatusOK {
+		t.Fatalf("unexpected statistics response %d: %s", status, body)
+	}
+
+	if len(stats) == 0 || stats[0].Day.Count == 0 {
+		t.Errorf("expected statistics of the simulated sensors, got %s", body)
+	}
+
+	if status, body = httpGet(t, srv.URL+"/stats"); status != http.StatusOK || !strings.Contains(body, "/api/stats") {
+		t.Errorf("expected the statistics page, got %d", status)
+	}
+
+	status, body = httpGet(t, srv.URL+"/api/config")
+	var dump map[string]interface{}
+	if err = json.Unmarshal([]byte(body), &dump); err != nil || status != http.StatusOK {
+		t.Fatalf("unexpected configuration response %d: %s", status, body)
+	}
+
+	if dump["homekitdevicepin"] != Redacted || dump["homekitbridgename"] != "Test Bridge" {
+		t.Errorf("expected the configuration with the setup code redacted, got %s", body)
+	}
+
+	if status, body = httpGet(t, srv.URL+"/"); status != http.StatusOK || !strings.Contains(body, "<html") {
+		t.Errorf("expected the main page, got %d", status)
+	}
+
+	cancel()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("the service failed: %v", err)
+		}
+	case <-time.After(ShutdownTimeout):
+		t.Fatalf("the service did not stop when cancelled")
+	}
+
+	if _, err = os.Stat(DefaultStatsFile); err != nil {
+		t.Errorf("the statistics were not saved when the service stopped: %v", err)
+	}
+}
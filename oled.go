@@ -7,11 +7,7 @@ import (
 	"strings"
 
 	"github.com/golang/freetype/truetype"
-	"periph.io/x/conn/v3/i2c"
-	"periph.io/x/conn/v3/i2c/i2creg"
-	"periph.io/x/devices/v3/ssd1306"
 	"periph.io/x/devices/v3/ssd1306/image1bit"
-	"periph.io/x/host/v3"
 
 	"golang.org/x/image/font"
 	"golang.org/x/image/font/inconsolata"
@@ -49,8 +45,7 @@ func (f *OLEDFont) GetFace(size float64) (face font.Face) {
 }
 
 type OLEDDisplay struct {
-	bus                 i2c.BusCloser
-	dev                 *ssd1306.Dev
+	dev                 DisplayDevice
 	font                *OLEDFont
 	numberFace          font.Face
 	symbolFace          font.Face
@@ -58,23 +53,14 @@ type OLEDDisplay struct {
 	temperatureDisplayY int
 }
 
-func NewOLEDDisplay() (d *OLEDDisplay, err error) {
+func NewOLEDDisplay(bus int) (d *OLEDDisplay, err error) {
 	d = &OLEDDisplay{}
 
-	if _, err = host.Init(); err != nil {
-		return
-	}
-
-	// Use i2creg I²C bus registry to find the first available I²C bus.
-	if d.bus, err = i2creg.Open(""); err != nil {
-		return
-	}
-
-	if d.dev, err = ssd1306.NewI2C(d.bus, &ssd1306.DefaultOpts); err != nil {
+	if d.font, err = LoadFont("Orbitron-Medium.ttf"); err != nil {
 		return
 	}
 
-	if d.font, err = LoadFont("Orbitron-Medium.ttf"); err != nil {
+	if d.dev, err = devices.OpenSSD1306(OnBus(bus)); err != nil {
 		return
 	}
 
@@ -115,6 +101,15 @@ func (d *OLEDDisplay) DisplayTemperature(t float64, s string) (err error) {
 	return d.dev.Draw(d.dev.Bounds(), img, image.Point{})
 }
 
+// Clear blanks the display
+func (d *OLEDDisplay) Clear() error {
+	return d.dev.Draw(d.dev.Bounds(), image1bit.NewVerticalLSB(d.dev.Bounds()), image.Point{})
+}
+
+func (d *OLEDDisplay) Close() {
+	d.dev.Close()
+}
+
 /*
 func (d *OLEDDisplay) WriteOLED(s string) {
 	img := image1bit.NewVerticalLSB(d.dev.Bounds())
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// SensorOptions tune the behaviour of a sensor, set under options in its entry in the
+// configuration. The constructor of a sensor type is given every option of the type, with the
+// default of each option which is not set.
+type SensorOptions map[string]interface{}
+
+// SensorOption describes an option of a sensor type. The type of the default is the type of the
+// option, which is one of int, float64, bool or string.
+type SensorOption struct {
+	Name        string
+	Default     interface{}
+	Min, Max    float64       // The range of a number, when Max is greater than Min
+	Values      []interface{} // The only values allowed, when there are any
+	Description string
+}
+
+// convert returns the value as the type of the option, checking it is in the range and one of
+// the values allowed
+func (o *SensorOption) convert(v interface{}) (value interface{}, err error) {
+	switch o.Default.(type) {
+	case int:
+		switch n := v.(type) {
+		case int:
+			value = n
+		case float64:
+			if n != math.Trunc(n) {
+				return nil, fmt.Errorf("%v is not a whole number", v)
+			}
+			value = int(n)
+		default:
+			return nil, fmt.Errorf("expected a whole number, got %v", v)
+		}
+	case float64:
+		switch n := v.(type) {
+		case int:
+			value = float64(n)
+		case float64:
+			value = n
+		default:
+			return nil, fmt.Errorf("expected a number, got %v", v)
+		}
+	case bool:
+		if _, ok := v.(bool); !ok {
+			return nil, fmt.Errorf("expected true or false, got %v", v)
+		}
+		value = v
+	case string:
+		if _, ok := v.(string); !ok {
+			return nil, fmt.Errorf("expected a string, got %v", v)
+		}
+		value = v
+	default:
+		return nil, fmt.Errorf("option of unsupported type %T", o.Default)
+	}
+
+	if o.Max > o.Min {
+		var n float64
+		switch x := value.(type) {
+		case int:
+			n = float64(x)
+		case float64:
+			n = x
+		}
+
+		if n < o.Min || n > o.Max {
+			return nil, fmt.Errorf("%v is out of the range %v to %v", value, o.Min, o.Max)
+		}
+	}
+
+	if len(o.Values) > 0 {
+		for _, allowed := range o.Values {
+			if value == allowed {
+				return
+			}
+		}
+		return nil, fmt.Errorf("%v is not one of %s", value, o.valueList())
+	}
+
+	return
+}
+
+func (o *SensorOption) valueList() string {
+	values := make([]string, len(o.Values))
+	for i, v := range o.Values {
+		values[i] = fmt.Sprint(v)
+	}
+	return strings.Join(values, ", ")
+}
+
+// String describes the option and its default for the list of sensor types
+func (o *SensorOption) String() string {
+	return fmt.Sprintf("%s=%v", o.Name, o.Default)
+}
+
+// ResolveOptions checks the options of a sensor against its type, returning every option of the
+// type with the value given or its default. Each option which is unknown or not valid is reported.
+func (st *SensorType) ResolveOptions(options SensorOptions, report func(name string, err error)) (resolved SensorOptions) {
+	resolved = make(SensorOptions, len(st.Options))
+	for i := range st.Options {
+		o := &st.Options[i]
+		resolved[o.Name] = o.Default
+
+		v, ok := options[o.Name]
+		if !ok || v == nil {
+			continue
+		}
+
+		if value, err := o.convert(v); err != nil {
+			report(o.Name, err)
+		} else {
+			resolved[o.Name] = value
+		}
+	}
+
+	names := make([]string, 0, len(st.Options))
+	for _, o := range st.Options {
+		names = append(names, o.Name)
+	}
+
+	var unknown []string
+	for name := range options {
+		if _, ok := resolved[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+
+	for _, name := range unknown {
+		switch suggestion := closestKey(name, names); {
+		case len(names) == 0:
+			report(name, fmt.Errorf("sensor type \"%s\" has no options", st.Name))
+		case suggestion != "":
+			report(name, fmt.Errorf("unknown option \"%s\", did you mean \"%s\"?", name, suggestion))
+		default:
+			report(name, fmt.Errorf("unknown option \"%s\", expected one of %s", name, strings.Join(names, ", ")))
+		}
+	}
+
+	return
+}
+
+// Int returns an option which ResolveOptions has set to a whole number
+func (so SensorOptions) Int(name string) int {
+	v, _ := so[name].(int)
+	return v
+}
+
+// Float returns an option which ResolveOptions has set to a number
+func (so SensorOptions) Float(name string) float64 {
+	v, _ := so[name].(float64)
+	return v
+}
+
+// Bool returns an option which ResolveOptions has set to true or false
+func (so SensorOptions) Bool(name string) bool {
+	v, _ := so[name].(bool)
+	return v
+}
+
+// String returns an option which ResolveOptions has set to a string
+func (so SensorOptions) String(name string) string {
+	v, _ := so[name].(string)
+	return v
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveOptions(t *testing.T) {
+	st, err := LookupSensorType("cap1203")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		options     SensorOptions
+		sensitivity int
+		problem     string
+	}{
+		{nil, 5, ""},
+		{SensorOptions{"sensitivity": 2}, 2, ""},
+		{SensorOptions{"sensitivity": 3.0}, 3, ""},
+		{SensorOptions{"sensitivity": 3.5}, 5, "3.5 is not a whole number"},
+		{SensorOptions{"sensitivity": "high"}, 5, "expected a whole number, got high"},
+		{SensorOptions{"sensitivity": 9}, 5, "9 is out of the range 0 to 7"},
+		{SensorOptions{"sensitivty": 2}, 5, "unknown option \"sensitivty\", did you mean \"sensitivity\"?"},
+	}
+
+	for _, test := range tests {
+		var problems []string
+		resolved := st.ResolveOptions(test.options, func(name string, err error) {
+			problems = append(problems, name+": "+err.Error())
+		})
+
+		if resolved.Int("sensitivity") != test.sensitivity {
+			t.Errorf("%v: expected sensitivity %d, got %v", test.options, test.sensitivity, resolved)
+		}
+
+		if problem := strings.Join(problems, "; "); !strings.Contains(problem, test.problem) || (test.problem == "" && problem != "") {
+			t.Errorf("%v: expected the problem \"%s\", got \"%s\"", test.options, test.problem, problem)
+		}
+	}
+}
+
+func TestParseConfigurationSensorOptions(t *testing.T) {
+	config, err := parseConfiguration([]byte(testConfigHeader+`sensors:
+  - sensortype: bme280
+    name: lounge
+    options:
+      pressureoversampling: 0
+      maxtemperature: 60
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if options := config.Sensors[0].Options; options["pressureoversampling"] != 0 || options["maxtemperature"] != 60 {
+		t.Errorf("expected the options of the sensor, got %v", options)
+	}
+}
+
+func TestNewSensorWithOptions(t *testing.T) {
+	UseSimulatedDevices()
+	defer func() { devices = HardwareDevices{} }()
+
+	config := &I2cConfiguration{}
+	sc := &SensorConfiguration{SensorType: "vl53l1x", Name: "options_hall", Options: SensorOptions{"occupancydistance": 0}}
+	s, err := NewSensor(sc, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm := NewSensorManagement(time.Second, time.Minute)
+	defer sm.Close()
+	sm.AddSensor(s, *sc)
+	sm.UpdateSensors()
+
+	if occupied, ok := sm.GetOccupancy(); !ok || occupied {
+		t.Errorf("expected the space to be empty with an occupancy distance of 0, got %t %t", occupied, ok)
+	}
+
+	sc = &SensorConfiguration{SensorType: "tmp117", Name: "options_study", Options: SensorOptions{"mintemperature": 50, "maxtemperature": 10}}
+	if _, err = NewSensor(sc, config); err == nil || !strings.Contains(err.Error(), "mintemperature 50 is not below maxtemperature 10") {
+		t.Errorf("expected the limits to be rejected, got %v", err)
+	}
+
+	sc = &SensorConfiguration{SensorType: "tmp117", Name: "options_study", Options: SensorOptions{"maxtemperature": "hot"}}
+	if _, err = NewSensor(sc, config); err == nil || !strings.Contains(err.Error(), "option \"maxtemperature\" of sensor \"options_study\"") {
+		t.Errorf("expected the option to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/drtimf/go-piicodev"
+)
+
+// serveOutputs are the OLED display, RGB LED and Lifx bulb of the service. They are opened and
+// closed as they are enabled and disabled in the configuration, including when it is reloaded.
+type serveOutputs struct {
+	mu      sync.Mutex
+	applied *I2cConfiguration
+
+	oled    *OLEDDisplay
+	oledBus int
+
+	// The LED is only driven by the lamp of the HomeKit bridge, which exists when lamp is set
+	led    RGBLEDDevice
+	ledBus int
+	lamp   bool
+
+	lbs     *LifxBulbState
+	bulb    *LifxBulb
+	lifxMAC string
+}
+
+func newServeOutputs(lamp bool) *serveOutputs {
+	return &serveOutputs{lamp: lamp}
+}
+
+// apply opens the outputs which are enabled and closes those which are not, reopening an output
+// whose bus has changed. An output which is already open is left as it is. A display or bulb
+// which cannot be found is logged, and tried again the next time the configuration is applied.
+func (o *serveOutputs) apply(config *I2cConfiguration) (err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	previous := o.applied
+	o.applied = config
+
+	if previous == nil || previous.EnableLifx != config.EnableLifx {
+		PrintState("Lifx bulb", config.EnableLifx)
+	}
+	o.applyLifx(config)
+
+	if previous == nil || previous.EnableOLED != config.EnableOLED {
+		PrintState("OLED display", config.EnableOLED)
+	}
+	o.applyOLED(config)
+
+	if previous == nil || previous.EnableLED != config.EnableLED {
+		PrintState("RGB LED", config.EnableLED)
+	}
+	return o.applyLED(config)
+}
+
+func (o *serveOutputs) applyLifx(config *I2cConfiguration) {
+	if !config.EnableLifx {
+		o.bulb = nil
+		return
+	}
+
+	if o.bulb != nil && o.lifxMAC == config.LifxMAC {
+		return
+	}
+
+	if o.lbs == nil {
+		o.lbs = NewLifxBulbState()
+		NewBulbLifxRouter(o.lbs)
+	} else if o.bulb == nil {
+		o.lbs.GetBulbs()
+	}
+
+	o.lifxMAC = config.LifxMAC
+
+	logLifx.Info("Looking for bulb", "mac", config.LifxMAC)
+	if o.bulb, _ = o.lbs.FindBulbByMAC(config.LifxMAC); o.bulb != nil {
+		logLifx.Info("Found bulb", "bulb", o.bulb.bulb.String())
+	} else {
+		logLifx.Warn("Bulb not found", "mac", config.LifxMAC)
+	}
+}
+
+func (o *serveOutputs) applyOLED(config *I2cConfiguration) {
+	if o.oled != nil && (!config.EnableOLED || o.oledBus != config.OLEDBusNumber()) {
+		if err := o.closeOLED(); err != nil {
+			logOLED.Error("Failed to clear display", "error", err)
+		}
+	}
+
+	if config.EnableOLED && o.oled == nil {
+		var err error
+		if o.oled, err = NewOLEDDisplay(config.OLEDBusNumber()); err != nil {
+			logOLED.Error("Failed to open display", "error", err)
+			o.oled = nil
+			return
+		}
+
+		o.oledBus = config.OLEDBusNumber()
+	}
+}
+
+func (o *serveOutputs) applyLED(config *I2cConfiguration) (err error) {
+	enabled := config.EnableLED && o.lamp
+
+	if o.led != nil && (!enabled || o.ledBus != config.LEDBusNumber()) {
+		if cerr := o.closeLED(); cerr != nil {
+			logMain.Error("Failed to turn off the RGB LED", "error", cerr)
+		}
+	}
+
+	if enabled && o.led == nil {
+		var led RGBLEDDevice
+		if led, err = devices.OpenRGBLED(piicodev.RGBLEDAddress, OnBus(config.LEDBusNumber())); err != nil {
+			return
+		}
+
+		led.SetBrightness(255)
+		led.EnablePowerLED(false)
+		o.led, o.ledBus = led, config.LEDBusNumber()
+	}
+
+	return
+}
+
+func (o *serveOutputs) closeOLED() (err error) {
+	defer o.oled.Close()
+	err = o.oled.Clear()
+	o.oled = nil
+	return
+}
+
+func (o *serveOutputs) closeLED() (err error) {
+	defer o.led.Close()
+	o.led.FillPixels(0, 0, 0)
+	err = o.led.Show()
+	o.led = nil
+	return
+}
+
+// setLamp shows the colour of the HomeKit lamp on the LED, if it is open
+func (o *serveOutputs) setLamp(hue, saturation float64, brightness int) (err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.led == nil {
+		return
+	}
+
+	red, green, blue := HSV2RGB(hue, float64(saturation)/100.0, float64(brightness)/100.0)
+	logHomeKit.Debug("Set lamp", "hue", hue, "saturation", saturation, "brightness", brightness,
+		"red", byte(red*255.0), "green", byte(green*255.0), "blue", byte(blue*255.0))
+
+	o.led.FillPixels(byte(red*255.0), byte(green*255.0), byte(blue*255.0))
+	return o.led.Show()
+}
+
+// current returns the display and bulb which are open, either of which may be nil
+func (o *serveOutputs) current() (oled *OLEDDisplay, bulb *LifxBulb) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.oled, o.bulb
+}
+
+// close turns off and closes the LED and display
+func (o *serveOutputs) close() (err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.led != nil {
+		err = o.closeLED()
+	}
+
+	if o.oled != nil {
+		if oerr := o.closeOLED(); oerr != nil && err == nil {
+			err = oerr
+		}
+	}
+
+	return
+}
@@ -3,19 +3,156 @@ package main
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// The collectors registered by the sensors by metric name, so that they can be unregistered when
+// a sensor is removed
+var sensorCollectors = struct {
+	sync.Mutex
+	byName map[string]prometheus.Collector
+}{byName: make(map[string]prometheus.Collector)}
+
+// The gauges of the sensors which SensorManagement sets once it has calibrated or filtered the
+// reading of the metric, by name of the gauge, with the name of the sensor
+var processedGauges = struct {
+	sync.RWMutex
+	byName map[string]string
+}{byName: make(map[string]string)}
+
+// setProcessedGauges marks the gauges of the metrics of the sensor which SensorManagement sets,
+// replacing those marked before for the sensor
+func setProcessedGauges(sensor string, metrics []string) {
+	processedGauges.Lock()
+	defer processedGauges.Unlock()
+
+	for name, owner := range processedGauges.byName {
+		if owner == sensor {
+			delete(processedGauges.byName, name)
+		}
+	}
+
+	for _, metric := range metrics {
+		processedGauges.byName[sensor+"_"+metric] = sensor
+	}
+}
+
+func isProcessedGauge(name string) bool {
+	processedGauges.RLock()
+	defer processedGauges.RUnlock()
+	_, ok := processedGauges.byName[name]
+	return ok
+}
+
+// sensorGauge is a gauge registered by a sensor, which ignores the raw value the sensor sets when
+// SensorManagement sets the processed value instead
+type sensorGauge struct {
+	prometheus.Gauge
+	name string
+}
+
+func (g *sensorGauge) Set(value float64) {
+	if !isProcessedGauge(g.name) {
+		g.Gauge.Set(value)
+	}
+}
+
+// setProcessedGauge sets the gauge registered by a sensor to the processed value of its metric
+func setProcessedGauge(name string, value float64) {
+	sensorCollectors.Lock()
+	c := sensorCollectors.byName[name]
+	sensorCollectors.Unlock()
+
+	if g, ok := c.(*sensorGauge); ok {
+		g.Gauge.Set(value)
+	}
+}
+
+// registerGauge registers a gauge with Prometheus. When a sensor is opened again the gauge which
+// was registered by the previous instance is returned so that it keeps its value.
+func registerGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	var g prometheus.Gauge = &sensorGauge{Gauge: prometheus.NewGauge(opts), name: opts.Name}
+	if err := prometheus.Register(g); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(prometheus.Gauge)
+		}
+		panic(err)
+	}
+
+	addSensorCollector(opts.Name, g)
+	return g
+}
+
+// registerCounter registers a counter with Prometheus in the same way as registerGauge
+func registerCounter(opts prometheus.CounterOpts) prometheus.Counter {
+	c := prometheus.NewCounter(opts)
+	if err := prometheus.Register(c); err != nil {
+		if are, ok := err.(prometheus.AlreadyRegisteredError); ok {
+			return are.ExistingCollector.(prometheus.Counter)
+		}
+		panic(err)
+	}
+
+	addSensorCollector(opts.Name, c)
+	return c
+}
+
+func addSensorCollector(name string, c prometheus.Collector) {
+	sensorCollectors.Lock()
+	defer sensorCollectors.Unlock()
+	sensorCollectors.byName[name] = c
+}
+
+// unregisterSensorCollector unregisters a single metric of a sensor
+func unregisterSensorCollector(name string) {
+	sensorCollectors.Lock()
+	defer sensorCollectors.Unlock()
+
+	if c, ok := sensorCollectors.byName[name]; ok {
+		prometheus.Unregister(c)
+		delete(sensorCollectors.byName, name)
+	}
+}
+
+// unregisterSensorCollectors unregisters the metrics of a sensor, which are named after it. A
+// metric of one of the other sensors whose name begins with the name of the sensor is kept.
+func unregisterSensorCollectors(sensor string, others []string) {
+	sensorCollectors.Lock()
+	defer sensorCollectors.Unlock()
+
+	for name, c := range sensorCollectors.byName {
+		if !strings.HasPrefix(name, sensor+"_") {
+			continue
+		}
+
+		owned := false
+		for _, other := range others {
+			if len(other) > len(sensor) && strings.HasPrefix(name, other+"_") {
+				owned = true
+			}
+		}
+
+		if !owned {
+			prometheus.Unregister(c)
+			delete(sensorCollectors.byName, name)
+		}
+	}
+}
+
 type PrometheusSensors struct {
 	wdHDPrice [hdTypeCapacitySize]prometheus.Gauge
+	server    *http.Server
 }
 
-func PrometheusStart(ctx context.Context) (p *PrometheusSensors) {
+// PrometheusStart registers the metrics handler and starts the HTTP server, which also serves the
+// web UI and API, on the address until Shutdown
+func PrometheusStart(address string) (p *PrometheusSensors) {
 	p = &PrometheusSensors{}
 
 	p.wdHDPrice[external14TB] = promauto.NewGauge(prometheus.GaugeOpts{
@@ -60,32 +197,27 @@ func PrometheusStart(ctx context.Context) (p *PrometheusSensors) {
 		Help: "The current Western Digital HD Price for Red 22TB",
 	})
 
-	server := &http.Server{
-		Addr: ":2112",
+	p.server = &http.Server{
+		Addr: address,
 	}
 
 	http.Handle("/metrics", promhttp.Handler())
 
 	go func() {
-		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-			fmt.Println("Prometheus HTTP server error: ", err)
-		}
-		fmt.Println("Prometheus HTTP server shutdown")
-	}()
-
-	go func() {
-		select {
-		case <-ctx.Done():
-			if err := server.Shutdown(ctx); err != nil {
-				fmt.Println("Prometheus HTTP server shutdown error: ", err)
-			}
-			return
+		if err := p.server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			logHTTP.Error("Server failed", "address", p.server.Addr, "error", err)
 		}
+		logHTTP.Info("Server shutdown")
 	}()
 
 	return
 }
 
+// Shutdown stops the HTTP server once the requests in progress have finished
+func (p *PrometheusSensors) Shutdown(ctx context.Context) error {
+	return p.server.Shutdown(ctx)
+}
+
 func (p *PrometheusSensors) SetWesternDigitalHDPrice(wd *WesternDigitalDiskPrices) {
 	if wd != nil {
 		var hdtc hdTypeCapacity = 0
@@ -1,9 +1,12 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"strconv"
 	"strings"
 
+	"github.com/brutella/hap/accessory"
 	"github.com/skip2/go-qrcode"
 )
 
@@ -48,3 +51,20 @@ func GenCLIQRCode(xhm string) (qr string, err error) {
 	qr = q.ToString(false)
 	return
 }
+
+// FormatSetupCode formats the pin as the HomeKit setup code, such as 123-44-321
+func FormatSetupCode(pin uint32) string {
+	code := fmt.Sprintf("%08d", pin)
+	return code[:3] + "-" + code[3:5] + "-" + code[5:]
+}
+
+// WriteHomeKitPairing writes the QR code and setup code which pair the bridge with the Home app
+func WriteHomeKitPairing(w io.Writer, deviceID string, pin uint32) (err error) {
+	var qr string
+	if qr, err = GenCLIQRCode(CreateXHMUrl(accessory.TypeBridge, HAP_TYPE_IP, pin, deviceID)); err != nil {
+		return
+	}
+
+	_, err = fmt.Fprintf(w, "%s\nSetup code: %s\n", qr, FormatSetupCode(pin))
+	return
+}
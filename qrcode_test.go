@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCreateXHMUrl(t *testing.T) {
+	tests := []struct {
+		category byte
+		hapType  int
+		pin      uint32
+		setupID  string
+		expected string
+	}{
+		{ACCESSORY_CATEGORY_BRIDGES, HAP_TYPE_IP, 12344321, "TF0X", "X-HM://0023OA51DTF0X"},
+		{ACCESSORY_CATEGORY_BRIDGES, HAP_TYPE_BLE, 11122333, "ABCD", "X-HM://00283DG9PABCD"},
+		{5, HAP_TYPE_IP_WAC, 87654321, "ZZ00", "X-HM://005L82E29ZZ00"},
+		{ACCESSORY_CATEGORY_BRIDGES, HAP_TYPE_IP, 0, "", "X-HM://0023GXK3K"},
+	}
+
+	for _, test := range tests {
+		if xhm := CreateXHMUrl(test.category, test.hapType, test.pin, test.setupID); xhm != test.expected {
+			t.Errorf("CreateXHMUrl(%d, %d, %d, %q) = %q, expected %q", test.category, test.hapType, test.pin, test.setupID, xhm, test.expected)
+		}
+	}
+}
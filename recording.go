@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The directory of the recording when it is not configured
+const DefaultRecordingDir = "recording"
+
+// The layout of the date in the name of each day's recording file
+const recordingFileDate = "2006-01-02"
+
+// RecordedReading is a line of the recording, and a row of an export
+type RecordedReading struct {
+	Time   time.Time `json:"time"`
+	Sensor string    `json:"sensor"`
+	Type   string    `json:"type"`
+	Metric string    `json:"metric"`
+	Value  float64   `json:"value"`
+	Unit   string    `json:"unit"`
+}
+
+// Recording appends every new reading to a file of newline delimited JSON for each UTC day, which
+// is kept until it is deleted by hand so that the raw data can be exported for any time range
+type Recording struct {
+	dir string
+
+	mu   sync.Mutex
+	f    *os.File
+	day  string
+	last map[string]time.Time
+}
+
+func OpenRecording(dir string) (rec *Recording, err error) {
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create recording directory \"%s\": %v", dir, err)
+	}
+
+	return &Recording{dir: dir, last: make(map[string]time.Time)}, nil
+}
+
+func recordingFileName(day string) string {
+	return "readings-" + day + ".ndjson"
+}
+
+// Record appends a reading of a sensor. Readings which have not been taken yet or are no newer
+// than the last reading of the same metric of the sensor are ignored.
+func (rec *Recording) Record(sensor, sensorType string, r Reading) (err error) {
+	if r.Time.IsZero() || math.IsNaN(r.Value) || math.IsInf(r.Value, 0) {
+		return
+	}
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	key := sensor + "/" + r.Metric
+	if !r.Time.After(rec.last[key]) {
+		return
+	}
+
+	day := r.Time.UTC().Format(recordingFileDate)
+	if rec.f == nil || day != rec.day {
+		if rec.f != nil {
+			rec.f.Close()
+			rec.f = nil
+		}
+
+		if rec.f, err = os.OpenFile(filepath.Join(rec.dir, recordingFileName(day)), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+			return fmt.Errorf("failed to open the recording: %v", err)
+		}
+		rec.day = day
+	}
+
+	var line []byte
+	if line, err = json.Marshal(RecordedReading{
+		Time:   r.Time.UTC(),
+		Sensor: sensor,
+		Type:   sensorType,
+		Metric: r.Metric,
+		Value:  r.Value,
+		Unit:   r.Unit,
+	}); err != nil {
+		return
+	}
+
+	if _, err = rec.f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write to the recording: %v", err)
+	}
+
+	rec.last[key] = r.Time
+	return
+}
+
+// Dir is the directory of the recording files
+func (rec *Recording) Dir() string {
+	return rec.dir
+}
+
+func (rec *Recording) Close() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.f != nil {
+		rec.f.Close()
+		rec.f = nil
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// The number of consecutive failed updates after which a sensor is closed and opened again
+const SensorReopenAfter = SensorFailedAfter
+
+// The time to wait before retrying to open a sensor, doubling after each failure up to the maximum
+const (
+	SensorOpenMinBackoff = 5 * time.Second
+	SensorOpenMaxBackoff = 5 * time.Minute
+)
+
+// SensorFactory creates a sensor. It is called again to reopen the device after the sensor has failed.
+type SensorFactory func() (Sensor, error)
+
+// SensorCloser is implemented by sensors which hold a device or goroutine that must be released
+// before the sensor can be opened again
+type SensorCloser interface {
+	Close()
+}
+
+// OpenSensor adds a sensor created by a factory. If the factory fails the sensor is still added
+// and opening it is retried with backoff once the sensors are started.
+func (sm *SensorManagement) OpenSensor(sc SensorConfiguration, factory SensorFactory) (err error) {
+	ms := sm.newManagedSensor(sc)
+	ms.factory = factory
+
+	if ms.sensor, err = factory(); err != nil {
+		ms.sensor = nil
+		ms.openFailures = 1
+	}
+
+	sm.addManagedSensor(ms, err)
+	if err != nil {
+		sm.recordOpenFailure(ms, err)
+	}
+	return
+}
+
+func (ms *managedSensor) isOpen() bool {
+	ms.updating.Lock()
+	defer ms.updating.Unlock()
+	return ms.sensor != nil
+}
+
+func (ms *managedSensor) openBackoff() (backoff time.Duration) {
+	ms.updating.Lock()
+	defer ms.updating.Unlock()
+
+	backoff = SensorOpenMinBackoff
+	for i := 1; i < ms.openFailures && backoff < SensorOpenMaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > SensorOpenMaxBackoff {
+		backoff = SensorOpenMaxBackoff
+	}
+
+	return
+}
+
+// openSensor tries to create the sensor again from its factory
+func (sm *SensorManagement) openSensor(ms *managedSensor) (err error) {
+	if ms.factory == nil {
+		return fmt.Errorf("sensor \"%s\" cannot be reopened", ms.config.Name)
+	}
+
+	ms.updating.Lock()
+	var s Sensor
+	if s, err = ms.factory(); err != nil {
+		ms.openFailures++
+		logSensors.Error("Failed to open sensor", "sensor", ms.config.Name, "attempt", ms.openFailures, "error", err)
+	} else {
+		ms.sensor = s
+		ms.openFailures = 0
+		logSensors.Info("Opened sensor", "sensor", ms.config.Name)
+	}
+	ms.updating.Unlock()
+
+	if err == nil {
+		sm.updateSensor(ms)
+	} else {
+		sm.recordOpenFailure(ms, err)
+	}
+
+	return
+}
+
+// recordOpenFailure counts a failed open in the health of the sensor, so that a sensor which
+// cannot be opened is degraded and then failed in the same way as one which cannot be updated
+func (sm *SensorManagement) recordOpenFailure(ms *managedSensor, err error) {
+	previous := ms.getSnapshot()
+
+	ms.mu.Lock()
+	ms.snapshot.Error = RedactSecrets(err.Error())
+	ms.snapshot.Health.recordUpdate(err, time.Now())
+	ms.mu.Unlock()
+
+	current := ms.getSnapshot()
+	publishSensorHealth(&current)
+	logHealthTransition(&previous, &current)
+}
+
+// closeSensor releases the device of a sensor so that it can be opened again
+func (sm *SensorManagement) closeSensor(ms *managedSensor) {
+	ms.updating.Lock()
+	defer ms.updating.Unlock()
+
+	if sc, ok := ms.sensor.(SensorCloser); ok {
+		sc.Close()
+	}
+
+	ms.sensor = nil
+	ms.openFailures = 1
+}
+
+func logHealthTransition(previous, current *SensorSnapshot) {
+	if !previous.Updated.IsZero() && previous.Health.State != current.Health.State {
+		log := logSensors.Warn
+		if current.Health.State == HealthHealthy {
+			log = logSensors.Info
+		}
+		log("Sensor health changed", "sensor", current.Name, "state", current.Health.State, "previous", previous.Health.State)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// SensorConfigField describes a key of a sensors entry in the configuration which a sensor type
+// uses. A secret key is redacted wherever the configuration is shown.
+type SensorConfigField struct {
+	Name        string
+	Required    bool
+	Secret      bool
+	Description string
+}
+
+var i2cAddressField = SensorConfigField{Name: "i2caddress", Description: "I2C address of the device"}
+var i2cBusField = SensorConfigField{Name: "i2cbus", Description: "I2C bus number of the device"}
+var multiplexerField = SensorConfigField{Name: "multiplexer", Description: "name of the multiplexer the device is behind"}
+var muxChannelField = SensorConfigField{Name: "muxchannel", Description: "multiplexer channel of the device"}
+
+// The keys of the sensors on the I2C bus
+var i2cFields = []SensorConfigField{i2cAddressField, i2cBusField, multiplexerField, muxChannelField}
+
+// The options of the temperature sensors, whose readings outside the limits are rejected by the
+// filter of the temperature, unless the filter sets its own min or max
+var temperatureLimitOptions = []SensorOption{
+	{Name: "mintemperature", Default: DefaultTemperatureLimits.Min, Description: "lowest plausible temperature in degrees Celsius"},
+	{Name: "maxtemperature", Default: DefaultTemperatureLimits.Max, Description: "highest plausible temperature in degrees Celsius"},
+}
+
+// NewSensorFunc creates a sensor from its entry in the configuration
+type NewSensorFunc func(sc *SensorConfiguration, config *I2cConfiguration) (Sensor, error)
+
+// SensorType is registered by each sensor implementation so that it can be created by name from the configuration
+type SensorType struct {
+	Name           string
+	Description    string
+	DefaultAddress uint8
+	Fields         []SensorConfigField
+	Options        []SensorOption
+	New            NewSensorFunc
+
+	// Other addresses the device can be set to and a check of its ID registers, used by the bus scan.
+	// Identify is nil for devices without an ID register, which the scan recognises by address alone.
+	AlternateAddresses []uint8
+	Identify           IdentifyFunc
+}
+
+var sensorTypes = make(map[string]*SensorType)
+
+// RegisterSensorType makes a sensor type available to the configuration. It is intended to be called
+// from the init function of the file implementing the sensor and panics if the name is already taken.
+func RegisterSensorType(st *SensorType) {
+	if st.Name == "" || st.New == nil {
+		panic("sensor type registered without a name or constructor")
+	}
+
+	if _, exists := sensorTypes[st.Name]; exists {
+		panic(fmt.Sprintf("sensor type \"%s\" registered twice", st.Name))
+	}
+
+	sensorTypes[st.Name] = st
+}
+
+func LookupSensorType(name string) (st *SensorType, err error) {
+	var ok bool
+	if st, ok = sensorTypes[name]; !ok {
+		err = fmt.Errorf("unknown sensor type \"%s\"", name)
+	}
+
+	return
+}
+
+// SensorTypes returns the registered sensor types ordered by name
+func SensorTypes() (types []*SensorType) {
+	types = make([]*SensorType, 0, len(sensorTypes))
+	for _, st := range sensorTypes {
+		types = append(types, st)
+	}
+
+	sort.Slice(types, func(i, j int) bool { return types[i].Name < types[j].Name })
+	return
+}
+
+func sensorConfigValue(sc *SensorConfiguration, field string) string {
+	switch field {
+	case "i2caddress":
+		if sc.I2CAddress == 0 {
+			return ""
+		}
+		return fmt.Sprintf("0x%02x", sc.I2CAddress)
+	case "i2cbus":
+		if sc.I2CBus == nil {
+			return ""
+		}
+		return fmt.Sprint(*sc.I2CBus)
+	case "multiplexer":
+		return sc.Multiplexer
+	case "muxchannel":
+		if sc.Multiplexer == "" {
+			return ""
+		}
+		return fmt.Sprint(sc.MuxChannel)
+	case "server":
+		return sc.Server
+	case "devicetype":
+		return sc.DeviceType
+	case "serial":
+		return sc.Serial
+	case "password":
+		return sc.Password
+	}
+
+	return ""
+}
+
+// NewSensor creates the sensor described by a sensors entry in the configuration
+func NewSensor(sc *SensorConfiguration, config *I2cConfiguration) (s Sensor, err error) {
+	var st *SensorType
+	if st, err = checkSensorConfiguration(sc); err != nil {
+		return
+	}
+
+	resolved := *sc
+	resolved.Options = st.ResolveOptions(sc.Options, func(name string, oerr error) {
+		if err == nil {
+			err = fmt.Errorf("option \"%s\" of sensor \"%s\": %v", name, sc.Name, oerr)
+		}
+	})
+	if err != nil {
+		return
+	}
+
+	return st.New(&resolved, config)
+}
+
+// resolvedOptions returns every option of the type of the sensor with the value given or its
+// default, leaving out those which are not valid, as NewSensor has already rejected them
+func resolvedOptions(sc *SensorConfiguration) SensorOptions {
+	st, err := LookupSensorType(sc.SensorType)
+	if err != nil {
+		return nil
+	}
+	return st.ResolveOptions(sc.Options, func(string, error) {})
+}
+
+// checkSensorConfiguration returns the type of the sensor after checking that it is known and
+// that the sensor has the keys the type requires
+func checkSensorConfiguration(sc *SensorConfiguration) (st *SensorType, err error) {
+	if st, err = LookupSensorType(sc.SensorType); err != nil {
+		return
+	}
+
+	for _, f := range st.Fields {
+		if f.Required && sensorConfigValue(sc, f.Name) == "" {
+			err = fmt.Errorf("sensor \"%s\" of type \"%s\" requires \"%s\"", sc.Name, sc.SensorType, f.Name)
+			return
+		}
+	}
+
+	return
+}
+
+// PrintSensorTypes writes a table of the registered sensor types with their configuration keys
+// and options
+func PrintSensorTypes(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tADDRESS\tDESCRIPTION\tKEYS\tOPTIONS")
+
+	for _, st := range SensorTypes() {
+		address := "-"
+		if st.DefaultAddress != 0 {
+			address = fmt.Sprintf("0x%02x", st.DefaultAddress)
+		}
+
+		keys := make([]string, 0, len(st.Fields))
+		for _, f := range st.Fields {
+			if f.Required {
+				keys = append(keys, f.Name+" (required)")
+			} else {
+				keys = append(keys, f.Name)
+			}
+		}
+
+		options := make([]string, 0, len(st.Options))
+		for i := range st.Options {
+			options = append(options, st.Options[i].String())
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", st.Name, address, st.Description, strings.Join(keys, ", "), strings.Join(options, ", "))
+	}
+
+	tw.Flush()
+}
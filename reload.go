@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// The time between checks for changes to the configuration file when watchconfig is set
+const ConfigWatchInterval = 5 * time.Second
+
+// configReloader applies a new configuration to the running service. The sensors, sample time,
+// stale age, logging and outputs change straight away, while the settings of the HomeKit bridge,
+// HTTP server and storage are only logged as needing a restart.
+type configReloader struct {
+	mu      sync.RWMutex
+	config  *I2cConfiguration
+	sm      *SensorManagement
+	outputs *serveOutputs
+	homeKit homeKitAccessories
+}
+
+// homeKitAccessories are the accessories of the HomeKit bridge, which are fixed when it starts
+type homeKitAccessories struct {
+	temperature, lightLevel, occupancy bool
+}
+
+func sensorAccessories(sm *SensorManagement) (hka homeKitAccessories) {
+	_, hka.temperature = sm.GetTemperature()
+	_, hka.lightLevel = sm.GetLightLevel()
+	_, hka.occupancy = sm.GetOccupancy()
+	return
+}
+
+// Reload loads the configuration file again and applies it. When the file cannot be loaded or is
+// not valid the error is returned and nothing is changed.
+func (r *configReloader) Reload() (err error) {
+	if r.config.path == "" {
+		return errors.New("the configuration was not loaded from a file")
+	}
+
+	var config *I2cConfiguration
+	if config, err = LoadConfiguration(r.config.path); err != nil {
+		return
+	}
+
+	r.apply(config)
+	return
+}
+
+// Configuration returns the configuration the service is running with
+func (r *configReloader) Configuration() *I2cConfiguration {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.config
+}
+
+// apply changes the running service to the configuration, which must be valid
+func (r *configReloader) apply(config *I2cConfiguration) {
+	r.mu.Lock()
+	previous := r.config
+	r.config = config
+	r.mu.Unlock()
+
+	for _, setting := range restartSettings(previous, config, r.outputs.lamp) {
+		logMain.Warn("Setting changed, restart to apply it", "setting", setting)
+	}
+
+	if !reflect.DeepEqual(previous.Logging, config.Logging) || previous.DebugOutput != config.DebugOutput {
+		if err := ConfigureLogging(config.Logging, config.DebugOutput); err != nil {
+			logMain.Error("Failed to configure logging", "error", err)
+		}
+	}
+
+	r.sm.Reconfigure(previous, config)
+
+	if hka := sensorAccessories(r.sm); hka != r.homeKit {
+		logHomeKit.Warn("The sensors have changed, restart to change the accessories of the bridge")
+	}
+
+	if err := r.outputs.apply(config); err != nil {
+		logMain.Error("Failed to open the RGB LED", "error", err)
+	}
+
+	logMain.Info("Configuration reloaded", "path", config.path, "sensors", len(config.Sensors))
+}
+
+// restartSettings returns the keys of the settings which have changed but only take effect when
+// the service is restarted
+func restartSettings(previous, config *I2cConfiguration, lamp bool) (changed []string) {
+	settings := []struct {
+		key               string
+		previous, current interface{}
+	}{
+		{"homekitdeviceid", previous.HomeKitDeviceID, config.HomeKitDeviceID},
+		{"homekitdevicepin", previous.HomeKitDevicePin, config.HomeKitDevicePin},
+		{"homekitbridgename", previous.HomeKitBridgeName, config.HomeKitBridgeName},
+		{"homekitderived", previous.HomeKitDerived, config.HomeKitDerived},
+		{"listenaddress", previous.HTTPAddress(), config.HTTPAddress()},
+		{"enablehdprice", previous.EnableHDPrice, config.EnableHDPrice},
+		{"enablehistory", previous.EnableHistory, config.EnableHistory},
+		{"history", previous.History, config.History},
+		{"enablerecording", previous.EnableRecording, config.EnableRecording},
+		{"recordingdir", previous.RecordingDirectory(), config.RecordingDirectory()},
+		{"statsfile", previous.StatsPath(), config.StatsPath()},
+		{"simulate", previous.Simulate, config.Simulate},
+	}
+
+	for _, s := range settings {
+		if !reflect.DeepEqual(s.previous, s.current) {
+			changed = append(changed, s.key)
+		}
+	}
+
+	// The LED shows the lamp of the HomeKit bridge, which is only added when the bridge starts
+	if config.EnableLED && !lamp {
+		changed = append(changed, "enableled")
+	}
+
+	return
+}
+
+// Reconfigure changes the sensors to those of the new configuration. Sensors which are no longer
+// configured are removed, new sensors are opened and polled straight away, and sensors whose
+// device has changed are closed and opened again. The others are kept open with their new
+// interval, stale age, calibration and filters.
+func (sm *SensorManagement) Reconfigure(previous, config *I2cConfiguration) {
+	defaultStaleAfter := config.StaleAfter
+	if defaultStaleAfter <= 0 {
+		defaultStaleAfter = DefaultStaleAfter
+	}
+
+	sm.mu.Lock()
+	sm.defaultInterval = config.SamplePeriod()
+	sm.defaultStaleAfter = defaultStaleAfter
+	sm.mu.Unlock()
+
+	var names []string
+	for i := range config.Sensors {
+		names = append(names, config.Sensors[i].Name)
+	}
+
+	for _, ms := range sm.managedSensors() {
+		if !containsString(names, ms.config.Name) {
+			logSensors.Info("Removing sensor", "sensor", ms.config.Name)
+			sm.RemoveSensor(ms.config.Name)
+		}
+	}
+
+	for i := range config.Sensors {
+		sc := &config.Sensors[i]
+
+		ms := sm.managedSensor(sc.Name)
+		if psc := previous.sensorConfiguration(sc.Name); ms != nil && psc != nil && sameDevice(previous, config, psc, sc) {
+			sm.retime(ms, *sc)
+			if !reflect.DeepEqual(psc.Calibration, sc.Calibration) || !reflect.DeepEqual(psc.Filters, sc.Filters) {
+				logSensors.Info("Changing the calibration and filters of the sensor", "sensor", sc.Name)
+				ms.setProcessing(sc)
+			}
+			continue
+		}
+
+		if ms != nil {
+			logSensors.Info("Reopening sensor with its new configuration", "sensor", sc.Name)
+			sm.detachSensor(ms)
+		} else {
+			logSensors.Info("Adding sensor", "sensor", sc.Name, "type", sc.SensorType)
+		}
+
+		if err := sm.OpenSensor(*sc, func() (Sensor, error) { return NewSensor(sc, config) }); err != nil {
+			logSensors.Error("Failed to open sensor, retrying in the background", "sensor", sc.Name, "type", sc.SensorType, "error", err)
+		}
+	}
+
+	sm.orderSensors(names)
+	sm.SetRooms(config.Rooms, config.HomeRoom)
+}
+
+// sensorConfiguration returns the entry of the named sensor, or nil when there is none
+func (c *I2cConfiguration) sensorConfiguration(name string) *SensorConfiguration {
+	for i := range c.Sensors {
+		if c.Sensors[i].Name == name {
+			return &c.Sensors[i]
+		}
+	}
+	return nil
+}
+
+// sameDevice is true when the entries of the sensor in both configurations open the same device in
+// the same way, on the same bus. The interval, stale age, calibration and filters can change
+// without opening the device again.
+func sameDevice(previous, config *I2cConfiguration, psc, sc *SensorConfiguration) bool {
+	if psc.SensorType != sc.SensorType || psc.I2CAddress != sc.I2CAddress || psc.Multiplexer != sc.Multiplexer ||
+		psc.MuxChannel != sc.MuxChannel || psc.Server != sc.Server || psc.DeviceType != sc.DeviceType ||
+		psc.Serial != sc.Serial || psc.Password != sc.Password || !reflect.DeepEqual(psc.Options, sc.Options) {
+		return false
+	}
+
+	pbus, perr := previous.SensorBus(psc)
+	bus, err := config.SensorBus(sc)
+	return perr == nil && err == nil && pbus == bus
+}
+
+// watchConfiguration sends to changed whenever the modification time or size of the file changes,
+// checking every interval until the context is cancelled
+func watchConfiguration(ctx context.Context, path string, interval time.Duration, changed chan<- struct{}) {
+	var modTime time.Time
+	var size int64
+	if fi, err := os.Stat(path); err == nil {
+		modTime, size = fi.ModTime(), fi.Size()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil || (fi.ModTime().Equal(modTime) && fi.Size() == size) {
+			continue
+		}
+
+		modTime, size = fi.ModTime(), fi.Size()
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const reloadTestConfig = `
+homekitdeviceid: TF0X
+homekitdevicepin: 12344321
+sampletime: 1
+sensors:
+  - sensortype: tmp117
+    name: reload_study
+  - sensortype: aht10
+    name: reload_hall
+`
+
+func registeredMetric(t *testing.T, name string) bool {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range families {
+		if mf.GetName() == name {
+			return true
+		}
+	}
+	return false
+}
+
+func sensorNames(sm *SensorManagement) (names []string) {
+	for _, ss := range sm.Snapshots() {
+		names = append(names, ss.Name)
+	}
+	return
+}
+
+// startReloadTest starts the sensors of the configuration file as serve does
+func startReloadTest(t *testing.T, path string) (r *configReloader, stop func()) {
+	UseSimulatedDevices()
+
+	config, err := LoadConfiguration(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sm := NewSensorManagement(config.SamplePeriod(), config.StaleAfter)
+	for i := range config.Sensors {
+		sc := &config.Sensors[i]
+		if err = sm.OpenSensor(*sc, func() (Sensor, error) { return NewSensor(sc, config) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sm.Start(ctx)
+
+	r = &configReloader{config: config, sm: sm, outputs: newServeOutputs(false), homeKit: sensorAccessories(sm)}
+	return r, func() {
+		cancel()
+		sm.Wait(context.Background())
+		sm.Close()
+		devices = HardwareDevices{}
+	}
+}
+
+func TestReloadSensors(t *testing.T) {
+	path := writeTestConfig(t, reloadTestConfig)
+	r, stop := startReloadTest(t, path)
+	defer stop()
+
+	study := r.sm.managedSensor("reload_study")
+	if !registeredMetric(t, "reload_hall_temperature") {
+		t.Fatal("the metrics of the sensor are not registered")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`
+homekitdeviceid: TF0X
+homekitdevicepin: 12344321
+sampletime: 2
+sensors:
+  - sensortype: ms5637
+    name: reload_lounge
+  - sensortype: tmp117
+    name: reload_study
+    interval: 1h
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := sensorNames(r.sm); !reflect.DeepEqual(names, []string{"reload_lounge", "reload_study"}) {
+		t.Errorf("expected the sensors of the new configuration in order, got %v", names)
+	}
+
+	if r.sm.managedSensor("reload_study") != study {
+		t.Error("the sensor was reopened when only its interval changed")
+	}
+
+	if interval := study.getInterval(); interval != time.Hour {
+		t.Errorf("expected the new interval of 1h, got %s", interval)
+	}
+
+	if registeredMetric(t, "reload_hall_temperature") || registeredMetric(t, "reload_hall_humidity") {
+		t.Error("the metrics of the removed sensor are still registered")
+	}
+
+	if !registeredMetric(t, "reload_lounge_pressure") {
+		t.Error("the metrics of the added sensor are not registered")
+	}
+
+	if ms := r.sm.managedSensor("reload_lounge"); ms.getInterval() != 2*time.Second {
+		t.Errorf("expected the added sensor to use the new sample time, got %s", ms.getInterval())
+	}
+
+	// A sensor whose entry changes is opened again, and a new sensor is polled straight away
+	time.Sleep(100 * time.Millisecond)
+	if ss, _ := r.sm.Snapshot("reload_lounge"); ss.Updated.IsZero() {
+		t.Error("the added sensor has not been updated")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`
+homekitdeviceid: TF0X
+homekitdevicepin: 12344321
+sensors:
+  - sensortype: tmp117
+    name: reload_study
+    i2caddress: 0x49
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.sm.managedSensor("reload_study") == study {
+		t.Error("the sensor was not reopened when its address changed")
+	}
+}
+
+func TestReloadCalibrationKeepsSensorOpen(t *testing.T) {
+	path := writeTestConfig(t, reloadTestConfig)
+	r, stop := startReloadTest(t, path)
+	defer stop()
+
+	study := r.sm.managedSensor("reload_study")
+
+	if err := ioutil.WriteFile(path, []byte(reloadTestConfig+`    calibration:
+      humidity:
+        offset: 2
+    filters:
+      humidity:
+        ema: 0.5
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	hall := r.sm.managedSensor("reload_hall")
+	if r.sm.managedSensor("reload_study") != study || !hall.isOpen() {
+		t.Error("a sensor was reopened when only the calibration and filters changed")
+	}
+
+	if !registeredMetric(t, "reload_hall_humidity_raw") || !isProcessedGauge("reload_hall_humidity") {
+		t.Error("the new calibration of the sensor is not applied")
+	}
+
+	if err := ioutil.WriteFile(path, []byte(reloadTestConfig), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if r.sm.managedSensor("reload_hall") != hall {
+		t.Error("the sensor was reopened when its calibration was removed")
+	}
+
+	if registeredMetric(t, "reload_hall_humidity_raw") {
+		t.Error("the removed calibration of the sensor is still applied")
+	}
+}
+
+func TestReloadRejectsInvalidConfiguration(t *testing.T) {
+	path := writeTestConfig(t, reloadTestConfig)
+	r, stop := startReloadTest(t, path)
+	defer stop()
+
+	config := r.config
+	if err := ioutil.WriteFile(path, []byte(`
+homekitdeviceid: TF0X
+homekitdevicepin: 12344321
+sampletime: 10
+sensors:
+  - sensortype: tmp117
+    name: reload_study
+  - sensortype: thermometer
+    name: reload_attic
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Reload(); err == nil {
+		t.Fatal("expected the reload of an invalid configuration to be rejected")
+	}
+
+	if r.config != config {
+		t.Error("the configuration was replaced by the rejected configuration")
+	}
+
+	if names := sensorNames(r.sm); !reflect.DeepEqual(names, []string{"reload_study", "reload_hall"}) {
+		t.Errorf("expected the sensors to be unchanged, got %v", names)
+	}
+
+	if interval := r.sm.managedSensor("reload_study").getInterval(); interval != time.Second {
+		t.Errorf("expected the interval to be unchanged, got %s", interval)
+	}
+}
+
+func TestRestartSettings(t *testing.T) {
+	previous := &I2cConfiguration{HomeKitBridgeName: "Bridge", SampleTime: 5}
+	config := &I2cConfiguration{HomeKitBridgeName: "New Bridge", SampleTime: 10, EnableLED: true, ListenAddress: ":2112"}
+
+	if changed := restartSettings(previous, config, false); !reflect.DeepEqual(changed, []string{"homekitbridgename", "enableled"}) {
+		t.Errorf("expected the bridge name and LED to need a restart, got %v", changed)
+	}
+
+	if changed := restartSettings(previous, previous, false); len(changed) != 0 {
+		t.Errorf("expected no settings to need a restart, got %v", changed)
+	}
+}
+
+func TestUnregisterSensorCollectors(t *testing.T) {
+	registerGauge(prometheus.GaugeOpts{Name: "unreg_temperature", Help: "test"})
+	registerGauge(prometheus.GaugeOpts{Name: "unreg_attic_temperature", Help: "test"})
+
+	unregisterSensorCollectors("unreg", []string{"unreg_attic"})
+
+	if registeredMetric(t, "unreg_temperature") {
+		t.Error("the metric of the sensor is still registered")
+	}
+
+	if !registeredMetric(t, "unreg_attic_temperature") {
+		t.Error("the metric of the other sensor was unregistered")
+	}
+
+	unregisterSensorCollectors("unreg_attic", nil)
+}
+
+func TestWatchConfiguration(t *testing.T) {
+	path := writeTestConfig(t, reloadTestConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	changed := make(chan struct{}, 1)
+	go watchConfiguration(ctx, path, 10*time.Millisecond, changed)
+
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-changed:
+		t.Fatal("a change was reported before the file changed")
+	default:
+	}
+
+	if err := ioutil.WriteFile(path, []byte(reloadTestConfig+"watchconfig: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Error("the change to the file was not reported")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// The policies which combine the readings of the sensors of a room into the value of the room
+const (
+	PolicyPrimary  = "primary"
+	PolicyMean     = "mean"
+	PolicyMedian   = "median"
+	PolicyMin      = "min"
+	PolicyMax      = "max"
+	PolicyFreshest = "freshest"
+)
+
+var RoomPolicies = []string{PolicyPrimary, PolicyMean, PolicyMedian, PolicyMin, PolicyMax, PolicyFreshest}
+
+// RoomConfiguration is a room or zone whose value of each metric is combined from the readings of
+// its sensors by its policy, or by the policy set for the metric. The primary policy takes the
+// first sensor in the list with a reading which is not stale.
+type RoomConfiguration struct {
+	Name     string
+	Sensors  []string
+	Policy   string
+	Policies map[string]string
+}
+
+// PolicyOf returns the policy which combines the readings of the metric
+func (rc *RoomConfiguration) PolicyOf(metric string) string {
+	if policy, ok := rc.Policies[metric]; ok && policy != "" {
+		return policy
+	}
+
+	if rc.Policy != "" {
+		return rc.Policy
+	}
+	return PolicyPrimary
+}
+
+// RoomSnapshot is the value of each metric of a room, which is stale when it was combined from
+// readings which are all stale
+type RoomSnapshot struct {
+	Name     string
+	Policy   string
+	Sensors  []string
+	Readings []Reading
+}
+
+// combineReadings combines the readings of the sensors of a room by the policy. Only the readings
+// which are not stale are combined, unless every reading is stale. A sensor which has never been
+// read has no time, and its reading is never combined.
+func combineReadings(readings []Reading, policy string) (r Reading, ok bool) {
+	var read, fresh []Reading
+	for _, r := range readings {
+		if r.Time.IsZero() {
+			continue
+		}
+
+		if read = append(read, r); !r.Stale {
+			fresh = append(fresh, r)
+		}
+	}
+
+	if len(fresh) == 0 {
+		fresh = read
+	}
+
+	if len(fresh) == 0 {
+		return
+	}
+
+	r, ok = fresh[0], true
+	switch policy {
+	case PolicyMean:
+		var sum float64
+		for _, fr := range fresh {
+			sum += fr.Value
+			r.Time = latest(r.Time, fr)
+		}
+		r.Value = sum / float64(len(fresh))
+
+	case PolicyMedian:
+		values := make([]float64, 0, len(fresh))
+		for _, fr := range fresh {
+			values = append(values, fr.Value)
+			r.Time = latest(r.Time, fr)
+		}
+		r.Value = median(values)
+
+	case PolicyMin:
+		for _, fr := range fresh {
+			if fr.Value < r.Value {
+				r = fr
+			}
+		}
+
+	case PolicyMax:
+		for _, fr := range fresh {
+			if fr.Value > r.Value {
+				r = fr
+			}
+		}
+
+	case PolicyFreshest:
+		for _, fr := range fresh {
+			if fr.Time.After(r.Time) {
+				r = fr
+			}
+		}
+	}
+
+	return
+}
+
+func latest(t time.Time, r Reading) time.Time {
+	if r.Time.After(t) {
+		return r.Time
+	}
+	return t
+}
+
+// SetRooms sets the rooms and the room whose values are returned by GetTemperature and the other
+// getters used by HomeKit, the OLED and the automations. Without rooms they return the reading of
+// the first sensor which has one.
+func (sm *SensorManagement) SetRooms(rooms []RoomConfiguration, home string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.rooms = append([]RoomConfiguration(nil), rooms...)
+	sm.homeRoom = home
+	if sm.homeRoom == "" && len(rooms) > 0 {
+		sm.homeRoom = rooms[0].Name
+	}
+}
+
+func (sm *SensorManagement) room(name string) (rc RoomConfiguration, ok bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	for _, rc = range sm.rooms {
+		if rc.Name == name {
+			return rc, true
+		}
+	}
+	return RoomConfiguration{}, false
+}
+
+// HomeRoom returns the name of the room used by HomeKit, the OLED and the automations, which is
+// empty when there are no rooms
+func (sm *SensorManagement) HomeRoom() string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.homeRoom
+}
+
+// roomReadings returns the readings of each metric of the sensors of the room by metric, in the
+// order of the sensors in the room. The raw and derived metrics of the sensors are left out, as the
+// derived metrics of the room are derived from its own temperature and humidity.
+func (sm *SensorManagement) roomReadings(rc *RoomConfiguration) (byMetric map[string][]Reading) {
+	byMetric = make(map[string][]Reading)
+	for _, name := range rc.Sensors {
+		ss, ok := sm.Snapshot(name)
+		if !ok {
+			continue
+		}
+
+		for _, r := range ss.Readings {
+			if !strings.HasSuffix(r.Metric, RawMetricSuffix) && !containsString(DerivedMetrics, r.Metric) {
+				byMetric[r.Metric] = append(byMetric[r.Metric], r)
+			}
+		}
+	}
+	return
+}
+
+// RoomReading returns the value of the metric in the room, combined from its sensors by the
+// policy of the metric, or derived from the temperature and humidity of the room
+func (sm *SensorManagement) RoomReading(room, metric string) (r Reading, ok bool) {
+	if !containsString(DerivedMetrics, metric) {
+		rc, found := sm.room(room)
+		if !found {
+			return
+		}
+
+		return combineReadings(sm.roomReadings(&rc)[metric], rc.PolicyOf(metric))
+	}
+
+	rs, found := sm.RoomSnapshot(room)
+	if !found {
+		return
+	}
+
+	for _, r = range rs.Readings {
+		if r.Metric == metric {
+			return r, true
+		}
+	}
+	return Reading{}, false
+}
+
+// RoomSnapshot returns the value of every metric measured in the room, followed by the derived
+// metrics when the room has a temperature and humidity
+func (sm *SensorManagement) RoomSnapshot(room string) (rs RoomSnapshot, ok bool) {
+	var rc RoomConfiguration
+	if rc, ok = sm.room(room); !ok {
+		return
+	}
+
+	rs = RoomSnapshot{Name: rc.Name, Policy: rc.PolicyOf(""), Sensors: rc.Sensors}
+
+	byMetric := sm.roomReadings(&rc)
+	metrics := make([]string, 0, len(byMetric))
+	for metric := range byMetric {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	for _, metric := range metrics {
+		if r, found := combineReadings(byMetric[metric], rc.PolicyOf(metric)); found {
+			rs.Readings = append(rs.Readings, r)
+		}
+	}
+
+	rs.Readings = deriveReadings(rs.Readings)
+	return
+}
+
+// RoomSnapshots returns the values of every room
+func (sm *SensorManagement) RoomSnapshots() (snapshots []RoomSnapshot) {
+	sm.mu.RLock()
+	rooms := sm.rooms
+	sm.mu.RUnlock()
+
+	snapshots = make([]RoomSnapshot, 0, len(rooms))
+	for _, rc := range rooms {
+		if rs, ok := sm.RoomSnapshot(rc.Name); ok {
+			snapshots = append(snapshots, rs)
+		}
+	}
+	return
+}
+
+// homeReading returns the value of the metric in the home room, or the reading of the first
+// sensor which has one when there are no rooms
+func (sm *SensorManagement) homeReading(metric string) (r Reading, ok bool) {
+	if home := sm.HomeRoom(); home != "" {
+		return sm.RoomReading(home, metric)
+	}
+	return sm.GetReading(metric)
+}
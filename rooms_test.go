@@ -0,0 +1,130 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCombineReadings(t *testing.T) {
+	now := time.Now()
+	fresh := func(v float64, age time.Duration) Reading {
+		return NewReading(MetricTemperature, v, UnitCelsius, now.Add(-age))
+	}
+	stale := func(v float64) Reading {
+		r := NewReading(MetricTemperature, v, UnitCelsius, now.Add(-time.Hour))
+		r.Stale = true
+		return r
+	}
+
+	readings := []Reading{stale(30), fresh(21, time.Second), fresh(19, 3*time.Second), fresh(23, 2*time.Second)}
+
+	tests := []struct {
+		policy string
+		value  float64
+	}{
+		{PolicyPrimary, 21},
+		{PolicyMean, 21},
+		{PolicyMedian, 21},
+		{PolicyMin, 19},
+		{PolicyMax, 23},
+		{PolicyFreshest, 21},
+	}
+
+	for _, test := range tests {
+		if r, ok := combineReadings(readings, test.policy); !ok || r.Value != test.value || r.Stale {
+			t.Errorf("%s: expected %v, got %t %+v", test.policy, test.value, ok, r)
+		}
+	}
+
+	if r, ok := combineReadings([]Reading{stale(30), stale(20)}, PolicyMean); !ok || r.Value != 25 || !r.Stale {
+		t.Errorf("expected the stale mean of every reading when all are stale, got %t %+v", ok, r)
+	}
+
+	unread := Reading{Metric: MetricTemperature, Unit: UnitCelsius, Stale: true}
+	if r, ok := combineReadings([]Reading{unread, stale(30)}, PolicyMin); !ok || r.Value != 30 {
+		t.Errorf("expected a sensor which has never been read to be left out, got %t %+v", ok, r)
+	}
+
+	if _, ok := combineReadings([]Reading{unread}, PolicyPrimary); ok {
+		t.Error("expected no value when no sensor has been read")
+	}
+
+	if _, ok := combineReadings(nil, PolicyPrimary); ok {
+		t.Error("expected no value without readings")
+	}
+}
+
+func TestSensorManagementRooms(t *testing.T) {
+	now := time.Now()
+	sm := NewSensorManagement(time.Second, time.Minute)
+	sm.AddSensor(&testReadingsSensor{readings: []Reading{NewReading(MetricTemperature, 12, UnitCelsius, now)}},
+		SensorConfiguration{SensorType: "bom", Name: "outside"})
+	sm.AddSensor(&testReadingsSensor{readings: []Reading{
+		NewReading(MetricTemperature, 21, UnitCelsius, now), NewReading(MetricHumidity, 50, UnitRelativeHumidity, now),
+	}}, SensorConfiguration{SensorType: "test", Name: "lounge_a"})
+	sm.AddSensor(&testReadingsSensor{readings: []Reading{
+		NewReading(MetricTemperature, 22, UnitCelsius, now), NewReading(MetricHumidity, 60, UnitRelativeHumidity, now),
+	}}, SensorConfiguration{SensorType: "test", Name: "lounge_b"})
+	sm.UpdateSensors()
+
+	if temperature, _ := sm.GetTemperature(); temperature != 12 {
+		t.Errorf("expected the first sensor without rooms, got %v", temperature)
+	}
+
+	sm.SetRooms([]RoomConfiguration{
+		{Name: "garden", Sensors: []string{"outside"}},
+		{Name: "lounge", Sensors: []string{"lounge_b", "lounge_a"}, Policies: map[string]string{MetricHumidity: PolicyMean}},
+	}, "lounge")
+
+	if temperature, _ := sm.GetTemperature(); temperature != 22 {
+		t.Errorf("expected the primary sensor of the home room, got %v", temperature)
+	}
+
+	if humidity, _ := sm.GetHumidity(); humidity != 55 {
+		t.Errorf("expected the mean humidity of the home room, got %v", humidity)
+	}
+
+	if dew, _ := sm.GetDerived(MetricDewPoint); dew != dewPoint(22, 55) {
+		t.Errorf("expected the dew point of the temperature and humidity of the home room, got %v", dew)
+	}
+
+	if r, ok := sm.RoomReading("garden", MetricTemperature); !ok || r.Value != 12 {
+		t.Errorf("expected the temperature of the garden, got %t %+v", ok, r)
+	}
+
+	if _, ok := sm.RoomReading("garden", MetricHumidity); ok {
+		t.Error("expected no humidity in the garden, which has no sensor measuring it")
+	}
+
+	rooms := sm.RoomSnapshots()
+	if len(rooms) != 2 || rooms[1].Name != "lounge" || len(rooms[1].Readings) != 2+len(DerivedMetrics) || rooms[1].Policy != PolicyPrimary {
+		t.Errorf("unexpected snapshots of the rooms %+v", rooms)
+	}
+
+	sm.SetRooms([]RoomConfiguration{{Name: "garden", Sensors: []string{"outside"}}}, "")
+	if home := sm.HomeRoom(); home != "garden" {
+		t.Errorf("expected the first room to be the home room, got %s", home)
+	}
+}
+
+func TestParseConfigurationRooms(t *testing.T) {
+	config, err := parseConfiguration([]byte(testConfigHeader+`homeroom: lounge
+sensors:
+  - sensortype: tmp117
+    name: lounge_tmp117
+  - sensortype: aht10
+    name: lounge_aht10
+rooms:
+  - name: lounge
+    sensors: [lounge_tmp117, lounge_aht10]
+    policies:
+      humidity: mean
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Rooms) != 1 || config.Rooms[0].PolicyOf(MetricTemperature) != PolicyPrimary || config.Rooms[0].PolicyOf(MetricHumidity) != PolicyMean {
+		t.Errorf("unexpected rooms %+v", config.Rooms)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// The range of addresses probed by the bus scan, which is the same as i2cdetect
+const (
+	ScanFirstAddress = 0x08
+	ScanLastAddress  = 0x77
+)
+
+// IdentifyFunc reads the ID registers of a device to check that it is the expected type
+type IdentifyFunc func(r RegisterDevice) bool
+
+// identifyReg8 matches a device with one of the values in an 8-bit ID register
+func identifyReg8(reg byte, values ...byte) IdentifyFunc {
+	return func(r RegisterDevice) bool {
+		val, err := r.ReadReg(reg, 1)
+		if err != nil {
+			return false
+		}
+
+		for _, v := range values {
+			if val[0] == v {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// identifyReg16 matches a device with one of the values in a 16-bit ID register, after applying the mask
+func identifyReg16(reg byte, order binary.ByteOrder, mask uint16, values ...uint16) IdentifyFunc {
+	return func(r RegisterDevice) bool {
+		val, err := r.ReadReg(reg, 2)
+		if err != nil {
+			return false
+		}
+
+		for _, v := range values {
+			if order.Uint16(val)&mask == v {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// identifyReg16Addr16 matches a device with a 16-bit ID register at a 16-bit register address
+func identifyReg16Addr16(reg uint16, value uint16) IdentifyFunc {
+	return func(r RegisterDevice) bool {
+		val, err := r.ReadReg16(reg, 2)
+		return err == nil && binary.BigEndian.Uint16(val) == value
+	}
+}
+
+// ScanDevice is a kind of device which the bus scan recognises
+type ScanDevice struct {
+	Description string
+	Addresses   []uint8
+	Identify    IdentifyFunc
+
+	// The sensor type for devices which are configured as sensors, otherwise the configuration which enables the device
+	SensorType string
+	Setting    string
+}
+
+// Devices on the bus which are not sensors
+var scanOtherDevices = []*ScanDevice{
+	{Description: "PiicoDev RGB LED", Addresses: []uint8{0x08}, Identify: identifyReg8(0x00, 0x84), Setting: "enableled: true"},
+	{Description: "SSD1306 OLED display", Addresses: []uint8{0x3C, 0x3D}, Setting: "enableoled: true"},
+}
+
+// scanDevices returns every device the bus scan recognises, from the registered sensor types and the other devices
+func scanDevices() (sds []*ScanDevice) {
+	for _, st := range SensorTypes() {
+		if st.DefaultAddress != 0 {
+			sds = append(sds, &ScanDevice{
+				Description: st.Description,
+				Addresses:   append([]uint8{st.DefaultAddress}, st.AlternateAddresses...),
+				Identify:    st.Identify,
+				SensorType:  st.Name,
+			})
+		}
+	}
+
+	return append(sds, scanOtherDevices...)
+}
+
+// ScanResult is a device found on the bus. Identified is set when the device matched its ID registers,
+// otherwise Candidates are the devices which can be at the address.
+type ScanResult struct {
+	Address    uint8
+	Busy       bool
+	Identified bool
+	Candidates []*ScanDevice
+}
+
+func (r *ScanResult) String() string {
+	switch {
+	case r.Busy:
+		return "in use by a kernel driver"
+	case r.Identified:
+		return r.Candidates[0].Description
+	case len(r.Candidates) > 0:
+		descriptions := make([]string, 0, len(r.Candidates))
+		for _, sd := range r.Candidates {
+			descriptions = append(descriptions, sd.Description)
+		}
+		return "possibly " + strings.Join(descriptions, " or ")
+	default:
+		return "unknown device"
+	}
+}
+
+// ScanBus probes every address on the bus and identifies the devices which respond
+func ScanBus(bus int) (results []ScanResult, err error) {
+	sds := scanDevices()
+
+	for address := ScanFirstAddress; address <= ScanLastAddress; address++ {
+		if perr := devices.ProbeI2C(uint8(address), bus); perr != nil {
+			if perr == ErrI2CAddressBusy {
+				results = append(results, ScanResult{Address: uint8(address), Busy: true})
+			} else if os.IsNotExist(perr) || os.IsPermission(perr) {
+				return nil, fmt.Errorf("failed to open I2C bus %d: %v", bus, perr)
+			}
+			continue
+		}
+
+		results = append(results, identifyDevice(uint8(address), bus, sds))
+	}
+
+	return
+}
+
+// identifyDevice checks the ID registers of the devices which can be at the address. Devices
+// without an ID register are candidates when no device with one matches.
+func identifyDevice(address uint8, bus int, sds []*ScanDevice) (result ScanResult) {
+	result.Address = address
+
+	r, err := devices.OpenRegisters(address, bus)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	var unidentified []*ScanDevice
+	for _, sd := range sds {
+		if !hasAddress(sd.Addresses, address) {
+			continue
+		}
+
+		if sd.Identify == nil {
+			unidentified = append(unidentified, sd)
+		} else if sd.Identify(r) {
+			result.Identified = true
+			result.Candidates = []*ScanDevice{sd}
+			return
+		}
+	}
+
+	result.Candidates = unidentified
+	return
+}
+
+func hasAddress(addresses []uint8, address uint8) bool {
+	for _, a := range addresses {
+		if a == address {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteScanResults prints the devices found and a sensors block for the configuration. Devices
+// recognised by address alone are included, with any other devices it could be commented out.
+func WriteScanResults(w io.Writer, bus int, results []ScanResult) {
+	fmt.Fprintf(w, "# Devices found on I2C bus %d\n", bus)
+	if len(results) == 0 {
+		fmt.Fprintln(w, "#   none")
+	}
+
+	for i := range results {
+		fmt.Fprintf(w, "#   0x%02x: %s\n", results[i].Address, &results[i])
+	}
+
+	// Sensors of the same type are named by address
+	types := make(map[string]int)
+	for _, r := range results {
+		for _, sd := range r.Candidates {
+			types[sd.SensorType]++
+		}
+	}
+
+	var settings []string
+	fmt.Fprintln(w, "\nsensors:")
+
+	for _, r := range results {
+		for i, sd := range r.Candidates {
+			if sd.SensorType == "" {
+				settings = append(settings, fmt.Sprintf("%s # 0x%02x: %s", sd.Setting, r.Address, sd.Description))
+				continue
+			}
+
+			name := sd.SensorType
+			if types[sd.SensorType] > 1 {
+				name = fmt.Sprintf("%s_%02x", sd.SensorType, r.Address)
+			}
+
+			prefix := ""
+			if i > 0 {
+				prefix = "#"
+			}
+
+			fmt.Fprintf(w, "%s  - sensortype: %s\n", prefix, sd.SensorType)
+			fmt.Fprintf(w, "%s    name: %s\n", prefix, name)
+			fmt.Fprintf(w, "%s    i2caddress: 0x%02x\n", prefix, r.Address)
+			if bus != DefaultI2CBus {
+				fmt.Fprintf(w, "%s    i2cbus: %d\n", prefix, bus)
+			}
+		}
+	}
+
+	sort.Strings(settings)
+	if len(settings) > 0 {
+		fmt.Fprintln(w)
+	}
+
+	for _, s := range settings {
+		fmt.Fprintln(w, s)
+	}
+}
+
+// RunScan is the scan command, which prints the devices found on a bus
+func RunScan(w io.Writer, args []string) (err error) {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	bus := fs.Int("bus", DefaultI2CBus, "the I2C bus to scan")
+	simulate := fs.Bool("simulate", false, "scan the simulated I2C bus")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+
+	if *simulate {
+		UseSimulatedDevices()
+	}
+
+	var results []ScanResult
+	if results, err = ScanBus(*bus); err != nil {
+		return
+	}
+
+	WriteScanResults(w, *bus, results)
+	return
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func useSimulatedBus(t *testing.T, bus map[uint8]map[uint16][]byte) {
+	previousDevices, previousBus := devices, simulatedBus
+	devices, simulatedBus = NewSimulatedDevices(), bus
+	t.Cleanup(func() { devices, simulatedBus = previousDevices, previousBus })
+}
+
+func TestScanBus(t *testing.T) {
+	useSimulatedBus(t, simulatedBus)
+
+	results, err := ScanBus(DefaultI2CBus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(results) != len(simulatedBus) {
+		t.Errorf("expected %d devices, found %d", len(simulatedBus), len(results))
+	}
+
+	var out bytes.Buffer
+	WriteScanResults(&out, DefaultI2CBus, results)
+
+	var config I2cConfiguration
+	if err = yaml.Unmarshal(out.Bytes(), &config); err != nil {
+		t.Fatalf("the scan output is not valid configuration: %v\n%s", err, out.String())
+	}
+
+	if !config.EnableLED || !config.EnableOLED {
+		t.Errorf("expected the LED and OLED to be enabled:\n%s", out.String())
+	}
+
+	types := make(map[string]SensorConfiguration)
+	for _, sc := range config.Sensors {
+		types[sc.SensorType] = sc
+		if _, err = LookupSensorType(sc.SensorType); err != nil {
+			t.Error(err)
+		}
+	}
+
+	for _, name := range []string{"tmp117", "bme280", "ens160", "vl53l1x", "cap1203", "switch", "potentiometer", "pir", "aht10", "ms5637", "veml6030"} {
+		sc, ok := types[name]
+		if !ok {
+			t.Errorf("expected a %s in the scan output", name)
+			continue
+		}
+
+		if st, _ := LookupSensorType(name); sc.I2CAddress != st.DefaultAddress || sc.Name != name {
+			t.Errorf("unexpected configuration of the %s: %+v", name, sc)
+		}
+	}
+}
+
+func TestScanBusIdentifiesByRegisters(t *testing.T) {
+	useSimulatedBus(t, map[uint8]map[uint16][]byte{
+		0x48: {0x0F: {0x21, 0x17}}, // TMP117 revision 2
+		0x49: {0x0F: {0x01, 0x17}}, // TMP117
+		0x4A: {0x0F: {0x00, 0x00}}, // TMP117 address, but no ID
+		0x50: {},                   // EEPROM
+		0x76: {0xD0: {0x58}},       // BMP280, not a BME280
+	})
+
+	results, err := ScanBus(DefaultI2CBus)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"TMP117 precision temperature sensor",
+		"TMP117 precision temperature sensor",
+		"unknown device",
+		"unknown device",
+		"possibly MS5637 pressure sensor",
+	}
+
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d devices, found %d", len(expected), len(results))
+	}
+
+	for i := range results {
+		if s := results[i].String(); s != expected[i] {
+			t.Errorf("0x%02x: expected %q, got %q", results[i].Address, expected[i], s)
+		}
+	}
+
+	var out bytes.Buffer
+	WriteScanResults(&out, DefaultI2CBus, results)
+
+	for _, s := range []string{"name: tmp117_48\n", "name: tmp117_49\n", "name: ms5637\n"} {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("expected %q in the scan output:\n%s", s, out.String())
+		}
+	}
+}
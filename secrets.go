@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The prefix of the environment variables which override the configuration, such as
+// I2C_HOMEKITDEVICEPIN, I2C_LOGGING_LEVEL or I2C_SENSORS_LOUNGE_FAN_PASSWORD
+const ConfigEnvPrefix = "I2C_"
+
+// The suffix of a key, or of an environment variable, whose value is the path of a file holding
+// the value, such as a Docker secret in /run/secrets
+const configFileSuffix = "_file"
+
+// What a secret is replaced with in the log, the sensor details and the configuration dump
+const Redacted = "<redacted>"
+
+// The keys of the configuration which are always secret. The keys of a sensor are secret when
+// its sensor type says so.
+var secretConfigKeys = []string{"homekitdevicepin"}
+
+// Secrets shorter than this are not redacted from text, where they would match too much
+const minRedactedLength = 4
+
+// readSecretFile reads a value from a file, without the line ending which editors add
+func readSecretFile(path string) (value string, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		return
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// setScalar replaces the node with a scalar holding the value, as a string when it is decoded
+// into a string so that a password such as 0123 keeps its leading zero
+func setScalar(n *yaml.Node, t reflect.Type, value string) {
+	*n = yaml.Node{Kind: yaml.ScalarNode, Value: value, Line: n.Line, Column: n.Column}
+	if t.Kind() == reflect.String {
+		n.Tag = "!!str"
+	}
+}
+
+func isScalarType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice:
+		return false
+	}
+	return true
+}
+
+// newConfigNode is an empty node for a value of the type, or nil for a list which cannot be added to
+func newConfigNode(t reflect.Type) *yaml.Node {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	case reflect.Slice:
+		return nil
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode}
+}
+
+// findMappingValue returns the value of the key in the mapping, or nil if it is not there
+func findMappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				return node.Content[i+1]
+			}
+		}
+	}
+	return nil
+}
+
+// mappingValue returns the value of the key in the mapping, adding the key when it is not there
+func mappingValue(node *yaml.Node, key string, t reflect.Type) *yaml.Node {
+	if node.Kind == yaml.ScalarNode && (node.Tag == "!!null" || node.Value == "") {
+		// An empty key such as "logging:" holds nothing yet
+		*node = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Line: node.Line, Column: node.Column}
+	}
+
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	if value := findMappingValue(node, key); value != nil {
+		return value
+	}
+
+	value := newConfigNode(t)
+	if value != nil {
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+	}
+	return value
+}
+
+// resolveFileKeys replaces each key such as password_file with the key password, holding the
+// contents of the file, and records the paths of the values read from files
+func (cc *configChecker) resolveFileKeys(node *yaml.Node, t reflect.Type, path string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case node.Kind == yaml.DocumentNode:
+		for _, n := range node.Content {
+			cc.resolveFileKeys(n, t, path)
+		}
+
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" {
+				fields[yamlKey(f)] = f.Type
+			}
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if !strings.HasSuffix(key.Value, configFileSuffix) {
+				if ft, ok := fields[key.Value]; ok {
+					cc.resolveFileKeys(value, ft, joinConfigPath(path, key.Value))
+				}
+				continue
+			}
+
+			// Any other key ending in _file is reported as unknown by checkKeys
+			name := strings.TrimSuffix(key.Value, configFileSuffix)
+			ft, ok := fields[name]
+			if !ok || !isScalarType(ft) {
+				continue
+			}
+
+			keyPath := joinConfigPath(path, name)
+			secret, err := readSecretFile(value.Value)
+			if err != nil {
+				cc.problems = append(cc.problems, ConfigProblem{Line: key.Line, Path: joinConfigPath(path, key.Value), Message: err.Error()})
+				continue
+			}
+
+			// The key is renamed, replacing the value it may also have been given
+			key.Value = name
+			setScalar(value, ft, secret)
+			cc.secrets[keyPath] = true
+
+			for j := 0; j+1 < len(node.Content); j += 2 {
+				if j != i && node.Content[j].Value == name {
+					node.Content = append(node.Content[:j], node.Content[j+2:]...)
+					if j < i {
+						i -= 2
+					}
+					break
+				}
+			}
+		}
+
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for i, n := range node.Content {
+			cc.resolveFileKeys(n, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	}
+}
+
+// applyEnvironment sets the value of each environment variable with ConfigEnvPrefix, or the
+// contents of the file it names when it ends in _FILE, replacing the value in the file
+func (cc *configChecker) applyEnvironment(root *yaml.Node, env []string) {
+	sort.Strings(env)
+
+	for _, kv := range env {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv, ConfigEnvPrefix) {
+			continue
+		}
+
+		name, value := kv[:i], kv[i+1:]
+		parts := strings.Split(strings.TrimPrefix(name, ConfigEnvPrefix), "_")
+
+		fromFile := len(parts) > 1 && strings.EqualFold(parts[len(parts)-1], strings.TrimPrefix(configFileSuffix, "_"))
+		if fromFile {
+			parts = parts[:len(parts)-1]
+
+			var err error
+			if value, err = readSecretFile(value); err != nil {
+				cc.add("", "environment variable %s: %v", name, err)
+				continue
+			}
+		}
+
+		path, ok := setConfigValue(root.Content[0], reflect.TypeOf(I2cConfiguration{}), parts, "", value)
+		if !ok {
+			cc.add("", "environment variable %s does not name a configuration key", name)
+			continue
+		}
+
+		if fromFile {
+			cc.secrets[path] = true
+		}
+	}
+}
+
+// setConfigValue sets the value at the key named by the parts of an environment variable, adding
+// the key when it is not in the file. A sensor or multiplexer is named by its index or its name.
+func setConfigValue(node *yaml.Node, t reflect.Type, parts []string, path string, value string) (string, bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if isScalarType(t) {
+		if len(parts) > 0 {
+			return "", false
+		}
+
+		setScalar(node, t, value)
+		return path, true
+	}
+
+	if len(parts) == 0 {
+		return "", false
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+
+			key := yamlKey(f)
+			for n := 1; n <= len(parts); n++ {
+				if strings.EqualFold(key, strings.Join(parts[:n], "_")) {
+					if child := mappingValue(node, key, f.Type); child != nil {
+						return setConfigValue(child, f.Type, parts[n:], joinConfigPath(path, key), value)
+					}
+				}
+			}
+		}
+
+	case reflect.Map:
+		if isScalarType(t.Elem()) {
+			key := strings.ToLower(strings.Join(parts, "_"))
+			if child := mappingValue(node, key, t.Elem()); child != nil {
+				return setConfigValue(child, t.Elem(), nil, joinConfigPath(path, key), value)
+			}
+			return "", false
+		}
+
+		// The key of a map of settings, such as the calibration of a metric, may itself contain an
+		// underscore: use the longest key which is already there, or else the longest which leaves
+		// the name of a setting
+		for n := len(parts) - 1; n >= 1; n-- {
+			key := strings.ToLower(strings.Join(parts[:n], "_"))
+			if child := findMappingValue(node, key); child != nil {
+				return setConfigValue(child, t.Elem(), parts[n:], joinConfigPath(path, key), value)
+			}
+		}
+
+		for n := len(parts) - 1; n >= 1; n-- {
+			if scratch := newConfigNode(t.Elem()); scratch != nil {
+				if _, ok := setConfigValue(scratch, t.Elem(), parts[n:], "", value); !ok {
+					continue
+				}
+			}
+
+			key := strings.ToLower(strings.Join(parts[:n], "_"))
+			if child := mappingValue(node, key, t.Elem()); child != nil {
+				return setConfigValue(child, t.Elem(), parts[n:], joinConfigPath(path, key), value)
+			}
+		}
+
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return "", false
+		}
+
+		if i, err := strconv.Atoi(parts[0]); err == nil && i >= 0 && i < len(node.Content) {
+			return setConfigValue(node.Content[i], t.Elem(), parts[1:], fmt.Sprintf("%s[%d]", path, i), value)
+		}
+
+		// The longest name which matches, as a name such as lounge_fan may also start another
+		for n := len(parts) - 1; n >= 1; n-- {
+			for i, item := range node.Content {
+				if name := findMappingValue(item, "name"); name != nil && name.Value != "" &&
+					strings.EqualFold(name.Value, strings.Join(parts[:n], "_")) {
+					return setConfigValue(item, t.Elem(), parts[n:], fmt.Sprintf("%s[%d]", path, i), value)
+				}
+			}
+		}
+	}
+
+	return "", false
+}
+
+// secretNodes calls the function with each value in the configuration which is a secret: the keys
+// which are always secret, the keys which the sensor types say are secret, and the values at the
+// paths which were read from files
+func secretNodes(root *yaml.Node, fromFiles map[string]bool, fn func(n *yaml.Node)) {
+	var walk func(node *yaml.Node, path string, st *SensorType)
+	walk = func(node *yaml.Node, path string, st *SensorType) {
+		switch node.Kind {
+		case yaml.DocumentNode:
+			for _, n := range node.Content {
+				walk(n, path, st)
+			}
+
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i].Value, node.Content[i+1]
+				keyPath := joinConfigPath(path, key)
+
+				secret := fromFiles[keyPath] || (path == "" && containsString(secretConfigKeys, key))
+				if st != nil {
+					for _, f := range st.Fields {
+						secret = secret || (f.Secret && f.Name == key)
+					}
+				}
+
+				if secret && value.Kind == yaml.ScalarNode {
+					fn(value)
+				} else {
+					walk(value, keyPath, nil)
+				}
+			}
+
+		case yaml.SequenceNode:
+			for i, item := range node.Content {
+				var itemType *SensorType
+				if path == "sensors" {
+					if t := findMappingValue(item, "sensortype"); t != nil {
+						itemType, _ = LookupSensorType(t.Value)
+					}
+				}
+				walk(item, fmt.Sprintf("%s[%d]", path, i), itemType)
+			}
+		}
+	}
+
+	if root != nil {
+		walk(root, "", nil)
+	}
+}
+
+// secretValues returns the secrets in the configuration, with the HomeKit setup code also as it
+// is written with dashes
+func secretValues(root *yaml.Node, fromFiles map[string]bool) (values []string) {
+	secretNodes(root, fromFiles, func(n *yaml.Node) {
+		if n.Tag == "!!null" || n.Value == "" {
+			return
+		}
+
+		values = append(values, n.Value)
+		if pin, err := strconv.ParseUint(n.Value, 10, 32); err == nil {
+			values = append(values, FormatSetupCode(uint32(pin)))
+		}
+	})
+	return
+}
+
+// RedactedConfiguration returns the configuration as YAML with its secrets replaced by Redacted
+func RedactedConfiguration(c *I2cConfiguration) (node *yaml.Node, err error) {
+	node = &yaml.Node{}
+	if err = node.Encode(c); err != nil {
+		return
+	}
+
+	secretNodes(node, c.secrets, func(n *yaml.Node) {
+		*n = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: Redacted}
+	})
+	return
+}
+
+// The secrets of every configuration which has been loaded, which are redacted from the log and
+// the state of the sensors
+var redaction = struct {
+	sync.RWMutex
+	values   []string
+	replacer *strings.Replacer
+}{replacer: strings.NewReplacer()}
+
+func addSecrets(values []string) {
+	redaction.Lock()
+	defer redaction.Unlock()
+
+	added := false
+	for _, v := range values {
+		if len(v) >= minRedactedLength && !containsString(redaction.values, v) {
+			redaction.values = append(redaction.values, v)
+			added = true
+		}
+	}
+
+	if !added {
+		return
+	}
+
+	// The longest first, so that a secret which contains another is replaced whole
+	sort.Slice(redaction.values, func(i, j int) bool { return len(redaction.values[i]) > len(redaction.values[j]) })
+
+	var pairs []string
+	for _, v := range redaction.values {
+		pairs = append(pairs, v, Redacted)
+	}
+	redaction.replacer = strings.NewReplacer(pairs...)
+}
+
+// RedactSecrets replaces each secret of the configuration in the text with Redacted
+func RedactSecrets(s string) string {
+	redaction.RLock()
+	defer redaction.RUnlock()
+	return redaction.replacer.Replace(s)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const secretsTestConfig = `homekitdeviceid: TF0X
+homekitdevicepin: 12344321
+logging:
+sensors:
+  - sensortype: tmp117
+    name: lounge
+  - sensortype: dysonhotcool
+    name: lounge_fan
+    server: tcp://192.168.1.20:1883
+    devicetype: "527"
+    serial: NK6-EU-MHA0000A
+    password: in-the-file
+`
+
+func writeSecretFile(t *testing.T, value string) string {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(path, []byte(value), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigurationFromEnvironment(t *testing.T) {
+	config, err := parseConfiguration([]byte(secretsTestConfig), []string{
+		"HOME=/root",
+		"I2C_HOMEKITDEVICEPIN_FILE=" + writeSecretFile(t, "23456781\n"),
+		"I2C_LOGGING_LEVEL=warn",
+		"I2C_LOGGING_SUBSYSTEMS_DYSON=debug",
+		"I2C_SENSORS_LOUNGE_INTERVAL=30s",
+		"I2C_SENSORS_LOUNGE_FAN_PASSWORD=0123",
+		"I2C_SENSORS_0_I2CADDRESS=0x49",
+		"I2C_OLEDBUS=3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.HomeKitDevicePin != 23456781 {
+		t.Errorf("expected the setup code from the file, got %d", config.HomeKitDevicePin)
+	}
+
+	if config.Logging.Level != "warn" || config.Logging.Subsystems["dyson"] != "debug" {
+		t.Errorf("expected the logging from the environment, got %+v", config.Logging)
+	}
+
+	if config.Sensors[0].Interval != 30*time.Second || config.Sensors[0].I2CAddress != 0x49 {
+		t.Errorf("expected the interval and address of lounge from the environment, got %s and 0x%02x",
+			config.Sensors[0].Interval, config.Sensors[0].I2CAddress)
+	}
+
+	if config.Sensors[1].Password != "0123" || config.Sensors[1].Interval != 0 {
+		t.Errorf("expected only the password of lounge_fan from the environment, got %+v", config.Sensors[1])
+	}
+
+	if config.OLEDBusNumber() != 3 {
+		t.Errorf("expected the OLED on bus 3, got %d", config.OLEDBusNumber())
+	}
+}
+
+func TestConfigurationFileKeys(t *testing.T) {
+	data := strings.Replace(secretsTestConfig, "password: in-the-file", "password_file: "+writeSecretFile(t, "from-the-file\n"), 1)
+	config, err := parseConfiguration([]byte(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Sensors[1].Password != "from-the-file" {
+		t.Errorf("expected the password from the file, got \"%s\"", config.Sensors[1].Password)
+	}
+
+	if !config.secrets["sensors[1].password"] {
+		t.Errorf("expected the password to be secret, got %v", config.secrets)
+	}
+
+	_, err = parseConfiguration([]byte(secretsTestConfig+"    serial_file: /nonexistent/serial\n"), nil)
+	if err == nil || !strings.Contains(err.Error(), "line 13: sensors[1].serial_file") {
+		t.Errorf("expected the file which cannot be read to be reported, got %v", err)
+	}
+}
+
+func TestConfigurationEnvironmentProblems(t *testing.T) {
+	_, err := parseConfiguration([]byte(secretsTestConfig), []string{
+		"I2C_SAMPELTIME=5",
+		"I2C_SENSORS_KITCHEN_INTERVAL=5s",
+		"I2C_HOMEKITDEVICEPIN_FILE=" + writeSecretFile(t, "not-a-pin"),
+	})
+
+	for _, e := range []string{
+		"environment variable I2C_SAMPELTIME does not name a configuration key",
+		"environment variable I2C_SENSORS_KITCHEN_INTERVAL does not name a configuration key",
+		"cannot unmarshal !!str `" + Redacted + "` into uint32",
+	} {
+		if err == nil || !strings.Contains(err.Error(), e) {
+			t.Errorf("expected the problem %s in:\n%v", e, err)
+		}
+	}
+
+	if strings.Contains(err.Error(), "not-a-pin") {
+		t.Errorf("the secret is in the problems:\n%v", err)
+	}
+}
+
+func TestRedactedConfiguration(t *testing.T) {
+	config, err := parseConfiguration([]byte(secretsTestConfig), []string{
+		"I2C_SENSORS_LOUNGE_FAN_SERIAL_FILE=" + writeSecretFile(t, "NK6-EU-SECRET01"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, err := RedactedConfiguration(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dump struct {
+		HomeKitDevicePin string
+		Sensors          []map[string]interface{}
+	}
+	if err = node.Decode(&dump); err != nil {
+		t.Fatal(err)
+	}
+
+	if dump.HomeKitDevicePin != Redacted {
+		t.Errorf("expected the setup code to be redacted, got %s", dump.HomeKitDevicePin)
+	}
+
+	if dump.Sensors[1]["password"] != Redacted || dump.Sensors[1]["serial"] != Redacted {
+		t.Errorf("expected the password and the serial from a file to be redacted, got %v", dump.Sensors[1])
+	}
+
+	if dump.Sensors[0]["password"] != "" || dump.Sensors[1]["server"] != "tcp://192.168.1.20:1883" {
+		t.Errorf("expected the other values to be shown, got %v", dump.Sensors)
+	}
+}
+
+func TestSecretsAreRedactedFromTheLog(t *testing.T) {
+	if _, err := parseConfiguration([]byte(strings.Replace(secretsTestConfig, "in-the-file", "s3cr3t-dyson", 1)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	b := captureLog(t, LoggingConfiguration{})
+	logDyson.Error("Failed to connect", "error", "bad user name or password s3cr3t-dyson", "pin", "123-44-321")
+
+	if out := b.String(); strings.Contains(out, "s3cr3t-dyson") || strings.Contains(out, "123-44-321") || !strings.Contains(out, Redacted) {
+		t.Errorf("expected the secrets to be redacted:\n%s", out)
+	}
+
+	if s := RedactSecrets("connected with s3cr3t-dyson"); s != "connected with "+Redacted {
+		t.Errorf("expected the secret to be redacted, got %s", s)
+	}
+}
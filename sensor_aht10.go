@@ -2,22 +2,47 @@ package main
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/drtimf/go-piicodev"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type SensorAHT10 struct {
 	name            string
-	aht10           *piicodev.AHT10
-	temperature     float64
-	humidity        float64
+	aht10           AHT10Device
 	promTemperature prometheus.Gauge
 	promHumidity    prometheus.Gauge
+
+	mu          sync.Mutex
+	temperature float64
+	humidity    float64
+	updated     time.Time
+}
+
+func init() {
+	RegisterSensorType(&SensorType{
+		Name:               "aht10",
+		Description:        "AHT10 temperature and humidity sensor",
+		DefaultAddress:     piicodev.AHT10Address,
+		AlternateAddresses: []uint8{0x39},
+		Fields:             i2cFields,
+		Options:            temperatureLimitOptions,
+		New: func(sc *SensorConfiguration, config *I2cConfiguration) (s Sensor, err error) {
+			var bus BusRef
+			if bus, err = config.SensorBus(sc); err != nil {
+				return
+			}
+			if _, err = temperatureLimits(sc.Options); err != nil {
+				return
+			}
+			return NewSensorAHT10(sc.Name, bus, sc.I2CAddress)
+		},
+	})
 }
 
-func NewSensorAHT10(name string, i2cAddress uint8) (s *SensorAHT10, err error) {
+func NewSensorAHT10(name string, bus BusRef, i2cAddress uint8) (s *SensorAHT10, err error) {
 	s = &SensorAHT10{
 		name: name,
 	}
@@ -26,40 +51,63 @@ func NewSensorAHT10(name string, i2cAddress uint8) (s *SensorAHT10, err error) {
 		i2cAddress = piicodev.AHT10Address
 	}
 
-	if s.aht10, err = piicodev.NewAHT10(i2cAddress, 1); err != nil {
+	if s.aht10, err = devices.OpenAHT10(i2cAddress, bus); err != nil {
 		return
 	}
 
-	s.promTemperature = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promTemperature = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_temperature",
 		Help: "Temperature from a AHT10 sensor",
 	})
 
-	s.promHumidity = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promHumidity = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_humidity",
 		Help: "Humidity from a AHT10 sensor",
 	})
 	return
 }
 
-func (s *SensorAHT10) Update() {
-	if temperature, humidity, err := s.aht10.ReadSensor(); err != nil {
-		fmt.Printf("ERROR: Failed to read temperature and humidity from AHT10 \"%s\": %v\n", s.name, err)
-	} else {
-		if temperature < 100 && temperature > -100 {
-			s.temperature = temperature
-			s.humidity = humidity
-		}
+func (s *SensorAHT10) Update() (err error) {
+	var t, h float64
+	if t, h, err = s.aht10.ReadSensor(); err != nil {
+		return fmt.Errorf("failed to read temperature and humidity from AHT10 \"%s\": %v", s.name, err)
 	}
 
-	s.promTemperature.Set(s.temperature)
-	s.promHumidity.Set(s.humidity)
+	s.mu.Lock()
+	s.temperature = t
+	s.humidity = h
+	s.updated = time.Now()
+	s.mu.Unlock()
+
+	s.promTemperature.Set(t)
+	s.promHumidity.Set(h)
+	return
+}
+
+func (s *SensorAHT10) Close() {
+	s.aht10.Close()
 }
 
 func (s *SensorAHT10) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s: %.2f C, %.2f rH", s.name, s.temperature, s.humidity)
 }
 
 func (s *SensorAHT10) Details() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s - AHT10 temperature and humidity: %.2f C, %.2f rH", s.name, s.temperature, s.humidity)
 }
+
+func (s *SensorAHT10) Temperature() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewReading(MetricTemperature, s.temperature, UnitCelsius, s.updated)
+}
+
+func (s *SensorAHT10) Humidity() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewReading(MetricHumidity, s.humidity, UnitRelativeHumidity, s.updated)
+}
@@ -2,46 +2,90 @@ package main
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type SensorBME280 struct {
 	name            string
-	bme280          *BME280
-	temperature     float64
-	pressure        float64
-	humidity        float64
+	bme280          BME280Device
 	promTemperature prometheus.Gauge
 	promPressure    prometheus.Gauge
 	promHumidity    prometheus.Gauge
+
+	mu          sync.Mutex
+	temperature float64
+	pressure    float64
+	humidity    float64
+	updated     time.Time
+}
+
+// The oversampling of the measurements, which is limited to the values of BME280Options
+var bme280OversamplingOptions = []SensorOption{
+	{Name: "temperatureoversampling", Default: DefaultBME280Options.Temperature, Values: []interface{}{1, 2, 4, 8, 16},
+		Description: "times the temperature is sampled and averaged"},
+	{Name: "pressureoversampling", Default: DefaultBME280Options.Pressure, Values: []interface{}{0, 1, 2, 4, 8, 16},
+		Description: "times the pressure is sampled and averaged, 0 to not measure it"},
+	{Name: "humidityoversampling", Default: DefaultBME280Options.Humidity, Values: []interface{}{0, 1, 2, 4, 8, 16},
+		Description: "times the humidity is sampled and averaged, 0 to not measure it"},
+}
+
+func bme280Options(options SensorOptions) BME280Options {
+	return BME280Options{
+		Temperature: options.Int("temperatureoversampling"),
+		Pressure:    options.Int("pressureoversampling"),
+		Humidity:    options.Int("humidityoversampling"),
+	}
 }
 
-func NewSensorBME280(name string, i2cAddress uint8) (s *SensorBME280, err error) {
+func init() {
+	RegisterSensorType(&SensorType{
+		Name:               "bme280",
+		Description:        "BME280 temperature, pressure and humidity sensor",
+		DefaultAddress:     BME280Address,
+		AlternateAddresses: []uint8{0x76},
+		Identify:           identifyReg8(0xD0, 0x60),
+		Fields:             i2cFields,
+		Options:            append(bme280OversamplingOptions, temperatureLimitOptions...),
+		New: func(sc *SensorConfiguration, config *I2cConfiguration) (s Sensor, err error) {
+			var bus BusRef
+			if bus, err = config.SensorBus(sc); err != nil {
+				return
+			}
+			if _, err = temperatureLimits(sc.Options); err != nil {
+				return
+			}
+			return NewSensorBME280(sc.Name, bus, sc.I2CAddress, bme280Options(sc.Options))
+		},
+	})
+}
+
+func NewSensorBME280(name string, bus BusRef, i2cAddress uint8, options BME280Options) (s *SensorBME280, err error) {
 	s = &SensorBME280{
 		name: name,
 	}
 
 	if i2cAddress == 0 {
-		i2cAddress = 0x77
+		i2cAddress = BME280Address
 	}
 
-	if s.bme280, err = NewBME280(i2cAddress); err != nil {
+	if s.bme280, err = devices.OpenBME280(i2cAddress, bus, options); err != nil {
 		return
 	}
 
-	s.promTemperature = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promTemperature = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_temperature",
 		Help: "Temperature from a BME280 sensor",
 	})
 
-	s.promPressure = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promPressure = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_pressure",
 		Help: "The current pressure from the BME280",
 	})
 
-	s.promHumidity = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promHumidity = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_humidity",
 		Help: "The current humidity from the BME280",
 	})
@@ -49,26 +93,55 @@ func NewSensorBME280(name string, i2cAddress uint8) (s *SensorBME280, err error)
 	return
 }
 
-func (s *SensorBME280) Update() {
-	if t, p, h, err := s.bme280.Read(); err != nil {
-		fmt.Printf("ERROR: Failed to read temperature, pressure and humidity from BME280 \"%s\": %v\n", s.name, err)
-	} else {
-		if t < 100 && t > -100 {
-			s.temperature = t
-			s.pressure = p
-			s.humidity = h
-		}
+func (s *SensorBME280) Update() (err error) {
+	var t, p, h float64
+	if t, p, h, err = s.bme280.Read(); err != nil {
+		return fmt.Errorf("failed to read temperature, pressure and humidity from BME280 \"%s\": %v", s.name, err)
 	}
 
-	s.promTemperature.Set(s.temperature)
-	s.promPressure.Set(s.pressure)
-	s.promHumidity.Set(s.humidity)
+	s.mu.Lock()
+	s.temperature = t
+	s.pressure = p
+	s.humidity = h
+	s.updated = time.Now()
+	s.mu.Unlock()
+
+	s.promTemperature.Set(t)
+	s.promPressure.Set(p)
+	s.promHumidity.Set(h)
+	return
+}
+
+func (s *SensorBME280) Close() {
+	s.bme280.Close()
 }
 
 func (s *SensorBME280) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s: %.2f C, %.2f hPa, %.2f rH", s.name, s.temperature, s.pressure, s.humidity)
 }
 
 func (s *SensorBME280) Details() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s - BME280 temperature, pressume and humidity sensor: %.2f C, %.2f hPa, %.2f rH", s.name, s.temperature, s.pressure, s.humidity)
 }
+
+func (s *SensorBME280) Temperature() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewReading(MetricTemperature, s.temperature, UnitCelsius, s.updated)
+}
+
+func (s *SensorBME280) Pressure() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewReading(MetricPressure, s.pressure, UnitHectopascal, s.updated)
+}
+
+func (s *SensorBME280) Humidity() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewReading(MetricHumidity, s.humidity, UnitRelativeHumidity, s.updated)
+}
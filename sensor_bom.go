@@ -4,7 +4,6 @@ import (
 	"fmt"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type SensorBOM struct {
@@ -16,31 +15,41 @@ type SensorBOM struct {
 	windDir     prometheus.Gauge
 }
 
-func NewSensorBOM(name string, debug bool) (s *SensorBOM, err error) {
+func init() {
+	RegisterSensorType(&SensorType{
+		Name:        "bom",
+		Description: "Australian Bureau of Meteorology observations",
+		New: func(sc *SensorConfiguration, config *I2cConfiguration) (Sensor, error) {
+			return NewSensorBOM(sc.Name)
+		},
+	})
+}
+
+func NewSensorBOM(name string) (s *SensorBOM, err error) {
 	s = &SensorBOM{
 		name: name,
 	}
 
-	if s.scanner, err = NewBOMScanner(debug); err != nil {
+	if s.scanner, err = NewBOMScanner(); err != nil {
 		return
 	}
 
-	s.temperature = promauto.NewGauge(prometheus.GaugeOpts{
+	s.temperature = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_temperature",
 		Help: "The current temperature from the BOM",
 	})
 
-	s.windSpeed = promauto.NewGauge(prometheus.GaugeOpts{
+	s.windSpeed = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_wind_speed",
 		Help: "The current wind speed from the BOM",
 	})
 
-	s.windGust = promauto.NewGauge(prometheus.GaugeOpts{
+	s.windGust = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_wind_gust",
 		Help: "The current wind gust speed from the BOM",
 	})
 
-	s.windDir = promauto.NewGauge(prometheus.GaugeOpts{
+	s.windDir = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_wind_dir",
 		Help: "The current wind direction from the BOM",
 	})
@@ -48,17 +57,35 @@ func NewSensorBOM(name string, debug bool) (s *SensorBOM, err error) {
 	return
 }
 
-func (s *SensorBOM) Update() {
-	s.temperature.Set(s.scanner.AirTemp)
-	s.windSpeed.Set(s.scanner.WindSpeed)
-	s.windGust.Set(s.scanner.WindGust)
-	s.windDir.Set(s.scanner.WindDir)
+func (s *SensorBOM) Update() (err error) {
+	o := s.scanner.Observation()
+	s.temperature.Set(o.AirTemp)
+	s.windSpeed.Set(o.WindSpeed)
+	s.windGust.Set(o.WindGust)
+	s.windDir.Set(o.WindDir)
+	return
 }
 
 func (s *SensorBOM) Summary() string {
-	return fmt.Sprintf("%s: %.2f C, %.0f-%.0f kph from %.1f", s.name, s.scanner.AirTemp, s.scanner.WindSpeed, s.scanner.WindGust, s.scanner.WindDir)
+	o := s.scanner.Observation()
+	return fmt.Sprintf("%s: %.2f C, %.0f-%.0f kph from %.1f", s.name, o.AirTemp, o.WindSpeed, o.WindGust, o.WindDir)
 }
 
 func (s *SensorBOM) Details() string {
-	return fmt.Sprintf("%s - Australian BOM scraper: %.2f C, %.0f-%.0f kph from %.1f", s.name, s.scanner.AirTemp, s.scanner.WindSpeed, s.scanner.WindGust, s.scanner.WindDir)
+	o := s.scanner.Observation()
+	return fmt.Sprintf("%s - Australian BOM scraper: %.2f C, %.0f-%.0f kph from %.1f", s.name, o.AirTemp, o.WindSpeed, o.WindGust, o.WindDir)
+}
+
+func (s *SensorBOM) Temperature() Reading {
+	o := s.scanner.Observation()
+	return NewReading(MetricTemperature, o.AirTemp, UnitCelsius, o.Updated)
+}
+
+func (s *SensorBOM) OtherReadings() []Reading {
+	o := s.scanner.Observation()
+	return []Reading{
+		NewReading(MetricWindSpeed, o.WindSpeed, UnitKilometresPerHour, o.Updated),
+		NewReading(MetricWindGust, o.WindGust, UnitKilometresPerHour, o.Updated),
+		NewReading(MetricWindDir, o.WindDir, UnitDegrees, o.Updated),
+	}
 }
@@ -2,17 +2,42 @@ package main
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/drtimf/go-piicodev"
 )
 
 type SensorCAP1203 struct {
 	name    string
-	cap1203 *piicodev.CAP1203
+	cap1203 CAP1203Device
+
+	mu      sync.Mutex
 	status  [3]bool
+	updated time.Time
+}
+
+func init() {
+	RegisterSensorType(&SensorType{
+		Name:           "cap1203",
+		Description:    "CAP1203 capacitive touch sensor",
+		DefaultAddress: piicodev.CAP1203Address,
+		Identify:       identifyReg8(piicodev.CAP1203ProdIDReg, piicodev.CAP1203ProdIDValue),
+		Fields:         i2cFields,
+		Options: []SensorOption{
+			{Name: "sensitivity", Default: 5, Min: 0, Max: 7, Description: "touch sensitivity, from 0 the most sensitive to 7 the least"},
+		},
+		New: func(sc *SensorConfiguration, config *I2cConfiguration) (s Sensor, err error) {
+			var bus BusRef
+			if bus, err = config.SensorBus(sc); err != nil {
+				return
+			}
+			return NewSensorCAP1203(sc.Name, bus, sc.I2CAddress, sc.Options.Int("sensitivity"))
+		},
+	})
 }
 
-func NewSensorCAP1203(name string, i2cAddress uint8) (s *SensorCAP1203, err error) {
+func NewSensorCAP1203(name string, bus BusRef, i2cAddress uint8, sensitivity int) (s *SensorCAP1203, err error) {
 	s = &SensorCAP1203{
 		name: name,
 	}
@@ -21,25 +46,56 @@ func NewSensorCAP1203(name string, i2cAddress uint8) (s *SensorCAP1203, err erro
 		i2cAddress = piicodev.CAP1203Address
 	}
 
-	if s.cap1203, err = piicodev.NewCAP1203(i2cAddress, 1); err != nil {
+	if s.cap1203, err = devices.OpenCAP1203(i2cAddress, bus); err != nil {
 		return
 	}
 
-	s.cap1203.SetSensitivity(5)
+	if err = s.cap1203.SetSensitivity(sensitivity); err != nil {
+		s.cap1203.Close()
+		err = fmt.Errorf("failed to set the sensitivity of CAP1203 \"%s\": %v", name, err)
+	}
+
 	return
 }
 
-func (s *SensorCAP1203) Update() {
-	var err error
-	if s.status[0], s.status[1], s.status[2], err = s.cap1203.Read(); err != nil {
-		fmt.Printf("ERROR: Failed to read capacitive status from CAP1203 \"%s\": %v\n", s.name, err)
+func (s *SensorCAP1203) Update() (err error) {
+	var status [3]bool
+	if status[0], status[1], status[2], err = s.cap1203.Read(); err != nil {
+		return fmt.Errorf("failed to read capacitive status from CAP1203 \"%s\": %v", s.name, err)
 	}
+
+	s.mu.Lock()
+	s.status = status
+	s.updated = time.Now()
+	s.mu.Unlock()
+	return
+}
+
+func (s *SensorCAP1203) Close() {
+	s.cap1203.Close()
 }
 
 func (s *SensorCAP1203) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s: %t,%t,%t", s.name, s.status[0], s.status[1], s.status[2])
 }
 
 func (s *SensorCAP1203) Details() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s - CAP1203 Capacitive Touch Sensor: %t,%t,%t", s.name, s.status[0], s.status[1], s.status[2])
 }
+
+func (s *SensorCAP1203) InputEvents() (events []InputEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, touched := range s.status {
+		if touched {
+			events = append(events, InputEvent{Type: InputEventTouched, Channel: i, Time: s.updated})
+		}
+	}
+
+	return
+}
@@ -6,11 +6,11 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 const DYSON_MESSAGE_CURRENT_STATE = "CURRENT-STATE"
@@ -76,18 +76,23 @@ type SensorDysonHotCool struct {
 	client          mqtt.Client
 	statusTopic     string
 	cmdTopic        string
-	temperature     float64
-	humidity        float64
-	pm25            int
-	pm10            int
-	va10            int
-	noxl            int
+	stop            chan struct{}
 	promTemperature prometheus.Gauge
 	promHumidity    prometheus.Gauge
 	promPM25        prometheus.Gauge
 	promPM10        prometheus.Gauge
 	promVA10        prometheus.Gauge
 	promNOXL        prometheus.Gauge
+
+	// Written from the MQTT client when a message is received
+	mu          sync.Mutex
+	temperature float64
+	humidity    float64
+	pm25        int
+	pm10        int
+	va10        int
+	noxl        int
+	updated     time.Time
 }
 
 func (s *SensorDysonHotCool) onMessageReceived(client mqtt.Client, message mqtt.Message) {
@@ -95,17 +100,21 @@ func (s *SensorDysonHotCool) onMessageReceived(client mqtt.Client, message mqtt.
 	var msg DysonMessageEnvironmentalSensorData
 
 	if err = json.Unmarshal(message.Payload(), &msg); err != nil {
-		fmt.Println("ERROR: Bad JSON MQTT payload", string(message.Payload()), err)
+		logDyson.Error("Bad JSON MQTT payload", "sensor", s.name, "payload", string(message.Payload()), "error", err)
 		return
 	}
 
 	if msg.Message == DYSON_MESSAGE_ENVIRONMENTAL_CURRENT_SENSOR_DATA && msg.Temperature() > 0 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
 		s.temperature = msg.Temperature()
 		s.humidity = float64(msg.Humidity())
 		s.pm25 = msg.ParticulateMatter25()
 		s.pm10 = msg.ParticulateMatter10()
 		s.va10 = msg.VolatileOrganicCompounds()
 		s.noxl = msg.NitrogenDioxide()
+		s.updated = time.Now()
 	}
 }
 
@@ -115,11 +124,28 @@ func (s *SensorDysonHotCool) publishUpdateRequest() {
 			time.Now().UTC().Format("2006-01-02T15:04:05.000Z")))
 }
 
-func NewSensorDysonHotCool(name string, server string, deviceType string, serial string, password string, debug bool) (s *SensorDysonHotCool, err error) {
+func init() {
+	RegisterSensorType(&SensorType{
+		Name:        "dysonhotcool",
+		Description: "Dyson Hot+Cool fan environmental sensor over MQTT",
+		Fields: []SensorConfigField{
+			{Name: "server", Required: true, Description: "MQTT broker URL of the fan"},
+			{Name: "devicetype", Required: true, Description: "Dyson product type code"},
+			{Name: "serial", Required: true, Description: "Serial number, also the MQTT user name"},
+			{Name: "password", Required: true, Secret: true, Description: "MQTT password"},
+		},
+		New: func(sc *SensorConfiguration, config *I2cConfiguration) (Sensor, error) {
+			return NewSensorDysonHotCool(sc.Name, sc.Server, sc.DeviceType, sc.Serial, sc.Password)
+		},
+	})
+}
+
+func NewSensorDysonHotCool(name string, server string, deviceType string, serial string, password string) (s *SensorDysonHotCool, err error) {
 	s = &SensorDysonHotCool{
 		name:        name,
 		statusTopic: fmt.Sprintf("%s/%s/status/current", deviceType, serial),
 		cmdTopic:    fmt.Sprintf("%s/%s/command", deviceType, serial),
+		stop:        make(chan struct{}),
 	}
 
 	hostname, _ := os.Hostname()
@@ -130,7 +156,8 @@ func NewSensorDysonHotCool(name string, server string, deviceType string, serial
 
 	connOpts.OnConnect = func(c mqtt.Client) {
 		if token := c.Subscribe(s.statusTopic, 0, s.onMessageReceived); token.Wait() && token.Error() != nil {
-			panic(token.Error())
+			logDyson.Error("Failed to subscribe", "sensor", s.name, "topic", s.statusTopic, "error", token.Error())
+			return
 		}
 
 		time.Sleep(1 * time.Second)
@@ -139,45 +166,54 @@ func NewSensorDysonHotCool(name string, server string, deviceType string, serial
 
 	s.client = mqtt.NewClient(connOpts)
 	if token := s.client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+		err = fmt.Errorf("failed to connect to Dyson \"%s\" at %s: %v", name, server, token.Error())
+		return
 	} else {
-		fmt.Printf("Connected to %s\n", server)
+		logDyson.Info("Connected", "sensor", name, "server", server)
 	}
 
-	s.promTemperature = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promTemperature = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_temperature",
 		Help: "Temperature from a Dyson Hot-Cool sensor",
 	})
 
-	s.promHumidity = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promHumidity = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_humidity",
 		Help: "Humidity from a Dyson Hot-Cool sensor",
 	})
 
-	s.promPM25 = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promPM25 = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_pm25",
 		Help: "Particulate Matter 2.5 from a Dyson Hot-Cool sensor",
 	})
 
-	s.promPM10 = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promPM10 = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_pm10",
 		Help: "Particulate Matter 10 from a Dyson Hot-Cool sensor",
 	})
 
-	s.promVA10 = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promVA10 = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_va10",
 		Help: "Volatile Organic Compounds from a Dyson Hot-Cool sensor",
 	})
 
-	s.promNOXL = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promNOXL = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_noxl",
 		Help: "Nitrogen Dioxide from a Dyson Hot-Cool sensor",
 	})
 
 	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+
 		for {
 			s.publishUpdateRequest()
-			time.Sleep(5 * time.Second)
+
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
 		}
 	}()
 
@@ -185,19 +221,57 @@ func NewSensorDysonHotCool(name string, server string, deviceType string, serial
 	return
 }
 
-func (s *SensorDysonHotCool) Update() {
-	s.promTemperature.Set(s.temperature)
-	s.promHumidity.Set(s.humidity)
-	s.promPM25.Set(float64(s.pm25))
-	s.promPM10.Set(float64(s.pm10))
-	s.promVA10.Set(float64(s.va10))
-	s.promNOXL.Set(float64(s.noxl))
+func (s *SensorDysonHotCool) Update() (err error) {
+	s.mu.Lock()
+	temperature, humidity := s.temperature, s.humidity
+	pm25, pm10, va10, noxl := s.pm25, s.pm10, s.va10, s.noxl
+	s.mu.Unlock()
+
+	s.promTemperature.Set(temperature)
+	s.promHumidity.Set(humidity)
+	s.promPM25.Set(float64(pm25))
+	s.promPM10.Set(float64(pm10))
+	s.promVA10.Set(float64(va10))
+	s.promNOXL.Set(float64(noxl))
+	return
+}
+
+func (s *SensorDysonHotCool) Close() {
+	close(s.stop)
+	s.client.Disconnect(250)
 }
 
 func (s *SensorDysonHotCool) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s: %.2f C, %.2f rH", s.name, s.temperature, s.humidity)
 }
 
 func (s *SensorDysonHotCool) Details() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s - Dyson Hot-Cool temperature and humidity: %.2f C, %.2f rH", s.name, s.temperature, s.humidity)
 }
+
+func (s *SensorDysonHotCool) Temperature() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewReading(MetricTemperature, s.temperature, UnitCelsius, s.updated)
+}
+
+func (s *SensorDysonHotCool) Humidity() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewReading(MetricHumidity, s.humidity, UnitRelativeHumidity, s.updated)
+}
+
+func (s *SensorDysonHotCool) AirQuality() []Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []Reading{
+		NewReading(MetricPM25, float64(s.pm25), UnitMicrogramsPerCubicMetre, s.updated),
+		NewReading(MetricPM10, float64(s.pm10), UnitMicrogramsPerCubicMetre, s.updated),
+		NewReading(MetricVOCIndex, float64(s.va10), UnitIndex, s.updated),
+		NewReading(MetricNO2Index, float64(s.noxl), UnitIndex, s.updated),
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestDysonMessageEnvironmentalSensorData(t *testing.T) {
+	tests := []struct {
+		payload     string
+		temperature float64
+		humidity    int
+		pm25        int
+		pm10        int
+		va10        int
+		noxl        int
+	}{
+		{`{"msg":"ENVIRONMENTAL-CURRENT-SENSOR-DATA","time":"2024-05-13T05:30:00.000Z","data":{"tact":"2951","hact":"45","pm25":"3","pm10":"4","va10":"5","noxl":"6","p25r":"3","p10r":"4","sltm":"OFF"}}`, 21.95, 45, 3, 4, 5, 6},
+		{`{"msg":"ENVIRONMENTAL-CURRENT-SENSOR-DATA","data":{"tact":"2731","hact":"0100","pm25":"0000","pm10":"0012","va10":"0001","noxl":"0000"}}`, -0.05, 100, 0, 12, 1, 0},
+
+		// The fan reports OFF for values it is not measuring, which read as zero
+		{`{"msg":"ENVIRONMENTAL-CURRENT-SENSOR-DATA","data":{"tact":"OFF","hact":"OFF","pm25":"INIT","pm10":"INIT","va10":"INIT","noxl":"INIT"}}`, -273.15, 0, 0, 0, 0, 0},
+		{`{"msg":"ENVIRONMENTAL-CURRENT-SENSOR-DATA","data":{}}`, -273.15, 0, 0, 0, 0, 0},
+	}
+
+	for _, test := range tests {
+		var msg DysonMessageEnvironmentalSensorData
+		if err := json.Unmarshal([]byte(test.payload), &msg); err != nil {
+			t.Fatalf("failed to parse %s: %v", test.payload, err)
+		}
+
+		if msg.Message != DYSON_MESSAGE_ENVIRONMENTAL_CURRENT_SENSOR_DATA {
+			t.Errorf("unexpected message type %q", msg.Message)
+		}
+
+		if temperature := msg.Temperature(); math.Abs(temperature-test.temperature) > 1e-9 {
+			t.Errorf("%s: expected temperature %f, got %f", test.payload, test.temperature, temperature)
+		}
+
+		if msg.Humidity() != test.humidity || msg.ParticulateMatter25() != test.pm25 || msg.ParticulateMatter10() != test.pm10 ||
+			msg.VolatileOrganicCompounds() != test.va10 || msg.NitrogenDioxide() != test.noxl {
+			t.Errorf("%s: expected %d,%d,%d,%d,%d, got %d,%d,%d,%d,%d", test.payload,
+				test.humidity, test.pm25, test.pm10, test.va10, test.noxl,
+				msg.Humidity(), msg.ParticulateMatter25(), msg.ParticulateMatter10(), msg.VolatileOrganicCompounds(), msg.NitrogenDioxide())
+		}
+	}
+}
+
+func TestSensorDysonHotCoolIgnoresOtherMessages(t *testing.T) {
+	s := &SensorDysonHotCool{name: "dyson"}
+
+	for _, payload := range []string{
+		`{"msg":"CURRENT-STATE","product-state":{"fpwr":"ON"}}`,
+		`{"msg":"ENVIRONMENTAL-CURRENT-SENSOR-DATA","data":{"tact":"OFF","hact":"50"}}`,
+		`not json`,
+	} {
+		s.onMessageReceived(nil, &testMQTTMessage{payload: []byte(payload)})
+	}
+
+	if r := s.Humidity(); !r.Time.IsZero() || r.Value != 0 {
+		t.Errorf("expected no reading from messages without sensor data, got %+v", r)
+	}
+}
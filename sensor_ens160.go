@@ -1,29 +1,52 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/drtimf/go-piicodev"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type SensorENS160 struct {
-	name       string
-	ens160     *piicodev.ENS160
+	name   string
+	ens160 ENS160Device
+
+	promAQI  prometheus.Gauge
+	promTVOC prometheus.Gauge
+	promECO2 prometheus.Gauge
+
+	mu         sync.Mutex
 	operation  string
 	aqi        byte
 	aqiRating  string
 	tvoc       uint16
 	eco2       uint16
 	eco2Rating string
+	updated    time.Time
+}
 
-	promAQI  prometheus.Gauge
-	promTVOC prometheus.Gauge
-	promECO2 prometheus.Gauge
+func init() {
+	RegisterSensorType(&SensorType{
+		Name:               "ens160",
+		Description:        "ENS160 air quality sensor",
+		DefaultAddress:     piicodev.ENS160Address,
+		AlternateAddresses: []uint8{0x52},
+		Identify:           identifyReg16(0x00, binary.LittleEndian, 0xFFFF, 0x0160),
+		Fields:             i2cFields,
+		New: func(sc *SensorConfiguration, config *I2cConfiguration) (s Sensor, err error) {
+			var bus BusRef
+			if bus, err = config.SensorBus(sc); err != nil {
+				return
+			}
+			return NewSensorENS160(sc.Name, bus, sc.I2CAddress)
+		},
+	})
 }
 
-func NewSensorENS160(name string, i2cAddress uint8) (s *SensorENS160, err error) {
+func NewSensorENS160(name string, bus BusRef, i2cAddress uint8) (s *SensorENS160, err error) {
 	s = &SensorENS160{
 		name: name,
 	}
@@ -32,63 +55,86 @@ func NewSensorENS160(name string, i2cAddress uint8) (s *SensorENS160, err error)
 		i2cAddress = piicodev.ENS160Address
 	}
 
-	if s.ens160, err = piicodev.NewENS160(i2cAddress, 1); err != nil {
+	if s.ens160, err = devices.OpenENS160(i2cAddress, bus); err != nil {
 		return
 	}
 
-	s.promAQI = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promAQI = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_aqi",
 		Help: "Air quality index from a ENS160 sensor",
 	})
 
-	s.promTVOC = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promTVOC = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_tvoc",
 		Help: "True volatile organic compounds from a ENS160 sensor",
 	})
 
-	s.promECO2 = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promECO2 = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_eco2",
 		Help: "CO2-equivalents from a ENS160 sensor",
 	})
 	return
 }
 
-func (s *SensorENS160) Update() {
-	if operation, err := s.ens160.GetOperation(); err != nil {
-		fmt.Printf("ERROR: Failed to read the operation from ENS160 \"%s\": %v\n", s.name, err)
-	} else {
-		s.operation = operation
+func (s *SensorENS160) Update() (err error) {
+	var operation, aqiRating, eco2Rating string
+	var aqi byte
+	var tvoc, eco2 uint16
+
+	if operation, err = s.ens160.GetOperation(); err != nil {
+		return fmt.Errorf("failed to read the operation from ENS160 \"%s\": %v", s.name, err)
 	}
 
-	if aqi, aqiRating, err := s.ens160.ReadAQI(); err != nil {
-		fmt.Printf("ERROR: Failed to read the AQI from ENS160 \"%s\": %v\n", s.name, err)
-	} else {
-		s.aqi = aqi
-		s.aqiRating = aqiRating
+	if aqi, aqiRating, err = s.ens160.ReadAQI(); err != nil {
+		return fmt.Errorf("failed to read the AQI from ENS160 \"%s\": %v", s.name, err)
 	}
 
-	if tvoc, err := s.ens160.ReadTVOC(); err != nil {
-		fmt.Printf("ERROR: Failed to read the TVOC from ENS160 \"%s\": %v\n", s.name, err)
-	} else {
-		s.tvoc = tvoc
+	if tvoc, err = s.ens160.ReadTVOC(); err != nil {
+		return fmt.Errorf("failed to read the TVOC from ENS160 \"%s\": %v", s.name, err)
 	}
 
-	if eco2, eco2Rating, err := s.ens160.ReadECO2(); err != nil {
-		fmt.Printf("ERROR: Failed to read the ECO2 from ENS160 \"%s\": %v\n", s.name, err)
-	} else {
-		s.eco2 = eco2
-		s.eco2Rating = eco2Rating
+	if eco2, eco2Rating, err = s.ens160.ReadECO2(); err != nil {
+		return fmt.Errorf("failed to read the ECO2 from ENS160 \"%s\": %v", s.name, err)
 	}
 
-	s.promAQI.Set(float64(s.aqi))
-	s.promTVOC.Set(float64(s.tvoc))
-	s.promECO2.Set(float64(s.eco2))
+	s.mu.Lock()
+	s.operation = operation
+	s.aqi = aqi
+	s.aqiRating = aqiRating
+	s.tvoc = tvoc
+	s.eco2 = eco2
+	s.eco2Rating = eco2Rating
+	s.updated = time.Now()
+	s.mu.Unlock()
+
+	s.promAQI.Set(float64(aqi))
+	s.promTVOC.Set(float64(tvoc))
+	s.promECO2.Set(float64(eco2))
+	return
+}
+
+func (s *SensorENS160) Close() {
+	s.ens160.Close()
 }
 
 func (s *SensorENS160) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s: [%s], %d (%s) AQI, %d TVOC, %d ppm (%s) eCO2", s.name, s.operation, s.aqi, s.aqiRating, s.tvoc, s.eco2, s.eco2Rating)
 }
 
 func (s *SensorENS160) Details() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s - ENS160 Air Quality Sensor: [%s], %d (%s) AQI, %d TVOC, %d ppm (%s) eCO2", s.name, s.operation, s.aqi, s.aqiRating, s.tvoc, s.eco2, s.eco2Rating)
 }
+
+func (s *SensorENS160) AirQuality() []Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []Reading{
+		NewReading(MetricAQI, float64(s.aqi), UnitIndex, s.updated),
+		NewReading(MetricTVOC, float64(s.tvoc), UnitPartsPerBillion, s.updated),
+		NewReading(MetricECO2, float64(s.eco2), UnitPartsPerMillion, s.updated),
+	}
+}
@@ -2,22 +2,46 @@ package main
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/drtimf/go-piicodev"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type SensorMS5637 struct {
 	name            string
-	ms5637          *piicodev.MS5637
-	pressure        float64
-	temperature     float64
+	ms5637          MS5637Device
 	promPressure    prometheus.Gauge
 	promTemperature prometheus.Gauge
+
+	mu          sync.Mutex
+	pressure    float64
+	temperature float64
+	updated     time.Time
+}
+
+func init() {
+	RegisterSensorType(&SensorType{
+		Name:           "ms5637",
+		Description:    "MS5637 pressure sensor",
+		DefaultAddress: piicodev.MS5637Address,
+		Fields:         i2cFields,
+		Options:        temperatureLimitOptions,
+		New: func(sc *SensorConfiguration, config *I2cConfiguration) (s Sensor, err error) {
+			var bus BusRef
+			if bus, err = config.SensorBus(sc); err != nil {
+				return
+			}
+			if _, err = temperatureLimits(sc.Options); err != nil {
+				return
+			}
+			return NewSensorMS5637(sc.Name, bus, sc.I2CAddress)
+		},
+	})
 }
 
-func NewSensorMS5637(name string, i2cAddress uint8) (s *SensorMS5637, err error) {
+func NewSensorMS5637(name string, bus BusRef, i2cAddress uint8) (s *SensorMS5637, err error) {
 	s = &SensorMS5637{
 		name: name,
 	}
@@ -26,16 +50,16 @@ func NewSensorMS5637(name string, i2cAddress uint8) (s *SensorMS5637, err error)
 		i2cAddress = piicodev.MS5637Address
 	}
 
-	if s.ms5637, err = piicodev.NewMS5637(i2cAddress, 1); err != nil {
+	if s.ms5637, err = devices.OpenMS5637(i2cAddress, bus); err != nil {
 		return
 	}
 
-	s.promPressure = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promPressure = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_pressure",
 		Help: "Pressure from a MS5637 sensor",
 	})
 
-	s.promTemperature = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promTemperature = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_temperature",
 		Help: "Temperature from a MS5637 sensor",
 	})
@@ -43,24 +67,47 @@ func NewSensorMS5637(name string, i2cAddress uint8) (s *SensorMS5637, err error)
 	return
 }
 
-func (s *SensorMS5637) Update() {
-	if p, t, err := s.ms5637.Read(); err != nil {
-		fmt.Printf("ERROR: Failed to read pressure and temperature from MS5637 \"%s\": %v\n", s.name, err)
-	} else {
-		if t < 100 && t > -100 {
-			s.pressure = p
-			s.temperature = t
-		}
+func (s *SensorMS5637) Update() (err error) {
+	var p, t float64
+	if p, t, err = s.ms5637.Read(); err != nil {
+		return fmt.Errorf("failed to read pressure and temperature from MS5637 \"%s\": %v", s.name, err)
 	}
 
-	s.promPressure.Set(s.pressure)
-	s.promTemperature.Set(s.temperature)
+	s.mu.Lock()
+	s.pressure = p
+	s.temperature = t
+	s.updated = time.Now()
+	s.mu.Unlock()
+
+	s.promPressure.Set(p)
+	s.promTemperature.Set(t)
+	return
+}
+
+func (s *SensorMS5637) Close() {
+	s.ms5637.Close()
 }
 
 func (s *SensorMS5637) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s: %.2f hPa, %.2f C", s.name, s.pressure, s.temperature)
 }
 
 func (s *SensorMS5637) Details() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s - MS5637 Pressure Sensor: %.2f hPa, %.2f C", s.name, s.pressure, s.temperature)
 }
+
+func (s *SensorMS5637) Temperature() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewReading(MetricTemperature, s.temperature, UnitCelsius, s.updated)
+}
+
+func (s *SensorMS5637) Pressure() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewReading(MetricPressure, s.pressure, UnitHectopascal, s.updated)
+}
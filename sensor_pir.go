@@ -2,89 +2,164 @@ package main
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/drtimf/go-piicodev"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type SensorPIR struct {
 	name              string
-	movementTriggered bool
-	movement          bool
+	pir               PIRDevice
 	promMovement      prometheus.Gauge
 	promMovementCount prometheus.Counter
+	stop              chan struct{}
+	done              chan struct{}
+
+	// Written by the sampling goroutine
+	mu                sync.Mutex
+	movementTriggered bool
+	movement          bool
+	updated           time.Time
+	err               error
 }
 
-func NewSensorPIR(name string, i2cAddress uint8) (s *SensorPIR, err error) {
+func init() {
+	RegisterSensorType(&SensorType{
+		Name:               "pir",
+		Description:        "SparkFun Qwiic PIR motion sensor",
+		DefaultAddress:     piicodev.QwiicPIRAddress,
+		AlternateAddresses: []uint8{0x13},
+		Identify:           identifyReg8(piicodev.QwiicPIRDeviceIDReg, piicodev.QwiicPIRDeviceID),
+		Fields:             i2cFields,
+		New: func(sc *SensorConfiguration, config *I2cConfiguration) (s Sensor, err error) {
+			var bus BusRef
+			if bus, err = config.SensorBus(sc); err != nil {
+				return
+			}
+			return NewSensorPIR(sc.Name, bus, sc.I2CAddress)
+		},
+	})
+}
+
+func NewSensorPIR(name string, bus BusRef, i2cAddress uint8) (s *SensorPIR, err error) {
 	s = &SensorPIR{
 		name: name,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
 	}
 
 	if i2cAddress == 0 {
 		i2cAddress = piicodev.QwiicPIRAddress
 	}
 
-	s.promMovement = promauto.NewGauge(prometheus.GaugeOpts{
+	if s.pir, err = devices.OpenPIR(i2cAddress, bus); err != nil {
+		return
+	}
+
+	s.promMovement = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_movement",
 		Help: "Movement detected",
 	})
 
-	s.promMovementCount = promauto.NewCounter(prometheus.CounterOpts{
+	s.promMovementCount = registerCounter(prometheus.CounterOpts{
 		Name: name + "_movement_count",
 		Help: "Number of movement events recorded by the PIR sensor",
 	})
 
-	go func() {
-		for {
-			var pir *piicodev.QwiicPIR = nil
-
-			if pir, err = piicodev.NewQwiicPIR(i2cAddress, 1); err != nil {
-				fmt.Printf("ERROR: Failed to open PIR sensor \"%s\": %v\n", s.name, err)
-			} else {
-				var nv, s1, s2, s3 bool
-
-				for {
-					if nv, err = pir.GetRawReading(); err != nil {
-						fmt.Printf("ERROR: Failed to read movement from PIR sensor \"%s\": %v\n", s.name, err)
-						break
-					} else {
-						s1 = s2
-						s2 = s3
-						s3 = nv
-
-						if s1 && s2 && s3 {
-							s.movementTriggered = true
-						}
-					}
-
-					time.Sleep(250 * time.Millisecond)
-				}
-			}
+	go s.sample()
+	return
+}
+
+// sample reads the PIR every 250ms and latches movement when three readings in a row detect it.
+// It stops on the first read error, which is then returned by Update so that the sensor is reopened.
+func (s *SensorPIR) sample() {
+	defer close(s.done)
 
-			time.Sleep(5 * time.Second)
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	var s1, s2, s3 bool
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
 		}
-	}()
 
-	return
+		nv, err := s.pir.GetRawReading()
+		if err != nil {
+			s.mu.Lock()
+			s.err = fmt.Errorf("failed to read movement from PIR sensor \"%s\": %v", s.name, err)
+			s.mu.Unlock()
+			return
+		}
+
+		s1 = s2
+		s2 = s3
+		s3 = nv
+
+		if s1 && s2 && s3 {
+			s.triggerMovement()
+		}
+	}
+}
+
+func (s *SensorPIR) Close() {
+	close(s.stop)
+	<-s.done
+	s.pir.Close()
+}
+
+// triggerMovement latches movement until the next Update
+func (s *SensorPIR) triggerMovement() {
+	s.mu.Lock()
+	s.movementTriggered = true
+	s.mu.Unlock()
 }
 
-func (s *SensorPIR) Update() {
+func (s *SensorPIR) Update() (err error) {
+	s.mu.Lock()
+	err = s.err
 	s.movement = s.movementTriggered
 	s.movementTriggered = false
 	if s.movement {
+		s.updated = time.Now()
+	}
+	movement := s.movement
+	s.mu.Unlock()
+
+	if movement {
 		s.promMovement.Set(1)
 		s.promMovementCount.Inc()
 	} else {
 		s.promMovement.Set(0)
 	}
+
+	return
 }
 
 func (s *SensorPIR) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s: %t", s.name, s.movement)
 }
 
 func (s *SensorPIR) Details() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s - SparkFun Electronics Qwiic PIR: %t", s.name, s.movement)
 }
+
+func (s *SensorPIR) InputEvents() (events []InputEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.movement {
+		events = append(events, InputEvent{Type: InputEventMotion, Time: s.updated})
+	}
+
+	return
+}
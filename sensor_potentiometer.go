@@ -1,16 +1,23 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/drtimf/go-piicodev"
 )
 
 type SensorPotentiometer struct {
-	name    string
-	pot     *piicodev.Potentiometer
+	name      string
+	pot       PotentiometerDevice
+	threshold int
+
+	mu      sync.Mutex
 	value   uint16
 	changed bool
+	updated time.Time
 }
 
 func abs(v int) int {
@@ -20,45 +27,91 @@ func abs(v int) int {
 	return v
 }
 
-func NewSensorPotentiometer(name string, i2cAddress uint8) (s *SensorPotentiometer, err error) {
+func init() {
+	RegisterSensorType(&SensorType{
+		Name:           "potentiometer",
+		Description:    "PiicoDev potentiometer",
+		DefaultAddress: piicodev.PotentiometerAddress,
+		Identify:       identifyReg16(0x01, binary.BigEndian, 0xFFFF, 379, 411),
+		Fields:         i2cFields,
+		Options: []SensorOption{
+			{Name: "threshold", Default: 5, Min: 0, Max: 1023, Description: "change in the raw value, from 0 to 1023, which is reported"},
+		},
+		New: func(sc *SensorConfiguration, config *I2cConfiguration) (s Sensor, err error) {
+			var bus BusRef
+			if bus, err = config.SensorBus(sc); err != nil {
+				return
+			}
+			return NewSensorPotentiometer(sc.Name, bus, sc.I2CAddress, sc.Options.Int("threshold"))
+		},
+	})
+}
+
+func NewSensorPotentiometer(name string, bus BusRef, i2cAddress uint8, threshold int) (s *SensorPotentiometer, err error) {
 	s = &SensorPotentiometer{
-		name: name,
+		name:      name,
+		threshold: threshold,
 	}
 
 	if i2cAddress == 0 {
 		i2cAddress = piicodev.PotentiometerAddress
 	}
 
-	if s.pot, err = piicodev.NewPotentiometer(i2cAddress, 1); err != nil {
+	if s.pot, err = devices.OpenPotentiometer(i2cAddress, bus); err != nil {
 		return
 	}
 
 	s.pot.SetLED(false)
 
-	s.value, err = s.pot.ReadRawValue()
+	if s.value, err = s.pot.ReadRawValue(); err != nil {
+		s.pot.Close()
+	}
 
 	return
 }
 
-func (s *SensorPotentiometer) Update() {
-	var err error
+func (s *SensorPotentiometer) Update() (err error) {
 	var newValue uint16
 	if newValue, err = s.pot.ReadRawValue(); err != nil {
-		fmt.Printf("ERROR: Failed to read raw value from Potentiometer \"%s\": %v\n", s.name, err)
-		return
+		return fmt.Errorf("failed to read raw value from Potentiometer \"%s\": %v", s.name, err)
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	s.changed = false
-	if abs(int(newValue)-int(s.value)) > 5 {
+	if abs(int(newValue)-int(s.value)) > s.threshold {
 		s.changed = true
 		s.value = newValue
+		s.updated = time.Now()
 	}
+
+	return
+}
+
+func (s *SensorPotentiometer) Close() {
+	s.pot.Close()
 }
 
 func (s *SensorPotentiometer) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s: %t,%d", s.name, s.changed, s.value)
 }
 
 func (s *SensorPotentiometer) Details() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s - Potentiometer: %t,%d", s.name, s.changed, s.value)
 }
+
+func (s *SensorPotentiometer) InputEvents() (events []InputEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.changed {
+		events = append(events, InputEvent{Type: InputEventValueChanged, Value: float64(s.value), Time: s.updated})
+	}
+
+	return
+}
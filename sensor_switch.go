@@ -1,19 +1,42 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/drtimf/go-piicodev"
 )
 
 type SensorSwitch struct {
-	name             string
-	sw               *piicodev.Switch
+	name string
+	sw   SwitchDevice
+
+	mu               sync.Mutex
 	wasPressed       bool
 	wasDoublePressed bool
+	updated          time.Time
+}
+
+func init() {
+	RegisterSensorType(&SensorType{
+		Name:           "switch",
+		Description:    "PiicoDev switch",
+		DefaultAddress: piicodev.SwitchAddress,
+		Identify:       identifyReg16(0x01, binary.BigEndian, 0xFFFF, 409),
+		Fields:         i2cFields,
+		New: func(sc *SensorConfiguration, config *I2cConfiguration) (s Sensor, err error) {
+			var bus BusRef
+			if bus, err = config.SensorBus(sc); err != nil {
+				return
+			}
+			return NewSensorSwitch(sc.Name, bus, sc.I2CAddress)
+		},
+	})
 }
 
-func NewSensorSwitch(name string, i2cAddress uint8) (s *SensorSwitch, err error) {
+func NewSensorSwitch(name string, bus BusRef, i2cAddress uint8) (s *SensorSwitch, err error) {
 	s = &SensorSwitch{
 		name: name,
 	}
@@ -22,7 +45,7 @@ func NewSensorSwitch(name string, i2cAddress uint8) (s *SensorSwitch, err error)
 		i2cAddress = piicodev.SwitchAddress
 	}
 
-	if s.sw, err = piicodev.NewSwitch(i2cAddress, 1); err != nil {
+	if s.sw, err = devices.OpenSwitch(i2cAddress, bus); err != nil {
 		return
 	}
 
@@ -31,22 +54,52 @@ func NewSensorSwitch(name string, i2cAddress uint8) (s *SensorSwitch, err error)
 	return
 }
 
-func (s *SensorSwitch) Update() {
-	var err error
+func (s *SensorSwitch) Update() (err error) {
+	var wasPressed, wasDoublePressed bool
 
-	if s.wasPressed, err = s.sw.WasPressed(); err != nil {
-		fmt.Printf("ERROR: Failed to read pressed status from Switch \"%s\": %v\n", s.name, err)
+	if wasPressed, err = s.sw.WasPressed(); err != nil {
+		return fmt.Errorf("failed to read pressed status from Switch \"%s\": %v", s.name, err)
 	}
 
-	if s.wasDoublePressed, err = s.sw.WasDoublePressed(); err != nil {
-		fmt.Printf("ERROR: Failed to read double-pressed status from Switch \"%s\": %v\n", s.name, err)
+	if wasDoublePressed, err = s.sw.WasDoublePressed(); err != nil {
+		return fmt.Errorf("failed to read double-pressed status from Switch \"%s\": %v", s.name, err)
 	}
+
+	s.mu.Lock()
+	s.wasPressed = wasPressed
+	s.wasDoublePressed = wasDoublePressed
+	s.updated = time.Now()
+	s.mu.Unlock()
+	return
+}
+
+func (s *SensorSwitch) Close() {
+	s.sw.Close()
 }
 
 func (s *SensorSwitch) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s: %t,%t", s.name, s.wasPressed, s.wasDoublePressed)
 }
 
 func (s *SensorSwitch) Details() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s - Switch: %t,%t", s.name, s.wasPressed, s.wasDoublePressed)
 }
+
+func (s *SensorSwitch) InputEvents() (events []InputEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wasPressed {
+		events = append(events, InputEvent{Type: InputEventPressed, Time: s.updated})
+	}
+
+	if s.wasDoublePressed {
+		events = append(events, InputEvent{Type: InputEventDoublePressed, Time: s.updated})
+	}
+
+	return
+}
@@ -1,21 +1,48 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/drtimf/go-piicodev"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type SensorTMP117 struct {
 	name            string
-	tmp117          *piicodev.TMP117
-	temperature     float64
+	tmp117          TMP117Device
 	promTemperature prometheus.Gauge
+
+	mu          sync.Mutex
+	temperature float64
+	updated     time.Time
 }
 
-func NewSensorTMP117(name string, i2cAddress uint8) (s *SensorTMP117, err error) {
+func init() {
+	RegisterSensorType(&SensorType{
+		Name:               "tmp117",
+		Description:        "TMP117 precision temperature sensor",
+		DefaultAddress:     piicodev.TMP117Address,
+		AlternateAddresses: []uint8{0x49, 0x4A, 0x4B},
+		Identify:           identifyReg16(0x0F, binary.BigEndian, 0x0FFF, 0x0117),
+		Fields:             i2cFields,
+		Options:            temperatureLimitOptions,
+		New: func(sc *SensorConfiguration, config *I2cConfiguration) (s Sensor, err error) {
+			var bus BusRef
+			if bus, err = config.SensorBus(sc); err != nil {
+				return
+			}
+			if _, err = temperatureLimits(sc.Options); err != nil {
+				return
+			}
+			return NewSensorTMP117(sc.Name, bus, sc.I2CAddress)
+		},
+	})
+}
+
+func NewSensorTMP117(name string, bus BusRef, i2cAddress uint8) (s *SensorTMP117, err error) {
 	s = &SensorTMP117{
 		name: name,
 	}
@@ -24,11 +51,11 @@ func NewSensorTMP117(name string, i2cAddress uint8) (s *SensorTMP117, err error)
 		i2cAddress = piicodev.TMP117Address
 	}
 
-	if s.tmp117, err = piicodev.NewTMP117(i2cAddress, 1); err != nil {
+	if s.tmp117, err = devices.OpenTMP117(i2cAddress, bus); err != nil {
 		return
 	}
 
-	s.promTemperature = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promTemperature = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_temperature",
 		Help: "Temperature from a TMP117 sensor",
 	})
@@ -36,22 +63,39 @@ func NewSensorTMP117(name string, i2cAddress uint8) (s *SensorTMP117, err error)
 	return
 }
 
-func (s *SensorTMP117) Update() {
-	if t, err := s.tmp117.ReadTempC(); err != nil {
-		fmt.Printf("ERROR: Failed to read temperature from TMP117 \"%s\": %v\n", s.name, err)
-	} else {
-		if t < 100 && t > -100 {
-			s.temperature = t
-		}
+func (s *SensorTMP117) Update() (err error) {
+	var t float64
+	if t, err = s.tmp117.ReadTempC(); err != nil {
+		return fmt.Errorf("failed to read temperature from TMP117 \"%s\": %v", s.name, err)
 	}
 
-	s.promTemperature.Set(s.temperature)
+	s.mu.Lock()
+	s.temperature = t
+	s.updated = time.Now()
+	s.mu.Unlock()
+
+	s.promTemperature.Set(t)
+	return
+}
+
+func (s *SensorTMP117) Close() {
+	s.tmp117.Close()
 }
 
 func (s *SensorTMP117) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s: %.2f C", s.name, s.temperature)
 }
 
 func (s *SensorTMP117) Details() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s - TMP117 Precision Temperature Sensor: %.2f C", s.name, s.temperature)
 }
+
+func (s *SensorTMP117) Temperature() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewReading(MetricTemperature, s.temperature, UnitCelsius, s.updated)
+}
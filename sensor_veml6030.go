@@ -2,20 +2,41 @@ package main
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/drtimf/go-piicodev"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type SensorVEML6030 struct {
 	name           string
-	veml6030       *piicodev.VEML6030
-	lightLevel     float64
+	veml6030       VEML6030Device
 	promLightLevel prometheus.Gauge
+
+	mu         sync.Mutex
+	lightLevel float64
+	updated    time.Time
 }
 
-func NewSensorVEML6030(name string, i2cAddress uint8) (s *SensorVEML6030, err error) {
+func init() {
+	RegisterSensorType(&SensorType{
+		Name:               "veml6030",
+		Description:        "VEML6030 ambient light sensor",
+		DefaultAddress:     piicodev.VEML6030Address,
+		AlternateAddresses: []uint8{0x48},
+		Fields:             i2cFields,
+		New: func(sc *SensorConfiguration, config *I2cConfiguration) (s Sensor, err error) {
+			var bus BusRef
+			if bus, err = config.SensorBus(sc); err != nil {
+				return
+			}
+			return NewSensorVEML6030(sc.Name, bus, sc.I2CAddress)
+		},
+	})
+}
+
+func NewSensorVEML6030(name string, bus BusRef, i2cAddress uint8) (s *SensorVEML6030, err error) {
 	s = &SensorVEML6030{
 		name: name,
 	}
@@ -24,11 +45,11 @@ func NewSensorVEML6030(name string, i2cAddress uint8) (s *SensorVEML6030, err er
 		i2cAddress = piicodev.VEML6030Address
 	}
 
-	if s.veml6030, err = piicodev.NewVEML6030(i2cAddress, 1); err != nil {
+	if s.veml6030, err = devices.OpenVEML6030(i2cAddress, bus); err != nil {
 		return
 	}
 
-	s.promLightLevel = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promLightLevel = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_light_level",
 		Help: "Light level from a VEML6030 sensor",
 	})
@@ -36,20 +57,39 @@ func NewSensorVEML6030(name string, i2cAddress uint8) (s *SensorVEML6030, err er
 	return
 }
 
-func (s *SensorVEML6030) Update() {
-	if l, err := s.veml6030.Read(); err != nil {
-		fmt.Printf("ERROR: Failed to read light level from VEML6040 \"%s\": %v\n", s.name, err)
-	} else {
-		s.lightLevel = l
+func (s *SensorVEML6030) Update() (err error) {
+	var l float64
+	if l, err = s.veml6030.Read(); err != nil {
+		return fmt.Errorf("failed to read light level from VEML6030 \"%s\": %v", s.name, err)
 	}
 
-	s.promLightLevel.Set(s.lightLevel)
+	s.mu.Lock()
+	s.lightLevel = l
+	s.updated = time.Now()
+	s.mu.Unlock()
+
+	s.promLightLevel.Set(l)
+	return
+}
+
+func (s *SensorVEML6030) Close() {
+	s.veml6030.Close()
 }
 
 func (s *SensorVEML6030) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s: %.2f lux", s.name, s.lightLevel)
 }
 
 func (s *SensorVEML6030) Details() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s - VEML6030 Ambient Light Sensor: %.2f lux", s.name, s.lightLevel)
 }
+
+func (s *SensorVEML6030) LightLevel() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewReading(MetricLightLevel, s.lightLevel, UnitLux, s.updated)
+}
@@ -2,33 +2,59 @@ package main
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/drtimf/go-piicodev"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 type SensorVL53L1X struct {
-	name         string
-	vl53l1x      *piicodev.VL53L1X
-	distance     uint16
-	promDistance prometheus.Gauge
+	name              string
+	vl53l1x           VL53L1XDevice
+	promDistance      prometheus.Gauge
+	occupancyDistance float64
+
+	mu       sync.Mutex
+	distance uint16
+	updated  time.Time
+}
+
+func init() {
+	RegisterSensorType(&SensorType{
+		Name:           "vl53l1x",
+		Description:    "VL53L1X distance sensor",
+		DefaultAddress: piicodev.VL53L1XAddress,
+		Identify:       identifyReg16Addr16(0x010F, 0xEACC),
+		Fields:         i2cFields,
+		Options: []SensorOption{
+			{Name: "occupancydistance", Default: OccupancyDistance, Min: 0, Max: 4000, Description: "distance in millimetres below which the space is occupied"},
+		},
+		New: func(sc *SensorConfiguration, config *I2cConfiguration) (s Sensor, err error) {
+			var bus BusRef
+			if bus, err = config.SensorBus(sc); err != nil {
+				return
+			}
+			return NewSensorVL53L1X(sc.Name, bus, sc.I2CAddress, sc.Options.Float("occupancydistance"))
+		},
+	})
 }
 
-func NewSensorVL53L1X(name string, i2cAddress uint8) (s *SensorVL53L1X, err error) {
+func NewSensorVL53L1X(name string, bus BusRef, i2cAddress uint8, occupancyDistance float64) (s *SensorVL53L1X, err error) {
 	s = &SensorVL53L1X{
-		name: name,
+		name:              name,
+		occupancyDistance: occupancyDistance,
 	}
 
 	if i2cAddress == 0 {
 		i2cAddress = piicodev.VL53L1XAddress
 	}
 
-	if s.vl53l1x, err = piicodev.NewVL53L1X(i2cAddress, 1); err != nil {
+	if s.vl53l1x, err = devices.OpenVL53L1X(i2cAddress, bus); err != nil {
 		return
 	}
 
-	s.promDistance = promauto.NewGauge(prometheus.GaugeOpts{
+	s.promDistance = registerGauge(prometheus.GaugeOpts{
 		Name: name + "_distance",
 		Help: "The current distance from a VL53L1X sensor",
 	})
@@ -36,20 +62,51 @@ func NewSensorVL53L1X(name string, i2cAddress uint8) (s *SensorVL53L1X, err erro
 	return
 }
 
-func (s *SensorVL53L1X) Update() {
-	if d, err := s.vl53l1x.Read(); err != nil {
-		fmt.Printf("ERROR: Failed to read distance from VL53L1X \"%s\": %v\n", s.name, err)
-	} else {
-		s.distance = d
+func (s *SensorVL53L1X) Update() (err error) {
+	var d uint16
+	if d, err = s.vl53l1x.Read(); err != nil {
+		return fmt.Errorf("failed to read distance from VL53L1X \"%s\": %v", s.name, err)
 	}
 
-	s.promDistance.Set(float64(s.distance))
+	s.mu.Lock()
+	s.distance = d
+	s.updated = time.Now()
+	s.mu.Unlock()
+
+	s.promDistance.Set(float64(d))
+	return
+}
+
+func (s *SensorVL53L1X) Close() {
+	s.vl53l1x.Close()
 }
 
 func (s *SensorVL53L1X) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s: %d mm", s.name, s.distance)
 }
 
 func (s *SensorVL53L1X) Details() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return fmt.Sprintf("%s - VL53L1X Distance Sensor: %d mm", s.name, s.distance)
 }
+
+func (s *SensorVL53L1X) Distance() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewReading(MetricDistance, float64(s.distance), UnitMillimetre, s.updated)
+}
+
+// OtherReadings is whether the distance is below the occupancy distance of the sensor
+func (s *SensorVL53L1X) OtherReadings() []Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	occupied := 0.0
+	if float64(s.distance) < s.occupancyDistance {
+		occupied = 1
+	}
+	return []Reading{NewReading(MetricOccupancy, occupied, UnitBoolean, s.updated)}
+}
@@ -1,43 +1,874 @@
 package main
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Units attached to sensor readings
+const (
+	UnitCelsius                 = "C"
+	UnitHectopascal             = "hPa"
+	UnitRelativeHumidity        = "rH"
+	UnitLux                     = "lux"
+	UnitMillimetre              = "mm"
+	UnitPartsPerMillion         = "ppm"
+	UnitPartsPerBillion         = "ppb"
+	UnitMicrogramsPerCubicMetre = "ug/m3"
+	UnitIndex                   = "index"
+	UnitKilometresPerHour       = "kph"
+	UnitDegrees                 = "deg"
+	UnitBoolean                 = "bool"
+	UnitGramsPerCubicMetre      = "g/m3"
+	UnitKilopascal              = "kPa"
+)
+
+// Metric names, also used as the suffix of the Prometheus gauge for the sensor
+const (
+	MetricTemperature = "temperature"
+	MetricHumidity    = "humidity"
+	MetricPressure    = "pressure"
+	MetricLightLevel  = "light_level"
+	MetricDistance    = "distance"
+	MetricAQI         = "aqi"
+	MetricTVOC        = "tvoc"
+	MetricECO2        = "eco2"
+	MetricPM25        = "pm25"
+	MetricPM10        = "pm10"
+	MetricVOCIndex    = "va10"
+	MetricNO2Index    = "noxl"
+	MetricWindSpeed   = "wind_speed"
+	MetricWindGust    = "wind_gust"
+	MetricWindDir     = "wind_dir"
+	MetricOccupancy   = "occupancy"
+
+	MetricDewPoint            = "dew_point"
+	MetricAbsoluteHumidity    = "absolute_humidity"
+	MetricHumidex             = "humidex"
+	MetricHeatIndex           = "heat_index"
+	MetricApparentTemperature = "apparent_temperature"
+	MetricVPD                 = "vpd"
+)
+
+// The metrics of measured values, which can be calibrated and filtered
+var MeasuredMetrics = []string{
+	MetricTemperature, MetricHumidity, MetricPressure, MetricLightLevel, MetricDistance, MetricAQI, MetricTVOC,
+	MetricECO2, MetricPM25, MetricPM10, MetricVOCIndex, MetricNO2Index, MetricWindSpeed, MetricWindGust, MetricWindDir,
+}
+
+// The distance in millimetres below which a distance sensor reports the space as occupied, unless
+// the sensor sets its own with the occupancydistance option
+const OccupancyDistance = 1000.0
+
+// TemperatureLimits are the temperatures in degrees Celsius outside which the reading of a
+// temperature sensor is rejected, along with the other values read with it, as a glitch of the device
+type TemperatureLimits struct {
+	Min, Max float64
+}
+
+var DefaultTemperatureLimits = TemperatureLimits{Min: DefaultMinTemperature, Max: DefaultMaxTemperature}
+
+// temperatureLimits returns the limits set by the mintemperature and maxtemperature options
+func temperatureLimits(options SensorOptions) (limits TemperatureLimits, err error) {
+	limits = TemperatureLimits{Min: options.Float("mintemperature"), Max: options.Float("maxtemperature")}
+	if limits.Min >= limits.Max {
+		err = fmt.Errorf("mintemperature %v is not below maxtemperature %v", limits.Min, limits.Max)
+	}
+	return
+}
+
+// Reading is a single measured value from a sensor. A zero Time means the sensor has not
+// yet produced a successful reading. Stale is set by SensorManagement when the reading is
+// older than the stale age of the sensor.
+type Reading struct {
+	Metric string
+	Value  float64
+	Unit   string
+	Time   time.Time
+	Stale  bool
+}
+
+func NewReading(metric string, value float64, unit string, t time.Time) Reading {
+	return Reading{
+		Metric: metric,
+		Value:  value,
+		Unit:   unit,
+		Time:   t,
+	}
+}
+
+type InputEventType int
+
+const (
+	InputEventPressed InputEventType = iota
+	InputEventDoublePressed
+	InputEventTouched
+	InputEventValueChanged
+	InputEventMotion
+)
+
+func (t InputEventType) String() string {
+	switch t {
+	case InputEventPressed:
+		return "pressed"
+	case InputEventDoublePressed:
+		return "double-pressed"
+	case InputEventTouched:
+		return "touched"
+	case InputEventValueChanged:
+		return "value-changed"
+	case InputEventMotion:
+		return "motion"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(t))
+	}
+}
+
+// InputEvent is something a person did to an input device, such as pressing a switch.
+// Channel identifies the pad or button on devices with more than one.
+type InputEvent struct {
+	Type    InputEventType
+	Channel int
+	Value   float64
+	Time    time.Time
+}
+
+// Sensor is implemented by every device and service which is polled by SensorManagement. Update
+// may be called concurrently with the other methods, so implementations guard their own state.
 type Sensor interface {
-	Update()
+	Update() error
 	Summary() string
 	Details() string
 }
 
+// Capability interfaces which a Sensor implements for each kind of value it measures
+
+type TemperatureSensor interface {
+	Temperature() Reading
+}
+
+type HumiditySensor interface {
+	Humidity() Reading
+}
+
+type PressureSensor interface {
+	Pressure() Reading
+}
+
+type LightLevelSensor interface {
+	LightLevel() Reading
+}
+
+type DistanceSensor interface {
+	Distance() Reading
+}
+
+type AirQualitySensor interface {
+	AirQuality() []Reading
+}
+
+// InputSensor returns the events that were detected by the last Update
+type InputSensor interface {
+	InputEvents() []InputEvent
+}
+
+// ReadingsSensor is implemented by sensors with readings that no capability interface covers
+type ReadingsSensor interface {
+	OtherReadings() []Reading
+}
+
+// The most input events held for consumers between reads
+const maxPendingInputEvents = 100
+
+// SensorSnapshot is a copy of the state of a sensor taken straight after it was updated, so that
+// consumers never see a sensor part way through an update. A snapshot is not modified once taken.
+type SensorSnapshot struct {
+	Name     string
+	Type     string
+	Summary  string
+	Details  string
+	Readings []Reading
+	Updated  time.Time
+	Error    string
+	Health   SensorHealth
+}
+
+// Reading returns the reading of a metric from the snapshot
+func (ss *SensorSnapshot) Reading(metric string) (r Reading, ok bool) {
+	for _, r = range ss.Readings {
+		if r.Metric == metric {
+			return r, true
+		}
+	}
+
+	return Reading{}, false
+}
+
+func (ss SensorSnapshot) copy() SensorSnapshot {
+	ss.Readings = append([]Reading(nil), ss.Readings...)
+	return ss
+}
+
+// DetailsWithHealth is the details of the sensor followed by its health and the last error
+func (ss *SensorSnapshot) DetailsWithHealth() (details string) {
+	details = fmt.Sprintf("%s [%s]", ss.Details, ss.Health)
+	if ss.Error != "" {
+		details += " (error: " + ss.Error + ")"
+	}
+	return
+}
+
+// captureReadings reads every capability of a sensor
+func captureReadings(s Sensor) (readings []Reading, events []InputEvent) {
+	if ts, ok := s.(TemperatureSensor); ok {
+		readings = append(readings, ts.Temperature())
+	}
+
+	if hs, ok := s.(HumiditySensor); ok {
+		readings = append(readings, hs.Humidity())
+	}
+
+	if ps, ok := s.(PressureSensor); ok {
+		readings = append(readings, ps.Pressure())
+	}
+
+	if ls, ok := s.(LightLevelSensor); ok {
+		readings = append(readings, ls.LightLevel())
+	}
+
+	if ds, ok := s.(DistanceSensor); ok {
+		readings = append(readings, ds.Distance())
+	}
+
+	if as, ok := s.(AirQualitySensor); ok {
+		readings = append(readings, as.AirQuality()...)
+	}
+
+	if rs, ok := s.(ReadingsSensor); ok {
+		readings = append(readings, rs.OtherReadings()...)
+	}
+
+	if is, ok := s.(InputSensor); ok {
+		events = is.InputEvents()
+	}
+
+	return
+}
+
+type managedSensor struct {
+	config SensorConfiguration
+
+	// The correction of each metric which is calibrated and the filter of each metric which is
+	// filtered, by metric name, and the gauges SensorManagement sets for the sensor, of the raw
+	// value of each metric which is calibrated and of each derived metric, by reading metric
+	calibrations map[string]Calibration
+	filters      map[string]*metricFilter
+	gauges       map[string]prometheus.Gauge
+	gaugesMu     sync.Mutex
+
+	// The distance below which the distance measured by the sensor is reported as occupancy, from
+	// the occupancydistance option of its type
+	occupancyDistance float64
+
+	// Stops the schedule of the sensor, which has finished once done is closed
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// Wakes the schedule when the interval has changed
+	wake chan struct{}
+
+	// Held while the sensor is being opened, updated or closed. The sensor is nil while it is not open.
+	updating     sync.Mutex
+	sensor       Sensor
+	factory      SensorFactory
+	openFailures int
+
+	mu         sync.RWMutex
+	snapshot   SensorSnapshot
+	interval   time.Duration
+	staleAfter time.Duration
+}
+
+// takeSnapshot captures the state of the sensor, which must be held by the caller
+func (ms *managedSensor) takeSnapshot(updateErr error) (ss SensorSnapshot, events []InputEvent) {
+	ss = SensorSnapshot{
+		Name:    ms.config.Name,
+		Type:    ms.config.SensorType,
+		Updated: time.Now(),
+	}
+
+	if updateErr != nil {
+		ss.Error = RedactSecrets(updateErr.Error())
+	}
+
+	if ms.sensor == nil {
+		ss.Summary = fmt.Sprintf("%s: not open", ms.config.Name)
+		ss.Details = fmt.Sprintf("%s - %s sensor which is not open", ms.config.Name, ms.config.SensorType)
+		return
+	}
+
+	ss.Readings, events = captureReadings(ms.sensor)
+	ss.Readings = deriveReadings(ms.filterReadings(calibrate(ss.Readings, ms.calibrations)))
+	ss.Readings = occupancyFromDistance(ss.Readings, ms.occupancyDistance)
+	ss.Summary, ss.Details = ms.describe(ss.Readings)
+	ss.Summary, ss.Details = RedactSecrets(ss.Summary), RedactSecrets(ss.Details)
+	return
+}
+
+// describe returns the summary and details of the sensor with the values of its measured metrics
+// after calibration and filtering, rather than the values the sensor read itself. A sensor without
+// measured metrics describes itself.
+func (ms *managedSensor) describe(readings []Reading) (summary, details string) {
+	var values []string
+	for _, r := range readings {
+		if containsString(MeasuredMetrics, r.Metric) {
+			values = append(values, fmt.Sprintf("%.2f %s", r.Value, r.Unit))
+		}
+	}
+
+	if len(values) == 0 {
+		return ms.sensor.Summary(), ms.sensor.Details()
+	}
+
+	description := ms.config.SensorType
+	if st, err := LookupSensorType(ms.config.SensorType); err == nil {
+		description = st.Description
+	}
+
+	summary = fmt.Sprintf("%s: %s", ms.config.Name, strings.Join(values, ", "))
+	details = fmt.Sprintf("%s - %s: %s", ms.config.Name, description, strings.Join(values, ", "))
+	return
+}
+
+// getSnapshot returns a copy of the latest snapshot with the staleness of its readings as of now
+func (ms *managedSensor) getSnapshot() (ss SensorSnapshot) {
+	ms.mu.RLock()
+	ss = ms.snapshot.copy()
+	staleAfter := ms.staleAfter
+	ms.mu.RUnlock()
+
+	ss.Health.assess(ss.Readings, staleAfter, time.Now())
+	return
+}
+
+func (ms *managedSensor) getInterval() time.Duration {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.interval
+}
+
+// SensorManagement polls every sensor on its own schedule and keeps the readings captured
+// after each update for the HomeKit, OLED and Prometheus consumers
 type SensorManagement struct {
-	sensors []Sensor
+	mu                sync.RWMutex
+	sensors           []*managedSensor
+	defaultInterval   time.Duration
+	defaultStaleAfter time.Duration
+	events            []InputEvent
+	history           *History
+	recording         *Recording
+	stats             *Statistics
+	rooms             []RoomConfiguration
+	homeRoom          string
+
+	// The context passed to Start, which is nil until the sensors are started, and the goroutines
+	// started since
+	ctx     context.Context
+	running sync.WaitGroup
 }
 
-func NewSensorManagement() (sm *SensorManagement) {
+// NewSensorManagement creates the sensor management with the update interval and stale age used
+// for sensors which do not set their own. A zero stale age is DefaultStaleAfter.
+func NewSensorManagement(defaultInterval, defaultStaleAfter time.Duration) (sm *SensorManagement) {
+	if defaultStaleAfter <= 0 {
+		defaultStaleAfter = DefaultStaleAfter
+	}
+
 	sm = &SensorManagement{
-		sensors: make([]Sensor, 0),
+		sensors:           make([]*managedSensor, 0),
+		defaultInterval:   defaultInterval,
+		defaultStaleAfter: defaultStaleAfter,
+		stats:             NewStatistics(),
 	}
 
 	return
 }
 
-func (sm *SensorManagement) AddSensor(s Sensor) {
-	sm.sensors = append(sm.sensors, s)
+// timing returns the interval and stale age of a sensor, which are the defaults unless its entry sets them
+func (sm *SensorManagement) timing(sc SensorConfiguration) (interval, staleAfter time.Duration) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	if interval = sc.Interval; interval <= 0 {
+		interval = sm.defaultInterval
+	}
+
+	if staleAfter = sc.StaleAfter; staleAfter <= 0 {
+		staleAfter = sm.defaultStaleAfter
+	}
+
+	return
 }
 
+func (sm *SensorManagement) newManagedSensor(sc SensorConfiguration) (ms *managedSensor) {
+	ms = &managedSensor{
+		config: sc,
+		wake:   make(chan struct{}, 1),
+	}
+
+	ms.interval, ms.staleAfter = sm.timing(sc)
+	ms.gauges = make(map[string]prometheus.Gauge)
+
+	ms.occupancyDistance = OccupancyDistance
+	if options := resolvedOptions(&sc); options["occupancydistance"] != nil {
+		ms.occupancyDistance = options.Float("occupancydistance")
+	}
+	ms.setProcessing(&sc)
+	return
+}
+
+// setProcessing sets the calibration and filters of the sensor from its entry, which can change
+// while the sensor is open. The gauges of the raw values of the metrics which are calibrated are
+// registered, and those of the metrics which no longer are are removed.
+func (ms *managedSensor) setProcessing(sc *SensorConfiguration) {
+	calibrations, err := sensorCalibrations(sc)
+	if err != nil {
+		logSensors.Error("Ignoring the calibration of the sensor", "sensor", sc.Name, "error", err)
+	}
+
+	filters, err := sensorFilters(sc)
+	if err != nil {
+		logSensors.Error("Ignoring the filters of the sensor", "sensor", sc.Name, "error", err)
+		filters, _ = sensorFilters(&SensorConfiguration{})
+	}
+
+	ms.updating.Lock()
+	previous := ms.processedMetrics()
+	ms.calibrations, ms.filters = calibrations, filters
+	metrics := ms.processedMetrics()
+	ms.updating.Unlock()
+
+	ms.gaugesMu.Lock()
+	for metric := range ms.gauges {
+		if _, ok := calibrations[strings.TrimSuffix(metric, RawMetricSuffix)]; strings.HasSuffix(metric, RawMetricSuffix) && !ok {
+			unregisterSensorCollector(sc.Name + "_" + metric)
+			delete(ms.gauges, metric)
+		}
+	}
+
+	for metric := range calibrations {
+		if _, ok := ms.gauges[metric+RawMetricSuffix]; !ok {
+			ms.gauges[metric+RawMetricSuffix] = registerGauge(prometheus.GaugeOpts{
+				Name: sc.Name + "_" + metric + RawMetricSuffix,
+				Help: "The " + metric + " of sensor " + sc.Name + " before it is calibrated",
+			})
+		}
+	}
+	ms.gaugesMu.Unlock()
+
+	setProcessedGauges(sc.Name, metrics)
+
+	var removed []string
+	for _, metric := range previous {
+		if !containsString(metrics, metric) {
+			removed = append(removed, metric)
+		}
+	}
+	unpublishRejectedSamples(sc.Name, removed)
+}
+
+// processedMetrics are the metrics which are calibrated or filtered
+func (ms *managedSensor) processedMetrics() (metrics []string) {
+	for metric := range ms.calibrations {
+		metrics = append(metrics, metric)
+	}
+
+	for metric := range ms.filters {
+		if _, ok := ms.calibrations[metric]; !ok {
+			metrics = append(metrics, metric)
+		}
+	}
+
+	sort.Strings(metrics)
+	return
+}
+
+// publishGauges sets the gauges of the metrics which are calibrated or filtered, which the sensor
+// itself leaves alone, and the gauges of the raw values and the derived metrics. The gauge of a
+// derived metric is registered when the sensor first has it.
+func (ms *managedSensor) publishGauges(readings []Reading) {
+	ms.gaugesMu.Lock()
+	defer ms.gaugesMu.Unlock()
+
+	for _, r := range readings {
+		if r.Time.IsZero() {
+			continue
+		}
+
+		if _, ok := ms.gauges[r.Metric]; !ok && containsString(DerivedMetrics, r.Metric) {
+			ms.gauges[r.Metric] = registerGauge(prometheus.GaugeOpts{
+				Name: ms.config.Name + "_" + r.Metric,
+				Help: "The " + strings.ReplaceAll(r.Metric, "_", " ") + " of sensor " + ms.config.Name + ", derived from its temperature and humidity",
+			})
+		}
+
+		if g, ok := ms.gauges[r.Metric]; ok {
+			g.Set(r.Value)
+		} else if isProcessedGauge(ms.config.Name + "_" + r.Metric) {
+			setProcessedGauge(ms.config.Name+"_"+r.Metric, r.Value)
+		}
+	}
+}
+
+// addManagedSensor adds the sensor, which is polled straight away when the sensors have already
+// been started
+func (sm *SensorManagement) addManagedSensor(ms *managedSensor, openErr error) {
+	// The initial snapshot shows the capabilities of the sensor before it has been updated
+	ms.snapshot, _ = ms.takeSnapshot(openErr)
+	ms.snapshot.Updated = time.Time{}
+
+	sm.mu.Lock()
+	sm.sensors = append(sm.sensors, ms)
+	if sm.ctx != nil {
+		sm.startSchedule(ms, 0)
+	}
+	sm.mu.Unlock()
+}
+
+// startSchedule starts polling the sensor after the wait. It must be called with sm.mu held.
+func (sm *SensorManagement) startSchedule(ms *managedSensor, wait time.Duration) {
+	var ctx context.Context
+	ctx, ms.cancel = context.WithCancel(sm.ctx)
+	ms.done = make(chan struct{})
+
+	sm.running.Add(1)
+	go func() {
+		defer sm.running.Done()
+		defer close(ms.done)
+		sm.schedule(ctx, ms, wait)
+	}()
+}
+
+// AddSensor adds a sensor created from an entry in the configuration. It is polled every interval
+// of the entry, or the default interval if the entry does not have one.
+func (sm *SensorManagement) AddSensor(s Sensor, sc SensorConfiguration) {
+	ms := sm.newManagedSensor(sc)
+	ms.sensor = s
+	sm.addManagedSensor(ms, nil)
+}
+
+func (sm *SensorManagement) managedSensors() []*managedSensor {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.sensors
+}
+
+// updateSensor updates an open sensor, returning the number of consecutive failed updates
+func (sm *SensorManagement) updateSensor(ms *managedSensor) (failures int) {
+	ms.updating.Lock()
+	if ms.sensor == nil {
+		ms.updating.Unlock()
+		return
+	}
+
+	err := ms.sensor.Update()
+	if err != nil {
+		logSensors.Error("Update failed", "sensor", ms.config.Name, "error", err)
+	}
+	snapshot, events := ms.takeSnapshot(err)
+	ms.updating.Unlock()
+
+	previous := ms.getSnapshot()
+
+	ms.mu.Lock()
+	snapshot.Health = ms.snapshot.Health
+	snapshot.Health.recordUpdate(err, snapshot.Updated)
+	ms.snapshot = snapshot
+	ms.mu.Unlock()
+
+	ms.publishGauges(snapshot.Readings)
+
+	if err == nil {
+		for _, r := range snapshot.Readings {
+			sm.stats.Record(ms.config.Name, r)
+		}
+	}
+
+	if history := sm.History(); history != nil && err == nil {
+		for _, r := range snapshot.Readings {
+			if herr := history.Record(ms.config.Name, r); herr != nil {
+				logStorage.Error("Failed to record history", "sensor", ms.config.Name, "error", herr)
+			}
+		}
+	}
+
+	if recording := sm.Recording(); recording != nil && err == nil {
+		for _, r := range snapshot.Readings {
+			if rerr := recording.Record(ms.config.Name, ms.config.SensorType, r); rerr != nil {
+				logStorage.Error("Failed to record reading", "sensor", ms.config.Name, "error", rerr)
+			}
+		}
+	}
+
+	current := ms.getSnapshot()
+	publishSensorHealth(&current)
+	logHealthTransition(&previous, &current)
+	failures = current.Health.ConsecutiveFailures
+
+	if len(events) > 0 {
+		sm.mu.Lock()
+		sm.events = append(sm.events, events...)
+		if len(sm.events) > maxPendingInputEvents {
+			sm.events = sm.events[len(sm.events)-maxPendingInputEvents:]
+		}
+		sm.mu.Unlock()
+	}
+
+	return
+}
+
+// Statistics returns the daily and weekly statistics of the readings of every sensor
+func (sm *SensorManagement) Statistics() *Statistics {
+	return sm.stats
+}
+
+// SetHistory records the readings of every update in the history
+func (sm *SensorManagement) SetHistory(history *History) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.history = history
+}
+
+// History returns the history the readings are recorded in, or nil if they are not recorded
+func (sm *SensorManagement) History() *History {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.history
+}
+
+// SetRecording appends the readings of every update to the recording
+func (sm *SensorManagement) SetRecording(recording *Recording) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.recording = recording
+}
+
+// Recording returns the recording the readings are appended to, or nil if they are not recorded
+func (sm *SensorManagement) Recording() *Recording {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.recording
+}
+
+// Snapshots returns the state of every sensor after its most recent update
+func (sm *SensorManagement) Snapshots() (snapshots []SensorSnapshot) {
+	for _, ms := range sm.managedSensors() {
+		snapshots = append(snapshots, ms.getSnapshot())
+	}
+	return
+}
+
+// Snapshot returns the state of the named sensor after its most recent update
+func (sm *SensorManagement) Snapshot(name string) (snapshot SensorSnapshot, ok bool) {
+	for _, ms := range sm.managedSensors() {
+		if ms.config.Name == name {
+			return ms.getSnapshot(), true
+		}
+	}
+	return
+}
+
+// UpdateSensors updates every sensor concurrently and returns once they have all finished
 func (sm *SensorManagement) UpdateSensors() {
-	for _, s := range sm.sensors {
-		s.Update()
+	var wg sync.WaitGroup
+	for _, ms := range sm.managedSensors() {
+		wg.Add(1)
+		go func(ms *managedSensor) {
+			defer wg.Done()
+			sm.updateSensor(ms)
+		}(ms)
+	}
+	wg.Wait()
+}
+
+// Start polls each sensor on its own interval until the context is cancelled. A sensor that
+// is slow to update only delays its own next update. Sensors which are not open are retried
+// with backoff and sensors which keep failing are reopened. The statistics are saved periodically.
+func (sm *SensorManagement) Start(ctx context.Context) {
+	sm.mu.Lock()
+	sm.ctx = ctx
+	for _, ms := range sm.sensors {
+		sm.startSchedule(ms, ms.getInterval())
+	}
+	sm.mu.Unlock()
+
+	sm.running.Add(1)
+	go func() {
+		defer sm.running.Done()
+		sm.stats.saveEvery(ctx, StatsSaveInterval)
+	}()
+}
+
+// Wait returns once the polling started by Start has stopped after its context was cancelled,
+// including any update in progress and the final save of the statistics
+func (sm *SensorManagement) Wait(ctx context.Context) error {
+	stopped := make(chan struct{})
+	go func() {
+		sm.running.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RemoveSensor stops polling the named sensor and closes it. Its Prometheus metrics and its
+// statistics are removed along with it.
+func (sm *SensorManagement) RemoveSensor(name string) (err error) {
+	var ms *managedSensor
+	if ms = sm.managedSensor(name); ms == nil {
+		return fmt.Errorf("there is no sensor named \"%s\"", name)
+	}
+
+	sm.detachSensor(ms)
+	unpublishSensorStats(name, sm.stats.Remove(name))
+	return
+}
+
+func (sm *SensorManagement) managedSensor(name string) *managedSensor {
+	for _, ms := range sm.managedSensors() {
+		if ms.config.Name == name {
+			return ms
+		}
+	}
+	return nil
+}
+
+// detachSensor removes the sensor, stops its schedule, closes it and unregisters its metrics
+func (sm *SensorManagement) detachSensor(ms *managedSensor) {
+	sm.mu.Lock()
+	// The readers of the previous list keep it as it was
+	sensors := make([]*managedSensor, 0, len(sm.sensors))
+	names := make([]string, 0, len(sm.sensors))
+	for _, other := range sm.sensors {
+		if other != ms {
+			sensors = append(sensors, other)
+			names = append(names, other.config.Name)
+		}
+	}
+	sm.sensors = sensors
+	cancel, done := ms.cancel, ms.done
+	sm.mu.Unlock()
+
+	if cancel != nil {
+		cancel()
+		<-done
+	}
+
+	if ms.isOpen() {
+		sm.closeSensor(ms)
+	}
+
+	setProcessedGauges(ms.config.Name, nil)
+	unpublishRejectedSamples(ms.config.Name, ms.processedMetrics())
+	unregisterSensorCollectors(ms.config.Name, names)
+	unpublishSensorHealth(ms.config.Name, ms.config.SensorType)
+}
+
+// retime changes the interval and stale age of the sensor to those of its entry, or the defaults
+func (sm *SensorManagement) retime(ms *managedSensor, sc SensorConfiguration) {
+	interval, staleAfter := sm.timing(sc)
+
+	ms.mu.Lock()
+	changed := interval != ms.interval
+	ms.interval, ms.staleAfter = interval, staleAfter
+	ms.mu.Unlock()
+
+	if changed {
+		select {
+		case ms.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// orderSensors puts the named sensors first in the order given, which decides the sensor a
+// metric such as the temperature is read from
+func (sm *SensorManagement) orderSensors(names []string) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sensors := make([]*managedSensor, 0, len(sm.sensors))
+	for _, name := range names {
+		for _, ms := range sm.sensors {
+			if ms.config.Name == name {
+				sensors = append(sensors, ms)
+			}
+		}
+	}
+
+	for _, ms := range sm.sensors {
+		if !containsString(names, ms.config.Name) {
+			sensors = append(sensors, ms)
+		}
+	}
+
+	sm.sensors = sensors
+}
+
+// Close closes every open sensor, which stops the goroutines and connections of sensors such as
+// the PIR and Dyson fan. It should only be called once the polling has stopped.
+func (sm *SensorManagement) Close() {
+	for _, ms := range sm.managedSensors() {
+		if ms.isOpen() {
+			sm.closeSensor(ms)
+		}
+	}
+}
+
+// schedule updates the sensor every interval until the context is cancelled. A change of the
+// interval wakes it to update straight away and then wait the new interval.
+func (sm *SensorManagement) schedule(ctx context.Context, ms *managedSensor, wait time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ms.wake:
+		case <-time.After(wait):
+		}
+
+		wait = ms.getInterval()
+
+		if !ms.isOpen() {
+			if err := sm.openSensor(ms); err != nil {
+				wait = ms.openBackoff()
+			}
+		} else if failures := sm.updateSensor(ms); failures >= SensorReopenAfter && ms.factory != nil {
+			logSensors.Warn("Reopening sensor", "sensor", ms.config.Name, "failures", failures)
+			sm.closeSensor(ms)
+			wait = ms.openBackoff()
+		}
 	}
 }
 
 func (sm *SensorManagement) Summary() (summary string) {
 	summary = ""
 
-	for i, s := range sm.sensors {
+	for i, ms := range sm.managedSensors() {
 		if i > 0 {
 			summary += " | "
 		}
-		summary += s.Summary()
+		summary += ms.getSnapshot().Summary
 	}
 
 	return
@@ -45,142 +876,194 @@ func (sm *SensorManagement) Summary() (summary string) {
 
 func (sm *SensorManagement) Details() (summary string) {
 	summary = ""
-	for _, s := range sm.sensors {
-		summary += fmt.Sprintf(" - %s\n", s.Details())
+	for _, ms := range sm.managedSensors() {
+		ss := ms.getSnapshot()
+		summary += fmt.Sprintf(" - %s\n", ss.DetailsWithHealth())
+
+		for _, st := range sm.stats.Sensor(ss.Name) {
+			summary += fmt.Sprintf("     %s day: %s; week: %s\n", st.Metric, st.Day.Format(st.Unit), st.Week.Format(st.Unit))
+		}
 	}
 	return
 }
 
-func (sm *SensorManagement) GetTemperature() (temperature float64, ok bool) {
-	ok = false
-	for _, s := range sm.sensors {
-		switch ts := s.(type) {
-		case *SensorTMP117:
-			ok = true
-			temperature = ts.temperature
-			return
-		case *SensorAHT10:
-			ok = true
-			temperature = ts.temperature
-			return
-		case *SensorBME280:
-			ok = true
-			temperature = ts.temperature
-			return
-		case *SensorBOM:
-			ok = true
-			temperature = ts.scanner.AirTemp
-			return
+// GetReading returns the reading of a metric from the first sensor which measures it and has a
+// reading that is not stale. If every reading of the metric is stale the first is returned.
+func (sm *SensorManagement) GetReading(metric string) (r Reading, ok bool) {
+	for _, ms := range sm.managedSensors() {
+		ss := ms.getSnapshot()
+		if sr, found := ss.Reading(metric); found {
+			if !ok || (r.Stale && !sr.Stale) {
+				r, ok = sr, true
+			}
+
+			if !r.Stale {
+				return
+			}
 		}
 	}
 	return
 }
 
+func (sm *SensorManagement) GetTemperature() (temperature float64, ok bool) {
+	var r Reading
+	if r, ok = sm.homeReading(MetricTemperature); ok {
+		temperature = r.Value
+	}
+	return
+}
+
 func (sm *SensorManagement) GetLightLevel() (lightLevel float64, ok bool) {
-	ok = false
-	for _, s := range sm.sensors {
-		switch ts := s.(type) {
-		case *SensorVEML6030:
-			ok = true
-			lightLevel = ts.lightLevel
-			return
-		}
+	var r Reading
+	if r, ok = sm.homeReading(MetricLightLevel); ok {
+		lightLevel = r.Value
 	}
 	return
 }
 
 func (sm *SensorManagement) GetPressure() (pressure float64, ok bool) {
-	ok = false
-	for _, s := range sm.sensors {
-		switch ts := s.(type) {
-		case *SensorMS5637:
-			ok = true
-			pressure = ts.pressure
-			return
-		case *SensorBME280:
-			ok = true
-			pressure = ts.pressure
-			return
-		}
+	var r Reading
+	if r, ok = sm.homeReading(MetricPressure); ok {
+		pressure = r.Value
 	}
 	return
 }
 
 func (sm *SensorManagement) GetHumidity() (humidity float64, ok bool) {
-	ok = false
-	for _, s := range sm.sensors {
-		switch ts := s.(type) {
-		case *SensorBME280:
-			ok = true
-			humidity = ts.humidity
-			return
-		case *SensorAHT10:
-			ok = true
-			humidity = ts.humidity
-			return
+	var r Reading
+	if r, ok = sm.homeReading(MetricHumidity); ok {
+		humidity = r.Value
+	}
+	return
+}
+
+// GetDerived returns the value of a derived metric, such as the dew point, in the home room
+func (sm *SensorManagement) GetDerived(metric string) (value float64, ok bool) {
+	var r Reading
+	if r, ok = sm.homeReading(metric); ok {
+		value = r.Value
+	}
+	return
+}
+
+func (sm *SensorManagement) GetDistance() (distance float64, ok bool) {
+	var r Reading
+	if r, ok = sm.homeReading(MetricDistance); ok {
+		distance = r.Value
+	}
+	return
+}
+
+// GetAirQuality returns the air quality readings from every sensor that measures air quality
+func (sm *SensorManagement) GetAirQuality() (readings []Reading, ok bool) {
+	for _, ms := range sm.managedSensors() {
+		for _, r := range ms.getSnapshot().Readings {
+			switch r.Metric {
+			case MetricAQI, MetricTVOC, MetricECO2, MetricPM25, MetricPM10, MetricVOCIndex, MetricNO2Index:
+				ok = true
+				readings = append(readings, r)
+			}
+		}
+	}
+	return
+}
+
+// GetInputEvents removes and returns the pending events of the given types from every input sensor.
+// Events are held from each update until they are read so none are lost when the sensors are
+// polled at a different rate to the consumer.
+func (sm *SensorManagement) GetInputEvents(types ...InputEventType) (events []InputEvent, ok bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	remaining := sm.events[:0]
+	for _, e := range sm.events {
+		matched := false
+		for _, t := range types {
+			if e.Type == t {
+				matched = true
+				break
+			}
+		}
+
+		if matched {
+			events = append(events, e)
+		} else {
+			remaining = append(remaining, e)
 		}
 	}
+	sm.events = remaining
+
+	ok = len(events) > 0
 	return
 }
 
 func (sm *SensorManagement) GetCapSensorStatus() (status [3]bool, ok bool) {
-	ok = false
-	for _, s := range sm.sensors {
-		switch ts := s.(type) {
-		case *SensorCAP1203:
+	var events []InputEvent
+	events, _ = sm.GetInputEvents(InputEventTouched)
+	for _, e := range events {
+		if e.Channel >= 0 && e.Channel < len(status) {
 			ok = true
-			status = ts.status
-			return
+			status[e.Channel] = true
 		}
 	}
 	return
 }
 
-func (sm *SensorManagement) GetOccupancy() (occupied, ok bool) {
-	ok = false
-	for _, s := range sm.sensors {
-		switch ts := s.(type) {
-		case *SensorVL53L1X:
-			ok = true
-			if ts.distance < 1000 {
-				occupied = true
-			} else {
-				occupied = false
-			}
-			return
+// occupancyFromDistance adds the occupancy of a sensor which measures a distance but does not
+// report occupancy itself, which is whether the distance is below the occupancy distance
+func occupancyFromDistance(readings []Reading, occupancyDistance float64) []Reading {
+	var distance *Reading
+	for i := range readings {
+		switch readings[i].Metric {
+		case MetricOccupancy:
+			return readings
+		case MetricDistance:
+			distance = &readings[i]
 		}
 	}
+
+	if distance == nil {
+		return readings
+	}
+
+	occupied := 0.0
+	if !distance.Time.IsZero() && distance.Value < occupancyDistance {
+		occupied = 1
+	}
+	return append(readings, NewReading(MetricOccupancy, occupied, UnitBoolean, distance.Time))
+}
+
+// GetOccupancy is from the sensors of the home room which report occupancy, including those which
+// measure a distance below their occupancydistance
+func (sm *SensorManagement) GetOccupancy() (occupied, ok bool) {
+	var r Reading
+	if r, ok = sm.homeReading(MetricOccupancy); ok {
+		occupied = r.Value != 0
+	}
 	return
 }
 
 func (sm *SensorManagement) GetSwitchPress() (pressType int, ok bool) {
-	ok = false
-	for _, s := range sm.sensors {
-		switch ts := s.(type) {
-		case *SensorSwitch:
-			ok = true
-			pressType = 0
-			if ts.wasDoublePressed {
-				pressType = 2
-			} else if ts.wasPressed {
-				pressType = 1
-			}
-			return
+	var events []InputEvent
+	events, _ = sm.GetInputEvents(InputEventPressed, InputEventDoublePressed)
+	for _, e := range events {
+		ok = true
+		if e.Type == InputEventDoublePressed {
+			pressType = 2
+		} else if pressType == 0 {
+			pressType = 1
 		}
 	}
 	return
 }
 
 func (sm *SensorManagement) GetPotentiometer() (changed bool, value uint16, ok bool) {
-	ok = false
-	for _, s := range sm.sensors {
-		switch ts := s.(type) {
-		case *SensorPotentiometer:
-			ok = true
-			changed = ts.changed
-			value = ts.value
-			return
-		}
+	var events []InputEvent
+	events, _ = sm.GetInputEvents(InputEventValueChanged)
+	for _, e := range events {
+		ok = true
+		changed = true
+		value = uint16(e.Value)
 	}
 	return
 }
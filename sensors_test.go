@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// testSensor is a temperature sensor whose value is also written from its own goroutine, in the
+// same way as the sensors driven by MQTT callbacks and background samplers
+type testSensor struct {
+	mu          sync.Mutex
+	name        string
+	temperature float64
+	pressed     bool
+	updated     time.Time
+	err         error
+}
+
+func (s *testSensor) set(temperature float64) {
+	s.mu.Lock()
+	s.temperature = temperature
+	s.updated = time.Now()
+	s.mu.Unlock()
+}
+
+func (s *testSensor) Update() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.temperature += 0.1
+	s.pressed = !s.pressed
+	s.updated = time.Now()
+	return s.err
+}
+
+func (s *testSensor) Summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%s: %.2f C", s.name, s.temperature)
+}
+
+func (s *testSensor) Details() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return fmt.Sprintf("%s - test sensor: %.2f C", s.name, s.temperature)
+}
+
+func (s *testSensor) Temperature() Reading {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return NewReading(MetricTemperature, s.temperature, UnitCelsius, s.updated)
+}
+
+func (s *testSensor) InputEvents() (events []InputEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pressed {
+		events = append(events, InputEvent{Type: InputEventPressed, Time: s.updated})
+	}
+	return
+}
+
+type testMQTTMessage struct {
+	payload []byte
+}
+
+func (m *testMQTTMessage) Duplicate() bool   { return false }
+func (m *testMQTTMessage) Qos() byte         { return 0 }
+func (m *testMQTTMessage) Retained() bool    { return false }
+func (m *testMQTTMessage) Topic() string     { return "test" }
+func (m *testMQTTMessage) MessageID() uint16 { return 0 }
+func (m *testMQTTMessage) Payload() []byte   { return m.payload }
+func (m *testMQTTMessage) Ack()              {}
+
+func newTestGauge() prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_gauge", Help: "Unregistered gauge for tests"})
+}
+
+// runConcurrently calls each function repeatedly from its own goroutine until the duration has passed
+func runConcurrently(d time.Duration, fns ...func()) {
+	var wg sync.WaitGroup
+	deadline := time.Now().Add(d)
+
+	for _, fn := range fns {
+		wg.Add(1)
+		go func(fn func()) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				fn()
+			}
+		}(fn)
+	}
+
+	wg.Wait()
+}
+
+func TestSensorManagementConcurrentUpdateAndRead(t *testing.T) {
+	sm := NewSensorManagement(time.Millisecond, 0)
+	a := &testSensor{name: "a"}
+	b := &testSensor{name: "b", err: errors.New("read failed")}
+	sm.AddSensor(a, SensorConfiguration{SensorType: "test", Name: "a"})
+	sm.AddSensor(b, SensorConfiguration{SensorType: "test", Name: "b", Interval: 2 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sm.Start(ctx)
+
+	runConcurrently(100*time.Millisecond,
+		func() { a.set(20) },
+		func() { sm.UpdateSensors() },
+		func() { sm.Snapshots() },
+		func() { sm.GetTemperature() },
+		func() { sm.GetSwitchPress() },
+		func() { _ = sm.Summary() + sm.Details() },
+	)
+
+	if _, ok := sm.GetTemperature(); !ok {
+		t.Error("expected a temperature from the test sensors")
+	}
+
+	ss, ok := sm.Snapshot("b")
+	if !ok {
+		t.Fatal("expected a snapshot of sensor b")
+	}
+
+	if ss.Type != "test" || ss.Error != "read failed" || ss.Updated.IsZero() {
+		t.Errorf("unexpected snapshot of sensor b: %+v", ss)
+	}
+}
+
+func TestSensorSnapshotIsImmutable(t *testing.T) {
+	sm := NewSensorManagement(time.Second, 0)
+	sm.AddSensor(&testSensor{name: "a", temperature: 21}, SensorConfiguration{SensorType: "test", Name: "a"})
+
+	first := sm.Snapshots()
+	first[0].Readings[0].Value = -40
+
+	if r, ok := sm.Snapshots()[0].Reading(MetricTemperature); !ok || r.Value != 21 {
+		t.Errorf("snapshot readings were modified through a copy: %+v", r)
+	}
+
+	if !first[0].Updated.IsZero() {
+		t.Errorf("a sensor which has not been updated should have a zero update time")
+	}
+}
+
+func TestSensorManagementInputEventsAreHeldUntilRead(t *testing.T) {
+	sm := NewSensorManagement(time.Second, 0)
+	sm.AddSensor(&testSensor{name: "switch"}, SensorConfiguration{SensorType: "test", Name: "switch"})
+
+	sm.UpdateSensors() // pressed
+	sm.UpdateSensors() // released
+	sm.UpdateSensors() // pressed
+
+	if events, _ := sm.GetInputEvents(InputEventPressed); len(events) != 2 {
+		t.Errorf("expected 2 press events, got %d", len(events))
+	}
+
+	if _, ok := sm.GetSwitchPress(); ok {
+		t.Errorf("press events should be removed once read")
+	}
+}
+
+func TestSensorPIRConcurrentMovement(t *testing.T) {
+	s := &SensorPIR{
+		name:              "pir",
+		promMovement:      newTestGauge(),
+		promMovementCount: prometheus.NewCounter(prometheus.CounterOpts{Name: "test_counter", Help: "Unregistered counter for tests"}),
+	}
+
+	runConcurrently(50*time.Millisecond,
+		s.triggerMovement,
+		func() { s.Update() },
+		func() { s.InputEvents() },
+		func() { _ = s.Summary() + s.Details() },
+	)
+}
+
+func TestSensorDysonHotCoolConcurrentMessages(t *testing.T) {
+	s := &SensorDysonHotCool{
+		name:            "dyson",
+		promTemperature: newTestGauge(),
+		promHumidity:    newTestGauge(),
+		promPM25:        newTestGauge(),
+		promPM10:        newTestGauge(),
+		promVA10:        newTestGauge(),
+		promNOXL:        newTestGauge(),
+	}
+
+	msg := &testMQTTMessage{payload: []byte(`{"msg":"ENVIRONMENTAL-CURRENT-SENSOR-DATA","data":{"tact":"2951","hact":"45","pm25":"3","pm10":"4","va10":"5","noxl":"6"}}`)}
+
+	runConcurrently(50*time.Millisecond,
+		func() { s.onMessageReceived(nil, msg) },
+		func() { s.Update() },
+		func() { s.Temperature() },
+		func() { s.AirQuality() },
+		func() { _ = s.Summary() + s.Details() },
+	)
+
+	if h := s.Humidity().Value; h != 45 {
+		t.Errorf("expected humidity 45, got %f", h)
+	}
+}
+
+func TestBOMScannerConcurrentObservation(t *testing.T) {
+	bs := &BOMScanner{}
+	qr := new(BOMQueryResult)
+
+	s := &SensorBOM{
+		name:        "bom",
+		scanner:     bs,
+		temperature: newTestGauge(),
+		windSpeed:   newTestGauge(),
+		windGust:    newTestGauge(),
+		windDir:     newTestGauge(),
+	}
+
+	if bs.setObservation(qr) {
+		t.Fatal("an empty query result should not be recorded")
+	}
+
+	if err := json.Unmarshal([]byte(`{"observations":{"data":[{"air_temp":18.5,"wind_spd_kmh":10,"gust_kmh":20,"wind_dir":"NW"}]}}`), qr); err != nil {
+		t.Fatal(err)
+	}
+
+	runConcurrently(50*time.Millisecond,
+		func() { bs.setObservation(qr) },
+		func() { s.Update() },
+		func() { s.Temperature() },
+		func() { _ = s.Summary() + s.Details() },
+	)
+
+	if o := bs.Observation(); o.AirTemp != 18.5 || o.WindDir != 315 {
+		t.Errorf("unexpected observation: %+v", o)
+	}
+}
+
+func TestSensorHealth(t *testing.T) {
+	sm := NewSensorManagement(time.Second, time.Minute)
+	s := &testSensor{name: "a"}
+	sm.AddSensor(s, SensorConfiguration{SensorType: "test", Name: "a"})
+
+	if ss, _ := sm.Snapshot("a"); ss.Health.State != HealthDegraded || !ss.Readings[0].Stale {
+		t.Errorf("a sensor without readings should be degraded and stale: %+v", ss.Health)
+	}
+
+	sm.UpdateSensors()
+	if ss, _ := sm.Snapshot("a"); ss.Health.State != HealthHealthy || ss.Health.LastSuccess.IsZero() || ss.Readings[0].Stale {
+		t.Errorf("expected a healthy sensor after a successful update: %+v", ss.Health)
+	}
+
+	s.mu.Lock()
+	s.err = errors.New("read failed")
+	s.mu.Unlock()
+
+	for i := 1; i <= SensorFailedAfter; i++ {
+		sm.UpdateSensors()
+
+		ss, _ := sm.Snapshot("a")
+		if ss.Health.ConsecutiveFailures != i {
+			t.Errorf("expected %d consecutive failures, got %d", i, ss.Health.ConsecutiveFailures)
+		}
+
+		expected := HealthDegraded
+		if i >= SensorFailedAfter {
+			expected = HealthFailed
+		}
+
+		if ss.Health.State != expected {
+			t.Errorf("expected %s after %d failures, got %s", expected, i, ss.Health.State)
+		}
+	}
+
+	if report := sm.HealthReport(); report.Status != HealthFailed || len(report.Sensors) != 1 {
+		t.Errorf("unexpected health report: %+v", report)
+	}
+}
+
+func TestSensorHealthStaleReadings(t *testing.T) {
+	var h SensorHealth
+	now := time.Now()
+	readings := []Reading{
+		NewReading(MetricTemperature, 20, UnitCelsius, now.Add(-time.Second)),
+		NewReading(MetricHumidity, 50, UnitRelativeHumidity, now.Add(-time.Hour)),
+	}
+
+	h.recordUpdate(nil, now)
+	h.assess(readings, time.Minute, now)
+
+	if readings[0].Stale || !readings[1].Stale || !h.Stale || h.State != HealthDegraded {
+		t.Errorf("expected only the hour old reading to be stale: %+v %+v", readings, h)
+	}
+}
+
+type testClosingSensor struct {
+	testSensor
+	closed bool
+}
+
+func (s *testClosingSensor) Close() {
+	s.closed = true
+}
+
+func sensorUp(t *testing.T, sensor string) float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range families {
+		if mf.GetName() != "sensor_up" {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() == "sensor" && lp.GetValue() == sensor {
+					return m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+	return -1
+}
+
+func TestSensorManagementRecovery(t *testing.T) {
+	sm := NewSensorManagement(time.Second, 0)
+
+	attempts := 0
+	var opened *testClosingSensor
+	factory := func() (Sensor, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, errors.New("no such device")
+		}
+		opened = &testClosingSensor{testSensor: testSensor{name: "a"}}
+		return opened, nil
+	}
+
+	if err := sm.OpenSensor(SensorConfiguration{SensorType: "test", Name: "a"}, factory); err == nil {
+		t.Fatal("expected the first open to fail")
+	}
+
+	ms := sm.managedSensors()[0]
+	if ss, _ := sm.Snapshot("a"); ss.Error != "no such device" || len(ss.Readings) != 0 {
+		t.Errorf("unexpected snapshot of a sensor which is not open: %+v", ss)
+	}
+
+	if ss, _ := sm.Snapshot("a"); ss.Health.State != HealthDegraded || ss.Health.ConsecutiveFailures != 1 {
+		t.Errorf("expected a sensor which failed to open to be degraded: %+v", ss.Health)
+	}
+
+	if up := sensorUp(t, "a"); up != 0 {
+		t.Errorf("expected sensor_up of a sensor which failed to open to be 0, got %v", up)
+	}
+
+	if sm.openSensor(ms) == nil || ms.openBackoff() != 2*SensorOpenMinBackoff {
+		t.Errorf("expected the second open to fail and the backoff to double")
+	}
+
+	if ss, _ := sm.Snapshot("a"); ss.Health.ConsecutiveFailures != 2 {
+		t.Errorf("expected each failed open to be counted: %+v", ss.Health)
+	}
+
+	if err := sm.openSensor(ms); err != nil || !ms.isOpen() {
+		t.Fatalf("expected the third open to succeed: %v", err)
+	}
+
+	if ss, _ := sm.Snapshot("a"); ss.Health.State != HealthHealthy || len(ss.Readings) != 1 {
+		t.Errorf("expected a healthy sensor once opened: %+v", ss)
+	}
+
+	if up := sensorUp(t, "a"); up != 1 {
+		t.Errorf("expected sensor_up to be 1 once opened, got %v", up)
+	}
+
+	sm.closeSensor(ms)
+	if !opened.closed || ms.isOpen() {
+		t.Errorf("expected the sensor to be closed")
+	}
+}
+
+// testReadingsSensor has a fixed set of readings and input events
+type testReadingsSensor struct {
+	readings []Reading
+	events   []InputEvent
+}
+
+func (s *testReadingsSensor) Update() error             { return nil }
+func (s *testReadingsSensor) Summary() string           { return "readings" }
+func (s *testReadingsSensor) Details() string           { return "readings - test sensor" }
+func (s *testReadingsSensor) OtherReadings() []Reading  { return s.readings }
+func (s *testReadingsSensor) InputEvents() []InputEvent { return s.events }
+
+func newTestSensorManagement(sensors ...*testReadingsSensor) (sm *SensorManagement) {
+	sm = NewSensorManagement(time.Second, time.Minute)
+	for i, s := range sensors {
+		sm.AddSensor(s, SensorConfiguration{SensorType: "test", Name: fmt.Sprintf("sensor%d", i)})
+	}
+	sm.UpdateSensors()
+	return
+}
+
+func TestSensorManagementGetReading(t *testing.T) {
+	now := time.Now()
+	fresh := func(v float64) Reading { return NewReading(MetricTemperature, v, UnitCelsius, now) }
+	stale := func(v float64) Reading { return NewReading(MetricTemperature, v, UnitCelsius, now.Add(-time.Hour)) }
+	humidity := NewReading(MetricHumidity, 50, UnitRelativeHumidity, now)
+
+	tests := []struct {
+		name     string
+		readings [][]Reading
+		ok       bool
+		value    float64
+		stale    bool
+	}{
+		{"none", nil, false, 0, false},
+		{"other metric", [][]Reading{{humidity}}, false, 0, false},
+		{"first fresh", [][]Reading{{fresh(20)}, {fresh(21)}}, true, 20, false},
+		{"stale skipped", [][]Reading{{stale(20)}, {humidity}, {fresh(21)}}, true, 21, false},
+		{"all stale", [][]Reading{{stale(20)}, {stale(21)}}, true, 20, true},
+		{"second metric of sensor", [][]Reading{{humidity, fresh(22)}}, true, 22, false},
+	}
+
+	for _, test := range tests {
+		var sensors []*testReadingsSensor
+		for _, readings := range test.readings {
+			sensors = append(sensors, &testReadingsSensor{readings: readings})
+		}
+
+		sm := newTestSensorManagement(sensors...)
+		r, ok := sm.GetReading(MetricTemperature)
+		if ok != test.ok || r.Value != test.value || r.Stale != test.stale {
+			t.Errorf("%s: expected %t %f stale %t, got %t %+v", test.name, test.ok, test.value, test.stale, ok, r)
+		}
+
+		if temperature, ok := sm.GetTemperature(); ok != test.ok || temperature != test.value {
+			t.Errorf("%s: expected temperature %f, got %f", test.name, test.value, temperature)
+		}
+	}
+}
+
+func TestSensorManagementGetOccupancy(t *testing.T) {
+	tests := []struct {
+		distance []float64
+		ok       bool
+		occupied bool
+	}{
+		{nil, false, false},
+		{[]float64{500}, true, true},
+		{[]float64{OccupancyDistance}, true, false},
+		{[]float64{1500, 200}, true, false},
+	}
+
+	for _, test := range tests {
+		var sensors []*testReadingsSensor
+		for _, d := range test.distance {
+			sensors = append(sensors, &testReadingsSensor{readings: []Reading{NewReading(MetricDistance, d, UnitMillimetre, time.Now())}})
+		}
+
+		if occupied, ok := newTestSensorManagement(sensors...).GetOccupancy(); ok != test.ok || occupied != test.occupied {
+			t.Errorf("%v: expected %t %t, got %t %t", test.distance, test.ok, test.occupied, ok, occupied)
+		}
+	}
+
+	// The occupancy distance of the sensor is used rather than the default
+	sm := NewSensorManagement(time.Second, time.Minute)
+	sm.AddSensor(&testReadingsSensor{readings: []Reading{NewReading(MetricDistance, 500, UnitMillimetre, time.Now())}},
+		SensorConfiguration{SensorType: "vl53l1x", Name: "near", Options: SensorOptions{"occupancydistance": 300}})
+	sm.UpdateSensors()
+
+	if occupied, ok := sm.GetOccupancy(); !ok || occupied {
+		t.Errorf("expected 500 mm to be unoccupied with an occupancy distance of 300 mm, got %t %t", ok, occupied)
+	}
+}
+
+func TestSensorManagementGetAirQuality(t *testing.T) {
+	now := time.Now()
+	sm := newTestSensorManagement(
+		&testReadingsSensor{readings: []Reading{NewReading(MetricAQI, 2, UnitIndex, now), NewReading(MetricTemperature, 20, UnitCelsius, now)}},
+		&testReadingsSensor{readings: []Reading{NewReading(MetricPM25, 3, UnitMicrogramsPerCubicMetre, now), NewReading(MetricNO2Index, 1, UnitIndex, now)}},
+	)
+
+	readings, ok := sm.GetAirQuality()
+	if !ok || len(readings) != 3 || readings[0].Metric != MetricAQI || readings[1].Metric != MetricPM25 || readings[2].Metric != MetricNO2Index {
+		t.Errorf("unexpected air quality readings: %+v", readings)
+	}
+
+	if _, ok = newTestSensorManagement().GetAirQuality(); ok {
+		t.Errorf("expected no air quality without sensors")
+	}
+}
+
+func TestSensorManagementInputEvents(t *testing.T) {
+	now := time.Now()
+	pressed := InputEvent{Type: InputEventPressed, Time: now}
+	doublePressed := InputEvent{Type: InputEventDoublePressed, Time: now}
+	touched := func(channel int) InputEvent { return InputEvent{Type: InputEventTouched, Channel: channel, Time: now} }
+	turned := func(value float64) InputEvent {
+		return InputEvent{Type: InputEventValueChanged, Value: value, Time: now}
+	}
+
+	tests := []struct {
+		name      string
+		events    []InputEvent
+		pressType int
+		pressOK   bool
+		status    [3]bool
+		statusOK  bool
+		value     uint16
+		valueOK   bool
+	}{
+		{"none", nil, 0, false, [3]bool{}, false, 0, false},
+		{"pressed", []InputEvent{pressed}, 1, true, [3]bool{}, false, 0, false},
+		{"double pressed wins", []InputEvent{pressed, doublePressed, pressed}, 2, true, [3]bool{}, false, 0, false},
+		{"touched", []InputEvent{touched(0), touched(2), touched(5)}, 0, false, [3]bool{true, false, true}, true, 0, false},
+		{"last value", []InputEvent{turned(100), turned(300)}, 0, false, [3]bool{}, false, 300, true},
+	}
+
+	for _, test := range tests {
+		sm := newTestSensorManagement(&testReadingsSensor{events: test.events})
+
+		if pressType, ok := sm.GetSwitchPress(); pressType != test.pressType || ok != test.pressOK {
+			t.Errorf("%s: expected press %d %t, got %d %t", test.name, test.pressType, test.pressOK, pressType, ok)
+		}
+
+		if status, ok := sm.GetCapSensorStatus(); status != test.status || ok != test.statusOK {
+			t.Errorf("%s: expected touch %v %t, got %v %t", test.name, test.status, test.statusOK, status, ok)
+		}
+
+		if changed, value, ok := sm.GetPotentiometer(); value != test.value || ok != test.valueOK || changed != test.valueOK {
+			t.Errorf("%s: expected value %d %t, got %d %t", test.name, test.value, test.valueOK, value, ok)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// The time allowed for the service to stop once it is asked to
+const ShutdownTimeout = 10 * time.Second
+
+// ShutdownStep stops one part of the service. It should give up when the context is done.
+type ShutdownStep struct {
+	Name string
+	Stop func(ctx context.Context) error
+}
+
+// Shutdown runs the steps in order, sharing the timeout between them. A step which has not
+// finished when the timeout expires is abandoned along with the steps after it, so that a device
+// which has stopped responding cannot hold up the exit.
+func Shutdown(steps []ShutdownStep, timeout time.Duration) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for _, step := range steps {
+		done := make(chan error, 1)
+		go func(step ShutdownStep) { done <- step.Stop(ctx) }(step)
+
+		select {
+		case serr := <-done:
+			if serr != nil {
+				logMain.Error("Failed to stop", "step", step.Name, "error", serr)
+				err = fmt.Errorf("failed to stop %s: %v", step.Name, serr)
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("timed out after %s stopping %s", timeout, step.Name)
+		}
+	}
+
+	return
+}
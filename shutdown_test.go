@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShutdownInOrder(t *testing.T) {
+	var stopped []string
+	step := func(name string, err error) ShutdownStep {
+		return ShutdownStep{name, func(ctx context.Context) error {
+			stopped = append(stopped, name)
+			return err
+		}}
+	}
+
+	err := Shutdown([]ShutdownStep{step("sensors", nil), step("server", errors.New("busy")), step("led", nil)}, time.Second)
+	if err == nil {
+		t.Error("no error when a step failed")
+	}
+
+	if expected := []string{"sensors", "server", "led"}; !reflect.DeepEqual(stopped, expected) {
+		t.Errorf("stopped %v, expected %v", stopped, expected)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+
+	var later bool
+	start := time.Now()
+	err := Shutdown([]ShutdownStep{
+		{"display", func(ctx context.Context) error { <-hung; return nil }},
+		{"led", func(ctx context.Context) error { later = true; return nil }},
+	}, 50*time.Millisecond)
+
+	if err == nil || time.Since(start) > time.Second {
+		t.Errorf("a step which did not stop held up the shutdown for %s: %v", time.Since(start), err)
+	}
+
+	if later {
+		t.Error("the steps after one which timed out were run")
+	}
+}
+
+func TestSensorManagementWaitAndClose(t *testing.T) {
+	sm := NewSensorManagement(10*time.Millisecond, 0)
+	s := &testClosingSensor{testSensor: testSensor{name: "closing"}}
+	sm.AddSensor(s, SensorConfiguration{SensorType: "test", Name: "closing"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sm.Start(ctx)
+	cancel()
+
+	wctx, wcancel := context.WithTimeout(context.Background(), time.Second)
+	defer wcancel()
+	if err := sm.Wait(wctx); err != nil {
+		t.Fatalf("the polling did not stop: %v", err)
+	}
+
+	sm.Close()
+	if !s.closed {
+		t.Error("the sensor was not closed")
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The rolling windows of the statistics, which are kept in hourly buckets
+const (
+	StatsDay    = 24 * time.Hour
+	StatsWeek   = 7 * 24 * time.Hour
+	statsBucket = time.Hour
+)
+
+// The file the statistics are kept in when it is not configured, and how often it is written
+const (
+	DefaultStatsFile  = "stats.json"
+	StatsSaveInterval = time.Minute
+)
+
+// MetricStats is the minimum, maximum and mean of a metric over a window, with the times of the extremes
+type MetricStats struct {
+	Min     float64
+	MinTime time.Time
+	Max     float64
+	MaxTime time.Time
+	Mean    float64
+	Count   int
+}
+
+func (ms MetricStats) Format(unit string) string {
+	return fmt.Sprintf("min %.1f %s at %s, max %.1f %s at %s, mean %.1f %s",
+		ms.Min, unit, formatStatsTime(ms.MinTime), ms.Max, unit, formatStatsTime(ms.MaxTime), ms.Mean, unit)
+}
+
+// formatStatsTime shows the time of day, with the day of the week for times before today
+func formatStatsTime(t time.Time) string {
+	t = t.Local()
+	if y, m, d := time.Now().Date(); t.Year() == y && t.Month() == m && t.Day() == d {
+		return t.Format("15:04")
+	}
+	return t.Format("Mon 15:04")
+}
+
+// SensorStats is the statistics of a metric of a sensor over the last day and week
+type SensorStats struct {
+	Sensor string
+	Metric string
+	Unit   string
+	Day    MetricStats
+	Week   MetricStats
+}
+
+// statsHour is the readings of a metric over an hour
+type statsHour struct {
+	Start   time.Time
+	Count   int
+	Sum     float64
+	Min     float64
+	MinTime time.Time
+	Max     float64
+	MaxTime time.Time
+}
+
+func (h *statsHour) add(v float64, t time.Time) {
+	if h.Count == 0 || v < h.Min {
+		h.Min, h.MinTime = v, t
+	}
+
+	if h.Count == 0 || v > h.Max {
+		h.Max, h.MaxTime = v, t
+	}
+
+	h.Count++
+	h.Sum += v
+}
+
+// statsSeries is the hours of the last week of a metric of a sensor, oldest first
+type statsSeries struct {
+	Sensor string
+	Metric string
+	Unit   string
+	Last   time.Time
+	Hours  []statsHour
+}
+
+func (s *statsSeries) add(r Reading) {
+	start := r.Time.Truncate(statsBucket)
+	if n := len(s.Hours); n == 0 || s.Hours[n-1].Start.Before(start) {
+		s.Hours = append(s.Hours, statsHour{Start: start})
+	}
+
+	s.Hours[len(s.Hours)-1].add(r.Value, r.Time)
+	s.Unit = r.Unit
+	s.Last = r.Time
+	s.expire(r.Time)
+}
+
+// expire drops the hours which have left the weekly window
+func (s *statsSeries) expire(now time.Time) {
+	i := 0
+	for i < len(s.Hours) && !s.Hours[i].Start.After(now.Add(-StatsWeek)) {
+		i++
+	}
+	s.Hours = s.Hours[i:]
+}
+
+// window combines the hours which started within the window before now
+func (s *statsSeries) window(window time.Duration, now time.Time) (ms MetricStats) {
+	var sum float64
+	for _, h := range s.Hours {
+		if !h.Start.After(now.Add(-window)) || h.Count == 0 {
+			continue
+		}
+
+		if ms.Count == 0 || h.Min < ms.Min {
+			ms.Min, ms.MinTime = h.Min, h.MinTime
+		}
+
+		if ms.Count == 0 || h.Max > ms.Max {
+			ms.Max, ms.MaxTime = h.Max, h.MaxTime
+		}
+
+		ms.Count += h.Count
+		sum += h.Sum
+	}
+
+	if ms.Count > 0 {
+		ms.Mean = sum / float64(ms.Count)
+	}
+	return
+}
+
+// Statistics keeps the rolling daily and weekly statistics of every metric of every sensor. They
+// are saved to a file so that they survive a restart.
+type Statistics struct {
+	mu     sync.Mutex
+	path   string
+	series map[string]*statsSeries
+	dirty  bool
+}
+
+func NewStatistics() *Statistics {
+	return &Statistics{series: make(map[string]*statsSeries)}
+}
+
+// Load reads the statistics saved in the file, which is where they are saved from now on. A
+// missing file starts the statistics afresh.
+func (st *Statistics) Load(path string) (err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.path = path
+
+	var data []byte
+	if data, err = ioutil.ReadFile(path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+
+	var saved []*statsSeries
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to read statistics from \"%s\": %v", path, err)
+	}
+
+	for _, s := range saved {
+		if s.expire(time.Now()); len(s.Hours) > 0 {
+			st.series[s.Sensor+"/"+s.Metric] = s
+		}
+	}
+
+	return
+}
+
+// Save writes the statistics to their file if they have changed since they were last saved
+func (st *Statistics) Save() (err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.path == "" || !st.dirty {
+		return
+	}
+
+	saved := make([]*statsSeries, 0, len(st.series))
+	for _, s := range st.series {
+		saved = append(saved, s)
+	}
+
+	var data []byte
+	if data, err = json.Marshal(saved); err != nil {
+		return
+	}
+
+	// Replace the file in one step so that a crash while saving does not lose the statistics
+	tmp := filepath.Join(filepath.Dir(st.path), "."+filepath.Base(st.path)+".tmp")
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmp, st.path); err != nil {
+		return
+	}
+
+	st.dirty = false
+	return
+}
+
+// Record adds a reading of a sensor. Readings which have not been taken yet or are no newer than
+// the last reading of the metric are ignored.
+func (st *Statistics) Record(sensor string, r Reading) {
+	if r.Time.IsZero() || math.IsNaN(r.Value) {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	key := sensor + "/" + r.Metric
+	s := st.series[key]
+	if s == nil {
+		s = &statsSeries{Sensor: sensor, Metric: r.Metric}
+		st.series[key] = s
+	}
+
+	if r.Time.After(s.Last) {
+		s.add(r)
+		st.dirty = true
+	}
+}
+
+// Remove forgets the statistics of a sensor which has been removed, returning its metrics
+func (st *Statistics) Remove(sensor string) (metrics []string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	for key, s := range st.series {
+		if s.Sensor == sensor {
+			metrics = append(metrics, s.Metric)
+			delete(st.series, key)
+			st.dirty = true
+		}
+	}
+
+	sort.Strings(metrics)
+	return
+}
+
+func (s *statsSeries) stats(now time.Time) SensorStats {
+	return SensorStats{
+		Sensor: s.Sensor,
+		Metric: s.Metric,
+		Unit:   s.Unit,
+		Day:    s.window(StatsDay, now),
+		Week:   s.window(StatsWeek, now),
+	}
+}
+
+// Sensor returns the statistics of each metric of the sensor with readings in the last week,
+// ordered by metric
+func (st *Statistics) Sensor(sensor string) (stats []SensorStats) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	for _, s := range st.series {
+		if s.Sensor != sensor {
+			continue
+		}
+
+		if ss := s.stats(now); ss.Week.Count > 0 {
+			stats = append(stats, ss)
+		}
+	}
+
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Metric < stats[j].Metric })
+	return
+}
+
+// All returns the statistics of every metric with readings in the last week, ordered by sensor and metric
+func (st *Statistics) All() (stats []SensorStats) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	stats = make([]SensorStats, 0, len(st.series))
+	for _, s := range st.series {
+		if ss := s.stats(now); ss.Week.Count > 0 {
+			stats = append(stats, ss)
+		}
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Sensor != stats[j].Sensor {
+			return stats[i].Sensor < stats[j].Sensor
+		}
+		return stats[i].Metric < stats[j].Metric
+	})
+	return
+}
+
+// publish sets the Prometheus gauges of the statistics of every metric, removing those of the
+// windows without readings. The statistics are held while they are published so that those of a
+// sensor which is being removed are not published again.
+func (st *Statistics) publish() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	stats := make([]SensorStats, 0, len(st.series))
+	for _, s := range st.series {
+		stats = append(stats, s.stats(now))
+	}
+
+	publishSensorStats(stats)
+}
+
+// saveEvery publishes and saves the statistics every interval, as they change too slowly to be
+// published on every reading, and saves them a final time when the context is cancelled
+func (st *Statistics) saveEvery(ctx context.Context, interval time.Duration) {
+	for {
+		st.publish()
+
+		select {
+		case <-ctx.Done():
+			if err := st.Save(); err != nil {
+				logStorage.Error("Failed to save statistics", "path", st.path, "error", err)
+			}
+			return
+		case <-time.After(interval):
+		}
+
+		if err := st.Save(); err != nil {
+			logStorage.Error("Failed to save statistics", "path", st.path, "error", err)
+		}
+	}
+}
+
+var promSensorStat = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sensor_statistic",
+	Help: "Minimum, maximum or mean of a metric of the sensor over the last day or week",
+}, []string{"sensor", "metric", "window", "statistic"})
+
+var promSensorStatTime = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sensor_statistic_timestamp",
+	Help: "Unix time of the minimum or maximum of a metric of the sensor over the last day or week",
+}, []string{"sensor", "metric", "window", "statistic"})
+
+func publishSensorStats(stats []SensorStats) {
+	for _, ss := range stats {
+		for _, w := range []struct {
+			name  string
+			stats MetricStats
+		}{{"day", ss.Day}, {"week", ss.Week}} {
+			// A window without readings has no minimum, maximum or mean to publish
+			if w.stats.Count == 0 {
+				unpublishStatsWindow(ss.Sensor, ss.Metric, w.name)
+				continue
+			}
+
+			promSensorStat.WithLabelValues(ss.Sensor, ss.Metric, w.name, "min").Set(w.stats.Min)
+			promSensorStat.WithLabelValues(ss.Sensor, ss.Metric, w.name, "max").Set(w.stats.Max)
+			promSensorStat.WithLabelValues(ss.Sensor, ss.Metric, w.name, "mean").Set(w.stats.Mean)
+			promSensorStatTime.WithLabelValues(ss.Sensor, ss.Metric, w.name, "min").Set(float64(w.stats.MinTime.UnixNano()) / 1e9)
+			promSensorStatTime.WithLabelValues(ss.Sensor, ss.Metric, w.name, "max").Set(float64(w.stats.MaxTime.UnixNano()) / 1e9)
+		}
+	}
+}
+
+// unpublishSensorStats removes the statistics of the metrics of a sensor which has been removed
+func unpublishSensorStats(sensor string, metrics []string) {
+	for _, metric := range metrics {
+		for _, window := range []string{"day", "week"} {
+			unpublishStatsWindow(sensor, metric, window)
+		}
+	}
+}
+
+func unpublishStatsWindow(sensor, metric, window string) {
+	for _, statistic := range []string{"min", "max", "mean"} {
+		promSensorStat.DeleteLabelValues(sensor, metric, window, statistic)
+		promSensorStatTime.DeleteLabelValues(sensor, metric, window, statistic)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// recordNight records a temperature every ten minutes for two days before now, which falls to its
+// lowest at the same time each night
+func recordNight(st *Statistics, now time.Time) (coldest time.Time) {
+	start := now.Add(-48 * time.Hour).Truncate(time.Hour)
+	for i := 0; i < 48*6; i++ {
+		t := start.Add(time.Duration(i) * 10 * time.Minute)
+		v := 20.0
+		switch i {
+		case 30:
+			v = 12 // Over a day ago, so only the weekly minimum
+		case 30 + 24*6:
+			v, coldest = 14, t
+		case 40 + 24*6:
+			v = 25
+		}
+
+		st.Record("study", NewReading(MetricTemperature, v, UnitCelsius, t))
+	}
+	return
+}
+
+func TestStatisticsWindows(t *testing.T) {
+	st := NewStatistics()
+	coldest := recordNight(st, time.Now())
+
+	stats := st.Sensor("study")
+	if len(stats) != 1 {
+		t.Fatalf("expected statistics for one metric, got %+v", stats)
+	}
+
+	day, week := stats[0].Day, stats[0].Week
+	if day.Min != 14 || !day.MinTime.Equal(coldest) || day.Max != 25 {
+		t.Errorf("unexpected daily statistics %+v", day)
+	}
+
+	if week.Min != 12 || week.Max != 25 || week.Count != 48*6 {
+		t.Errorf("unexpected weekly statistics %+v", week)
+	}
+
+	if day.Mean < 19.9 || day.Mean > 20.1 {
+		t.Errorf("unexpected daily mean %f", day.Mean)
+	}
+
+	// Readings which are not new are ignored
+	st.Record("study", NewReading(MetricTemperature, -40, UnitCelsius, coldest))
+	if st.Sensor("study")[0].Week.Min != 12 {
+		t.Error("a reading older than the last one changed the statistics")
+	}
+}
+
+func TestStatisticsExpire(t *testing.T) {
+	st := NewStatistics()
+	now := time.Now()
+	st.Record("study", NewReading(MetricTemperature, 5, UnitCelsius, now.Add(-8*24*time.Hour)))
+	st.Record("study", NewReading(MetricTemperature, 20, UnitCelsius, now))
+
+	if week := st.Sensor("study")[0].Week; week.Min != 20 || week.Count != 1 {
+		t.Errorf("a reading from over a week ago is still in the statistics: %+v", week)
+	}
+}
+
+func TestStatisticsSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stats.json")
+
+	st := NewStatistics()
+	if err := st.Load(path); err != nil {
+		t.Fatalf("a missing statistics file failed to load: %v", err)
+	}
+
+	coldest := recordNight(st, time.Now())
+	if err := st.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := NewStatistics()
+	if err := loaded.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := loaded.Sensor("study")
+	if len(stats) != 1 || stats[0].Unit != UnitCelsius || !stats[0].Day.MinTime.Equal(coldest) || stats[0].Week.Min != 12 {
+		t.Errorf("unexpected statistics after loading: %+v", stats)
+	}
+}
+
+func TestDetailsIncludesStatistics(t *testing.T) {
+	sm := NewSensorManagement(time.Second, 0)
+	s := &testReadingsSensor{readings: []Reading{NewReading(MetricTemperature, 17.5, UnitCelsius, time.Now())}}
+	sm.AddSensor(s, SensorConfiguration{Name: "study", SensorType: "test"})
+	sm.UpdateSensors()
+
+	details := sm.Details()
+	if !strings.Contains(details, "temperature day: min 17.5 C at ") || !strings.Contains(details, "week: min 17.5 C") {
+		t.Errorf("expected the statistics in the details:\n%s", details)
+	}
+}
+
+// publishedStatsWindows counts the statistics of the sensor published by window
+func publishedStatsWindows(t *testing.T, sensor string) map[string]int {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	windows := make(map[string]int)
+	for _, mf := range families {
+		if mf.GetName() != "sensor_statistic" && mf.GetName() != "sensor_statistic_timestamp" {
+			continue
+		}
+
+		for _, m := range mf.GetMetric() {
+			labels := make(map[string]string)
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+
+			if labels["sensor"] == sensor {
+				windows[labels["window"]]++
+			}
+		}
+	}
+	return windows
+}
+
+func TestPublishSensorStatsSkipsEmptyWindows(t *testing.T) {
+	st := NewStatistics()
+	st.Record("stats_attic", NewReading(MetricTemperature, 20, UnitCelsius, time.Now()))
+	publishSensorStats(st.Sensor("stats_attic"))
+
+	// Once the reading is over a day old the daily window is empty
+	stats := st.Sensor("stats_attic")
+	stats[0].Day = MetricStats{}
+	publishSensorStats(stats)
+	defer unpublishSensorStats("stats_attic", []string{MetricTemperature})
+
+	if windows := publishedStatsWindows(t, "stats_attic"); windows["day"] != 0 || windows["week"] != 5 {
+		t.Errorf("expected only the weekly statistics to be published, got %v", windows)
+	}
+}
+
+func TestStatisticsPublish(t *testing.T) {
+	st := NewStatistics()
+	st.Record("stats_cellar", NewReading(MetricTemperature, 14, UnitCelsius, time.Now()))
+	st.Record("stats_loft", NewReading(MetricTemperature, 24, UnitCelsius, time.Now()))
+	defer unpublishSensorStats("stats_loft", []string{MetricTemperature})
+
+	st.publish()
+	if windows := publishedStatsWindows(t, "stats_cellar"); windows["day"] != 5 || windows["week"] != 5 {
+		t.Errorf("expected the statistics of every sensor to be published, got %v", windows)
+	}
+
+	unpublishSensorStats("stats_cellar", st.Remove("stats_cellar"))
+	st.publish()
+	if windows := publishedStatsWindows(t, "stats_cellar"); len(windows) != 0 {
+		t.Errorf("expected the statistics of the removed sensor to stay unpublished, got %v", windows)
+	}
+
+	if stats := st.Sensor("stats_loft"); len(stats) != 1 || stats[0].Metric != MetricTemperature {
+		t.Errorf("expected the statistics of the one sensor, got %+v", stats)
+	}
+}
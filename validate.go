@@ -0,0 +1,557 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigProblem is a mistake in the configuration, at its line in the file when it is known
+type ConfigProblem struct {
+	Line    int
+	Path    string
+	Message string
+}
+
+func (p ConfigProblem) String() string {
+	s := p.Message
+	if p.Path != "" {
+		s = p.Path + ": " + s
+	}
+	if p.Line > 0 {
+		s = fmt.Sprintf("line %d: %s", p.Line, s)
+	}
+	return s
+}
+
+// ConfigErrors is every problem found in a configuration, in the order of their lines
+type ConfigErrors []ConfigProblem
+
+func (e ConfigErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].String()
+	}
+
+	lines := []string{fmt.Sprintf("%d problems in the configuration:", len(e))}
+	for _, p := range e {
+		lines = append(lines, "  "+p.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// configChecker collects the problems in a configuration, using the lines of its keys to say
+// where each one is
+type configChecker struct {
+	lines    map[string]int
+	problems ConfigErrors
+
+	// The paths of the values read from files, and a replacer of the secrets in decoding errors
+	secrets  map[string]bool
+	redactor *strings.Replacer
+}
+
+// add records a problem with the value at the path, such as sensors[2].name
+func (cc *configChecker) add(path string, format string, a ...interface{}) {
+	cc.problems = append(cc.problems, ConfigProblem{Line: cc.line(path), Path: path, Message: fmt.Sprintf(format, a...)})
+}
+
+// line is the line of the path, or of the closest enclosing path with a line
+func (cc *configChecker) line(path string) int {
+	for path != "" {
+		if line, ok := cc.lines[path]; ok {
+			return line
+		}
+
+		if i := strings.LastIndexAny(path, ".["); i >= 0 {
+			path = path[:i]
+		} else {
+			path = ""
+		}
+	}
+	return 0
+}
+
+func (cc *configChecker) err() error {
+	if len(cc.problems) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(cc.problems, func(i, j int) bool { return cc.problems[i].Line < cc.problems[j].Line })
+	return cc.problems
+}
+
+// yamlKey is the key of a field of a configuration struct, which is the lower case name of the field
+func yamlKey(f reflect.StructField) string {
+	if tag := strings.Split(f.Tag.Get("yaml"), ",")[0]; tag != "" {
+		return tag
+	}
+	return strings.ToLower(f.Name)
+}
+
+// checkKeys records the line of every key in the node and reports the keys which are not fields
+// of the type it is decoded into
+func (cc *configChecker) checkKeys(node *yaml.Node, t reflect.Type, path string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case node.Kind == yaml.DocumentNode:
+		for _, n := range node.Content {
+			cc.checkKeys(n, t, path)
+		}
+
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields := make(map[string]reflect.Type)
+		var keys []string
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" {
+				fields[yamlKey(f)] = f.Type
+				keys = append(keys, yamlKey(f))
+			}
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			keyPath := joinConfigPath(path, key.Value)
+			cc.lines[keyPath] = key.Line
+
+			if ft, ok := fields[key.Value]; ok {
+				cc.checkKeys(value, ft, keyPath)
+			} else if suggestion := closestKey(key.Value, keys); suggestion != "" {
+				cc.add(keyPath, "unknown key \"%s\", did you mean \"%s\"?", key.Value, suggestion)
+			} else {
+				cc.add(keyPath, "unknown key \"%s\"", key.Value)
+			}
+		}
+
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyPath := joinConfigPath(path, node.Content[i].Value)
+			cc.lines[keyPath] = node.Content[i].Line
+			cc.checkKeys(node.Content[i+1], t.Elem(), keyPath)
+		}
+
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for i, n := range node.Content {
+			itemPath := fmt.Sprintf("%s[%d]", path, i)
+			cc.lines[itemPath] = n.Line
+			cc.checkKeys(n, t.Elem(), itemPath)
+		}
+	}
+}
+
+func joinConfigPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// closestKey returns the key which is a small edit away from the unknown key, if there is one
+func closestKey(unknown string, keys []string) (closest string) {
+	best := 3
+	for _, k := range keys {
+		if d := editDistance(strings.ToLower(unknown), k); d < best {
+			best, closest = d, k
+		}
+	}
+	return
+}
+
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = previous[j-1] + cost
+			if previous[j]+1 < current[j] {
+				current[j] = previous[j] + 1
+			}
+			if current[j-1]+1 < current[j] {
+				current[j] = current[j-1] + 1
+			}
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(b)]
+}
+
+// addDecodeErrors records the errors from decoding the YAML, which start with their line
+func (cc *configChecker) addDecodeErrors(err error) {
+	var messages []string
+	if te, ok := err.(*yaml.TypeError); ok {
+		messages = te.Errors
+	} else {
+		messages = []string{strings.TrimPrefix(err.Error(), "yaml: ")}
+	}
+
+	for _, m := range messages {
+		var p ConfigProblem
+		if _, serr := fmt.Sscanf(m, "line %d:", &p.Line); serr == nil {
+			m = strings.TrimSpace(m[strings.Index(m, ":")+1:])
+		}
+		if cc.redactor != nil {
+			m = cc.redactor.Replace(m)
+		}
+		p.Message = m
+		cc.problems = append(cc.problems, p)
+	}
+}
+
+// The sensor name is the start of the names of its Prometheus metrics
+var metricNamePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// A MAC address as Lifx reports it, such as d0:73:d5:64:72:09
+var macPattern = regexp.MustCompile(`^[0-9a-fA-F]{2}(:[0-9a-fA-F]{2}){5}$`)
+
+// A HomeKit setup ID is four upper case letters and digits
+var setupIDPattern = regexp.MustCompile(`^[0-9A-Z]{4}$`)
+
+// The setup codes which HomeKit rejects as too easy to guess
+var trivialSetupCodes = map[uint32]bool{
+	0: true, 11111111: true, 22222222: true, 33333333: true, 44444444: true, 55555555: true,
+	66666666: true, 77777777: true, 88888888: true, 99999999: true, 12345678: true, 87654321: true,
+}
+
+// The 7 bit I2C addresses which are not reserved
+const (
+	MinI2CAddress = 0x08
+	MaxI2CAddress = 0x77
+)
+
+func (cc *configChecker) checkAddress(path string, address uint8, min, max uint8) {
+	if address != 0 && (address < min || address > max) {
+		cc.add(path, "I2C address 0x%02x is out of range, expected 0x%02x to 0x%02x", address, min, max)
+	}
+}
+
+func (cc *configChecker) checkBus(path string, bus *int) {
+	if bus != nil && *bus < 0 {
+		cc.add(path, "I2C bus %d is not a bus number", *bus)
+	}
+}
+
+// check reports every problem in the configuration
+func (cc *configChecker) check(c *I2cConfiguration) {
+	if c.HomeKitDeviceID == "" {
+		cc.add("homekitdeviceid", "homekitdeviceid is required, four upper case letters or digits such as TF0X")
+	} else if !setupIDPattern.MatchString(c.HomeKitDeviceID) {
+		cc.add("homekitdeviceid", "\"%s\" is not a HomeKit setup ID, which is four upper case letters or digits such as TF0X", c.HomeKitDeviceID)
+	}
+
+	if c.HomeKitDevicePin == 0 {
+		cc.add("homekitdevicepin", "homekitdevicepin is required, the eight digit HomeKit setup code")
+	} else if c.HomeKitDevicePin > 99999999 {
+		cc.add("homekitdevicepin", "the setup code has more than the eight digits of a HomeKit setup code")
+	} else if trivialSetupCodes[c.HomeKitDevicePin] {
+		cc.add("homekitdevicepin", "HomeKit rejects the setup code as too easy to guess, choose another")
+	}
+
+	for i, metric := range c.HomeKitDerived {
+		path := fmt.Sprintf("homekitderived[%d]", i)
+		switch {
+		case containsString(HomeKitDerivedMetrics, metric):
+		case containsString(DerivedMetrics, metric):
+			cc.add(path, "HomeKit cannot show %s, expected one of %s", metric, strings.Join(HomeKitDerivedMetrics, ", "))
+		default:
+			if suggestion := closestKey(metric, HomeKitDerivedMetrics); suggestion != "" {
+				cc.add(path, "unknown derived metric \"%s\", did you mean \"%s\"?", metric, suggestion)
+			} else {
+				cc.add(path, "unknown derived metric \"%s\", expected one of %s", metric, strings.Join(HomeKitDerivedMetrics, ", "))
+			}
+		}
+	}
+
+	if (c.EnableLifx || c.LifxMAC != "") && !macPattern.MatchString(c.LifxMAC) {
+		cc.add("lifxmac", "\"%s\" is not a MAC address such as d0:73:d5:64:72:09", c.LifxMAC)
+	}
+
+	cc.checkBus("oledbus", c.OLEDBus)
+	cc.checkBus("ledbus", c.LEDBus)
+
+	muxes := make(map[string]int)
+	for i := range c.Multiplexers {
+		mc := &c.Multiplexers[i]
+		path := fmt.Sprintf("multiplexers[%d]", i)
+
+		if mc.Name == "" {
+			cc.add(path, "multiplexer has no name")
+		} else if first, ok := muxes[mc.Name]; ok {
+			cc.add(path+".name", "multiplexer \"%s\" is already defined at line %d", mc.Name, cc.line(fmt.Sprintf("multiplexers[%d]", first)))
+		} else {
+			muxes[mc.Name] = i
+		}
+
+		cc.checkAddress(path+".i2caddress", mc.I2CAddress, TCA9548AAddress, TCA9548AAddress+7)
+		cc.checkBus(path+".i2cbus", mc.I2CBus)
+	}
+
+	names := make(map[string]int)
+	for i := range c.Sensors {
+		cc.checkSensor(c, i, names)
+	}
+
+	cc.checkRooms(c)
+
+	if _, _, _, err := parseLogging(c.Logging, c.DebugOutput); err != nil {
+		cc.add("logging", "%v", err)
+	}
+}
+
+// checkRooms checks that each room has a unique name and is made of sensors which are configured,
+// combined by known policies, and that the home room is one of the rooms
+func (cc *configChecker) checkRooms(c *I2cConfiguration) {
+	var sensors []string
+	for _, sc := range c.Sensors {
+		sensors = append(sensors, sc.Name)
+	}
+
+	rooms := make(map[string]int)
+	var roomNames []string
+	for i := range c.Rooms {
+		rc := &c.Rooms[i]
+		path := fmt.Sprintf("rooms[%d]", i)
+
+		if rc.Name == "" {
+			cc.add(path, "room has no name")
+		} else if first, ok := rooms[rc.Name]; ok {
+			cc.add(path+".name", "room \"%s\" is already defined at line %d", rc.Name, cc.line(fmt.Sprintf("rooms[%d]", first)))
+		} else {
+			rooms[rc.Name] = i
+			roomNames = append(roomNames, rc.Name)
+		}
+
+		if len(rc.Sensors) == 0 {
+			cc.add(path, "room \"%s\" has no sensors", rc.Name)
+		}
+
+		for j, name := range rc.Sensors {
+			if containsString(sensors, name) {
+				continue
+			}
+
+			sensorPath := fmt.Sprintf("%s.sensors[%d]", path, j)
+			if suggestion := closestKey(name, sensors); suggestion != "" {
+				cc.add(sensorPath, "unknown sensor \"%s\", did you mean \"%s\"?", name, suggestion)
+			} else {
+				cc.add(sensorPath, "unknown sensor \"%s\"", name)
+			}
+		}
+
+		if rc.Policy != "" && !containsString(RoomPolicies, rc.Policy) {
+			cc.add(path+".policy", "unknown policy \"%s\", expected one of %s", rc.Policy, strings.Join(RoomPolicies, ", "))
+		}
+
+		metrics := make([]string, 0, len(rc.Policies))
+		for metric := range rc.Policies {
+			metrics = append(metrics, metric)
+		}
+		sort.Strings(metrics)
+
+		for _, metric := range metrics {
+			policyPath := path + ".policies." + metric
+			if containsString(DerivedMetrics, metric) {
+				cc.add(policyPath, "%s is derived from the temperature and humidity of the room, which have their own policies", metric)
+				continue
+			}
+
+			if metric != MetricOccupancy && !cc.checkMetric(policyPath, metric) {
+				continue
+			}
+
+			if policy := rc.Policies[metric]; !containsString(RoomPolicies, policy) {
+				cc.add(policyPath, "unknown policy \"%s\", expected one of %s", policy, strings.Join(RoomPolicies, ", "))
+			}
+		}
+	}
+
+	if c.HomeRoom != "" && !containsString(roomNames, c.HomeRoom) {
+		if len(roomNames) == 0 {
+			cc.add("homeroom", "home room \"%s\" is set without any rooms", c.HomeRoom)
+		} else {
+			cc.add("homeroom", "unknown room \"%s\", expected one of %s", c.HomeRoom, strings.Join(roomNames, ", "))
+		}
+	}
+}
+
+func (cc *configChecker) checkSensor(c *I2cConfiguration, i int, names map[string]int) {
+	sc := &c.Sensors[i]
+	path := fmt.Sprintf("sensors[%d]", i)
+
+	switch first, ok := names[sc.Name]; {
+	case sc.Name == "":
+		cc.add(path, "sensor has no name")
+	case ok:
+		cc.add(path+".name", "sensor name \"%s\" is already used at line %d", sc.Name, cc.line(fmt.Sprintf("sensors[%d].name", first)))
+	case !metricNamePattern.MatchString(sc.Name):
+		cc.add(path+".name", "sensor name \"%s\" cannot start a Prometheus metric name, use letters, digits and underscores", sc.Name)
+	default:
+		names[sc.Name] = i
+	}
+
+	st, err := LookupSensorType(sc.SensorType)
+	if err != nil {
+		cc.add(path+".sensortype", "unknown sensor type \"%s\", run i2c sensor-types for the list", sc.SensorType)
+		return
+	}
+
+	var missing []string
+	for _, f := range st.Fields {
+		if f.Required && sensorConfigValue(sc, f.Name) == "" {
+			missing = append(missing, f.Name)
+		}
+	}
+
+	if len(missing) > 0 {
+		cc.add(path, "sensor \"%s\" of type \"%s\" requires %s", sc.Name, sc.SensorType, strings.Join(missing, ", "))
+	}
+
+	cc.checkAddress(path+".i2caddress", sc.I2CAddress, MinI2CAddress, MaxI2CAddress)
+	cc.checkBus(path+".i2cbus", sc.I2CBus)
+
+	if sc.Multiplexer != "" {
+		if _, err = c.SensorBus(sc); err != nil {
+			cc.add(path+".multiplexer", "%v", err)
+		}
+	} else if sc.MuxChannel != 0 {
+		cc.add(path+".muxchannel", "muxchannel is set without a multiplexer")
+	}
+
+	st.ResolveOptions(sc.Options, func(name string, err error) {
+		cc.add(path+".options."+name, "%v", err)
+	})
+
+	cc.checkCalibration(path+".calibration", sc)
+	cc.checkFilters(path+".filters", sc)
+
+	if sc.Interval < 0 {
+		cc.add(path+".interval", "interval %s is negative", sc.Interval)
+	}
+
+	if sc.StaleAfter < 0 {
+		cc.add(path+".staleafter", "staleafter %s is negative", sc.StaleAfter)
+	}
+}
+
+// checkMetric reports a key of the calibration or filters of a sensor which is not a measured metric
+func (cc *configChecker) checkMetric(path, metric string) bool {
+	if containsString(MeasuredMetrics, metric) {
+		return true
+	}
+
+	if suggestion := closestKey(metric, MeasuredMetrics); suggestion != "" {
+		cc.add(path, "unknown metric \"%s\", did you mean \"%s\"?", metric, suggestion)
+	} else {
+		cc.add(path, "unknown metric \"%s\", expected one of %s", metric, strings.Join(MeasuredMetrics, ", "))
+	}
+	return false
+}
+
+// checkCalibration checks that each calibration is of a metric and is a correction which can be applied
+func (cc *configChecker) checkCalibration(path string, sc *SensorConfiguration) {
+	metrics := make([]string, 0, len(sc.Calibration))
+	for metric := range sc.Calibration {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	for _, metric := range metrics {
+		calibration := sc.Calibration[metric]
+		if !cc.checkMetric(path+"."+metric, metric) {
+			continue
+		}
+
+		if _, err := calibration.Calibration(); err != nil {
+			cc.add(path+"."+metric, "%v", err)
+		}
+	}
+}
+
+// checkFilters checks that each filter is of a metric and has settings which can be applied
+func (cc *configChecker) checkFilters(path string, sc *SensorConfiguration) {
+	metrics := make([]string, 0, len(sc.Filters))
+	for metric := range sc.Filters {
+		metrics = append(metrics, metric)
+	}
+	sort.Strings(metrics)
+
+	for _, metric := range metrics {
+		if !cc.checkMetric(path+"."+metric, metric) {
+			continue
+		}
+
+		if _, err := newMetricFilter(metric, sc.Filters[metric]); err != nil {
+			cc.add(path+"."+metric, "%v", err)
+		}
+	}
+}
+
+// parseConfiguration decodes the YAML, reporting unknown keys and values of the wrong type along
+// with every other problem found by Validate. Keys ending in _file and then the variables of the
+// environment with ConfigEnvPrefix override the values in the YAML.
+func parseConfiguration(data []byte, env []string) (cfg *I2cConfiguration, err error) {
+	cfg = &I2cConfiguration{}
+	cc := &configChecker{lines: make(map[string]int), secrets: make(map[string]bool)}
+
+	var root yaml.Node
+	if err = yaml.Unmarshal(data, &root); err != nil {
+		cc.addDecodeErrors(err)
+		return nil, cc.err()
+	}
+
+	if len(root.Content) == 0 {
+		root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+
+	cc.resolveFileKeys(&root, reflect.TypeOf(cfg), "")
+	cc.applyEnvironment(&root, env)
+
+	secrets := secretValues(&root, cc.secrets)
+	addSecrets(secrets)
+	var pairs []string
+	for _, v := range secrets {
+		pairs = append(pairs, v, Redacted)
+	}
+	cc.redactor = strings.NewReplacer(pairs...)
+
+	cc.checkKeys(&root, reflect.TypeOf(cfg), "")
+
+	if len(root.Content) > 0 {
+		if err = root.Decode(cfg); err != nil {
+			cc.addDecodeErrors(err)
+		}
+	}
+
+	cfg.lines = cc.lines
+	cfg.secrets = cc.secrets
+	cc.check(cfg)
+
+	if err = cc.err(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Validate checks the whole configuration and returns ConfigErrors listing every problem, so
+// that mistakes are reported together before any hardware is touched
+func (c *I2cConfiguration) Validate() error {
+	cc := &configChecker{lines: c.lines}
+	cc.check(c)
+	return cc.err()
+}
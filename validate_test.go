@@ -0,0 +1,230 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// testConfigHeader is the HomeKit settings which every valid configuration has
+const testConfigHeader = `homekitdeviceid: TF0X
+homekitdevicepin: 12344321
+`
+
+// expectConfigProblems parses the configuration following testConfigHeader and checks that it has
+// the problems and no others. The lines of the problems count those of the header.
+func expectConfigProblems(t *testing.T, yaml string, problems ...string) {
+	_, err := parseConfiguration([]byte(testConfigHeader+yaml), nil)
+	if reported, _ := err.(ConfigErrors); len(reported) != len(problems) {
+		t.Errorf("expected %d problems, got %d:\n%v", len(problems), len(reported), err)
+	}
+
+	for _, p := range problems {
+		if err == nil || !strings.Contains(err.Error(), p) {
+			t.Errorf("expected the problem %s in:\n%v", p, err)
+		}
+	}
+}
+
+func TestParseConfigurationReportsEveryProblem(t *testing.T) {
+	_, err := parseConfiguration([]byte(`homekitdeviceid: tf0x
+homekitdevicepin: 12345678
+enablelifx: true
+lifxmac: d0-73-d5-64-72-09
+sampeltime: 1
+multiplexers:
+  - name: cabinet
+    i2caddress: 0x60
+sensors:
+  - sensortype: tmp117
+    name: study
+    i2caddress: 0x80
+  - sensortype: aht10
+    name: study
+    multiplexer: cabinet
+    muxchannel: 9
+  - sensortype: dysonhotcool
+    name: lounge-fan
+    server: tcp://fan:1883
+  - sensortype: toaster
+    name: kitchen
+    colour: red
+`), nil)
+
+	problems, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+
+	expected := []string{
+		`line 1: homekitdeviceid: "tf0x" is not a HomeKit setup ID`,
+		`line 2: homekitdevicepin: HomeKit rejects the setup code as too easy to guess`,
+		`line 4: lifxmac: "d0-73-d5-64-72-09" is not a MAC address`,
+		`line 5: sampeltime: unknown key "sampeltime", did you mean "sampletime"?`,
+		`line 8: multiplexers[0].i2caddress: I2C address 0x60 is out of range, expected 0x70 to 0x77`,
+		`line 12: sensors[0].i2caddress: I2C address 0x80 is out of range`,
+		`line 14: sensors[1].name: sensor name "study" is already used at line 11`,
+		`line 15: sensors[1].multiplexer: sensor "study" is on channel 9 of multiplexer "cabinet"`,
+		`line 17: sensors[2]: sensor "lounge-fan" of type "dysonhotcool" requires devicetype, serial, password`,
+		`line 18: sensors[2].name: sensor name "lounge-fan" cannot start a Prometheus metric name`,
+		`line 20: sensors[3].sensortype: unknown sensor type "toaster"`,
+		`line 22: sensors[3].colour: unknown key "colour"`,
+	}
+
+	if len(problems) != len(expected) {
+		t.Errorf("expected %d problems, got %d:\n%v", len(expected), len(problems), err)
+	}
+
+	for _, e := range expected {
+		if !strings.Contains(err.Error(), e) {
+			t.Errorf("expected the problem %s in:\n%v", e, err)
+		}
+	}
+}
+
+func TestParseConfigurationTypeErrors(t *testing.T) {
+	_, err := parseConfiguration([]byte(`homekitdeviceid: TF0X
+homekitdevicepin: 12344321
+sampletime: often
+sensors:
+  - sensortype: tmp117
+    name: study
+    i2caddress: 0x148
+`), nil)
+
+	if err == nil || !strings.Contains(err.Error(), "line 3: ") || !strings.Contains(err.Error(), "line 7: ") {
+		t.Errorf("expected the lines of the values of the wrong type, got %v", err)
+	}
+}
+
+func TestParseConfigurationValid(t *testing.T) {
+	config, err := parseConfiguration([]byte(`homekitdeviceid: TF0X
+homekitdevicepin: 12344321
+staleafter: 10m
+multiplexers:
+  - name: cabinet
+sensors:
+  - sensortype: aht10
+    name: shelf
+    multiplexer: cabinet
+    muxchannel: 3
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.Sensors) != 1 || config.Sensors[0].MuxChannel != 3 || config.StaleAfter.Minutes() != 10 {
+		t.Errorf("unexpected configuration %+v", config)
+	}
+}
+
+func TestValidateWithoutFile(t *testing.T) {
+	config := &I2cConfiguration{
+		HomeKitDeviceID:  "TF0X",
+		HomeKitDevicePin: 12344321,
+		Sensors:          []SensorConfiguration{{SensorType: "tmp117", Name: "a"}, {SensorType: "tmp117", Name: "a"}},
+	}
+
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), `sensors[1].name: sensor name "a" is already used`) {
+		t.Errorf("expected the duplicate name, got %v", err)
+	}
+}
+
+func TestParseConfigurationProblems(t *testing.T) {
+	tests := []struct {
+		yaml     string
+		problems []string
+	}{
+		// Options of the sensors
+		{`sensors:
+  - sensortype: bme280
+    name: lounge
+    options:
+      temperatureoversampling: 3
+      filter: 16
+  - sensortype: aht10
+    name: hall
+    options:
+      mintemperature: cold
+  - sensortype: bom
+    name: outside
+    options:
+      station: 94868
+`, []string{
+			`line 7: sensors[0].options.temperatureoversampling: 3 is not one of 1, 2, 4, 8, 16`,
+			`line 8: sensors[0].options.filter: unknown option "filter", expected one of`,
+			`line 12: sensors[1].options.mintemperature: expected a number, got cold`,
+			`line 16: sensors[2].options.station: sensor type "bom" has no options`,
+		}},
+		// Calibration
+		{`sensors:
+  - sensortype: aht10
+    name: hall
+    calibration:
+      temprature:
+        offset: -1.3
+      humidity:
+        ofset: 2
+      pressure:
+        scale: 0
+`, []string{
+			`line 7: sensors[0].calibration.temprature: unknown metric "temprature", did you mean "temperature"?`,
+			`line 10: sensors[0].calibration.humidity.ofset: unknown key "ofset", did you mean "offset"?`,
+			`line 11: sensors[0].calibration.pressure: scale 0 would make every reading the offset`,
+		}},
+		// Filters
+		{`sensors:
+  - sensortype: aht10
+    name: hall
+    filters:
+      temperature:
+        min: 150
+      humidity:
+        ema: 2
+      humdity:
+        median: 3
+`, []string{
+			`line 7: sensors[0].filters.temperature: min 150 is not below max 100`,
+			`line 9: sensors[0].filters.humidity: ema 2 is out of range, expected 0 to 1`,
+			`line 11: sensors[0].filters.humdity: unknown metric "humdity", did you mean "humidity"?`,
+		}},
+		// Rooms
+		{`homeroom: kitchen
+sensors:
+  - sensortype: tmp117
+    name: lounge_tmp117
+rooms:
+  - name: lounge
+    sensors: [lounge_tmp11]
+    policy: average
+    policies:
+      humidty: max
+  - name: lounge
+`, []string{
+			`line 3: homeroom: unknown room "kitchen", expected one of lounge`,
+			`line 9: rooms[0].sensors[0]: unknown sensor "lounge_tmp11", did you mean "lounge_tmp117"?`,
+			`line 10: rooms[0].policy: unknown policy "average", expected one of primary, mean, median, min, max, freshest`,
+			`line 12: rooms[0].policies.humidty: unknown metric "humidty", did you mean "humidity"?`,
+			`line 13: rooms[1].name: room "lounge" is already defined at line 8`,
+			`line 13: rooms[1]: room "lounge" has no sensors`,
+		}},
+		// Derived metrics
+		{`homekitderived: [dew_point, vpd, dew_piont]
+sensors:
+  - sensortype: aht10
+    name: hall
+rooms:
+  - name: hall
+    sensors: [hall]
+    policies:
+      dew_point: mean
+`, []string{
+			`line 3: homekitderived[1]: HomeKit cannot show vpd, expected one of dew_point, humidex, heat_index, apparent_temperature`,
+			`line 3: homekitderived[2]: unknown derived metric "dew_piont", did you mean "dew_point"?`,
+			`line 11: rooms[0].policies.dew_point: dew_point is derived from the temperature and humidity of the room`,
+		}},
+	}
+
+	for _, test := range tests {
+		expectConfigProblems(t, test.yaml, test.problems...)
+	}
+}